@@ -0,0 +1,88 @@
+package ftpserver
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a minimal thread-safe buffer: access records can be emitted
+// from the session goroutines while the test is reading them
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p) //nolint:wrapcheck // here wrapping errors brings nothing
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestAccessLogWriter(t *testing.T) {
+	buf := &syncBuffer{}
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false})
+	server.AccessLogger = NewWriterAccessLogger(buf)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	content := strings.Repeat("x", 1024)
+	require.NoError(t, client.Store("file.bin", strings.NewReader(content)))
+
+	logged := buf.String()
+
+	// one record per command ...
+	require.Contains(t, logged, "kind=command")
+	require.Contains(t, logged, "verb=USER")
+	require.Contains(t, logged, "verb=STOR")
+	require.Contains(t, logged, fmt.Sprintf("user=%q", authUser))
+
+	// ... and one per transfer, with the byte count and the reply code
+	require.Contains(t, logged, "kind=transfer")
+	require.Contains(t, logged, fmt.Sprintf("path=%q", "/file.bin"))
+	require.Contains(t, logged, fmt.Sprintf("code=%d bytes=%d", StatusClosingDataConn, len(content)))
+}
+
+func TestAccessLogSlog(t *testing.T) {
+	buf := &syncBuffer{}
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false})
+	server.AccessLogger = NewSlogAccessLogger(slog.NewTextHandler(buf, nil))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	_, err = client.ReadDir("/")
+	require.NoError(t, err)
+
+	logged := buf.String()
+	require.Contains(t, logged, "msg=access")
+	require.Contains(t, logged, "kind=command")
+	require.Contains(t, logged, fmt.Sprintf("user=%s", authUser))
+}
@@ -1,8 +1,8 @@
 package ftpserver
 
 import (
-	"bufio"
 	"io"
+	"sync"
 )
 
 type convertMode int8
@@ -11,79 +11,174 @@ const (
 	convertModeToCRLF convertMode = iota
 	convertModeToLF
 
-	bufferSize = 4096
+	// defaultASCIIChunkSize is the input chunk size used when
+	// Settings.ASCIIConversionChunkSize doesn't pick another one
+	defaultASCIIChunkSize = 32 * 1024
 )
 
+// asciiBufferPool recycles the conversion buffers across transfers, so
+// multi-GB ASCII transfers don't keep the garbage collector busy
+var asciiBufferPool sync.Pool //nolint:gochecknoglobals // pools are package-level by nature
+
+// asciiConverter rewrites the line endings of a stream, one chunk at a time:
+// LF becomes CRLF on the way to the client and CRLF becomes LF on the way to
+// the storage (except on Windows). Each converter moves its bytes through a
+// single pooled buffer, without any per-line allocation. CR bytes that are
+// not part of a CRLF pair are data and pass through unchanged, even when a
+// chunk boundary splits the pair
 type asciiConverter struct {
-	reader    *bufio.Reader
+	reader    io.Reader
 	mode      convertMode
-	remaining []byte
+	chunkSize int
+	buffer    []byte // pooled backing buffer: the input chunk, then the output area
+	chunk     []byte // input chunk, the first chunkSize bytes of the buffer
+	output    []byte // output area, sized for the worst-case expansion of a chunk
+	pending   []byte // converted bytes not handed out yet
+	prevCR    bool   // the last input byte was a CR (convertModeToCRLF)
+	heldCR    bool   // a CR is held back until the next byte settles its fate (convertModeToLF)
+	discard   int64  // converted bytes still to drop for a resumed transfer
+	err       error  // terminal error of the source, delivered after the pending bytes
 }
 
 func newASCIIConverter(r io.Reader, mode convertMode) *asciiConverter {
-	reader := bufio.NewReaderSize(r, bufferSize)
+	return newASCIIConverterWithOffset(r, mode, 0)
+}
 
+// newASCIIConverterWithOffset builds a converter dropping the first offset
+// bytes of the converted stream, which is how ASCII transfers are resumed:
+// the offset is counted after conversion, so it doesn't depend on the line
+// endings of the stored representation
+func newASCIIConverterWithOffset(r io.Reader, mode convertMode, offset int64) *asciiConverter {
 	return &asciiConverter{
-		reader:    reader,
+		reader:    r,
 		mode:      mode,
-		remaining: nil,
+		chunkSize: defaultASCIIChunkSize,
+		discard:   offset,
 	}
 }
 
+// withChunkSize overrides the input chunk size, see
+// Settings.ASCIIConversionChunkSize. Values below one are ignored. The
+// buffers are only borrowed on the first read, so this can be called anytime
+// before it
+func (c *asciiConverter) withChunkSize(size int) *asciiConverter {
+	if size > 0 {
+		c.chunkSize = size
+	}
+
+	return c
+}
+
+// Read hands out the converted stream, minus the part a resumed transfer
+// already moved
 func (c *asciiConverter) Read(bytes []byte) (int, error) {
-	var data []byte
-	var readBytes int
-	var err error
+	for {
+		if c.discard > 0 && len(c.pending) > 0 {
+			dropped := int64(len(c.pending))
+			if dropped > c.discard {
+				dropped = c.discard
+			}
 
-	if len(c.remaining) > 0 {
-		data = c.remaining
-		c.remaining = nil
-	} else {
-		data, _, err = c.reader.ReadLine()
-		if err != nil {
-			return readBytes, err
+			c.pending = c.pending[dropped:]
+			c.discard -= dropped
+
+			continue
 		}
+
+		if len(c.pending) > 0 {
+			copied := copy(bytes, c.pending)
+			c.pending = c.pending[copied:]
+
+			return copied, nil
+		}
+
+		if c.err != nil {
+			c.release()
+
+			return 0, c.err //nolint:wrapcheck // here wrapping errors brings nothing
+		}
+
+		c.fill()
+	}
+}
+
+// fill reads one chunk from the source and converts it into the output area
+func (c *asciiConverter) fill() {
+	if c.buffer == nil {
+		c.borrowBuffer()
 	}
 
-	readBytes = len(data)
-	if readBytes > 0 {
-		maxSize := len(bytes) - 2
-		if readBytes > maxSize {
-			copy(bytes, data[:maxSize])
-			c.remaining = data[maxSize:]
+	read, err := c.reader.Read(c.chunk)
+	out := c.output[:0]
+
+	switch c.mode {
+	case convertModeToCRLF:
+		for _, value := range c.chunk[:read] {
+			if value == '\n' && !c.prevCR {
+				out = append(out, '\r')
+			}
 
-			return maxSize, nil
+			c.prevCR = value == '\r'
+			out = append(out, value)
 		}
+	case convertModeToLF:
+		for _, value := range c.chunk[:read] {
+			if c.heldCR {
+				c.heldCR = false
+
+				if value != '\n' {
+					out = append(out, '\r')
+				}
+			}
+
+			if value == '\r' {
+				c.heldCR = true
+
+				continue
+			}
 
-		copy(bytes[:readBytes], data[:readBytes])
+			out = append(out, value)
+		}
 	}
 
-	// we can have a partial read if the line is too long
-	// or a trailing line without a line ending, so we check
-	// the last byte to decide if we need to add a line ending.
-	// This will also ensure that a file without line endings
-	// will remain unchanged.
-	// Please note that a binary file will likely contain
-	// newline chars so it will be still corrupted if the
-	// client transfers it in ASCII mode
-	err = c.reader.UnreadByte()
 	if err != nil {
-		return readBytes, err
+		// a CR closing the stream was not the start of a CRLF pair
+		if c.heldCR {
+			out = append(out, '\r')
+			c.heldCR = false
+		}
+
+		c.err = err
 	}
 
-	lastByte, err := c.reader.ReadByte()
-
-	if err == nil && lastByte == '\n' {
-		switch c.mode {
-		case convertModeToCRLF:
-			bytes[readBytes] = '\r'
-			bytes[readBytes+1] = '\n'
-			readBytes += 2
-		case convertModeToLF:
-			bytes[readBytes] = '\n'
-			readBytes++
-		}
+	c.pending = out
+}
+
+// borrowBuffer takes a buffer from the pool, or allocates one when the pool
+// is empty or only holds smaller ones. A chunk of lone LF bytes doubles in
+// size on its way to CRLF, plus one held-back CR, which bounds the output
+// area at twice the chunk size plus one
+func (c *asciiConverter) borrowBuffer() {
+	size := c.chunkSize*3 + 1
+
+	if pooled, ok := asciiBufferPool.Get().(*[]byte); ok && cap(*pooled) >= size {
+		c.buffer = (*pooled)[:size]
+	} else {
+		c.buffer = make([]byte, size)
+	}
+
+	c.chunk = c.buffer[:c.chunkSize]
+	c.output = c.buffer[c.chunkSize:]
+}
+
+// release gives the buffer back to the pool once the stream is over. Only
+// called with no pending bytes, as those point into the buffer
+func (c *asciiConverter) release() {
+	if c.buffer == nil {
+		return
 	}
 
-	return readBytes, err //nolint:wrapcheck // here wrapping errors brings nothing
+	buffer := c.buffer
+	c.buffer, c.chunk, c.output, c.pending = nil, nil, nil, nil
+	asciiBufferPool.Put(&buffer)
 }
@@ -35,6 +35,47 @@ func TestASCIIConvert(t *testing.T) {
 	_, err = io.Copy(dst, converter)
 	require.NoError(t, err)
 	require.Equal(t, buf, dst.Bytes())
+
+	// CR bytes that are not part of a CRLF pair are data: they pass through
+	// both conversions, even when a one-byte chunk splits every pair
+	for _, chunkSize := range []int{0, 1} {
+		dst = bytes.NewBuffer(nil)
+		converter = newASCIIConverter(bytes.NewBufferString("a\rb\r\nc\r"), convertModeToLF).withChunkSize(chunkSize)
+		_, err = io.Copy(dst, converter)
+		require.NoError(t, err)
+		require.Equal(t, []byte("a\rb\nc\r"), dst.Bytes())
+
+		dst = bytes.NewBuffer(nil)
+		converter = newASCIIConverter(bytes.NewBufferString("a\rb\r\nc\n"), convertModeToCRLF).withChunkSize(chunkSize)
+		_, err = io.Copy(dst, converter)
+		require.NoError(t, err)
+		require.Equal(t, []byte("a\rb\r\nc\r\n"), dst.Bytes())
+	}
+}
+
+func TestASCIIConvertWithOffset(t *testing.T) {
+	// the offset is counted on the converted stream: 7 bytes cover
+	// "line1\r\n" even though the source only stores "line1\n"
+	src := bytes.NewBufferString("line1\nline2\nline3")
+	dst := bytes.NewBuffer(nil)
+	converter := newASCIIConverterWithOffset(src, convertModeToCRLF, 7)
+	_, err := io.Copy(dst, converter)
+	require.NoError(t, err)
+	require.Equal(t, []byte("line2\r\nline3"), dst.Bytes())
+
+	// an offset falling in the middle of a line keeps its tail
+	dst = bytes.NewBuffer(nil)
+	converter = newASCIIConverterWithOffset(bytes.NewBufferString("line1\nline2\n"), convertModeToCRLF, 3)
+	_, err = io.Copy(dst, converter)
+	require.NoError(t, err)
+	require.Equal(t, []byte("e1\r\nline2\r\n"), dst.Bytes())
+
+	// a zero offset leaves the stream untouched
+	dst = bytes.NewBuffer(nil)
+	converter = newASCIIConverterWithOffset(bytes.NewBufferString("line1\n"), convertModeToCRLF, 0)
+	_, err = io.Copy(dst, converter)
+	require.NoError(t, err)
+	require.Equal(t, []byte("line1\r\n"), dst.Bytes())
 }
 
 func BenchmarkASCIIConverter(b *testing.B) {
@@ -64,3 +105,22 @@ func BenchmarkASCIIConverter(b *testing.B) {
 		panicOnError(err)
 	}
 }
+
+func BenchmarkASCIIConverterChunked(b *testing.B) {
+	// a few MB of mixed line endings, converted both ways with a large chunk
+	payload := bytes.Repeat([]byte("some line of text\r\nanother one\n"), 1<<17)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(2 * len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		converter := newASCIIConverter(bytes.NewReader(payload), convertModeToLF).withChunkSize(1 << 17)
+		_, err := io.Copy(io.Discard, converter)
+		panicOnError(err)
+
+		converter = newASCIIConverter(bytes.NewReader(payload), convertModeToCRLF).withChunkSize(1 << 17)
+		_, err = io.Copy(io.Discard, converter)
+		panicOnError(err)
+	}
+}
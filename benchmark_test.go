@@ -0,0 +1,244 @@
+package ftpserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// benchFileSize is the payload size used by the transfer benchmarks
+const benchFileSize = 256 * 1024
+
+// newBenchmarkServer starts a server backed by an in-memory filesystem, so the
+// figures reflect the handler and transfer paths rather than disk latency
+func newBenchmarkServer(b *testing.B) *FtpServer {
+	b.Helper()
+
+	driver := &TestServerDriver{}
+	driver.Init()
+	driver.fs = afero.NewMemMapFs()
+
+	server := NewFtpServer(driver)
+
+	if err := server.Listen(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Cleanup(func() {
+		mustStopServer(server)
+	})
+
+	go func() {
+		_ = server.Serve()
+	}()
+
+	return server
+}
+
+func newBenchmarkClient(b *testing.B, server *FtpServer) *goftp.Client {
+	b.Helper()
+
+	client, err := goftp.DialConfig(goftp.Config{User: authUser, Password: authPass}, server.Addr())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Cleanup(func() {
+		panicOnError(client.Close())
+	})
+
+	return client
+}
+
+// measureAllocs returns the number of heap allocations performed while fn runs.
+// Unlike b.ReportAllocs it also covers the server goroutines, which is where
+// most of the work measured here happens.
+func measureAllocs(fn func()) uint64 {
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+
+	return after.Mallocs - before.Mallocs
+}
+
+func BenchmarkCommandLIST(b *testing.B) {
+	server := newBenchmarkServer(b)
+	client := newBenchmarkClient(b, server)
+
+	content := bytes.Repeat([]byte("x"), 1024)
+	for i := 0; i < 32; i++ {
+		if err := client.Store(fmt.Sprintf("file-%d.bin", i), bytes.NewReader(content)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+
+	allocs := measureAllocs(func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.ReadDir("/"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(allocs)/float64(b.N), "allocs/cmd")
+}
+
+func BenchmarkTransferSTOR(b *testing.B) {
+	server := newBenchmarkServer(b)
+	client := newBenchmarkClient(b, server)
+	content := bytes.Repeat([]byte("A"), benchFileSize)
+
+	b.SetBytes(benchFileSize)
+	b.ResetTimer()
+
+	allocs := measureAllocs(func() {
+		for i := 0; i < b.N; i++ {
+			if err := client.Store("bench.bin", bytes.NewReader(content)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(allocs)/(float64(b.N)*benchFileSize/(1<<20)), "allocs/MB")
+}
+
+func BenchmarkTransferRETR(b *testing.B) {
+	server := newBenchmarkServer(b)
+	client := newBenchmarkClient(b, server)
+	content := bytes.Repeat([]byte("A"), benchFileSize)
+
+	if err := client.Store("bench.bin", bytes.NewReader(content)); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(benchFileSize)
+	b.ResetTimer()
+
+	allocs := measureAllocs(func() {
+		for i := 0; i < b.N; i++ {
+			if err := client.Retrieve("bench.bin", io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(allocs)/(float64(b.N)*benchFileSize/(1<<20)), "allocs/MB")
+}
+
+// BenchmarkConcurrentSessions runs a mixed STOR/RETR/LIST workload over many
+// sessions at once; with the default GOMAXPROCS the parallelism factor below
+// drives a few hundred concurrent connections
+func BenchmarkConcurrentSessions(b *testing.B) {
+	server := newBenchmarkServer(b)
+	content := bytes.Repeat([]byte("x"), 32*1024)
+
+	var sessions int32
+
+	b.SetParallelism(64)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		name := fmt.Sprintf("soak-%d.bin", atomic.AddInt32(&sessions, 1))
+
+		client, err := goftp.DialConfig(goftp.Config{User: authUser, Password: authPass}, server.Addr())
+		if err != nil {
+			b.Error(err)
+
+			return
+		}
+
+		defer func() { _ = client.Close() }()
+
+		for pb.Next() {
+			if err := runMixedRound(client, name, content); err != nil {
+				b.Error(err)
+
+				return
+			}
+		}
+	})
+}
+
+// TestSoakMixedWorkload hammers the server with a hundred concurrent sessions,
+// each looping over the same mix of commands the benchmarks use, to flush out
+// races and state leaks that a single connection would never hit
+func TestSoakMixedWorkload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test skipped in short mode")
+	}
+
+	driver := &TestServerDriver{}
+	driver.Init()
+	driver.fs = afero.NewMemMapFs()
+	server := NewTestServerWithDriver(t, driver)
+
+	const (
+		sessions = 100
+		rounds   = 5
+	)
+
+	content := bytes.Repeat([]byte("x"), 16*1024)
+	errs := make(chan error, sessions)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+
+		go func(id int) {
+			defer wg.Done()
+
+			errs <- runMixedSession(server.Addr(), fmt.Sprintf("soak-%d.bin", id), content, rounds)
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func runMixedSession(addr, name string, content []byte, rounds int) error {
+	client, err := goftp.DialConfig(goftp.Config{User: authUser, Password: authPass}, addr)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = client.Close() }()
+
+	for i := 0; i < rounds; i++ {
+		if err := runMixedRound(client, name, content); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runMixedRound(client *goftp.Client, name string, content []byte) error {
+	if err := client.Store(name, bytes.NewReader(content)); err != nil {
+		return err
+	}
+
+	if err := client.Retrieve(name, io.Discard); err != nil {
+		return err
+	}
+
+	_, err := client.ReadDir("/")
+
+	return err
+}
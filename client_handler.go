@@ -2,15 +2,25 @@ package ftpserver
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/fclairamb/go-log"
+	"golang.org/x/text/encoding/charmap"
 )
 
 // HASHAlgo is the enumerable that represents the supported HASH algorithms.
@@ -77,37 +87,142 @@ func getHashName(algo HASHAlgo) string {
 	return hashName
 }
 
+// transferLifecycle is the state of the data connection, guarded by transferMu
+type transferLifecycle int8
+
+const (
+	// transferIdle means no data connection is expected
+	transferIdle transferLifecycle = iota
+	// transferReady means PORT/EPRT/PASV/EPSV set up a transfer handler that
+	// is not open yet
+	transferReady
+	// transferOpen means the data connection is established
+	transferOpen
+	// transferAborted means the transfer was torn down by ABOR or an external
+	// Close, and the next transfer open/close must stay silent
+	transferAborted
+)
+
+// transferReply is a control connection reply decided while holding
+// transferMu. Replies are queued and written once the mutex is released, so
+// that a client slow to read its control connection cannot stall every caller
+// needing the transfer state
+type transferReply struct {
+	code    int
+	message string
+}
+
 //nolint:maligned
 type clientHandler struct {
-	id                  uint32          // ID of the client
-	server              *FtpServer      // Server on which the connection was accepted
-	driver              ClientDriver    // Client handling driver
-	conn                net.Conn        // TCP connection
-	writer              *bufio.Writer   // Writer on the TCP connection
-	reader              *bufio.Reader   // Reader on the TCP connection
-	user                string          // Authenticated user
-	path                string          // Current path
-	listPath            string          // Path for NLST/LIST requests
-	clnt                string          // Identified client
-	command             string          // Command received on the connection
-	connectedAt         time.Time       // Date of connection
-	ctxRnfr             string          // Rename from
-	ctxRest             int64           // Restart point
-	debug               bool            // Show debugging info on the server side
-	transferTLS         bool            // Use TLS for transfer connection
-	controlTLS          bool            // Use TLS for control connection
-	selectedHashAlgo    HASHAlgo        // algorithm used when we receive the HASH command
-	logger              log.Logger      // Client handler logging
-	currentTransferType TransferType    // current transfer type
-	transferWg          sync.WaitGroup  // wait group for command that open a transfer connection
-	transferMu          sync.Mutex      // this mutex will protect the transfer parameters
-	transfer            transferHandler // Transfer connection (passive or active)s
-	lastDataChannel     DataChannel     // Last data channel mode (passive or active)
-	isTransferOpen      bool            // indicate if the transfer connection is opened
-	isTransferAborted   bool            // indicate if the transfer was aborted
-	tlsRequirement      TLSRequirement  // TLS requirement to respect
-	extra               any             // Additional application-specific data
-	paramsMutex         sync.RWMutex    // mutex to protect the parameters exposed to the library users
+	id                  uint32            // ID of the client
+	sessionToken        string            // Random token identifying the session across distributed logs
+	server              *FtpServer        // Server on which the connection was accepted
+	driver              ClientDriver      // Client handling driver
+	conn                net.Conn          // TCP connection
+	writer              *bufio.Writer     // Writer on the TCP connection
+	reader              *bufio.Reader     // Reader on the TCP connection
+	user                string            // Authenticated user
+	registeredUser      string            // Username under which the session is registered in the per-user registry
+	path                string            // Current path
+	listPath            string            // Path for NLST/LIST requests
+	clnt                string            // Identified client
+	host                string            // Virtual host selected through the HOST command
+	hostTLSConfig       *tls.Config       // TLS configuration of the selected virtual host, overrides the default one
+	command             string            // Command received on the connection
+	connectedAt         time.Time         // Date of connection
+	ctxRnfr             string            // Rename from
+	alloSize            int64             // Size announced through ALLO or OPTS STOR SIZE, consumed by the next upload
+	resume              resumeContext     // Pending restart state set through REST/RANG for the next transfer
+	debug               bool              // Show debugging info on the server side
+	transferTLS         bool              // Use TLS for transfer connection
+	controlTLS          bool              // Use TLS for control connection
+	selectedHashAlgo    HASHAlgo          // algorithm used when we receive the HASH command
+	logger              log.Logger        // Client handler logging
+	currentTransferType TransferType      // current transfer type
+	transferWg          sync.WaitGroup    // wait group for command that open a transfer connection
+	transferMu          sync.Mutex        // this mutex will protect the transfer parameters
+	replyMu             sync.Mutex        // serializes whole replies written on the control connection
+	transfer            transferHandler   // Transfer connection (passive or active)s
+	dataConn            net.Conn          // Data connection of the transfer in progress, guarded by transferMu
+	lastDataChannel     DataChannel       // Last data channel mode (passive or active)
+	lastDataTLS         *SessionTLSInfo   // TLS parameters of the last closed data connection, guarded by paramsMutex
+	transferState       transferLifecycle // lifecycle of the data connection, guarded by transferMu
+	pendingReplies      []transferReply   // replies decided under transferMu, waiting to be written
+	replyFlushing       bool              // a goroutine is draining pendingReplies, guarded by transferMu
+	transferDirection   TransferDirection // direction of the file transfer in progress
+	transferPath        string            // path of the file being transferred
+	transferStart       time.Time         // when the file transfer in progress started
+	transferBytes       int64             // bytes moved by the transfer in progress (atomic access)
+	tlsRequirement      TLSRequirement    // TLS requirement to respect
+	shutdownReason      ShutdownReason    // Why the server ended the session, ShutdownNone otherwise
+	elevatedUntil       time.Time         // Until when the session holds a "SITE AUTHZ" elevation
+	failedLogins        int               // Failed PASS attempts on this connection, see Settings.MaxFailedLogins
+	extra               any               // Additional application-specific data
+	paramsMutex         sync.RWMutex      // mutex to protect the parameters exposed to the library users
+	bytesUploaded       int64             // Number of bytes received on data connections (atomic access)
+	bytesDownloaded     int64             // Number of bytes sent on data connections (atomic access)
+	lastReplyCode       int32             // Last reply code sent to the client, for access logging (atomic access)
+	notFoundCount       int32             // Number of 550 replies sent, for enumeration protection (atomic access)
+	listOpts            listOptions       // Directory listing options set through OPTS LIST/NLST
+	mlsxFacts           []string          // Facts selected through OPTS MLST, nil means all of them
+	legacyCharmap       *charmap.Charmap  // Charset negotiated through "OPTS UTF8 OFF", nil means UTF-8
+	utf8Negotiated      bool              // The client selected UTF-8 through "OPTS UTF8 ON"
+	mlsdPageSize        int               // Page size negotiated through "OPTS MLSD PARTIAL", 0 means complete listings
+	inProgressUploads   []string          // Final paths of the atomic uploads currently written under a temporary name
+	history             sessionHistory    // Ring buffer of the latest commands, for session reports
+
+	sessionCtx    context.Context    // Lives for the whole session, see Context()
+	sessionCancel context.CancelFunc // Cancels sessionCtx when the session ends
+}
+
+// The handlers and their bufio readers/writers are pooled: with thousands of
+// short-lived sessions per second the 4KB command buffers dominate the
+// allocation profile
+var (
+	clientHandlerPool = sync.Pool{New: func() any { return &clientHandler{} }}                         //nolint:gochecknoglobals
+	readerPool        = sync.Pool{New: func() any { return bufio.NewReaderSize(nil, maxCommandSize) }} //nolint:gochecknoglobals
+	writerPool        = sync.Pool{New: func() any { return bufio.NewWriter(nil) }}                     //nolint:gochecknoglobals
+)
+
+func acquireReader(connection net.Conn, commandSize int) *bufio.Reader {
+	// sessions allowing commands longer than the pooled buffers get a
+	// dedicated reader, releaseReader keeps it out of the pool
+	if commandSize > maxCommandSize {
+		return bufio.NewReaderSize(connection, commandSize)
+	}
+
+	reader, _ := readerPool.Get().(*bufio.Reader)
+	reader.Reset(connection)
+
+	return reader
+}
+
+func releaseReader(reader *bufio.Reader) {
+	if reader == nil {
+		return
+	}
+
+	reader.Reset(nil)
+
+	if reader.Size() == maxCommandSize {
+		readerPool.Put(reader)
+	}
+}
+
+func acquireWriter(connection net.Conn) *bufio.Writer {
+	writer, _ := writerPool.Get().(*bufio.Writer)
+	writer.Reset(connection)
+
+	return writer
+}
+
+func releaseWriter(writer *bufio.Writer) {
+	if writer == nil {
+		return
+	}
+
+	writer.Reset(nil)
+	writerPool.Put(writer)
 }
 
 // newClientHandler initializes a client handler when someone connects
@@ -116,18 +231,89 @@ func (server *FtpServer) newClientHandler(
 	clientID uint32,
 	transferType TransferType,
 ) *clientHandler {
-	return &clientHandler{
-		server:              server,
-		conn:                connection,
-		id:                  clientID,
-		writer:              bufio.NewWriter(connection),
-		reader:              bufio.NewReaderSize(connection, maxCommandSize),
-		connectedAt:         time.Now().UTC(),
-		path:                "/",
-		selectedHashAlgo:    HASHAlgoSHA256,
-		currentTransferType: transferType,
-		logger:              server.Logger.With("clientId", clientID),
-	}
+	handler, _ := clientHandlerPool.Get().(*clientHandler)
+	handler.reset()
+
+	handler.server = server
+	handler.conn = connection
+	handler.id = clientID
+	handler.writer = acquireWriter(connection)
+	handler.reader = acquireReader(connection, server.getSettings().MaxCommandSize)
+	handler.connectedAt = time.Now().UTC()
+	handler.path = "/"
+	handler.selectedHashAlgo = HASHAlgoSHA256
+	handler.currentTransferType = transferType
+	handler.sessionToken = newSessionToken()
+	handler.logger = server.Logger.With("clientId", clientID, "sessionToken", handler.sessionToken)
+	handler.sessionCtx, handler.sessionCancel = context.WithCancel(context.Background())
+
+	server.registerClient(handler)
+
+	return handler
+}
+
+// reset clears whatever a previous session may have left in a recycled
+// handler. The mutexes and the wait group are left untouched: a handler is
+// only recycled once it is quiescent
+func (c *clientHandler) reset() {
+	c.paramsMutex.Lock()
+	c.driver = nil
+	c.user = ""
+	c.registeredUser = ""
+	c.listPath = ""
+	c.clnt = ""
+	c.host = ""
+	c.hostTLSConfig = nil
+	c.command = ""
+	c.ctxRnfr = ""
+	c.alloSize = 0
+	c.resume.clear()
+	c.debug = false
+	c.transferTLS = false
+	c.controlTLS = false
+	c.lastDataChannel = 0
+	c.tlsRequirement = 0
+	c.shutdownReason = ShutdownNone
+	c.elevatedUntil = time.Time{}
+	c.failedLogins = 0
+	c.extra = nil
+	c.listOpts = listOptions{}
+	c.mlsxFacts = nil
+	c.legacyCharmap = nil
+	c.utf8Negotiated = false
+	c.lastDataTLS = nil
+	c.mlsdPageSize = 0
+	c.inProgressUploads = nil
+	c.paramsMutex.Unlock()
+
+	c.transferMu.Lock()
+	c.transfer = nil
+	c.dataConn = nil
+	c.transferState = transferIdle
+	c.pendingReplies = nil
+	c.replyFlushing = false
+	c.transferDirection = TransferDirectionNone
+	c.transferPath = ""
+	c.transferStart = time.Time{}
+	c.transferMu.Unlock()
+
+	atomic.StoreInt64(&c.bytesUploaded, 0)
+	atomic.StoreInt64(&c.bytesDownloaded, 0)
+	atomic.StoreInt64(&c.transferBytes, 0)
+	atomic.StoreInt32(&c.lastReplyCode, 0)
+	atomic.StoreInt32(&c.notFoundCount, 0)
+	c.history.reset()
+}
+
+// release returns the handler and its buffers to their pools. It must only be
+// called once the session is over and no other goroutine can reach the handler
+func (c *clientHandler) release() {
+	releaseReader(c.reader)
+	c.reader = nil
+	releaseWriter(c.writer)
+	c.writer = nil
+
+	clientHandlerPool.Put(c)
 }
 
 func (c *clientHandler) disconnect() {
@@ -192,6 +378,28 @@ func (c *clientHandler) ID() uint32 {
 	return c.id
 }
 
+// sessionTokenBytes is the entropy of a session token: 6 bytes make a 12
+// character hexadecimal token, short enough to quote over the phone and
+// unique enough to grep across the logs of a whole fleet
+const sessionTokenBytes = 6
+
+// newSessionToken draws a random session token. A failing system randomness
+// source leaves a timestamp-based token rather than no correlation at all
+func newSessionToken() string {
+	token := make([]byte, sessionTokenBytes)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Sprintf("t%011x", time.Now().UnixMicro()&0xfffffffffff)
+	}
+
+	return hex.EncodeToString(token)
+}
+
+// GetSessionToken returns the random token identifying this session in the
+// server logs
+func (c *clientHandler) GetSessionToken() string {
+	return c.sessionToken
+}
+
 // RemoteAddr returns the remote network address.
 func (c *clientHandler) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
@@ -210,6 +418,38 @@ func (c *clientHandler) GetClientVersion() string {
 	return c.clnt
 }
 
+// getLegacyCharmap returns the charset negotiated through "OPTS UTF8 OFF",
+// nil while the session is in the default UTF-8 mode
+func (c *clientHandler) getLegacyCharmap() *charmap.Charmap {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.legacyCharmap
+}
+
+func (c *clientHandler) setLegacyCharmap(cmap *charmap.Charmap) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.legacyCharmap = cmap
+}
+
+// hasNegotiatedUTF8 reports whether the client explicitly selected UTF-8
+// through "OPTS UTF8 ON", which exempts it from Settings.NonASCIIReplyPolicy
+func (c *clientHandler) hasNegotiatedUTF8() bool {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.utf8Negotiated
+}
+
+func (c *clientHandler) setUTF8Negotiated(negotiated bool) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.utf8Negotiated = negotiated
+}
+
 func (c *clientHandler) setClientVersion(value string) {
 	c.paramsMutex.Lock()
 	defer c.paramsMutex.Unlock()
@@ -217,9 +457,101 @@ func (c *clientHandler) setClientVersion(value string) {
 	c.clnt = value
 }
 
+// hasDriverCapability tells whether the current driver supports an optional
+// afero feature. Drivers not implementing the capabilities extension, and
+// sessions not yet authenticated, are assumed to support everything
+func (c *clientHandler) hasDriverCapability(capability DriverCapabilities) bool {
+	if prober, ok := c.driver.(ClientDriverExtensionCapabilities); ok {
+		return prober.GetCapabilities()&capability != 0
+	}
+
+	return true
+}
+
+// GetHost returns the virtual host selected through the HOST command, can be empty.
+func (c *clientHandler) GetHost() string {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.host
+}
+
+func (c *clientHandler) setHost(host string, tlsConfig *tls.Config) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.host = host
+	c.hostTLSConfig = tlsConfig
+}
+
+func (c *clientHandler) getHostTLSConfig() *tls.Config {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.hostTLSConfig
+}
+
+// Context returns the session context, cancelled once the control connection
+// ends. The field is written once before the session starts, so it can be
+// read without locking
+func (c *clientHandler) Context() context.Context {
+	return c.sessionCtx
+}
+
+// bindDriverContext hands the session context to drivers implementing
+// ClientDriverWithContext, right after the authentication selected them
+func (c *clientHandler) bindDriverContext() {
+	if withContext, ok := c.driver.(ClientDriverWithContext); ok {
+		if driver := withContext.WithContext(c.sessionCtx); driver != nil {
+			c.driver = driver
+		}
+	}
+}
+
+// GetShutdownReason returns why the server ended the session, ShutdownNone
+// when the session was not closed by a server shutdown
+func (c *clientHandler) GetShutdownReason() ShutdownReason {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.shutdownReason
+}
+
+func (c *clientHandler) setShutdownReason(reason ShutdownReason) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.shutdownReason = reason
+}
+
+func (c *clientHandler) setUser(user string) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.user = user
+}
+
+func (c *clientHandler) setCurrentTransferType(value TransferType) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.currentTransferType = value
+}
+
 // HasTLSForControl returns true if the control connection is over TLS
+// GetPeerCertificates returns the certificate chain presented by the client
+// on the control connection, leaf first, or nil when the connection is not
+// over TLS or the client didn't present one
+func (c *clientHandler) GetPeerCertificates() []*x509.Certificate {
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState().PeerCertificates
+	}
+
+	return nil
+}
+
 func (c *clientHandler) HasTLSForControl() bool {
-	if c.server.settings.TLSRequired == ImplicitEncryption {
+	if c.server.getSettings().TLSRequired == ImplicitEncryption {
 		return true
 	}
 
@@ -238,7 +570,7 @@ func (c *clientHandler) setTLSForControl(value bool) {
 
 // HasTLSForTransfers returns true if the transfer connection is over TLS
 func (c *clientHandler) HasTLSForTransfers() bool {
-	if c.server.settings.TLSRequired == ImplicitEncryption {
+	if c.server.getSettings().TLSRequired == ImplicitEncryption {
 		return true
 	}
 
@@ -248,6 +580,219 @@ func (c *clientHandler) HasTLSForTransfers() bool {
 	return c.transferTLS
 }
 
+// getListOptions returns the directory listing options of this session
+func (c *clientHandler) getListOptions() listOptions {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.listOpts
+}
+
+// setListOptions changes the directory listing options of this session
+func (c *clientHandler) setListOptions(opts listOptions) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.listOpts = opts
+}
+
+// getMLSxFacts returns the facts selected through "OPTS MLST", nil when the
+// client never narrowed the selection
+func (c *clientHandler) getMLSxFacts() []string {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.mlsxFacts
+}
+
+// setMLSxFacts changes the facts returned in MLSD/MLST entries
+func (c *clientHandler) setMLSxFacts(facts []string) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.mlsxFacts = facts
+}
+
+// getMLSDPageSize returns the page size negotiated through
+// "OPTS MLSD PARTIAL", 0 when listings are served in full
+func (c *clientHandler) getMLSDPageSize() int {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.mlsdPageSize
+}
+
+// setMLSDPageSize caps MLSD responses to the given number of entries
+func (c *clientHandler) setMLSDPageSize(pageSize int) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.mlsdPageSize = pageSize
+}
+
+// addInProgressUpload records the final path of an atomic upload for the
+// duration of the transfer to its temporary name
+func (c *clientHandler) addInProgressUpload(finalPath string) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.inProgressUploads = append(c.inProgressUploads, finalPath)
+}
+
+// removeInProgressUpload drops the final path of an atomic upload once its
+// temporary file was renamed into place or cleaned up
+func (c *clientHandler) removeInProgressUpload(finalPath string) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	for idx, upload := range c.inProgressUploads {
+		if upload == finalPath {
+			c.inProgressUploads = append(c.inProgressUploads[:idx], c.inProgressUploads[idx+1:]...)
+
+			return
+		}
+	}
+}
+
+// GetInProgressUploads returns the final paths of the atomic uploads this
+// session is currently writing under a temporary name
+func (c *clientHandler) GetInProgressUploads() []string {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	if len(c.inProgressUploads) == 0 {
+		return nil
+	}
+
+	uploads := make([]string, len(c.inProgressUploads))
+	copy(uploads, c.inProgressUploads)
+
+	return uploads
+}
+
+// GetTransferredBytes returns the number of bytes uploaded and downloaded
+// on data connections since the beginning of the session
+func (c *clientHandler) GetTransferredBytes() (int64, int64) {
+	return atomic.LoadInt64(&c.bytesUploaded), atomic.LoadInt64(&c.bytesDownloaded)
+}
+
+// accountDataTransfer updates the session byte counters and gives the driver,
+// if it implements ClientDriverExtensionTransferAccounting, a chance to abort
+// the transfer when a bandwidth quota is exceeded
+func (c *clientHandler) accountDataTransfer(upload bool, size int64) error {
+	if upload {
+		atomic.AddInt64(&c.bytesUploaded, size)
+	} else {
+		atomic.AddInt64(&c.bytesDownloaded, size)
+	}
+
+	atomic.AddInt64(&c.transferBytes, size)
+
+	if collector := c.server.MetricsCollector; collector != nil {
+		if upload {
+			collector.DataTransferred(size, 0)
+		} else {
+			collector.DataTransferred(0, size)
+		}
+	}
+
+	if accounter, ok := c.driver.(ClientDriverExtensionTransferAccounting); ok {
+		if err := accounter.AccountDataTransfer(c.GetTransferredBytes()); err != nil {
+			return newDriverError("calling AccountDataTransfer", err)
+		}
+	}
+
+	return nil
+}
+
+// logAccess emits an access record for a command or a transfer that just
+// finished, if an access logger is configured
+func (c *clientHandler) logAccess(kind AccessRecordKind, verb, path string, bytes int64, start time.Time) {
+	if c.server.AccessLogger == nil {
+		return
+	}
+
+	c.server.logAccess(AccessRecord{
+		Kind:       kind,
+		Time:       time.Now().UTC(),
+		User:       c.user,
+		RemoteAddr: c.conn.RemoteAddr().String(),
+		Verb:       verb,
+		Path:       path,
+		Code:       int(atomic.LoadInt32(&c.lastReplyCode)),
+		Bytes:      bytes,
+		Duration:   time.Since(start),
+	})
+}
+
+// startTransferStats records the beginning of a file transfer so that
+// GetTransferStats can report live progress
+func (c *clientHandler) startTransferStats(direction TransferDirection, path string) {
+	c.transferMu.Lock()
+	c.transferDirection = direction
+	c.transferPath = path
+	c.transferStart = time.Now().UTC()
+	c.transferMu.Unlock()
+
+	atomic.StoreInt64(&c.transferBytes, 0)
+}
+
+// GetTransferStats returns a snapshot of the file transfer in progress, or the
+// zero value when there is none
+func (c *clientHandler) GetTransferStats() TransferStats {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	return c.transferStatsLocked()
+}
+
+// transferStatsLocked builds the snapshot for callers already holding transferMu
+func (c *clientHandler) transferStatsLocked() TransferStats {
+	if c.transferDirection == TransferDirectionNone {
+		return TransferStats{}
+	}
+
+	return TransferStats{
+		Direction:        c.transferDirection,
+		Path:             c.transferPath,
+		Start:            c.transferStart,
+		BytesTransferred: atomic.LoadInt64(&c.transferBytes),
+	}
+}
+
+// registerUserSession adds the session to the per-user registry once the
+// credentials are accepted, enforcing MaxConnectionsPerUser. A session
+// re-authenticating under another name leaves its previous slot first
+func (c *clientHandler) registerUserSession() bool {
+	if c.registeredUser != "" {
+		c.server.unregisterUserSession(c.registeredUser, c)
+		c.registeredUser = ""
+	}
+
+	if !c.server.registerUserSession(c.user, c) {
+		return false
+	}
+
+	c.registeredUser = c.user
+
+	return true
+}
+
+// IsElevated returns true while the session holds a "SITE AUTHZ" elevation
+func (c *clientHandler) IsElevated() bool {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return !c.elevatedUntil.IsZero() && time.Now().Before(c.elevatedUntil)
+}
+
+func (c *clientHandler) setElevatedUntil(until time.Time) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.elevatedUntil = until
+}
+
 func (c *clientHandler) SetExtra(extra any) {
 	c.extra = extra
 }
@@ -278,7 +823,7 @@ func (c *clientHandler) SetTLSRequirement(requirement TLSRequirement) error {
 }
 
 func (c *clientHandler) isTLSRequired() bool {
-	if c.server.settings.TLSRequired == MandatoryEncryption {
+	if c.server.getSettings().TLSRequired == MandatoryEncryption {
 		return true
 	}
 
@@ -319,10 +864,21 @@ func (c *clientHandler) setLastDataChannel(channel DataChannel) {
 }
 
 func (c *clientHandler) closeTransfer() error {
+	// the negotiated TLS parameters outlive the connection in the session
+	// report, see SessionReport.LastDataTLS
+	if c.dataConn != nil {
+		if info := newSessionTLSInfo(c.dataConn); info != nil {
+			c.paramsMutex.Lock()
+			c.lastDataTLS = info
+			c.paramsMutex.Unlock()
+		}
+
+		c.dataConn = nil
+	}
+
 	var err error
 	if c.transfer != nil {
 		err = c.transfer.Close()
-		c.isTransferOpen = false
 		c.transfer = nil
 
 		if c.debug {
@@ -342,9 +898,9 @@ func (c *clientHandler) Close() error {
 	c.transferMu.Lock()
 	defer c.transferMu.Unlock()
 
-	// set isTransferAborted to true so any transfer in progress will not try to write
-	// to the closed connection on transfer close
-	c.isTransferAborted = true
+	// switch to the aborted state so any transfer in progress will not try to
+	// write to the closed connection on transfer close
+	c.transferState = transferAborted
 
 	if err := c.closeTransfer(); err != nil {
 		c.logger.Warn(
@@ -368,7 +924,40 @@ func (c *clientHandler) Close() error {
 	return err
 }
 
+// disconnectForShutdown records why the server is ending the session, sends
+// the final 421 reply and closes the connection. The reason stays readable
+// through GetShutdownReason until the handler is recycled, so the driver's
+// ClientDisconnected sees it
+func (c *clientHandler) disconnectForShutdown(reason ShutdownReason) {
+	c.setShutdownReason(reason)
+
+	c.logger.Info(
+		"Closing session for server shutdown",
+		"reason", reason.String(),
+	)
+
+	// the reply is written straight on the connection: concurrent writes on a
+	// net.Conn are safe while the session's buffered writer is not
+	if _, err := fmt.Fprintf(c.conn, "%d %s\r\n", StatusServiceNotAvailable, reason.message()); err != nil {
+		c.logger.Debug(
+			"Problem sending the shutdown reply",
+			"err", err,
+		)
+	}
+
+	if err := c.Close(); err != nil {
+		c.logger.Debug(
+			"Problem closing a connection on shutdown",
+			"err", err,
+		)
+	}
+}
+
 func (c *clientHandler) end() {
+	// the session context goes first, so backend calls still in flight can be
+	// aborted before the driver is notified
+	c.sessionCancel()
+
 	c.server.driver.ClientDisconnected(c)
 	c.server.clientDeparture(c)
 
@@ -380,7 +969,6 @@ func (c *clientHandler) end() {
 	}
 
 	c.transferMu.Lock()
-	defer c.transferMu.Unlock()
 
 	if err := c.closeTransfer(); err != nil {
 		c.logger.Warn(
@@ -388,20 +976,61 @@ func (c *clientHandler) end() {
 			"err", err,
 		)
 	}
+
+	c.transferMu.Unlock()
+
+	// an abruptly disconnected client can leave a transfer command running,
+	// wait for it before recycling the handler
+	c.transferWg.Wait()
+	c.release()
 }
 
 func (c *clientHandler) isCommandAborted() bool {
 	c.transferMu.Lock()
 	defer c.transferMu.Unlock()
 
-	return c.isTransferAborted
+	return c.transferState == transferAborted
 }
 
 // HandleCommands reads the stream of commands
 func (c *clientHandler) HandleCommands() {
 	defer c.end()
 
+	if collector := c.server.MetricsCollector; collector != nil {
+		collector.ConnectionOpened()
+
+		defer collector.ConnectionClosed()
+	}
+
+	// the global connection limit is enforced before greeting the client
+	if maxConnections := c.server.getSettings().MaxConnections; maxConnections > 0 &&
+		c.server.clientsCount() > maxConnections {
+		c.writeMessage(StatusServiceNotAvailable, "Too many connections")
+
+		return
+	}
+
+	// a source IP banned for brute forcing logins is refused the same way
+	if c.server.getSettings().MaxFailedLoginsPerIP > 0 {
+		if ipAddress, errIP := getIPFromRemoteAddr(c.conn.RemoteAddr()); errIP == nil &&
+			!c.server.loginThrottler().LoginAllowed(ipAddress.String()) {
+			c.writeMessage(StatusServiceNotAvailable, "Temporarily banned: too many failed logins")
+
+			return
+		}
+	}
+
 	if msg, err := c.server.driver.ClientConnected(c); err == nil {
+		// the node identifier in the banner tells multi-node deployments
+		// apart before any command is exchanged
+		if settings := c.server.getSettings(); settings.NodeIdentifierInBanner && settings.NodeIdentifier != "" {
+			msg = fmt.Sprintf("%s [%s]", msg, settings.NodeIdentifier)
+		}
+
+		if banner := c.server.getSettings().WelcomeBanner; banner != "" {
+			msg = c.expandWelcomeBanner(banner, msg)
+		}
+
 		c.writeMessage(StatusServiceReady, msg)
 	} else {
 		c.writeMessage(StatusSyntaxErrorNotRecognised, msg)
@@ -416,6 +1045,36 @@ func (c *clientHandler) HandleCommands() {
 	}
 }
 
+// expandWelcomeBanner fills the placeholders of the WelcomeBanner template
+// for this client. The "\n" separators of the template then come out as a
+// multiline reply through writeMessage
+func (c *clientHandler) expandWelcomeBanner(banner, driverMessage string) string {
+	settings := c.server.getSettings()
+
+	remaining := "unlimited"
+
+	if settings.MaxConnections > 0 {
+		count := settings.MaxConnections - c.server.clientsCount()
+		if count < 0 {
+			count = 0
+		}
+
+		remaining = strconv.Itoa(count)
+	}
+
+	clientIP := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+
+	return strings.NewReplacer(
+		"{{clientIP}}", clientIP,
+		"{{nodeIdentifier}}", settings.NodeIdentifier,
+		"{{remainingConnections}}", remaining,
+		"{{driverMessage}}", driverMessage,
+	).Replace(banner)
+}
+
 func (c *clientHandler) readCommand() bool {
 	if c.reader == nil {
 		if c.debug {
@@ -426,9 +1085,15 @@ func (c *clientHandler) readCommand() bool {
 	}
 
 	// florent(2018-01-14): #58: IDLE timeout: Preparing the deadline before we read
-	if c.server.settings.IdleTimeout > 0 {
+	if timeout := c.effectiveReadTimeout(); timeout > 0 {
 		if err := c.conn.SetDeadline(
-			time.Now().Add(time.Duration(time.Second.Nanoseconds() * int64(c.server.settings.IdleTimeout)))); err != nil {
+			time.Now().Add(time.Duration(time.Second.Nanoseconds() * int64(timeout)))); err != nil {
+			c.logger.Error("Network error", "err", err)
+		}
+	} else if c.server.getSettings().PreAuthTimeout > 0 {
+		// the pre-authentication deadline must be cleared once the client is
+		// authenticated and no idle timeout applies
+		if err := c.conn.SetDeadline(time.Time{}); err != nil {
 			c.logger.Error("Network error", "err", err)
 		}
 	}
@@ -436,12 +1101,7 @@ func (c *clientHandler) readCommand() bool {
 	lineSlice, isPrefix, err := c.reader.ReadLine()
 
 	if isPrefix {
-		if c.debug {
-			c.logger.Warn("Received line too long, disconnecting client",
-				"size", len(lineSlice))
-		}
-
-		return true
+		return c.rejectOversizedLine(len(lineSlice))
 	}
 
 	if err != nil {
@@ -452,6 +1112,13 @@ func (c *clientHandler) readCommand() bool {
 
 	line := string(lineSlice)
 
+	if maxSize := c.server.getSettings().MaxCommandSize; maxSize > 0 && len(line) > maxSize {
+		c.logger.Warn("Received line too long, rejecting command", "size", len(line))
+		c.writeMessage(StatusSyntaxErrorNotRecognised, "Command line too long")
+
+		return false
+	}
+
 	if c.debug {
 		c.logger.Debug("Received line", "line", line)
 	}
@@ -461,6 +1128,56 @@ func (c *clientHandler) readCommand() bool {
 	return false
 }
 
+// oversizedDrainLimit bounds how many bytes of an oversized command line are
+// drained before giving up on the connection: a client streaming an endless
+// line is still disconnected rather than read forever
+const oversizedDrainLimit = 64 * 1024
+
+// rejectOversizedLine drains the rest of a command line longer than the read
+// buffer and refuses it with a 500 reply, so one oversized command no longer
+// costs the whole session. It returns true, ending the session, when the
+// line goes past oversizedDrainLimit or the connection breaks while draining
+func (c *clientHandler) rejectOversizedLine(size int) bool {
+	for {
+		segment, isPrefix, err := c.reader.ReadLine()
+		if err != nil {
+			c.handleCommandsStreamError(err)
+
+			return true
+		}
+
+		size += len(segment)
+
+		if !isPrefix {
+			break
+		}
+
+		if size > oversizedDrainLimit {
+			c.logger.Warn("Received endless line, disconnecting client", "size", size)
+
+			return true
+		}
+	}
+
+	c.logger.Warn("Received line too long, rejecting command", "size", size)
+	c.writeMessage(StatusSyntaxErrorNotRecognised, "Command line too long")
+
+	return false
+}
+
+// effectiveReadTimeout returns the control connection read timeout in seconds
+// that currently applies: PreAuthTimeout until the client is authenticated,
+// IdleTimeout afterwards
+func (c *clientHandler) effectiveReadTimeout() int {
+	settings := c.server.getSettings()
+
+	if settings.PreAuthTimeout > 0 && c.driver == nil {
+		return settings.PreAuthTimeout
+	}
+
+	return settings.IdleTimeout
+}
+
 func (c *clientHandler) handleCommandsStreamError(err error) {
 	// florent(2018-01-14): #58: IDLE timeout: Adding some code to deal with the deadline
 	var errNetError net.Error
@@ -474,7 +1191,7 @@ func (c *clientHandler) handleCommandsStreamError(err error) {
 			c.logger.Info("Client IDLE timeout", "err", err)
 			c.writeMessage(
 				StatusServiceNotAvailable,
-				fmt.Sprintf("command timeout (%d seconds): closing control connection", c.server.settings.IdleTimeout))
+				fmt.Sprintf("command timeout (%d seconds): closing control connection", c.effectiveReadTimeout()))
 
 			if errFlush := c.writer.Flush(); errFlush != nil {
 				c.logger.Error("Flush error", "err", errFlush)
@@ -495,12 +1212,45 @@ func (c *clientHandler) handleCommandsStreamError(err error) {
 	}
 }
 
+// notifyCommandReceived reports a received command line to the
+// MainDriverExtensionCommandLogger extension, the PASS argument replaced so
+// transcripts never contain a password
+func (c *clientHandler) notifyCommandReceived(command, param string) {
+	commandLogger, ok := c.server.driver.(MainDriverExtensionCommandLogger)
+	if !ok {
+		return
+	}
+
+	if command == "PASS" && param != "" {
+		param = "****"
+	}
+
+	line := command
+	if param != "" {
+		line += " " + param
+	}
+
+	commandLogger.CommandReceived(c, line)
+}
+
 // handleCommand takes care of executing the received line
 func (c *clientHandler) handleCommand(line string) {
+	start := time.Now()
 	command, param := parseLine(line)
 	command = strings.ToUpper(command)
 
-	cmdDesc := commandsMap[command]
+	// file name parameters sent by a client that turned UTF-8 off arrive in
+	// the negotiated legacy charset
+	if cmap := c.getLegacyCharmap(); cmap != nil && param != "" {
+		if decoded, err := cmap.NewDecoder().String(param); err == nil {
+			param = decoded
+		}
+	}
+
+	c.history.recordCommand(command, param)
+	c.notifyCommandReceived(command, param)
+
+	cmdDesc := c.server.commandDescription(command)
 	if cmdDesc == nil {
 		// Search among commands having a "special semantic". They
 		// should be sent by following the RFC-959 procedure of sending
@@ -509,7 +1259,7 @@ func (c *clientHandler) handleCommand(line string) {
 		// command suffix.
 		for _, cmd := range specialAttentionCommands {
 			if strings.HasSuffix(command, cmd) {
-				cmdDesc = commandsMap[cmd]
+				cmdDesc = c.server.commandDescription(cmd)
 				command = cmd
 
 				break
@@ -520,6 +1270,7 @@ func (c *clientHandler) handleCommand(line string) {
 			c.logger.Warn("Unknown command", "command", command)
 			c.setLastCommand(command)
 			c.writeMessage(StatusSyntaxErrorNotRecognised, fmt.Sprintf("Unknown command %#v", command))
+			c.logAccess(AccessRecordKindCommand, command, param, 0, start)
 
 			return
 		}
@@ -527,6 +1278,7 @@ func (c *clientHandler) handleCommand(line string) {
 
 	if c.driver == nil && !cmdDesc.Open {
 		c.writeMessage(StatusNotLoggedIn, "Please login with USER and PASS")
+		c.logAccess(AccessRecordKindCommand, command, param, 0, start)
 
 		return
 	}
@@ -541,49 +1293,124 @@ func (c *clientHandler) handleCommand(line string) {
 	}
 
 	c.setLastCommand(command)
+	c.server.recordCommandStat(c.user, command)
+
+	if err := c.server.runPreCommandHooks(c, command, param); err != nil {
+		code := StatusActionNotTaken
+
+		var hookErr HookError
+		if errors.As(err, &hookErr) && hookErr.Code != 0 {
+			code = hookErr.Code
+		}
+
+		c.writeMessage(code, err.Error())
+		c.logAccess(AccessRecordKindCommand, command, param, 0, start)
+
+		return
+	}
 
 	if cmdDesc.TransferRelated {
 		// these commands will be started in a separate goroutine so
 		// they can be aborted.
-		// We cannot have two concurrent transfers so also set isTransferAborted
-		// to false here.
-		// isTransferAborted could remain to true if the previous command is
+		// We cannot have two concurrent transfers so also leave the aborted
+		// state here.
+		// The aborted state could remain if the previous command is
 		// aborted and it does not open a transfer connection, see "transferFile"
 		// for details. For this to happen a client should send an ABOR before
 		// receiving the StatusFileStatusOK response. This is very unlikely
 		// A lock is not required here, we cannot have another concurrent ABOR
 		// or transfer active here
-		c.isTransferAborted = false
+		if c.transferState == transferAborted {
+			c.transferState = transferIdle
+		}
 
 		c.transferWg.Add(1)
 
 		go func(cmd, param string) {
 			defer c.transferWg.Done()
 
-			c.executeCommandFn(cmdDesc, cmd, param)
+			c.executeCommandFn(cmdDesc, cmd, param, start)
 		}(command, param)
 	} else {
-		c.executeCommandFn(cmdDesc, command, param)
+		c.executeCommandFn(cmdDesc, command, param, start)
 	}
 }
 
-func (c *clientHandler) executeCommandFn(cmdDesc *CommandDescription, command, param string) {
-	// Let's prepare to recover in case there's a command error
+// recoverDriverPanic converts a panic raised by driver code into a
+// PanicError assigned to *errPtr, so the caller's usual error path (reply,
+// cleanup, transfer notifications) keeps running instead of being unwound.
+// The panic is reported as a structured event carrying the stack captured
+// where it was raised. It must be deferred directly, recover is a no-op
+// anywhere else
+func (c *clientHandler) recoverDriverPanic(boundary string, errPtr *error) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	panicErr := newPanicError(value, debug.Stack())
+	c.logger.Error(
+		"Driver panic",
+		"boundary", boundary,
+		"err", panicErr.Error(),
+		"stack", string(panicErr.Stack()),
+	)
+
+	*errPtr = panicErr
+}
+
+func (c *clientHandler) executeCommandFn(cmdDesc *CommandDescription, command, param string, start time.Time) {
+	// the last panic boundary: whatever escaped the per-driver-call ones
+	// still only costs this command its reply, not the session
+	var panicErr error
+
 	defer func() {
-		if r := recover(); r != nil {
-			c.writeMessage(StatusSyntaxErrorNotRecognised, fmt.Sprintf("Unhandled internal error: %s", r))
-			c.logger.Warn(
-				"Internal command handling error",
-				"err", r,
-				"command", command,
-				"param", param,
-			)
+		if panicErr != nil {
+			c.writeMessage(getErrorCode(panicErr, StatusActionAbortedLocalError),
+				fmt.Sprintf("Unhandled internal error: %v", panicErr))
 		}
 	}()
+	defer c.recoverDriverPanic(command, &panicErr)
+
+	// a handler stuck on a hung driver or peer past this bound takes the
+	// session down rather than leaking it forever
+	if timeout := c.server.getSettings().CommandWatchdogTimeout; timeout > 0 {
+		fired := make(chan struct{})
+		watchdog := time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+			defer close(fired)
+
+			c.logger.Error(
+				"Command watchdog triggered, closing the session",
+				"command", command,
+				"timeoutSeconds", timeout,
+			)
+
+			if errClose := c.Close(); errClose != nil {
+				c.logger.Warn("Could not close the stuck session", "err", errClose)
+			}
+		})
+
+		defer func() {
+			// a callback that already started must finish before the command
+			// returns, or a late Close could hit a handler that was recycled
+			// for another client in the meantime
+			if !watchdog.Stop() {
+				<-fired
+			}
+		}()
+	}
 
 	if err := cmdDesc.Fn(c, param); err != nil {
 		c.writeMessage(StatusSyntaxErrorNotRecognised, fmt.Sprintf("Error: %s", err))
 	}
+
+	c.server.runPostCommandHooks(c, command, param)
+
+	if collector := c.server.MetricsCollector; collector != nil {
+		collector.CommandProcessed(command, time.Since(start))
+	}
+
+	c.logAccess(AccessRecordKindCommand, command, param, 0, start)
 }
 
 func (c *clientHandler) writeLine(line string) {
@@ -591,12 +1418,38 @@ func (c *clientHandler) writeLine(line string) {
 		c.logger.Debug("Sending answer", "line", line)
 	}
 
+	// replies carrying file names are re-encoded for clients that turned
+	// UTF-8 off; the charsets are ASCII supersets, the protocol part of the
+	// reply goes through unchanged
+	if cmap := c.getLegacyCharmap(); cmap != nil {
+		if encoded, err := newFilenameEncoder(cmap).String(line); err == nil {
+			line = encoded
+		}
+	} else if policy := c.server.getSettings().NonASCIIReplyPolicy; policy != NonASCIIPolicyKeep && !c.hasNegotiatedUTF8() {
+		line = sanitizeNonASCII(line, policy)
+	}
+
+	// a bounded write cannot block on a client that stopped reading its
+	// control connection, see Settings.ControlWriteTimeout
+	if timeout := c.server.getSettings().ControlWriteTimeout; timeout > 0 {
+		deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+		if err := c.conn.SetWriteDeadline(deadline); err != nil {
+			c.logger.Warn(
+				"Couldn't set the control write deadline",
+				"err", err,
+			)
+		}
+	}
+
 	if _, err := fmt.Fprintf(c.writer, "%s\r\n", line); err != nil {
 		c.logger.Warn(
 			"Answer couldn't be sent",
 			"line", line,
 			"err", err,
 		)
+		c.disconnectIfWriteDeadlineExpired(err)
+
+		return
 	}
 
 	if err := c.writer.Flush(); err != nil {
@@ -604,12 +1457,42 @@ func (c *clientHandler) writeLine(line string) {
 			"Couldn't flush line",
 			"err", err,
 		)
+		c.disconnectIfWriteDeadlineExpired(err)
+	}
+}
+
+// disconnectIfWriteDeadlineExpired cuts a client loose once a reply write ran
+// into Settings.ControlWriteTimeout: a peer that stopped reading its replies
+// would otherwise block every following one for the same duration
+func (c *clientHandler) disconnectIfWriteDeadlineExpired(err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.disconnect()
 	}
 }
 
 func (c *clientHandler) writeMessage(code int, message string) {
+	// a reply is written as a unit: a special action command running next to
+	// a transfer must not interleave its lines with another reply
+	c.replyMu.Lock()
+	defer c.replyMu.Unlock()
+
+	c.history.recordReply(code)
+	atomic.StoreInt32(&c.lastReplyCode, int32(code))
+
+	if commandLogger, ok := c.server.driver.(MainDriverExtensionCommandLogger); ok {
+		commandLogger.ReplySent(c, code, message)
+	}
+
 	lines := getMessageLines(message)
 
+	if maxLen := c.server.getSettings().MaxReplyLineLength; maxLen > 0 {
+		lines = foldMessageLines(lines, maxLen-replyLinePrefixLength)
+	}
+
+	if code == StatusActionNotTaken {
+		c.throttleNotFoundReply()
+	}
+
 	for idx, line := range lines {
 		if idx < len(lines)-1 {
 			c.writeLine(fmt.Sprintf("%d-%s", code, line))
@@ -617,35 +1500,122 @@ func (c *clientHandler) writeMessage(code int, message string) {
 			c.writeLine(fmt.Sprintf("%d %s", code, line))
 		}
 	}
+
+	if code == StatusActionNotTaken {
+		c.enforceNotFoundLimit()
+	}
 }
 
-func (c *clientHandler) GetTranferInfo() string {
-	if c.transfer == nil {
-		return ""
+// notFoundThrottleDelay is how long a 550 reply is held back once a session
+// went past half of Settings.MaxNotFoundReplies
+const notFoundThrottleDelay = 500 * time.Millisecond
+
+// throttleNotFoundReply counts the 550 replies of the session and holds the
+// current one back once the count went past half of
+// Settings.MaxNotFoundReplies. Bulk path enumeration triggers long runs of
+// 550 replies no regular client produces, and the delay slows scanners down
+// before they reach the limit
+func (c *clientHandler) throttleNotFoundReply() {
+	limit := c.server.getSettings().MaxNotFoundReplies
+	if limit <= 0 {
+		return
 	}
 
-	return c.transfer.GetInfo()
+	if count := int(atomic.AddInt32(&c.notFoundCount, 1)); count > limit/2 && count < limit {
+		time.Sleep(notFoundThrottleDelay)
+	}
+}
+
+// enforceNotFoundLimit disconnects a session that reached
+// Settings.MaxNotFoundReplies failed path lookups, right after its last 550
+// reply went out, and reports it through the
+// MainDriverExtensionEnumerationNotifier extension
+func (c *clientHandler) enforceNotFoundLimit() {
+	limit := c.server.getSettings().MaxNotFoundReplies
+	if limit <= 0 {
+		return
+	}
+
+	count := int(atomic.LoadInt32(&c.notFoundCount))
+	if count < limit {
+		return
+	}
+
+	if notifier, ok := c.server.driver.(MainDriverExtensionEnumerationNotifier); ok {
+		notifier.PathEnumerationDetected(c, count)
+	}
+
+	c.logger.Warn(
+		"Too many failed path lookups, disconnecting",
+		"notFoundCount", count,
+	)
+	c.disconnect()
+}
+
+// queueTransferReply records a reply decided while holding transferMu. The
+// caller must call flushTransferReplies once the mutex is released
+func (c *clientHandler) queueTransferReply(code int, message string) {
+	c.pendingReplies = append(c.pendingReplies, transferReply{code: code, message: message})
+}
+
+// flushTransferReplies writes the queued replies in the order they were
+// decided, without holding transferMu. When another goroutine is already
+// draining the queue the new entries are left to it, keeping a single writer
+// and the decided order
+func (c *clientHandler) flushTransferReplies() {
+	for {
+		c.transferMu.Lock()
+
+		if c.replyFlushing || len(c.pendingReplies) == 0 {
+			c.transferMu.Unlock()
+
+			return
+		}
+
+		replies := c.pendingReplies
+		c.pendingReplies = nil
+		c.replyFlushing = true
+		c.transferMu.Unlock()
+
+		for _, reply := range replies {
+			c.writeMessage(reply.code, reply.message)
+		}
+
+		c.transferMu.Lock()
+		c.replyFlushing = false
+		c.transferMu.Unlock()
+	}
 }
 
 func (c *clientHandler) TransferOpen(info string) (net.Conn, error) {
+	conn, err := c.transferOpen(info)
+	c.flushTransferReplies()
+
+	return conn, err
+}
+
+// transferOpen drives the idle/ready/open state machine under transferMu and
+// queues the resulting reply instead of writing it, so that the mutex is
+// never held across a control connection write
+func (c *clientHandler) transferOpen(info string) (net.Conn, error) {
 	c.transferMu.Lock()
 	defer c.transferMu.Unlock()
 
 	if c.transfer == nil {
 		// a transfer could be aborted before it is opened, in this case no response should be returned
-		if c.isTransferAborted {
-			c.isTransferAborted = false
+		if c.transferState == transferAborted {
+			c.transferState = transferIdle
 
 			return nil, errNoTransferConnection
 		}
 
-		c.writeMessage(StatusActionNotTaken, errNoTransferConnection.Error())
+		c.queueTransferReply(StatusActionNotTaken, errNoTransferConnection.Error())
 
 		return nil, errNoTransferConnection
 	}
 
 	if c.isTLSRequired() && !c.HasTLSForTransfers() {
-		c.writeMessage(StatusServiceNotAvailable, errTLSRequired.Error())
+		c.queueTransferReply(StatusServiceNotAvailable, errTLSRequired.Error())
 
 		return nil, errTLSRequired
 	}
@@ -656,17 +1626,23 @@ func (c *clientHandler) TransferOpen(info string) (net.Conn, error) {
 			"Unable to open transfer",
 			"error", err)
 
-		c.writeMessage(StatusCannotOpenDataConnection, err.Error())
+		c.queueTransferReply(StatusCannotOpenDataConnection, err.Error())
 
 		err = newNetworkError("Unable to open transfer", err)
 
 		return nil, err
 	}
 
-	c.isTransferOpen = true
+	c.transferState = transferOpen
 	c.transfer.SetInfo(info)
+	c.dataConn = conn
 
-	c.writeMessage(StatusFileStatusOK, "Using transfer connection")
+	message := "Using transfer connection"
+	if c.server.getSettings().EnableSizeInTransferReply && info != "" {
+		message += " for " + info
+	}
+
+	c.queueTransferReply(StatusFileStatusOK, message)
 
 	if c.debug {
 		c.logger.Debug(
@@ -679,6 +1655,13 @@ func (c *clientHandler) TransferOpen(info string) (net.Conn, error) {
 }
 
 func (c *clientHandler) TransferClose(err error) {
+	c.transferClose(err)
+	c.flushTransferReplies()
+}
+
+// transferClose closes the transfer under transferMu and queues the final
+// reply, suppressed when the transfer was aborted
+func (c *clientHandler) transferClose(err error) {
 	c.transferMu.Lock()
 	defer c.transferMu.Unlock()
 
@@ -690,20 +1673,27 @@ func (c *clientHandler) TransferClose(err error) {
 		)
 	}
 
+	// the file transfer, if any, is over: stop reporting its progress
+	c.transferDirection = TransferDirectionNone
+	c.transferPath = ""
+	c.transferStart = time.Time{}
+
 	// if the transfer was aborted we don't have to send a response
-	if c.isTransferAborted {
-		c.isTransferAborted = false
+	if c.transferState == transferAborted {
+		c.transferState = transferIdle
 
 		return
 	}
 
+	c.transferState = transferIdle
+
 	switch {
 	case err == nil && errClose == nil:
-		c.writeMessage(StatusClosingDataConn, "Closing transfer connection")
+		c.queueTransferReply(StatusClosingDataConn, "Closing transfer connection")
 	case errClose != nil:
-		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Issue during transfer close: %v", errClose))
+		c.queueTransferReply(StatusActionNotTaken, fmt.Sprintf("Issue during transfer close: %v", errClose))
 	case err != nil:
-		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Issue during transfer: %v", err))
+		c.queueTransferReply(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Issue during transfer: %v", err))
 	}
 }
 
@@ -712,19 +1702,41 @@ func (c *clientHandler) checkDataConnectionRequirement(dataConnIP net.IP, channe
 
 	switch channelType {
 	case DataChannelActive:
-		requirement = c.server.settings.ActiveConnectionsCheck
+		requirement = c.server.getSettings().ActiveConnectionsCheck
 	case DataChannelPassive:
-		requirement = c.server.settings.PasvConnectionsCheck
+		requirement = c.server.getSettings().PasvConnectionsCheck
 	}
 
 	switch requirement {
-	case IPMatchRequired:
+	case IPMatchRequired, CertMatchRequired:
 		controlConnIP, err := getIPFromRemoteAddr(c.RemoteAddr())
 		if err != nil {
 			return err
 		}
 
 		if !controlConnIP.Equal(dataConnIP) {
+			// the driver can accept specific mismatching peers (e.g. known NAT gateways)
+			if verifier, ok := c.server.driver.(MainDriverExtensionDataConnectionVerifier); ok {
+				errVerify := verifier.VerifyDataConnection(c, controlConnIP, dataConnIP, channelType)
+				c.logger.Info(
+					"Data connection peer mismatch submitted to driver",
+					"controlConnIP", controlConnIP,
+					"dataConnIP", dataConnIP,
+					"channelType", channelType,
+					"err", errVerify,
+				)
+
+				if errVerify == nil {
+					return nil
+				}
+			}
+
+			// a foreign peer is what an FXP transfer looks like: the other
+			// server connects (or is connected to) in place of the client
+			if c.server.getSettings().EnableFXP {
+				return c.authorizeFXPPeer(dataConnIP, channelType)
+			}
+
 			return &ipValidationError{error: fmt.Sprintf("data connection ip address %v "+
 				"does not match control connection ip address %v",
 				dataConnIP, controlConnIP)}
@@ -739,6 +1751,130 @@ func (c *clientHandler) checkDataConnectionRequirement(dataConnIP net.IP, channe
 	}
 }
 
+// authorizeFXPPeer submits a foreign data connection peer to the driver when
+// it implements the MainDriverExtensionFXPAuthorizer extension; without the
+// extension every foreign peer is accepted, EnableFXP alone vouches for them
+func (c *clientHandler) authorizeFXPPeer(dataConnIP net.IP, channelType DataChannel) error {
+	authorizer, ok := c.server.driver.(MainDriverExtensionFXPAuthorizer)
+	if !ok {
+		return nil
+	}
+
+	errAuth := authorizer.AuthorizeDataConnection(c, dataConnIP, channelType)
+	c.logger.Info(
+		"FXP data connection peer submitted to driver",
+		"dataConnIP", dataConnIP,
+		"channelType", channelType,
+		"err", errAuth,
+	)
+
+	if errAuth != nil {
+		return &ipValidationError{error: fmt.Sprintf("FXP peer %v refused: %v", dataConnIP, errAuth)}
+	}
+
+	return nil
+}
+
+// getTLSConfig returns the TLS configuration of this session: the one of the
+// virtual host selected through HOST wins, then the per-client one when the
+// driver provides it, then the server-wide one
+func (c *clientHandler) getTLSConfig() (*tls.Config, error) {
+	if tlsConfig := c.getHostTLSConfig(); tlsConfig != nil {
+		return tlsConfig, nil
+	}
+
+	if perClient, ok := c.server.driver.(MainDriverExtensionPerClientTLS); ok {
+		tlsConfig, err := perClient.GetClientTLSConfig(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if tlsConfig != nil {
+			return tlsConfig, nil
+		}
+	}
+
+	return c.server.driver.GetTLSConfig()
+}
+
+// dataTLSConfig returns the TLS configuration to apply on a data connection
+// for the given channel. With the CertMatchRequired requirement the handshake
+// itself carries the certificate half of the ownership check: a client
+// certificate becomes mandatory and its subject is compared to the control
+// connection one through VerifyConnection, so a mismatch aborts the handshake
+// instead of an established transfer. The IP half has already been checked
+// before the connection was accepted. With TLSSessionResumptionRequired the
+// same callback refuses handshakes that did not resume a session issued by
+// this server, which only a party holding a control connection session can
+// present
+func (c *clientHandler) dataTLSConfig(tlsConfig *tls.Config, channelType DataChannel) *tls.Config {
+	if tlsConfig == nil {
+		return nil
+	}
+
+	var requirement DataConnectionRequirement
+
+	switch channelType {
+	case DataChannelActive:
+		requirement = c.server.getSettings().ActiveConnectionsCheck
+	case DataChannelPassive:
+		requirement = c.server.getSettings().PasvConnectionsCheck
+	}
+
+	certMatch := requirement == CertMatchRequired
+	resumptionRequired := c.server.getSettings().TLSSessionResumptionRequired
+
+	if !certMatch && !resumptionRequired {
+		return tlsConfig
+	}
+
+	tlsConfig = tlsConfig.Clone()
+
+	if certMatch && (tlsConfig.ClientAuth == tls.NoClientCert || tlsConfig.ClientAuth == tls.RequestClientCert) {
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	}
+
+	previousVerify := tlsConfig.VerifyConnection
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if previousVerify != nil {
+			if err := previousVerify(state); err != nil {
+				return err
+			}
+		}
+
+		if resumptionRequired && !state.DidResume {
+			return &ipValidationError{error: "the data connection did not resume the TLS session of the control connection"}
+		}
+
+		if certMatch {
+			return c.verifyDataConnCert(state.PeerCertificates)
+		}
+
+		return nil
+	}
+
+	return tlsConfig
+}
+
+// verifyDataConnCert ties a data connection to the session it belongs to by
+// comparing the subject of its client certificate with the one presented on
+// the control connection
+func (c *clientHandler) verifyDataConnCert(dataCerts []*x509.Certificate) error {
+	controlCerts := c.GetPeerCertificates()
+
+	if len(dataCerts) == 0 || len(controlCerts) == 0 {
+		return &ipValidationError{error: "both control and data connections must present a client certificate"}
+	}
+
+	if dataCerts[0].Subject.String() != controlCerts[0].Subject.String() {
+		return &ipValidationError{error: fmt.Sprintf(
+			"data connection certificate subject %#v does not match control connection one %#v",
+			dataCerts[0].Subject.String(), controlCerts[0].Subject.String())}
+	}
+
+	return nil
+}
+
 func getIPFromRemoteAddr(remoteAddr net.Addr) (net.IP, error) {
 	if remoteAddr == nil {
 		return nil, &ipValidationError{error: "nil remote address"}
@@ -774,6 +1910,38 @@ func (c *clientHandler) multilineAnswer(code int, message string) func() {
 	}
 }
 
+// replyLinePrefixLength is what the "230-" prefix adds in front of every
+// line of a reply
+const replyLinePrefixLength = 4
+
+// foldMessageLines splits the lines longer than width into additional lines
+// of the same multiline reply, so no length bound silently truncates them.
+// A fold backs off to the previous rune boundary rather than cutting through
+// a UTF-8 sequence
+func foldMessageLines(lines []string, width int) []string {
+	if width < 1 {
+		width = 1
+	}
+
+	folded := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		for len(line) > width {
+			cut := width
+			for cut > 1 && line[cut]&0xc0 == 0x80 {
+				cut--
+			}
+
+			folded = append(folded, line[:cut])
+			line = line[cut:]
+		}
+
+		folded = append(folded, line)
+	}
+
+	return folded
+}
+
 func getMessageLines(message string) []string {
 	lines := make([]string, 0, 1)
 	sc := bufio.NewScanner(strings.NewReader(message))
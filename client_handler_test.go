@@ -1,13 +1,20 @@
 package ftpserver
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -79,6 +86,97 @@ func TestDOS(t *testing.T) {
 	}
 }
 
+func TestMaxCommandSize(t *testing.T) {
+	driver := &TestServerDriver{
+		Settings: &Settings{MaxCommandSize: 50},
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	reader := bufio.NewReader(conn)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	send := func(command string) string {
+		_, errWrite := fmt.Fprintf(conn, "%s\r\n", command)
+		require.NoError(t, errWrite)
+
+		line, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return strings.TrimRight(line, "\r\n")
+	}
+
+	// a line over the configured limit is refused but not fatal
+	response := send("NOOP " + strings.Repeat("a", 100))
+	require.Equal(t, "500 Command line too long", response)
+
+	// a line over the read buffer itself is drained before being refused
+	response = send("NOOP " + strings.Repeat("b", 5000))
+	require.Equal(t, "500 Command line too long", response)
+
+	// the session survived both
+	response = send("NOOP")
+	require.Equal(t, "200 OK", response)
+}
+
+// hangServerDriver hands out client drivers hanging on specific file names
+type hangServerDriver struct {
+	TestServerDriver
+}
+
+func (driver *hangServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hangClientDriver{ClientDriver: clientDriver}, nil
+}
+
+type hangClientDriver struct {
+	ClientDriver
+}
+
+func (driver *hangClientDriver) OpenFile(path string, flag int, perm os.FileMode) (afero.File, error) {
+	if strings.Contains(path, "hang") {
+		time.Sleep(2 * time.Second)
+	}
+
+	return driver.ClientDriver.OpenFile(path, flag, perm) //nolint:wrapcheck // test code
+}
+
+func TestCommandWatchdog(t *testing.T) {
+	driver := &hangServerDriver{}
+	driver.Settings = &Settings{CommandWatchdogTimeout: 1}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { _ = client.Close() }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { _ = raw.Close() }()
+
+	// the handler hangs in the driver, the watchdog kills the session
+	start := time.Now()
+	_, _, err = raw.SendCommand("STOR hang.bin")
+	require.Error(t, err, "The stuck session should have been closed")
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
 func TestLastCommand(t *testing.T) {
 	cc := clientHandler{}
 	assert.Empty(t, cc.GetLastCommand())
@@ -171,6 +269,31 @@ func TestConnectionNotAllowed(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestConnectionFilter(t *testing.T) {
+	var filtered int32
+
+	driver := &TestServerDriver{
+		Debug: false,
+		ConnectionFilter: func(_ net.Addr) error {
+			atomic.AddInt32(&filtered, 1)
+
+			return errConnectionNotAllowed
+		},
+	}
+	s := NewTestServerWithTestDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	// the connection is closed without even a welcome banner
+	buf := make([]byte, 128)
+	_, err = conn.Read(buf)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, int32(1), atomic.LoadInt32(&filtered))
+}
+
 func TestCloseConnection(t *testing.T) {
 	driver := &TestServerDriver{
 		Debug: false,
@@ -390,9 +513,13 @@ type testNetListener struct {
 	conn net.Conn
 }
 
+// Accept hands out the configured connection once, as a real peer only
+// connects a single time
 func (l *testNetListener) Accept() (net.Conn, error) {
-	if l.conn != nil {
-		return l.conn, nil
+	if conn := l.conn; conn != nil {
+		l.conn = nil
+
+		return conn, nil
 	}
 
 	return nil, &net.AddrError{}
@@ -410,16 +537,17 @@ func TestDataConnectionRequirements(t *testing.T) {
 	req := require.New(t)
 	controlConnIP := net.ParseIP("192.168.1.1")
 
+	server := &FtpServer{}
+	server.settings.Store(&Settings{
+		PasvConnectionsCheck:   IPMatchRequired,
+		ActiveConnectionsCheck: IPMatchRequired,
+	})
+
 	cltHandler := clientHandler{
 		conn: &testNetConn{
 			remoteAddr: &net.TCPAddr{IP: controlConnIP, Port: 21},
 		},
-		server: &FtpServer{
-			settings: &Settings{
-				PasvConnectionsCheck:   IPMatchRequired,
-				ActiveConnectionsCheck: IPMatchRequired,
-			},
-		},
+		server: server,
 	}
 
 	err := cltHandler.checkDataConnectionRequirement(controlConnIP, DataChannelPassive)
@@ -453,7 +581,7 @@ func TestDataConnectionRequirements(t *testing.T) {
 	}
 
 	// invalid setting
-	cltHandler.server.settings.PasvConnectionsCheck = 100
+	mustSwapSettings(cltHandler.server, func(settings *Settings) { settings.PasvConnectionsCheck = 100 })
 	err = cltHandler.checkDataConnectionRequirement(controlConnIP, DataChannelPassive)
 
 	if assert.Error(t, err) {
@@ -493,3 +621,240 @@ func TestExtraData(t *testing.T) {
 		require.Equal(t, k, extra)
 	}
 }
+
+// BenchmarkClientHandlerReuse measures the allocation cost of a connection
+// arrival/departure cycle, which the handler and buffer pools keep low under
+// high connection turnover
+func BenchmarkClientHandlerReuse(b *testing.B) {
+	server := NewFtpServer(&TestServerDriver{})
+	conn, remote := net.Pipe()
+
+	defer func() {
+		_ = conn.Close()
+		_ = remote.Close()
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		handler := server.newClientHandler(conn, uint32(i), TransferTypeBinary)
+		server.clientDeparture(handler)
+		handler.release()
+	}
+}
+
+// contextClientDriver records the session context handed over through
+// ClientDriverWithContext
+type contextClientDriver struct {
+	ClientDriver
+	ctx context.Context
+}
+
+func (driver *contextClientDriver) WithContext(ctx context.Context) ClientDriver {
+	driver.ctx = ctx
+
+	return driver
+}
+
+type contextServerDriver struct {
+	TestServerDriver
+	mu         sync.Mutex
+	lastClient *contextClientDriver
+}
+
+func (driver *contextServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	base, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &contextClientDriver{ClientDriver: base}
+
+	driver.mu.Lock()
+	driver.lastClient = client
+	driver.mu.Unlock()
+
+	return client, nil
+}
+
+func (driver *contextServerDriver) getLastClient() *contextClientDriver {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+
+	return driver.lastClient
+}
+
+func TestClientContextCancelledOnDisconnect(t *testing.T) {
+	driver := &contextServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{User: authUser, Password: authPass}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	// the driver keeps working through the wrapper returned by WithContext
+	_, err = client.ReadDir("/")
+	require.NoError(t, err)
+
+	clientDriver := driver.getLastClient()
+	require.NotNil(t, clientDriver)
+	require.NotNil(t, clientDriver.ctx)
+	require.NoError(t, clientDriver.ctx.Err(), "The session context shouldn't be cancelled yet")
+
+	require.NoError(t, client.Close())
+
+	require.Eventually(t, func() bool {
+		return clientDriver.ctx.Err() != nil
+	}, time.Second, 10*time.Millisecond, "The session context should be cancelled on disconnect")
+	require.ErrorIs(t, clientDriver.ctx.Err(), context.Canceled)
+}
+
+func TestControlWriteTimeout(t *testing.T) {
+	driver := &TestServerDriver{
+		Settings: &Settings{ControlWriteTimeout: 1},
+	}
+	driver.Init()
+	server := NewFtpServer(driver)
+	require.NoError(t, server.loadSettings())
+
+	conn, remote := net.Pipe()
+
+	defer func() { _ = remote.Close() }()
+
+	handler := server.newClientHandler(conn, 1, TransferTypeBinary)
+
+	defer func() {
+		server.clientDeparture(handler)
+		handler.release()
+	}()
+
+	done := make(chan struct{})
+
+	go func() {
+		// the peer never reads its replies, the write must be abandoned
+		// once the deadline trips
+		handler.writeMessage(StatusOK, "is anybody out there")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The reply write should have been abandoned after the deadline")
+	}
+
+	// the stuck client was disconnected along the way
+	_, err := remote.Read(make([]byte, 64))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+// enumerationNotifierDriver records the event reported through
+// MainDriverExtensionEnumerationNotifier
+type enumerationNotifierDriver struct {
+	TestServerDriver
+	reportedCount int32
+}
+
+func (driver *enumerationNotifierDriver) PathEnumerationDetected(_ ClientContext, notFoundCount int) {
+	atomic.StoreInt32(&driver.reportedCount, int32(notFoundCount))
+}
+
+func TestMaxNotFoundReplies(t *testing.T) {
+	driver := &enumerationNotifierDriver{}
+	driver.Settings = &Settings{
+		DefaultTransferType: TransferTypeBinary,
+		MaxNotFoundReplies:  3,
+	}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { _ = raw.Close() }()
+
+	// the first failed lookup comes back right away
+	returnCode, response, err := raw.SendCommand("SIZE nothing-here-1")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, returnCode, response)
+
+	// past half the limit the replies are slowed down
+	throttleStart := time.Now()
+	returnCode, response, err = raw.SendCommand("SIZE nothing-here-2")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, returnCode, response)
+	require.GreaterOrEqual(t, time.Since(throttleStart), notFoundThrottleDelay,
+		"The reply should have been held back")
+
+	// at the limit the session is reported and disconnected
+	returnCode, response, err = raw.SendCommand("SIZE nothing-here-3")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, returnCode, response)
+
+	_, _, err = raw.SendCommand("NOOP")
+	require.Error(t, err, "The enumerating session should have been disconnected")
+
+	require.Equal(t, int32(3), atomic.LoadInt32(&driver.reportedCount))
+}
+
+// commandLoggerDriver records the session transcript reported through
+// MainDriverExtensionCommandLogger
+type commandLoggerDriver struct {
+	TestServerDriver
+	mu       sync.Mutex
+	commands []string
+	replies  []int
+}
+
+func (driver *commandLoggerDriver) CommandReceived(_ ClientContext, line string) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+
+	driver.commands = append(driver.commands, line)
+}
+
+func (driver *commandLoggerDriver) ReplySent(_ ClientContext, code int, _ string) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+
+	driver.replies = append(driver.replies, code)
+}
+
+func TestCommandLogger(t *testing.T) {
+	driver := &commandLoggerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	_, err = client.ReadDir("/")
+	require.NoError(t, err)
+
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+
+	require.Contains(t, driver.commands, "USER "+authUser)
+	require.Contains(t, driver.commands, "PASS ****", "The password should be redacted")
+	require.NotContains(t, driver.commands, "PASS "+authPass)
+
+	require.Contains(t, driver.replies, StatusServiceReady)
+	require.Contains(t, driver.replies, StatusUserLoggedIn)
+}
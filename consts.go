@@ -41,16 +41,80 @@ const (
 	StatusCannotOpenDataConnection = 425 // RFC 959, 4.2.1
 	StatusTransferAborted          = 426 // RFC 959, 4.2.1
 	StatusFileActionNotTaken       = 450 // RFC 959, 4.2.1
+	StatusActionAbortedLocalError  = 451 // RFC 959, 4.2.1
 
 	// 500 Series - Syntax error, command unrecognized and the requested action did not take
 	// place. This may include errors such as command line too long.
-	StatusSyntaxErrorNotRecognised = 500 // RFC 959, 4.2.1
-	StatusSyntaxErrorParameters    = 501 // RFC 959, 4.2.1
-	StatusCommandNotImplemented    = 502 // RFC 959, 4.2.1
-	StatusBadCommandSequence       = 503 // RFC 959, 4.2.1
-	StatusNotImplementedParam      = 504 // RFC 959, 4.2.1
-	StatusNotLoggedIn              = 530 // RFC 959, 4.2.1
-	StatusActionNotTaken           = 550 // RFC 959, 4.2.1
-	StatusActionAborted            = 552 // RFC 959, 4.2.1
-	StatusActionNotTakenNoFile     = 553 // RFC 959, 4.2.1
+	StatusSyntaxErrorNotRecognised    = 500 // RFC 959, 4.2.1
+	StatusSyntaxErrorParameters       = 501 // RFC 959, 4.2.1
+	StatusCommandNotImplemented       = 502 // RFC 959, 4.2.1
+	StatusBadCommandSequence          = 503 // RFC 959, 4.2.1
+	StatusNotImplementedParam         = 504 // RFC 959, 4.2.1
+	StatusNetworkProtocolNotSupported = 522 // RFC 2428, 2
+	StatusNotLoggedIn                 = 530 // RFC 959, 4.2.1
+	StatusRequestDenied               = 534 // RFC 2228, 3
+	StatusActionNotTaken              = 550 // RFC 959, 4.2.1
+	StatusActionAborted               = 552 // RFC 959, 4.2.1
+	StatusActionNotTakenNoFile        = 553 // RFC 959, 4.2.1
 )
+
+// StatusCategory represents the reply class of a status code, i.e. its first
+// digit as defined by RFC 959 (section 4.2)
+type StatusCategory int8
+
+// Status code categories
+const (
+	// StatusCategoryUnknown is returned for codes outside of the 100-599 range
+	StatusCategoryUnknown StatusCategory = iota
+	// StatusCategoryPositivePreliminary regroups the 1xx replies
+	StatusCategoryPositivePreliminary
+	// StatusCategoryPositiveCompletion regroups the 2xx replies
+	StatusCategoryPositiveCompletion
+	// StatusCategoryPositiveIntermediate regroups the 3xx replies
+	StatusCategoryPositiveIntermediate
+	// StatusCategoryTransientNegative regroups the 4xx replies
+	StatusCategoryTransientNegative
+	// StatusCategoryPermanentNegative regroups the 5xx replies
+	StatusCategoryPermanentNegative
+)
+
+// GetStatusCategory returns the category a status code belongs to, so that
+// drivers and hook implementations can reason about reply classes without
+// hard-coding numeric ranges
+func GetStatusCategory(code int) StatusCategory {
+	if code < 100 || code > 599 {
+		return StatusCategoryUnknown
+	}
+
+	return StatusCategory(code / 100) //nolint:gosec // the range is checked above
+}
+
+// IsPositivePreliminary returns true for 1xx status codes: the requested action
+// is being initiated, expect another reply before proceeding with a new command
+func IsPositivePreliminary(code int) bool {
+	return GetStatusCategory(code) == StatusCategoryPositivePreliminary
+}
+
+// IsPositiveCompletion returns true for 2xx status codes: the requested action
+// has been successfully completed
+func IsPositiveCompletion(code int) bool {
+	return GetStatusCategory(code) == StatusCategoryPositiveCompletion
+}
+
+// IsPositiveIntermediate returns true for 3xx status codes: the command has been
+// accepted but the requested action is on hold, pending receipt of further information
+func IsPositiveIntermediate(code int) bool {
+	return GetStatusCategory(code) == StatusCategoryPositiveIntermediate
+}
+
+// IsTransientNegative returns true for 4xx status codes: the action did not take
+// place, but the error condition is temporary and it may be requested again
+func IsTransientNegative(code int) bool {
+	return GetStatusCategory(code) == StatusCategoryTransientNegative
+}
+
+// IsPermanentNegative returns true for 5xx status codes: the action did not take
+// place and should not be requested again as is
+func IsPermanentNegative(code int) bool {
+	return GetStatusCategory(code) == StatusCategoryPermanentNegative
+}
@@ -0,0 +1,26 @@
+package ftpserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCategories(t *testing.T) {
+	require.Equal(t, StatusCategoryPositivePreliminary, GetStatusCategory(StatusFileStatusOK))
+	require.Equal(t, StatusCategoryPositiveCompletion, GetStatusCategory(StatusOK))
+	require.Equal(t, StatusCategoryPositiveIntermediate, GetStatusCategory(StatusUserOK))
+	require.Equal(t, StatusCategoryTransientNegative, GetStatusCategory(StatusServiceNotAvailable))
+	require.Equal(t, StatusCategoryPermanentNegative, GetStatusCategory(StatusActionNotTaken))
+	require.Equal(t, StatusCategoryUnknown, GetStatusCategory(0))
+	require.Equal(t, StatusCategoryUnknown, GetStatusCategory(600))
+
+	require.True(t, IsPositivePreliminary(StatusFileStatusOK))
+	require.True(t, IsPositiveCompletion(StatusClosingDataConn))
+	require.True(t, IsPositiveIntermediate(StatusFileActionPending))
+	require.True(t, IsTransientNegative(StatusTransferAborted))
+	require.True(t, IsPermanentNegative(StatusNotLoggedIn))
+
+	require.False(t, IsPositiveCompletion(StatusNotLoggedIn))
+	require.False(t, IsTransientNegative(StatusOK))
+}
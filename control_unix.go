@@ -15,6 +15,11 @@ func Control(_, _ string, c syscall.RawConn) error {
 	var errSetOpts error
 
 	err := c.Control(func(unixFd uintptr) {
+		// the net package marks its sockets close-on-exec by itself; doing it
+		// here too keeps the guarantee for data sockets even if a future Go
+		// version or an exotic platform behaves differently
+		unix.CloseOnExec(int(unixFd))
+
 		errSetOpts = unix.SetsockoptInt(int(unixFd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
 		if errSetOpts != nil {
 			return
@@ -1,17 +1,20 @@
 package ftpserver
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net"
 	"os"
+	"time"
 
 	"github.com/spf13/afero"
 )
 
 // This file is the driver part of the server. It must be implemented by anyone wanting to use the server.
 
-// MainDriver handles the authentication and ClientHandlingDriver selection
+// MainDriver handles the authentication and ClientDriver selection
 type MainDriver interface {
 	// GetSettings returns some general settings around the server setup
 	GetSettings() (*Settings, error)
@@ -40,6 +43,43 @@ type MainDriverExtensionTLSVerifier interface {
 	VerifyConnection(cc ClientContext, user string, tlsConn *tls.Conn) (ClientDriver, error)
 }
 
+// MainDriverExtensionClientCertAuth is an extension that allows to
+// authenticate clients with TLS certificates. When implemented, the TLS
+// configurations returned by the driver are adjusted to request a client
+// certificate during the handshake, and the chain presented by the client is
+// checked against the CA pool returned for the user when the "USER" command
+// is received, mirroring tls.RequireAndVerifyClientCert on a per-user basis.
+// The verified chain stays available through
+// ClientContext.GetPeerCertificates, e.g. for a
+// MainDriverExtensionTLSVerifier mapping CN or SAN values to accounts
+type MainDriverExtensionClientCertAuth interface {
+	// GetClientCertPool returns the CA pool the certificate chain of the
+	// given user must verify against, or nil when the user may log in
+	// without a client certificate. Returning an error refuses the login
+	GetClientCertPool(cc ClientContext, user string) (*x509.CertPool, error)
+}
+
+// MainDriverExtensionCustomCommands is an extension that allows to add
+// proprietary verbs next to the built-in command set, or to replace built-in
+// ones. The returned descriptions are registered when the server instance is
+// created, as if RegisterCommand had been called for each of them
+type MainDriverExtensionCustomCommands interface {
+	// GetCustomCommands returns the commands to register, keyed by verb
+	GetCustomCommands() map[string]CustomCommandDescription
+}
+
+// MainDriverExtensionPerClientTLS is an extension that allows to serve a
+// different TLS configuration per client, e.g. one certificate per virtual
+// host when clients are told apart by the address they connected to. It is
+// consulted for the control connection upgrade (AUTH TLS) and for the data
+// connections of the session; implicit TLS still uses GetTLSConfig, as it
+// happens before any client exists
+type MainDriverExtensionPerClientTLS interface {
+	// GetClientTLSConfig returns the TLS configuration to use for the given
+	// client. Returning a nil configuration falls back to GetTLSConfig
+	GetClientTLSConfig(cc ClientContext) (*tls.Config, error)
+}
+
 // MainDriverExtensionPassiveWrapper is an extension that allows to wrap the listener
 // used for passive connection
 type MainDriverExtensionPassiveWrapper interface {
@@ -58,6 +98,51 @@ type MainDriverExtensionUserVerifier interface {
 	PreAuthUser(cc ClientContext, user string) error
 }
 
+// MainDriverExtensionDataConnectionVerifier is an extension that allows to accept
+// data connections whose peer IP address doesn't match the control connection one,
+// e.g. clients behind known NAT gateways, without disabling the IP-match check globally
+type MainDriverExtensionDataConnectionVerifier interface {
+	// VerifyDataConnection is called with the control and data connection peer IP
+	// addresses when the IP-match check fails, before rejecting the data connection.
+	// Returning a nil error accepts the data connection despite the mismatch,
+	// a non-nil error rejects it
+	VerifyDataConnection(cc ClientContext, controlConnIP, dataConnIP net.IP, channelType DataChannel) error
+}
+
+// MainDriverExtensionFXPAuthorizer is an extension that lets the driver decide
+// which foreign peers are acceptable for server-to-server (FXP) transfers once
+// EnableFXP is set, e.g. by checking the address against a list of trusted
+// partner servers. Without this extension, EnableFXP accepts any foreign peer
+type MainDriverExtensionFXPAuthorizer interface {
+	// AuthorizeDataConnection is called with the foreign data connection peer
+	// IP address when it doesn't match the control connection one and FXP is
+	// enabled. Returning a nil error accepts the peer, a non-nil error rejects
+	// the data connection
+	AuthorizeDataConnection(cc ClientContext, dataConnIP net.IP, channelType DataChannel) error
+}
+
+// MainDriverExtensionActiveTargetValidator is an extension that lets the
+// driver apply its own policy to the targets of PORT and EPRT commands, on
+// top of the checks selected through Settings.ActiveTargetRestrictions, e.g.
+// an allowlist of partner servers acceptable for site-to-site transfers
+type MainDriverExtensionActiveTargetValidator interface {
+	// ValidateActiveTarget is called with the address a PORT or EPRT command
+	// asks the server to connect to, before any connection attempt.
+	// Returning a non-nil error refuses the command with a 501 reply
+	ValidateActiveTarget(cc ClientContext, ip net.IP, port int) error
+}
+
+// MainDriverExtensionTLSDowngradeVerifier is an extension that allows to refuse
+// the switch back to cleartext data connections ("PROT C") on a per-user or
+// per-path basis, e.g. for accounts whose data must stay encrypted even though
+// control channel TLS is optional
+type MainDriverExtensionTLSDowngradeVerifier interface {
+	// VerifyTLSDowngrade is called when the client requests "PROT C".
+	// Returning a non-nil error refuses the downgrade with a 534 reply and
+	// keeps the current data channel protection level
+	VerifyTLSDowngrade(cc ClientContext) error
+}
+
 // MainDriverExtensionPostAuthMessage is an extension that allows to send a message
 // after the authentication
 type MainDriverExtensionPostAuthMessage interface {
@@ -71,11 +156,177 @@ type MainDriverExtensionQuitMessage interface {
 	QuitMessage() string
 }
 
+// MainDriverExtensionReinit is an extension that lets the driver release
+// per-user resources when a client reinitializes its session through REIN,
+// before the control connection is handed to a new authentication sequence
+type MainDriverExtensionReinit interface {
+	// ClientReinit is called when an authenticated client sends REIN, with
+	// the user the session is about to drop
+	ClientReinit(cc ClientContext, user string)
+}
+
+// MainDriverExtensionAdminVerifier is an extension that enables the hidden
+// administrative SITE subcommands (KICK, DRAIN, RELOAD). They only become
+// visible once the session obtained an elevation through "SITE AUTHZ <token>",
+// verified by this extension, so admin functionality can be deployed without
+// exposing it to every authenticated user
+type MainDriverExtensionAdminVerifier interface {
+	// VerifySiteAuthz is called when an authenticated user issues
+	// "SITE AUTHZ <token>". Returning a nil error grants the session an
+	// elevation valid for the returned duration
+	VerifySiteAuthz(cc ClientContext, token string) (time.Duration, error)
+}
+
+// MainDriverExtensionConnectionFilter is an extension that allows to reject
+// incoming connections from their remote address alone. It is called right
+// after Accept, before any resource is allocated for the session: rejected
+// clients don't get a welcome banner nor a dedicated goroutine
+type MainDriverExtensionConnectionFilter interface {
+	// FilterConnection is called with the remote address of every incoming
+	// connection. If it returns a non-nil error, the connection is closed
+	// without any reply
+	FilterConnection(addr net.Addr) error
+}
+
+// MainDriverExtensionCommandLogger is an extension receiving the whole
+// conversation of every session: each command line as it was received, with
+// the PASS argument redacted, and each reply with its status code. It lets
+// embedding servers persist full session transcripts without parsing the
+// debug logger output
+type MainDriverExtensionCommandLogger interface {
+	// CommandReceived is called with every command line read on a control
+	// connection, the password argument of PASS replaced by stars
+	CommandReceived(cc ClientContext, line string)
+
+	// ReplySent is called with every reply written on a control
+	// connection, once per reply whatever its number of lines
+	ReplySent(cc ClientContext, code int, message string)
+}
+
+// MainDriverExtensionEnumerationNotifier is an extension notified when a
+// session accumulated Settings.MaxNotFoundReplies failed path lookups and is
+// about to be disconnected, so embedding servers can log the event or ban
+// the remote address
+type MainDriverExtensionEnumerationNotifier interface {
+	// PathEnumerationDetected is called with the session and the number of
+	// 550 replies it triggered, right before it is disconnected
+	PathEnumerationDetected(cc ClientContext, notFoundCount int)
+}
+
+// MainDriverExtensionTransferNotifier is an extension that reports the
+// lifecycle of every file transfer to the main driver. It gives a single
+// place to aggregate transfer metrics, where per-file instrumentation would
+// require wrapping every handle the client driver returns
+type MainDriverExtensionTransferNotifier interface {
+	// TransferStarted is called once the data connection of a file transfer
+	// is open, before any data is moved
+	TransferStarted(cc ClientContext, direction TransferDirection, path string)
+
+	// TransferCompleted is called when the transfer ends, successfully or
+	// not, with the number of bytes moved, how long the transfer took and
+	// the error that stopped it, if any
+	TransferCompleted(cc ClientContext, direction TransferDirection, path string,
+		bytes int64, duration time.Duration, err error)
+}
+
+// MainDriverExtensionTransferPriority is an extension classifying file
+// transfers into priority classes, whose concurrency is capped by the
+// TransferClassLimits setting. Bulk backup accounts can be put in a class
+// with a low limit so they can't starve interactive users on a shared server
+type MainDriverExtensionTransferPriority interface {
+	// GetTransferClass returns the priority class of the transfer about to
+	// start. An empty class leaves the transfer subject only to the global
+	// MaxConcurrentTransfers limit
+	GetTransferClass(cc ClientContext, direction TransferDirection, path string) string
+}
+
+// MainDriverExtensionVirtualHost is an extension that adds support for the
+// HOST command (RFC 7151). It lets a single server instance serve several
+// virtual hosts: the driver learns which hostname the client asked for
+// before authentication and can hand back a dedicated TLS configuration,
+// typically carrying the certificate of that host, for a subsequent AUTH TLS
+type MainDriverExtensionVirtualHost interface {
+	// SelectVirtualHost is called with the hostname received in a HOST
+	// command, before the client is authenticated. Returning a non-nil
+	// error rejects the host with a 501 reply. The returned TLS
+	// configuration replaces the one from GetTLSConfig for this session;
+	// it may be nil to keep the default one
+	SelectVirtualHost(cc ClientContext, host string) (*tls.Config, error)
+}
+
 // ClientDriver is the base FS implementation that allows to manipulate files
 type ClientDriver interface {
 	afero.Fs
 }
 
+// DriverCapabilities is a bitmask of the optional afero features a client
+// driver actually supports
+type DriverCapabilities uint32
+
+// Optional driver capabilities and the commands they back
+const (
+	// CapabilityChtimes covers the MFMT command
+	CapabilityChtimes DriverCapabilities = 1 << iota
+	// CapabilityChmod covers the SITE CHMOD command
+	CapabilityChmod
+	// CapabilityChown covers the SITE CHOWN command
+	CapabilityChown
+)
+
+// ClientDriverExtensionCapabilities is an extension to implement when the
+// driver cannot honor parts of the afero.Fs interface, e.g. a read-only or
+// object-store backed Fs. Commands relying on a missing capability are left
+// out of FEAT and SITE HELP and answered with a 502 reply right away, instead
+// of failing with a misleading 550 once the call has been attempted. Drivers
+// not implementing this extension are assumed to support everything
+type ClientDriverExtensionCapabilities interface {
+	// GetCapabilities returns the set of optional features the driver supports
+	GetCapabilities() DriverCapabilities
+}
+
+// ClientDriverWithContext is an extension the ClientDriver returned by
+// AuthUser can implement to be handed the session context right after the
+// authentication. Backends talking to remote services (object stores,
+// databases) can bind their requests to it and have them aborted as soon as
+// the client goes away
+type ClientDriverWithContext interface {
+	// WithContext receives the context described on ClientContext.Context
+	// and returns the ClientDriver to use for the rest of the session
+	WithContext(ctx context.Context) ClientDriver
+}
+
+// ClientDriverExtensionQuota is an extension to enforce a storage quota:
+// uploads are refused with a 552 reply when the account has no room left,
+// either before the transfer when the size announced through ALLO does not
+// fit, or in the middle of it once the byte counter crosses the limit
+type ClientDriverExtensionQuota interface {
+	// GetUsage returns the number of bytes the account currently stores
+	GetUsage() (int64, error)
+	// GetQuota returns the number of bytes the account may store at most,
+	// a negative value meaning unlimited
+	GetQuota() (int64, error)
+}
+
+// ClientDriverExtensionDirSize is an extension to support the "DSIZ" -
+// directory size - command, for backends that can compute the total size of
+// a directory cheaply, typically object stores keeping per-prefix usage
+// counters. Without it, DSIZ is answered by a bounded recursive walk when
+// the EnableDSIZWalkFallback setting is on, and refused otherwise
+type ClientDriverExtensionDirSize interface {
+	// DirSize returns the total size, in bytes, of the files stored below
+	// the directory named by name
+	DirSize(name string) (int64, error)
+}
+
+// ClientDriverExtensionSetCTime is an extension to support the "MFCT" -
+// modify creation time - command, for filesystems that record one, typically
+// Windows backends or object stores keeping custom metadata. afero has no
+// portable way to set it
+type ClientDriverExtensionSetCTime interface {
+	// SetCTime sets the creation time of the file named by name
+	SetCTime(name string, ctime time.Time) error
+}
+
 // ClientDriverExtensionAllocate is an extension to support the "ALLO" - file allocation - command
 type ClientDriverExtensionAllocate interface {
 	// AllocateSpace reserves the space necessary to upload files
@@ -98,6 +349,52 @@ type ClientDriverExtensionFileList interface {
 	ReadDir(name string) ([]os.FileInfo, error)
 }
 
+// ClientDriverExtensionDirectoryPager is an extension for backends with
+// native listing pagination, typically object stores: the directory is read
+// one page at a time, each page coming with an opaque token the next one is
+// requested with. It only kicks in once the client negotiated partial MLSD
+// listings through "OPTS MLSD PARTIAL=<size>"
+type ClientDriverExtensionDirectoryPager interface {
+	// ReadDirPage returns up to limit entries of the directory named by name,
+	// resuming after the given continuation token, empty for the first page.
+	// The returned token requests the following page, empty once the listing
+	// is complete
+	ReadDirPage(name string, token string, limit int) ([]os.FileInfo, string, error)
+}
+
+// ClientDriverExtensionMLSxFacts is an extension to implement to enrich the
+// MLSD/MLST entries with facts beyond the built-in Type, Size and Modify,
+// typically Perm, Unique, UNIX.mode or UNIX.owner
+type ClientDriverExtensionMLSxFacts interface {
+	// GetExtraMLSxFacts returns extra facts for the given file, keyed by fact
+	// name. Facts deselected by the client through "OPTS MLST" are filtered
+	// out by the server
+	GetExtraMLSxFacts(path string, info os.FileInfo) map[string]string
+}
+
+// ClientDriverExtensionListFormatter is an extension to implement to take
+// over the formatting of LIST and STAT entries, which otherwise follow a
+// Unix "ls -l" layout with a hardcoded "ftp ftp" owner and group. It can be
+// used to emit real owner and group names, or Windows-style listings for
+// legacy clients
+type ClientDriverExtensionListFormatter interface {
+	// FormatListLine returns the listing line for the given file, without
+	// the trailing CRLF
+	FormatListLine(info os.FileInfo) string
+}
+
+// ClientDriverExtensionListLine is an extension to supply individual LIST and
+// STAT entry lines, for drivers carrying per-file metadata that the standard
+// layout cannot express (ACL flags, archive or online status, ...). It is
+// consulted before ClientDriverExtensionListFormatter and also receives the
+// path of the entry, so the decision can be made file by file
+type ClientDriverExtensionListLine interface {
+	// FormatListEntry returns the listing line for the file at the given
+	// path, without the trailing CRLF. Returning false declines the entry,
+	// which is then formatted as if the extension was not implemented
+	FormatListEntry(info os.FileInfo, path string) (string, bool)
+}
+
 // ClientDriverExtentionFileTransfer is a convenience extension to allow to transfer files
 // without requiring to implement the methods Create/Open/OpenFile for your custom afero.File.
 type ClientDriverExtentionFileTransfer interface {
@@ -130,6 +427,65 @@ type ClientDriverExtensionAvailableSpace interface {
 	GetAvailableSpace(dirName string) (int64, error)
 }
 
+// ClientDriverExtensionTransferAccounting is an extension to implement to keep track
+// of the data transferred on data connections and to enforce bandwidth quotas.
+// AccountDataTransfer is called each time data is read from or written to a data
+// connection with the session directional totals, so the driver can aggregate them
+// per user. Returning a non-nil error (typically ErrBandwidthQuotaExceeded) aborts
+// the transfer in progress with a 552 reply
+type ClientDriverExtensionTransferAccounting interface {
+	// AccountDataTransfer receives the number of bytes uploaded and downloaded
+	// by the session so far
+	AccountDataTransfer(uploadedBytes, downloadedBytes int64) error
+}
+
+// ClientDriverExtensionContentSniffer is an extension to implement to inspect the
+// first bytes of every uploaded file, typically to reject unwanted content such
+// as executables or encrypted archives before most of the data has been accepted.
+// The sniffing stage is skipped for appends (APPE) and resumed uploads (REST) as
+// the beginning of the file isn't transferred in those cases
+type ClientDriverExtensionContentSniffer interface {
+	// SniffContent receives the path of the uploaded file and up to its first
+	// contentSniffSize bytes (less when the upload is smaller). Returning a
+	// non-nil error rejects the upload with a 553 reply
+	SniffContent(name string, header []byte) error
+}
+
+// ClientDriverExtensionUploadDeduplicator is an extension to implement to
+// deduplicate uploads by content: the driver learns what the client intends
+// to store before any byte is moved and receives the digest of the streamed
+// content before the file becomes visible, so known content can be stored by
+// reference while the client still gets a successful reply. Deduplication
+// only runs for uploads written from their beginning, not for appends (APPE),
+// resumed (REST) or range (RANG) uploads
+type ClientDriverExtensionUploadDeduplicator interface {
+	// PreUpload receives the path about to be uploaded and the size the
+	// client declared through ALLO or "OPTS STOR SIZE", 0 when unknown.
+	// Returning a non-nil error refuses the upload
+	PreUpload(name string, declaredSize int64) error
+
+	// IsDuplicateUpload receives the path, the hex SHA-256 digest of the
+	// stored content and its size once the data connection is drained but
+	// before the upload is finalized. Returning true discards the freshly
+	// written data, the driver being expected to materialize the file by
+	// reference itself; returning a non-nil error fails the upload
+	IsDuplicateUpload(name string, digest string, size int64) (bool, error)
+}
+
+// ClientDriverExtensionPathResolver is an extension to implement to rewrite
+// the paths received from the client before any command uses them: virtual
+// folders, per-user chroots and aliases (e.g. "/uploads" mapping to another
+// backing location) can be implemented once here instead of overloading the
+// afero.Fs semantics. The resolver runs on every client-supplied path, after
+// it was made absolute and cleaned. The resolved path is the one the session
+// works with from then on (it is quoted by PWD and relative paths resolve
+// against it), so the resolver must accept already-resolved paths unchanged
+type ClientDriverExtensionPathResolver interface {
+	// ResolvePath receives a cleaned absolute virtual path and returns the
+	// path handed to the driver
+	ResolvePath(path string) string
+}
+
 // ClientContext is implemented on the server side to provide some access to few data around the client
 type ClientContext interface {
 	// Path provides the path of the current connection
@@ -156,6 +512,12 @@ type ClientContext interface {
 	// Client's ID on the server
 	ID() uint32
 
+	// GetSessionToken returns a short random token identifying this session:
+	// it is part of every log line and session report, so a user quoting it
+	// in a problem report lets operators grep the matching session across
+	// distributed logs. See also Settings.SessionTokenInWelcome
+	GetSessionToken() string
+
 	// Client's address
 	RemoteAddr() net.Addr
 
@@ -189,6 +551,46 @@ type ClientContext interface {
 	// clients, use the TLSRequired parameter defined in server settings instead
 	SetTLSRequirement(requirement TLSRequirement) error
 
+	// GetTransferredBytes returns the number of bytes uploaded and downloaded
+	// on data connections since the beginning of the session
+	GetTransferredBytes() (uploadedBytes, downloadedBytes int64)
+
+	// GetTransferStats returns a snapshot of the file transfer in progress.
+	// The zero value, with TransferDirectionNone, is returned when no file
+	// transfer is in progress
+	GetTransferStats() TransferStats
+
+	// GetInProgressUploads returns the final paths of the uploads the
+	// session is currently writing under a temporary name, see
+	// Settings.EnableAtomicUploads. It returns nil when no atomic upload
+	// is in progress
+	GetInProgressUploads() []string
+
+	// IsElevated returns true while the session holds an administrative
+	// elevation granted through "SITE AUTHZ" and verified by the
+	// MainDriverExtensionAdminVerifier extension
+	IsElevated() bool
+
+	// GetHost returns the virtual host selected through the HOST command,
+	// or an empty string when the client didn't send one
+	GetHost() string
+
+	// Context returns a context living for the duration of the session. It
+	// is cancelled once the control connection ends, whether the client left
+	// or the server shut down, so drivers can abort in-flight backend calls
+	Context() context.Context
+
+	// GetShutdownReason returns the reason the server gave when it ended
+	// the session, or ShutdownNone when the session was not closed by a
+	// server shutdown. It is meant to be read from
+	// MainDriver.ClientDisconnected
+	GetShutdownReason() ShutdownReason
+
+	// GetPeerCertificates returns the certificate chain presented by the
+	// client on the control connection, leaf first, or nil when the
+	// connection is not over TLS or no certificate was presented
+	GetPeerCertificates() []*x509.Certificate
+
 	// SetExtra allows to set application specific data
 	SetExtra(extra any)
 
@@ -205,10 +607,78 @@ type FileTransfer interface {
 }
 
 // FileTransferError is a FileTransfer extension used to notify errors.
+// It is called for every failure class (open, seek, data and close failures)
+// with a TransferError wrapping the underlying error
 type FileTransferError interface {
 	TransferError(err error)
 }
 
+// FileTransferDone is a FileTransfer extension used to notify the end of a
+// successful transfer, along with the number of bytes exchanged on the data
+// connection, before the success reply is sent to the client
+type FileTransferDone interface {
+	TransferDone(bytes int64)
+}
+
+// TransferDirection identifies the direction of a file transfer
+type TransferDirection int8
+
+// Transfer directions
+const (
+	TransferDirectionNone     TransferDirection = iota // no file transfer in progress
+	TransferDirectionUpload                            // the client is storing a file
+	TransferDirectionDownload                          // the client is retrieving a file
+)
+
+// TransferStats is a point-in-time snapshot of the file transfer in progress,
+// returned by ClientContext.GetTransferStats so drivers can display live
+// progress
+type TransferStats struct {
+	Direction        TransferDirection // Direction of the transfer
+	Path             string            // Path of the file being transferred
+	Start            time.Time         // When the transfer started
+	BytesTransferred int64             // Bytes exchanged on the data connection so far
+}
+
+// StallSource identifies which side of a buffered upload a stall was waiting on
+type StallSource int8
+
+// Stall sources
+const (
+	// StallSourceClient means the upload buffer ran empty: the client (or the
+	// network) was not delivering data fast enough
+	StallSourceClient StallSource = iota + 1
+	// StallSourceStorage means the upload buffer filled up: the driver's Write
+	// was not draining data fast enough
+	StallSourceStorage
+)
+
+// String returns a human readable version of the stall source
+func (s StallSource) String() string {
+	switch s {
+	case StallSourceClient:
+		return "client"
+	case StallSourceStorage:
+		return "storage"
+	default:
+		return "unknown"
+	}
+}
+
+// TransferStall reports a single pause observed in the buffered upload path
+type TransferStall struct {
+	Source   StallSource   // The side of the transfer the stall was waiting on
+	Duration time.Duration // How long the transfer was paused
+}
+
+// FileTransferStallNotifier is a FileTransfer extension notified of the stalls
+// observed while uploading through the buffer enabled by
+// Settings.UploadBufferSize, so that slow clients can be told apart from slow
+// storage
+type FileTransferStallNotifier interface {
+	TransferStall(stall TransferStall)
+}
+
 // PortRange is a range of ports
 type PortRange struct {
 	Start int // Range start
@@ -219,6 +689,12 @@ type PortRange struct {
 // to use in the response to the PASV command, or an error if a public IP cannot be determined.
 type PublicIPResolver func(ClientContext) (string, error)
 
+// PasvPortResolver takes a ClientContext and the port a passive listener was
+// bound to, and returns the address and port the passive reply should
+// advertise, or an error if no mapping exists for this client. See
+// Settings.PasvPortResolver
+type PasvPortResolver func(cc ClientContext, internalPort int) (externalIP string, externalPort int, err error)
+
 // TLSRequirement is the enumerable that represents the supported TLS mode
 type TLSRequirement int8
 
@@ -239,15 +715,127 @@ const (
 	IPMatchRequired DataConnectionRequirement = iota
 	// IPMatchDisabled disables checking peer IP addresses of control and data connection
 	IPMatchDisabled
+	// CertMatchRequired requires, on top of matching peer IP addresses, that
+	// a TLS data connection presents a client certificate whose subject
+	// matches the control connection one, an ownership check that cannot be
+	// defeated by address spoofing or shared NAT addresses
+	CertMatchRequired
 )
 
+// ActiveTargetRestrictions is a bitmask of the RFC 2577 anti-bounce checks
+// applied to the targets of PORT and EPRT commands, see
+// Settings.ActiveTargetRestrictions
+type ActiveTargetRestrictions uint8
+
+// Supported active target restrictions
+const (
+	// ActiveTargetRefusePrivilegedPorts refuses targets below port 1024,
+	// the ports a bounce attack would abuse to reach other services
+	ActiveTargetRefusePrivilegedPorts ActiveTargetRestrictions = 1 << iota
+	// ActiveTargetRefusePrivateAddresses refuses targets in the loopback,
+	// link-local and RFC 1918 private ranges, which a client reached over
+	// the Internet has no business pointing the server at
+	ActiveTargetRefusePrivateAddresses
+	// ActiveTargetRequireControlIP refuses targets that differ from the
+	// peer address of the control connection, closing the bounce vector
+	// entirely at the cost of breaking site-to-site transfers
+	ActiveTargetRequireControlIP
+)
+
+// RestAppendPolicy is the enumerable that represents how an APPE received with
+// a pending REST offset is handled
+type RestAppendPolicy int8
+
+// Supported REST with APPE policies
+const (
+	// RestAppendPolicyIgnore silently drops the offset and appends to the end
+	// of the file (historical behavior)
+	RestAppendPolicyIgnore RestAppendPolicy = iota
+	// RestAppendPolicyRefuse replies a 501 so the client can notice and resume
+	// with a plain REST and STOR sequence
+	RestAppendPolicyRefuse
+	// RestAppendPolicyHonor seeks to the offset and writes from there, which
+	// requires the driver files to support seeking files opened for writing
+	RestAppendPolicyHonor
+)
+
+// NonASCIIPolicy is the enumerable that represents how non-ASCII characters
+// in replies and listings are handled for sessions that didn't negotiate
+// UTF-8, see Settings.NonASCIIReplyPolicy
+type NonASCIIPolicy int8
+
+// Supported non-ASCII reply policies
+const (
+	// NonASCIIPolicyKeep sends the replies as produced, raw UTF-8 bytes
+	// included (historical behavior)
+	NonASCIIPolicyKeep NonASCIIPolicy = iota
+	// NonASCIIPolicyEscape percent-encodes every non-ASCII byte, so "é"
+	// travels as "%C3%A9" and no information is lost
+	NonASCIIPolicyEscape
+	// NonASCIIPolicyTransliterate decomposes accented letters to their ASCII
+	// base ("é" becomes "e") and replaces the remaining non-ASCII characters
+	// with a question mark
+	NonASCIIPolicyTransliterate
+)
+
+// ShutdownReason tells connected sessions why the server is going away. It
+// selects the text of the final 421 reply and is exposed through
+// ClientContext.GetShutdownReason, so that MainDriver.ClientDisconnected can
+// tell a deliberate shutdown from a lost connection in its bookkeeping
+type ShutdownReason int8
+
+// Shutdown reasons
+const (
+	// ShutdownNone is reported for sessions that ended on their own, without
+	// a server shutdown
+	ShutdownNone ShutdownReason = iota
+	// ShutdownMaintenance is a planned shutdown, e.g. for an upgrade
+	ShutdownMaintenance
+	// ShutdownOverload is a shutdown performed to shed load
+	ShutdownOverload
+	// ShutdownError is a shutdown caused by an unrecoverable server problem
+	ShutdownError
+)
+
+// String returns a human readable version of the shutdown reason
+func (reason ShutdownReason) String() string {
+	switch reason {
+	case ShutdownMaintenance:
+		return "maintenance"
+	case ShutdownOverload:
+		return "overload"
+	case ShutdownError:
+		return "error"
+	case ShutdownNone:
+		return "none"
+	default:
+		return "none"
+	}
+}
+
+// message returns the text of the final 421 reply sent for this reason
+func (reason ShutdownReason) message() string {
+	switch reason {
+	case ShutdownMaintenance:
+		return "Server is going down for maintenance"
+	case ShutdownOverload:
+		return "Server is overloaded, closing connection"
+	case ShutdownError:
+		return "Server encountered an internal error, closing connection"
+	case ShutdownNone:
+		return "Server is shutting down"
+	default:
+		return "Server is shutting down"
+	}
+}
+
 // Settings defines all the server settings
 //
 //nolint:maligned
 type Settings struct {
 	Listener                 net.Listener     // (Optional) To provide an already initialized listener
 	ListenAddr               string           // Listening address
-	PublicHost               string           // Public IP to expose (only an IP address is accepted at this stage)
+	PublicHost               string           // Public IP to expose (only an IP address is accepted at this stage, IPv6 can be bracketed and carry a scope ID)
 	PublicIPResolver         PublicIPResolver // (Optional) To fetch a public IP lookup
 	PassiveTransferPortRange *PortRange       // (Optional) Port Range for data connections. Random if not specified
 	ActiveTransferPortNon20  bool             // Do not impose the port 20 for active data transfer (#88, RFC 1579)
@@ -266,8 +854,335 @@ type Settings struct {
 	DisableSYST              bool             // Disable SYST
 	EnableCOMB               bool             // Enable COMB support
 	DefaultTransferType      TransferType     // Transfer type to use if the client don't send the TYPE command
+	// EnableMLSDFilePath allows MLSD on a file path to return the single entry,
+	// like LIST and NLST do, instead of failing. Some sync tools call MLSD on files
+	// to fetch facts and treat the error as a missing file
+	EnableMLSDFilePath bool
+	// ListRecentTimeFormat is the time layout used in LIST responses for entries modified
+	// less than six months ago (default "Jan _2 15:04")
+	ListRecentTimeFormat string
+	// ListOldTimeFormat is the time layout used in LIST responses for older entries
+	// (default "Jan _2  2006"). Legacy parsers requiring the year on every entry can set
+	// both layouts to the same value
+	ListOldTimeFormat string
+	// ListTimeLocation is the time zone applied to modification times in LIST responses.
+	// The driver-provided time is used unchanged if it is nil. MLSD is not affected, it
+	// always uses UTC as required by RFC 3659
+	ListTimeLocation *time.Location
 	// ActiveConnectionsCheck defines the security requirements for active connections
 	ActiveConnectionsCheck DataConnectionRequirement
 	// PasvConnectionsCheck defines the security requirements for passive connections
 	PasvConnectionsCheck DataConnectionRequirement
+	// FeatFilter allows truncating or reordering the feature lines advertised
+	// by FEAT, which are otherwise sorted alphabetically. It can be used to pin
+	// a specific ordering or to reproduce client interop bugs
+	FeatFilter func(features []string) []string
+	// FeatEndLine overrides the text of the FEAT terminating line (default "end").
+	// Some clients are sensitive to its exact formatting, this allows reproducing
+	// their stalls deterministically. It must be left empty in production
+	FeatEndLine string
+	// ActiveFallbackOnPasvFailure makes PASV/EPSV listener allocation failures
+	// (port exhaustion, wrapper failure) reply with a non-fatal 425 carrying an
+	// active-mode hint, keeping the session healthy for an immediate PORT/EPRT
+	// retry, instead of the historical 421 that makes some clients abandon the
+	// session entirely
+	ActiveFallbackOnPasvFailure bool
+	// PreAuthTimeout is the maximum number of seconds a client can take to send
+	// a command before it is authenticated, so port scanners and stuck TCP peers
+	// that never speak FTP are shed quickly instead of holding a goroutine and a
+	// file descriptor until IdleTimeout. When it is 0 only IdleTimeout applies
+	PreAuthTimeout int
+	// SystResponse overrides the reply to the SYST command (default
+	// SystResponseUnix). SystResponseWindows is provided for clients that adapt
+	// their path handling and listing parser to the announced platform
+	SystResponse string
+	// RestAppendPolicy defines how an APPE received with a pending REST offset
+	// is handled, the offset being silently ignored by default. See the
+	// RestAppendPolicy values for the alternatives
+	RestAppendPolicy RestAppendPolicy
+	// EnableSizeInTransferReply includes the transfer description and, for
+	// downloads, the file size in the 150 reply (e.g. "Using transfer
+	// connection for RETR file (12345 bytes)"). Several clients parse the
+	// size to display accurate progress
+	EnableSizeInTransferReply bool
+	// UploadBufferSize enables a bounded buffer, of the given size in bytes,
+	// between the data connection and the driver's Write on uploads. When the
+	// driver is slower than the network the buffer fills up and reads from the
+	// data socket are paused, letting TCP backpressure reach the client. The
+	// driver file can implement FileTransferStallNotifier to be notified of
+	// the resulting stalls. 0 (the default) keeps the unbuffered path
+	UploadBufferSize int
+	// MaxTransferDuration is the maximum time, in seconds, a single data
+	// transfer is allowed to run. Transfers running longer are aborted with a
+	// 426 reply, so that eternal trickle transfers cannot hold server
+	// resources forever. 0 (the default) doesn't limit transfer durations
+	MaxTransferDuration int
+	// DisableASCIITransfers makes TYPE A return a 504 reply and keeps the
+	// session in binary mode, for deployments where ASCII conversion is never
+	// wanted and its edge cases are pure liability
+	DisableASCIITransfers bool
+	// MaxConnections is the maximum number of concurrent sessions. Additional
+	// connections are refused with a 421 reply. 0 (the default) means unlimited
+	MaxConnections int
+	// MaxConnectionsPerUser is the maximum number of concurrent sessions
+	// authenticated as the same user. Logins exceeding it are refused with a
+	// 421 reply. 0 (the default) means unlimited
+	MaxConnectionsPerUser int
+	// ActiveTransferDialTimeout is the timeout, in seconds, of a single dial
+	// attempt when opening an active (PORT/EPRT) data connection.
+	// 0 falls back to ConnectionTimeout
+	ActiveTransferDialTimeout int
+	// ActiveTransferDialRetries is the number of additional dial attempts
+	// made when the client refuses the active data connection, e.g. because
+	// its firewall is slow to open the port. Attempts are spaced by a growing
+	// backoff. 0 (the default) means a single attempt
+	ActiveTransferDialRetries int
+	// ActiveTransferSourcePort binds active data connections requested
+	// through EPRT to this source port, for strict firewalls that only
+	// accept a fixed origin port. It takes precedence over the default
+	// port 20 behavior controlled by ActiveTransferPortNon20
+	ActiveTransferSourcePort int
+	// TLSMinVersion overrides the minimum TLS version (e.g. tls.VersionTLS13)
+	// of the configuration returned by the driver's GetTLSConfig, for control
+	// and data connections alike. 0 keeps the driver's value
+	TLSMinVersion uint16
+	// TLSMaxVersion overrides the maximum accepted TLS version.
+	// 0 keeps the driver's value
+	TLSMaxVersion uint16
+	// TLSCipherSuites overrides the cipher suites offered for TLS 1.2 and
+	// below; TLS 1.3 suites are not configurable. An empty list keeps the
+	// driver's value
+	TLSCipherSuites []uint16
+	// TLSKeyLogWriter receives the TLS session keys of the control and data
+	// connections in NSS key log format, so captured FTPS traffic can be
+	// decrypted with tools like Wireshark when debugging interop problems.
+	// Strictly for test environments: the keys defeat the encryption of
+	// every recorded session. nil, the default, logs nothing
+	TLSKeyLogWriter io.Writer
+	// AllowASCIIResume allows REST while the session is in ASCII mode. The
+	// offset is counted on the converted stream: the stored bytes for
+	// uploads, the bytes sent on the wire for downloads, so it doesn't
+	// depend on the platform line endings. Disabled by default because some
+	// clients compute the offset on their local representation instead
+	AllowASCIIResume bool
+
+	// PassiveCoordinator synchronizes the passive ports advertised to clients
+	// across server instances sharing one public address. Left nil, each
+	// instance advertises any free local port without consulting anyone
+	PassiveCoordinator PassiveCoordination
+
+	// DataFdSoftLimit refuses new passive data connections with a 425 reply
+	// once the estimated number of file descriptors held by this server
+	// (control connections, data listeners and data connections) reaches the
+	// limit, keeping the process clear of its fd rlimit. Zero disables the
+	// check
+	DataFdSoftLimit int
+
+	// LegacyFilenameEncoding is the charset file names are exchanged in once
+	// a client sends "OPTS UTF8 OFF", e.g. "CP1251" or "ISO-8859-1" for old
+	// Windows clients. File names remain UTF-8 on the driver side. When
+	// empty, turning UTF-8 off is refused
+	LegacyFilenameEncoding string
+
+	// NLSTCompatFlags maps list-style flags ("-l", "-al", ...) received as
+	// the first NLST argument to the way they are handled: stripped, or
+	// answered with LIST-style lines as some legacy clients expect. Flags
+	// without an entry keep the historical behavior of being treated as a
+	// path
+	NLSTCompatFlags map[string]NLSTFlagBehavior
+
+	// PrebindPassivePorts binds one listener per port of
+	// PassiveTransferPortRange when the server starts listening, and PASV
+	// borrows from that pool instead of binding a fresh listener on every
+	// call. Requires PassiveTransferPortRange; changing either setting needs
+	// a server restart
+	PrebindPassivePorts bool
+
+	// EnableFXP accepts data connection peers that differ from the control
+	// connection one, which the IP-match checks would otherwise reject, so
+	// that server-to-server (FXP) transfers become possible. The driver can
+	// restrict which foreign peers qualify through the
+	// MainDriverExtensionFXPAuthorizer extension, and PORT/EPRT commands
+	// pointing at privileged ports of other hosts are still refused to block
+	// bounce attacks
+	EnableFXP bool
+
+	// EnableAtomicUploads writes fresh uploads to a temporary sibling name
+	// and renames them into place once the transfer succeeded. The temporary
+	// names are hidden from LIST, NLST and MLSD output, so other sessions
+	// polling a directory never see half-written files. Resumed and appended
+	// uploads keep writing to the final name directly
+	EnableAtomicUploads bool
+
+	// EnableCCC allows clients to clear the command channel with the "CCC"
+	// command after "AUTH TLS": the control connection goes back to
+	// plaintext so NAT devices can rewrite PASV replies again, while the
+	// data channel protection negotiated through PROT stays untouched.
+	// Disabled by default as it exposes commands, including file names, on
+	// the wire
+	EnableCCC bool
+
+	// ControlWriteTimeout is the maximum time, in seconds, a single reply
+	// write on the control connection may take. A client that stopped
+	// reading its replies is disconnected once the deadline trips, instead
+	// of holding a goroutine forever. 0, the default, never gives up on a
+	// write
+	ControlWriteTimeout int
+
+	// MaxNotFoundReplies caps the number of 550 replies a session may
+	// trigger before it is disconnected, containing bulk path enumeration.
+	// Past half the limit every further 550 reply is also held back
+	// shortly, to slow scanners down before they reach it. The
+	// MainDriverExtensionEnumerationNotifier extension is told about the
+	// disconnection. 0, the default, disables the protection
+	MaxNotFoundReplies int
+
+	// NodeIdentifier is a short opaque token identifying this server
+	// instance in multi-node deployments. When set it is advertised as a
+	// "NODE <identifier>" FEAT line, so stateful load balancers and
+	// support engineers can tell which backend served a session when
+	// diagnosing PASV address problems. Empty by default
+	NodeIdentifier string
+
+	// NodeIdentifierInBanner also appends the NodeIdentifier, between
+	// square brackets, to the 220 welcome banner, for clients and proxies
+	// that don't issue FEAT
+	NodeIdentifierInBanner bool
+
+	// PasvIPv4Fallbacks lists IPv4 addresses to advertise in PASV replies
+	// when the public host or the control connection address is IPv6, as
+	// happens behind NAT64 or on dual-stack deployments. The first entry is
+	// used; without one, IPv6 sessions are told to switch to EPSV and the
+	// FEAT listing advertises "EPSV REQUIRED"
+	PasvIPv4Fallbacks []string
+
+	// EnableDSIZWalkFallback answers the DSIZ command by recursively
+	// walking the directory when the driver does not implement
+	// ClientDriverExtensionDirSize. The walk is bounded in depth and time
+	// as it can be expensive on large trees. Disabled by default
+	EnableDSIZWalkFallback bool
+
+	// MaxConcurrentTransfers caps the number of file transfers running at
+	// the same time across all sessions. Transfers past the limit are
+	// refused with a 450 reply asking the client to retry later. 0, the
+	// default, means no limit
+	MaxConcurrentTransfers int
+
+	// TransferClassLimits caps the concurrent transfers per priority class
+	// returned by the MainDriverExtensionTransferPriority extension, within
+	// the global MaxConcurrentTransfers budget. Classes without an entry,
+	// and transfers the extension leaves unclassified, only follow the
+	// global limit
+	TransferClassLimits map[string]int
+
+	// RejectEmptyUploads refuses, with a 552 reply, uploads that end
+	// without a single byte moved, and removes the empty file created for
+	// them. By default empty uploads are accepted and leave an empty file
+	RejectEmptyUploads bool
+
+	// ASCIIConversionChunkSize is the size, in bytes, of the chunks ASCII
+	// mode transfers are converted by. Larger chunks lower the per-read
+	// overhead of multi-GB ASCII transfers at the cost of more memory per
+	// running transfer. 0, the default, picks 32KB
+	ASCIIConversionChunkSize int
+
+	// NonASCIIReplyPolicy is what happens to non-ASCII characters in the
+	// replies and directory listings sent to a client that didn't select
+	// UTF-8 through "OPTS UTF8 ON": such a client would render raw UTF-8
+	// bytes as mojibake. The default keeps them as-is
+	NonASCIIReplyPolicy NonASCIIPolicy
+
+	// PasvPortResolver computes, per connection, the address and port the
+	// passive replies advertise for a locally bound port. It takes
+	// precedence over PublicHost and PublicIPResolver and is meant for
+	// deployments reachable through several NATs, where each client needs a
+	// different mapping. EPSV replies only carry the resolved port
+	PasvPortResolver PasvPortResolver
+
+	// SessionTokenInWelcome appends the session token to the 230 reply sent
+	// after a successful login, so users can quote it when reporting a
+	// problem without any client-side tooling
+	SessionTokenInWelcome bool
+
+	// ActiveTargetRestrictions selects the RFC 2577 anti-bounce checks
+	// applied to the targets of PORT and EPRT commands, before any
+	// connection attempt. The MainDriverExtensionActiveTargetValidator
+	// extension runs on top of the selected checks. No check by default
+	ActiveTargetRestrictions ActiveTargetRestrictions
+
+	// MaxReplyLineLength is the maximum length, in bytes, of a single control
+	// connection reply line, CRLF excluded. Longer message lines are folded
+	// into additional lines of the same multiline reply, and MLSx entries,
+	// which cannot span lines, shed their trailing facts to fit; the file
+	// name itself is never cut. 0, the default, puts no bound
+	MaxReplyLineLength int
+
+	// TLSSessionResumption shares a single set of TLS session ticket keys
+	// between all the handshakes of this server, so a client can resume the
+	// TLS session of its control connection on every data connection instead
+	// of paying a full handshake per transfer. Without it, the configurations
+	// cloned for each handshake rotate their ticket keys independently and a
+	// ticket issued on the control connection is useless elsewhere
+	TLSSessionResumption bool
+
+	// TLSSessionResumptionRequired refuses TLS data connections whose
+	// handshake did not resume an existing session with this server, tying
+	// data connections to clients holding a control connection session the
+	// same way FileZilla's "Require TLS session resumption" option does. It
+	// implies TLSSessionResumption
+	TLSSessionResumptionRequired bool
+
+	// WelcomeBanner is a template for the 220 greeting, taking precedence
+	// over the message returned by ClientConnected when not empty. "\n"
+	// separated lines come out as a correctly formatted multiline reply, and
+	// the {{clientIP}}, {{nodeIdentifier}}, {{remainingConnections}} and
+	// {{driverMessage}} placeholders are expanded for each client,
+	// {{driverMessage}} being the ClientConnected return value
+	WelcomeBanner string
+
+	// MaxCommandSize is the maximum length, in bytes, of a single command
+	// line, CRLF excluded. A longer line is drained and refused with a 500
+	// reply instead of closing the connection. The read buffer is sized at
+	// connection time, so raising it at runtime only affects new sessions.
+	// 0, the default, applies the built-in 4096 bytes limit
+	MaxCommandSize int
+
+	// CommandWatchdogTimeout is the maximum time, in seconds, a single
+	// command handler may run before the session is considered stuck and its
+	// control connection closed. It also covers transfer commands, so it
+	// must stay above MaxTransferDuration when both are set. 0, the default,
+	// disables the watchdog
+	CommandWatchdogTimeout int
+
+	// MaxFailedLogins is the number of failed PASS attempts one connection
+	// may make before it is dropped with a 421 reply. When 0, the default,
+	// a single failure ends the session right after its 530 reply, the
+	// historical behavior
+	MaxFailedLogins int
+
+	// MaxFailedLoginsPerIP is the number of failed PASS attempts a source
+	// IP may accumulate over LoginFailureWindow before its new connections
+	// are refused with a 421 reply for LoginBanDuration. The attempts are
+	// counted by LoginThrottler. 0 disables the per-IP protection
+	MaxFailedLoginsPerIP int
+
+	// LoginFailureWindow is the sliding window, in seconds, during which a
+	// failed attempt counts against MaxFailedLoginsPerIP. 10 minutes when 0
+	LoginFailureWindow int
+
+	// LoginBanDuration is how long, in seconds, an offending source IP
+	// stays banned. 10 minutes when 0
+	LoginBanDuration int
+
+	// LoginThrottler replaces the store counting failed logins per source
+	// IP, so deployments spanning several nodes can share the counters
+	// through Redis or similar. The built-in in-memory store is used when
+	// nil
+	LoginThrottler LoginThrottler
+
+	// EnableRepeatedAUTH allows a client to issue AUTH again on an already
+	// TLS protected control connection, starting a new handshake on top of
+	// the current one to upgrade to stronger parameters. When false, the
+	// default, a repeated AUTH is rejected with a 503 reply
+	EnableRepeatedAUTH bool
 }
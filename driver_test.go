@@ -125,23 +125,65 @@ type TestServerDriver struct {
 	TLS            bool
 	CloseOnConnect bool // disconnect the client as soon as it connects
 
-	Settings             *Settings // Settings
+	Settings             *Settings                                                   // Settings
+	TransferQuota        int64                                                       // Traffic allowance in bytes per session, 0 means unlimited
+	ContentSniffer       func(name string, header []byte) error                      // Upload content verdict, nil means everything is accepted
+	ConnectionFilter     func(addr net.Addr) error                                   // Connection verdict, nil means everyone may connect
+	SiteAuthzVerifier    func(cc ClientContext, token string) (time.Duration, error) // "SITE AUTHZ" verdict, nil refuses any elevation
+	VirtualHostSelector  func(cc ClientContext, host string) (*tls.Config, error)    // HOST verdict, nil refuses any host
 	fs                   afero.Fs
 	clientMU             sync.Mutex
 	Clients              []ClientContext
+	disconnectionReasons []ShutdownReason
 	TLSVerificationReply tlsVerificationReply
 	errPassiveListener   error
 	TLSRequirement       TLSRequirement
+	fileMU               sync.Mutex
+	lastOpenedFile       *testFile
+	notificationMU       sync.Mutex
+	notifications        []transferNotification
+}
+
+// transferNotification records one call to TransferStarted or TransferCompleted
+type transferNotification struct {
+	direction TransferDirection
+	path      string
+	bytes     int64
+	duration  time.Duration
+	err       error
+	completed bool
+}
+
+func (driver *TestServerDriver) setLastOpenedFile(file *testFile) {
+	driver.fileMU.Lock()
+	defer driver.fileMU.Unlock()
+
+	driver.lastOpenedFile = file
+}
+
+// GetLastOpenedFile returns the last file opened through OpenFile, so tests can
+// check the transfer outcome reported to it
+func (driver *TestServerDriver) GetLastOpenedFile() *testFile {
+	driver.fileMU.Lock()
+	defer driver.fileMU.Unlock()
+
+	return driver.lastOpenedFile
 }
 
 // TestClientDriver defines a minimal serverftp client driver
 type TestClientDriver struct {
 	afero.Fs
+	transferQuota  int64
+	contentSniffer func(name string, header []byte) error
+	serverDriver   *TestServerDriver
 }
 
 type testFile struct {
 	afero.File
-	errTransfer error
+	mu               sync.Mutex
+	errTransfer      error
+	transferredBytes int64
+	stalls           []TransferStall
 }
 
 var (
@@ -166,6 +208,10 @@ func (f *testFile) Write(out []byte) (int, error) {
 		return 0, errFailWrite
 	}
 
+	if strings.Contains(f.File.Name(), "panic-on-write") {
+		panic("broken driver file")
+	}
+
 	// simulating a slow writing allows us to test ABOR
 	if strings.Contains(f.File.Name(), "delay-io") {
 		time.Sleep(500 * time.Millisecond)
@@ -212,13 +258,51 @@ func (f *testFile) Readdir(count int) ([]os.FileInfo, error) {
 
 // TransferError implements the FileTransferError interface
 func (f *testFile) TransferError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	f.errTransfer = err
 }
 
+// TransferDone implements the FileTransferDone interface
+func (f *testFile) TransferDone(bytes int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.transferredBytes = bytes
+}
+
+// getTransferOutcome returns what the transfer notifications reported
+func (f *testFile) getTransferOutcome() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.transferredBytes, f.errTransfer
+}
+
+// TransferStall implements the FileTransferStallNotifier interface
+func (f *testFile) TransferStall(stall TransferStall) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stalls = append(f.stalls, stall)
+}
+
+// getStalls returns the stalls reported through the buffered upload path
+func (f *testFile) getStalls() []TransferStall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]TransferStall(nil), f.stalls...)
+}
+
 // NewTestClientDriver creates a client driver
 func NewTestClientDriver(server *TestServerDriver) *TestClientDriver {
 	return &TestClientDriver{
-		Fs: server.fs,
+		Fs:             server.fs,
+		transferQuota:  server.TransferQuota,
+		contentSniffer: server.ContentSniffer,
+		serverDriver:   server,
 	}
 }
 
@@ -229,7 +313,18 @@ func mustStopServer(server *FtpServer) {
 	}
 }
 
-var errConnectionNotAllowed = errors.New("connection not allowed")
+func mustSwapSettings(server *FtpServer, modify func(settings *Settings)) {
+	err := server.CloneAndSwapSettings(modify)
+	if err != nil {
+		panic(err)
+	}
+}
+
+var (
+	errConnectionNotAllowed = errors.New("connection not allowed")
+	errElevationRefused     = errors.New("elevation refused")
+	errHostRejected         = errors.New("host rejected")
+)
 
 // ClientConnected is the very first message people will see
 func (driver *TestServerDriver) ClientConnected(cltContext ClientContext) (string, error) {
@@ -289,6 +384,8 @@ func (driver *TestServerDriver) ClientDisconnected(cc ClientContext) {
 	driver.clientMU.Lock()
 	defer driver.clientMU.Unlock()
 
+	driver.disconnectionReasons = append(driver.disconnectionReasons, cc.GetShutdownReason())
+
 	for idx, client := range driver.Clients {
 		if client.ID() == cc.ID() {
 			lastIdx := len(driver.Clients) - 1
@@ -301,6 +398,18 @@ func (driver *TestServerDriver) ClientDisconnected(cc ClientContext) {
 	}
 }
 
+// getDisconnectionReasons returns the shutdown reasons observed when clients
+// disconnected, ShutdownNone for sessions that ended on their own
+func (driver *TestServerDriver) getDisconnectionReasons() []ShutdownReason {
+	driver.clientMU.Lock()
+	defer driver.clientMU.Unlock()
+
+	reasons := make([]ShutdownReason, len(driver.disconnectionReasons))
+	copy(reasons, driver.disconnectionReasons)
+
+	return reasons
+}
+
 // GetClientsInfo returns info about the connected clients
 func (driver *TestServerDriver) GetClientsInfo() map[uint32]interface{} {
 	driver.clientMU.Lock()
@@ -386,6 +495,65 @@ func (driver *TestServerDriver) VerifyConnection(_ ClientContext, _ string,
 	return nil, nil //nolint:nilnil
 }
 
+// VerifySiteAuthz grants administrative elevations according to the configured verifier
+func (driver *TestServerDriver) VerifySiteAuthz(cc ClientContext, token string) (time.Duration, error) {
+	if driver.SiteAuthzVerifier == nil {
+		return 0, errElevationRefused
+	}
+
+	return driver.SiteAuthzVerifier(cc, token)
+}
+
+// TransferStarted records the beginning of a file transfer
+func (driver *TestServerDriver) TransferStarted(_ ClientContext, direction TransferDirection, path string) {
+	driver.notificationMU.Lock()
+	defer driver.notificationMU.Unlock()
+
+	driver.notifications = append(driver.notifications, transferNotification{direction: direction, path: path})
+}
+
+// TransferCompleted records the end of a file transfer
+func (driver *TestServerDriver) TransferCompleted(_ ClientContext, direction TransferDirection, path string,
+	bytes int64, duration time.Duration, err error,
+) {
+	driver.notificationMU.Lock()
+	defer driver.notificationMU.Unlock()
+
+	driver.notifications = append(driver.notifications, transferNotification{
+		direction: direction,
+		path:      path,
+		bytes:     bytes,
+		duration:  duration,
+		err:       err,
+		completed: true,
+	})
+}
+
+func (driver *TestServerDriver) getTransferNotifications() []transferNotification {
+	driver.notificationMU.Lock()
+	defer driver.notificationMU.Unlock()
+
+	return append([]transferNotification(nil), driver.notifications...)
+}
+
+// SelectVirtualHost routes HOST commands according to the configured selector
+func (driver *TestServerDriver) SelectVirtualHost(cc ClientContext, host string) (*tls.Config, error) {
+	if driver.VirtualHostSelector == nil {
+		return nil, errHostRejected
+	}
+
+	return driver.VirtualHostSelector(cc, host)
+}
+
+// FilterConnection rejects incoming connections according to the configured filter
+func (driver *TestServerDriver) FilterConnection(addr net.Addr) error {
+	if driver.ConnectionFilter != nil {
+		return driver.ConnectionFilter(addr)
+	}
+
+	return nil
+}
+
 func (driver *TestServerDriver) WrapPassiveListener(listener net.Listener) (net.Listener, error) {
 	if driver.errPassiveListener != nil {
 		return nil, driver.errPassiveListener
@@ -400,6 +568,10 @@ func (driver *TestClientDriver) OpenFile(path string, flag int, perm os.FileMode
 		return nil, errFailOpen
 	}
 
+	if strings.Contains(path, "panic-on-open") {
+		panic("broken driver open")
+	}
+
 	if strings.Contains(path, "quota-exceeded") {
 		return nil, ErrStorageExceeded
 	}
@@ -411,7 +583,9 @@ func (driver *TestClientDriver) OpenFile(path string, flag int, perm os.FileMode
 	file, err := driver.Fs.OpenFile(path, flag, perm)
 
 	if err == nil {
-		file = &testFile{File: file}
+		wrapped := &testFile{File: file}
+		driver.serverDriver.setLastOpenedFile(wrapped)
+		file = wrapped
 	}
 
 	return file, err
@@ -439,6 +613,24 @@ func (driver *TestClientDriver) Rename(oldname, newname string) error {
 	return driver.Fs.Rename(oldname, newname)
 }
 
+// AccountDataTransfer implements the ClientDriverExtensionTransferAccounting extension
+func (driver *TestClientDriver) AccountDataTransfer(uploadedBytes, downloadedBytes int64) error {
+	if driver.transferQuota > 0 && uploadedBytes+downloadedBytes > driver.transferQuota {
+		return ErrBandwidthQuotaExceeded
+	}
+
+	return nil
+}
+
+// SniffContent implements the ClientDriverExtensionContentSniffer extension
+func (driver *TestClientDriver) SniffContent(name string, header []byte) error {
+	if driver.contentSniffer != nil {
+		return driver.contentSniffer(name, header)
+	}
+
+	return nil
+}
+
 var errTooMuchSpaceRequested = errors.New("you're requesting too much space")
 
 func (driver *TestClientDriver) AllocateSpace(size int) error {
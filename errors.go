@@ -12,19 +12,139 @@ var (
 	// ErrFileNameNotAllowed defines the error mapped to the FTP 553 reply code.
 	// As for RFC 959 this error is checked for STOR, APPE, RNTO
 	ErrFileNameNotAllowed = errors.New("filename not allowed")
+	// ErrBandwidthQuotaExceeded defines the error mapped to the FTP 552 reply code.
+	// It is meant to be returned from ClientDriverExtensionTransferAccounting when
+	// the session exceeded its traffic allowance
+	ErrBandwidthQuotaExceeded = errors.New("bandwidth quota exceeded")
+	// ErrContentTypeNotAllowed defines the error mapped to the FTP 553 reply code.
+	// It wraps any error returned by ClientDriverExtensionContentSniffer when the
+	// content of an upload is rejected
+	ErrContentTypeNotAllowed = errors.New("content type not allowed")
+	// ErrTransferDurationExceeded defines the error mapped to the FTP 426 reply
+	// code. It is returned when a data transfer ran longer than
+	// Settings.MaxTransferDuration allows
+	ErrTransferDurationExceeded = errors.New("maximum transfer duration exceeded")
+	// ErrEmptyUploadRejected defines the error mapped to the FTP 552 reply
+	// code when Settings.RejectEmptyUploads is on and an upload ends without
+	// having moved a single byte
+	ErrEmptyUploadRejected = errors.New("empty upload rejected")
+	// ErrUploadTruncated defines the error mapped to the FTP 451 reply code.
+	// It is returned when an upload stored fewer bytes than were received on
+	// the data connection, or than the size the client declared through ALLO
+	// or "OPTS STOR SIZE"
+	ErrUploadTruncated = errors.New("upload truncated")
 )
 
+// PanicError wraps a panic recovered at a driver call boundary. It is mapped
+// to the FTP 451 reply code and keeps the panic value along with the stack
+// captured where it was raised, for the logs and post-mortem analysis
+type PanicError struct {
+	value any
+	stack []byte
+}
+
+func newPanicError(value any, stack []byte) PanicError {
+	return PanicError{value: value, stack: stack}
+}
+
+// Value returns the value the driver panicked with
+func (e PanicError) Value() any {
+	return e.value
+}
+
+// Stack returns the stack captured where the panic was raised
+func (e PanicError) Stack() []byte {
+	return e.stack
+}
+
+func (e PanicError) Error() string {
+	return fmt.Sprintf("driver panic: %v", e.value)
+}
+
 func getErrorCode(err error, defaultCode int) int {
+	var panicErr PanicError
+
 	switch {
+	case errors.As(err, &panicErr):
+		return StatusActionAbortedLocalError
 	case errors.Is(err, ErrStorageExceeded):
 		return StatusActionAborted
+	case errors.Is(err, ErrBandwidthQuotaExceeded):
+		return StatusActionAborted
+	case errors.Is(err, ErrEmptyUploadRejected):
+		return StatusActionAborted
+	case errors.Is(err, ErrUploadTruncated):
+		return StatusActionAbortedLocalError
 	case errors.Is(err, ErrFileNameNotAllowed):
 		return StatusActionNotTakenNoFile
+	case errors.Is(err, ErrContentTypeNotAllowed):
+		return StatusActionNotTakenNoFile
+	case errors.Is(err, ErrTransferDurationExceeded):
+		return StatusTransferAborted
 	default:
 		return defaultCode
 	}
 }
 
+// TransferPhase tells FileTransferError implementations in which phase a file
+// transfer failed
+type TransferPhase int8
+
+// Supported transfer phases
+const (
+	// TransferPhaseOpen covers the failures to open the data connection,
+	// including unmet TLS requirements and aborts received before the
+	// connection was opened
+	TransferPhaseOpen TransferPhase = iota + 1
+	// TransferPhaseSeek covers the failures to reach the restart position
+	TransferPhaseSeek
+	// TransferPhaseData covers the read/write failures while moving the data
+	TransferPhaseData
+	// TransferPhaseClose covers the failures to close the file after an upload
+	TransferPhaseClose
+)
+
+func (phase TransferPhase) String() string {
+	switch phase {
+	case TransferPhaseOpen:
+		return "open"
+	case TransferPhaseSeek:
+		return "seek"
+	case TransferPhaseData:
+		return "data"
+	case TransferPhaseClose:
+		return "close"
+	default:
+		return "unknown"
+	}
+}
+
+// TransferError is a wrapper for any error that makes a file transfer fail.
+// It is the error handed to FileTransferError implementations: Phase tells
+// the failure classes apart and the underlying error remains available
+// through errors.Is/errors.As
+type TransferError struct {
+	phase TransferPhase
+	err   error
+}
+
+func newTransferError(phase TransferPhase, err error) TransferError {
+	return TransferError{phase: phase, err: err}
+}
+
+// Phase reports in which phase the transfer failed
+func (e TransferError) Phase() TransferPhase {
+	return e.phase
+}
+
+func (e TransferError) Error() string {
+	return fmt.Sprintf("transfer error (%s): %v", e.phase, e.err)
+}
+
+func (e TransferError) Unwrap() error {
+	return e.err
+}
+
 // DriverError is a wrapper is for any error that occur while contacting the drivers
 type DriverError struct {
 	str string
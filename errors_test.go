@@ -22,8 +22,11 @@ func TestCustomErrorsCode(t *testing.T) {
 }
 
 func TestTransferCloseStorageExceeded(t *testing.T) {
+	server := NewFtpServer(&TestServerDriver{Settings: &Settings{}})
+	require.NoError(t, server.loadSettings())
+
 	buf := bytes.Buffer{}
-	h := clientHandler{writer: bufio.NewWriter(&buf)}
+	h := clientHandler{writer: bufio.NewWriter(&buf), server: server}
 	h.TransferClose(ErrStorageExceeded)
 	require.Equal(t, "552 Issue during transfer: storage limit exceeded\r\n", buf.String())
 }
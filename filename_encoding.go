@@ -0,0 +1,172 @@
+package ftpserver
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/unicode/norm"
+)
+
+// lookupFilenameEncoding maps the names accepted by
+// Settings.LegacyFilenameEncoding to their character maps. Unknown names
+// return nil
+func lookupFilenameEncoding(name string) *charmap.Charmap {
+	switch strings.ToUpper(name) {
+	case "CP1251", "WINDOWS-1251":
+		return charmap.Windows1251
+	case "CP1252", "WINDOWS-1252":
+		return charmap.Windows1252
+	case "LATIN-1", "ISO-8859-1", "ISO8859-1":
+		return charmap.ISO8859_1
+	case "CP437", "IBM437":
+		return charmap.CodePage437
+	default:
+		return nil
+	}
+}
+
+// newFilenameEncoder returns an encoder for the given character map that
+// never fails: runes the charset cannot represent are replaced with its
+// substitution character instead
+func newFilenameEncoder(cmap *charmap.Charmap) *encoding.Encoder {
+	return encoding.ReplaceUnsupported(cmap.NewEncoder())
+}
+
+// encodedListingWriter re-encodes directory listing lines for clients that
+// negotiated a legacy charset through "OPTS UTF8 OFF"
+type encodedListingWriter struct {
+	writer  io.Writer
+	encoder *encoding.Encoder
+}
+
+func (w *encodedListingWriter) Write(p []byte) (int, error) {
+	encoded, err := w.encoder.Bytes(p)
+	if err != nil {
+		// the replacing encoder cannot fail, but falling back to the raw
+		// bytes beats dropping the entry
+		encoded = p
+	}
+
+	if _, err := w.writer.Write(encoded); err != nil {
+		return 0, err
+	}
+
+	// the consumed length is reported, the encoded one can differ
+	return len(p), nil
+}
+
+// listingWriter wraps the data connection with the charset negotiated by the
+// client, or returns it untouched for the default UTF-8 mode
+func (c *clientHandler) listingWriter(conn io.Writer) io.Writer {
+	if cmap := c.getLegacyCharmap(); cmap != nil {
+		return &encodedListingWriter{writer: conn, encoder: newFilenameEncoder(cmap)}
+	}
+
+	if policy := c.server.getSettings().NonASCIIReplyPolicy; policy != NonASCIIPolicyKeep && !c.hasNegotiatedUTF8() {
+		return &sanitizingListingWriter{writer: conn, policy: policy}
+	}
+
+	return conn
+}
+
+// sanitizingListingWriter applies Settings.NonASCIIReplyPolicy to directory
+// listings for clients that never selected UTF-8
+type sanitizingListingWriter struct {
+	writer io.Writer
+	policy NonASCIIPolicy
+}
+
+func (w *sanitizingListingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.writer, sanitizeNonASCII(string(p), w.policy)); err != nil {
+		return 0, err
+	}
+
+	// the consumed length is reported, the sanitized one can differ
+	return len(p), nil
+}
+
+// sanitizeNonASCII applies a Settings.NonASCIIReplyPolicy to a reply line or
+// a listing chunk. The common all-ASCII case goes through without allocating
+func sanitizeNonASCII(line string, policy NonASCIIPolicy) string {
+	ascii := true
+
+	for i := 0; i < len(line); i++ {
+		if line[i] >= utf8.RuneSelf {
+			ascii = false
+
+			break
+		}
+	}
+
+	if ascii {
+		return line
+	}
+
+	switch policy {
+	case NonASCIIPolicyEscape:
+		return escapeNonASCII(line)
+	case NonASCIIPolicyTransliterate:
+		return transliterateNonASCII(line)
+	case NonASCIIPolicyKeep:
+	}
+
+	return line
+}
+
+// escapeNonASCII percent-encodes every byte outside the ASCII range, which
+// keeps the reply reversible: "é" travels as "%C3%A9"
+func escapeNonASCII(line string) string {
+	var out strings.Builder
+
+	out.Grow(len(line))
+
+	for i := 0; i < len(line); i++ {
+		value := line[i]
+		if value < utf8.RuneSelf {
+			out.WriteByte(value)
+
+			continue
+		}
+
+		fmt.Fprintf(&out, "%%%02X", value)
+	}
+
+	return out.String()
+}
+
+// transliterateNonASCII reduces a line to ASCII: accented letters decompose
+// to their base letter and anything without an ASCII part becomes a question
+// mark. Lossy, but what a mojibake-prone client can actually display
+func transliterateNonASCII(line string) string {
+	var out strings.Builder
+
+	out.Grow(len(line))
+
+	for _, value := range line {
+		if value < utf8.RuneSelf {
+			out.WriteRune(value)
+
+			continue
+		}
+
+		replaced := false
+
+		for _, decomposed := range norm.NFKD.String(string(value)) {
+			if decomposed < utf8.RuneSelf {
+				out.WriteRune(decomposed)
+
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			out.WriteByte('?')
+		}
+	}
+
+	return out.String()
+}
@@ -0,0 +1,269 @@
+// Package ftpservertest helps driver authors test their ftpserverlib
+// drivers: it provides a ready-to-use in-memory MainDriver, helpers to spin
+// up a server and move files through it, and a conformance suite covering the
+// basic FTP scenarios every storage backend should support.
+package ftpservertest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+// DefaultUser and DefaultPassword are the credentials Driver accepts when
+// none are configured
+const (
+	DefaultUser     = "test"
+	DefaultPassword = "test"
+)
+
+var (
+	errBadUserNameOrPassword = errors.New("bad username or password")
+	errNoTLS                 = errors.New("TLS is not configured")
+)
+
+// Driver is a minimal MainDriver backed by a single file system shared by
+// every session, in-memory unless replaced. It accepts exactly one
+// user/password pair and serves no TLS
+type Driver struct {
+	Settings *ftpserver.Settings // Server settings, nil listens on 127.0.0.1:0 with the defaults
+	Username string              // Accepted username, DefaultUser when empty
+	Password string              // Accepted password, DefaultPassword when empty
+	Fs       afero.Fs            // File system handed to every session, in-memory when nil
+}
+
+// NewDriver returns a Driver serving an empty in-memory file system to the
+// default test credentials
+func NewDriver() *Driver {
+	return &Driver{
+		Settings: &ftpserver.Settings{ListenAddr: "127.0.0.1:0"},
+		Username: DefaultUser,
+		Password: DefaultPassword,
+		Fs:       afero.NewMemMapFs(),
+	}
+}
+
+// GetSettings returns the configured settings, filling in a local listen
+// address so tests never bind a public port
+func (driver *Driver) GetSettings() (*ftpserver.Settings, error) {
+	if driver.Settings == nil {
+		driver.Settings = &ftpserver.Settings{}
+	}
+
+	if driver.Settings.ListenAddr == "" {
+		driver.Settings.ListenAddr = "127.0.0.1:0"
+	}
+
+	return driver.Settings, nil
+}
+
+// ClientConnected welcomes every connection
+func (driver *Driver) ClientConnected(_ ftpserver.ClientContext) (string, error) {
+	return "TEST Server", nil
+}
+
+// ClientDisconnected does nothing
+func (driver *Driver) ClientDisconnected(_ ftpserver.ClientContext) {}
+
+// AuthUser hands out the shared file system to the configured credentials
+func (driver *Driver) AuthUser(_ ftpserver.ClientContext, user, pass string) (ftpserver.ClientDriver, error) {
+	username, password := driver.Username, driver.Password
+
+	if username == "" {
+		username = DefaultUser
+	}
+
+	if password == "" {
+		password = DefaultPassword
+	}
+
+	if user != username || pass != password {
+		return nil, errBadUserNameOrPassword
+	}
+
+	if driver.Fs == nil {
+		driver.Fs = afero.NewMemMapFs()
+	}
+
+	return driver.Fs, nil
+}
+
+// GetTLSConfig reports that no TLS is available
+func (driver *Driver) GetTLSConfig() (*tls.Config, error) {
+	return nil, errNoTLS
+}
+
+// NewServer starts a server for the given driver and stops it when the test
+// ends. The address to connect to is server.Addr()
+func NewServer(tb testing.TB, driver ftpserver.MainDriver) *ftpserver.FtpServer {
+	tb.Helper()
+
+	server := ftpserver.NewFtpServer(driver)
+
+	if err := server.Listen(); err != nil {
+		tb.Fatalf("Couldn't listen: %v", err)
+	}
+
+	tb.Cleanup(func() {
+		if err := server.Stop(); err != nil {
+			tb.Errorf("Couldn't stop server: %v", err)
+		}
+	})
+
+	go func() {
+		if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+			server.Logger.Error("problem serving", "err", err)
+		}
+	}()
+
+	return server
+}
+
+// NewTestServer starts a server backed by a fresh in-memory Driver and
+// returns both, so tests can reach the stored files through Driver.Fs
+func NewTestServer(tb testing.TB) (*ftpserver.FtpServer, *Driver) {
+	tb.Helper()
+
+	driver := NewDriver()
+
+	return NewServer(tb, driver), driver
+}
+
+// Connect opens an authenticated client connection to the server, closed
+// when the test ends
+func Connect(tb testing.TB, server *ftpserver.FtpServer, user, pass string) *goftp.Client {
+	tb.Helper()
+
+	client, err := goftp.DialConfig(goftp.Config{User: user, Password: pass}, server.Addr())
+	if err != nil {
+		tb.Fatalf("Couldn't connect: %v", err)
+	}
+
+	tb.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+// Upload stores content under path and fails the test when it can't
+func Upload(tb testing.TB, client *goftp.Client, path string, content []byte) {
+	tb.Helper()
+
+	if err := client.Store(path, bytes.NewReader(content)); err != nil {
+		tb.Fatalf("Couldn't upload %s: %v", path, err)
+	}
+}
+
+// Download retrieves the content stored under path and fails the test when
+// it can't
+func Download(tb testing.TB, client *goftp.Client, path string) []byte {
+	tb.Helper()
+
+	var buf bytes.Buffer
+
+	if err := client.Retrieve(path, &buf); err != nil {
+		tb.Fatalf("Couldn't download %s: %v", path, err)
+	}
+
+	return buf.Bytes()
+}
+
+// Hash returns the hexadecimal SHA-256 digest of content, the algorithm the
+// HASH command defaults to, handy for comparing a download to what was
+// uploaded
+func Hash(content []byte) string {
+	digest := sha256.Sum256(content)
+
+	return hex.EncodeToString(digest[:])
+}
+
+// Conformance runs the basic FTP scenarios every driver is expected to
+// support, one fresh server per subtest. newDriver builds the driver under
+// test, user and pass are the credentials it accepts
+func Conformance(t *testing.T, user, pass string, newDriver func(tb testing.TB) ftpserver.MainDriver) {
+	t.Run("UploadDownload", func(t *testing.T) {
+		client := Connect(t, NewServer(t, newDriver(t)), user, pass)
+		content := bytes.Repeat([]byte("conformance "), 1024)
+
+		Upload(t, client, "/file.bin", content)
+
+		if downloaded := Download(t, client, "/file.bin"); Hash(downloaded) != Hash(content) {
+			t.Errorf("Downloaded %d bytes that don't match the %d uploaded ones", len(downloaded), len(content))
+		}
+
+		stats, err := client.Stat("/file.bin")
+		if err != nil {
+			t.Fatalf("Couldn't stat the uploaded file: %v", err)
+		}
+
+		if stats.Size() != int64(len(content)) {
+			t.Errorf("Stat reported %d bytes instead of %d", stats.Size(), len(content))
+		}
+	})
+
+	t.Run("Directories", func(t *testing.T) {
+		client := Connect(t, NewServer(t, newDriver(t)), user, pass)
+
+		if _, err := client.Mkdir("/dir"); err != nil {
+			t.Fatalf("Couldn't create a directory: %v", err)
+		}
+
+		if _, err := client.Mkdir("/dir/sub"); err != nil {
+			t.Fatalf("Couldn't create a nested directory: %v", err)
+		}
+
+		Upload(t, client, "/dir/sub/file.bin", []byte("content"))
+
+		entries, err := client.ReadDir("/dir/sub")
+		if err != nil {
+			t.Fatalf("Couldn't list the nested directory: %v", err)
+		}
+
+		if len(entries) != 1 || entries[0].Name() != "file.bin" {
+			t.Errorf("Expected the listing to only carry file.bin, got %v", entries)
+		}
+
+		if err := client.Delete("/dir/sub/file.bin"); err != nil {
+			t.Fatalf("Couldn't delete the uploaded file: %v", err)
+		}
+
+		if err := client.Rmdir("/dir/sub"); err != nil {
+			t.Fatalf("Couldn't remove the emptied directory: %v", err)
+		}
+	})
+
+	t.Run("RenameDelete", func(t *testing.T) {
+		client := Connect(t, NewServer(t, newDriver(t)), user, pass)
+		content := []byte("moving content")
+
+		Upload(t, client, "/old.bin", content)
+
+		if err := client.Rename("/old.bin", "/new.bin"); err != nil {
+			t.Fatalf("Couldn't rename: %v", err)
+		}
+
+		if _, err := client.Stat("/old.bin"); err == nil {
+			t.Error("The old name should be gone after the rename")
+		}
+
+		if downloaded := Download(t, client, "/new.bin"); !bytes.Equal(downloaded, content) {
+			t.Error("The renamed file should keep its content")
+		}
+
+		if err := client.Delete("/new.bin"); err != nil {
+			t.Fatalf("Couldn't delete: %v", err)
+		}
+
+		if _, err := client.Stat("/new.bin"); err == nil {
+			t.Error("The file should be gone after the delete")
+		}
+	})
+}
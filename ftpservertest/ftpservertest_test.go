@@ -0,0 +1,40 @@
+package ftpservertest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+// TestConformance runs the conformance suite against the in-memory driver,
+// the way an external driver author would run it against theirs
+func TestConformance(t *testing.T) {
+	Conformance(t, DefaultUser, DefaultPassword, func(tb testing.TB) ftpserver.MainDriver {
+		tb.Helper()
+
+		return NewDriver()
+	})
+}
+
+func TestHelpers(t *testing.T) {
+	server, driver := NewTestServer(t)
+	client := Connect(t, server, DefaultUser, DefaultPassword)
+	content := []byte("some content")
+
+	Upload(t, client, "/file.bin", content)
+
+	// the stored files stay reachable through the driver
+	stats, err := driver.Fs.Stat("/file.bin")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), stats.Size())
+
+	require.Equal(t, Hash(content), Hash(Download(t, client, "/file.bin")))
+}
+
+func TestBadCredentials(t *testing.T) {
+	driver := NewDriver()
+	_, err := driver.AuthUser(nil, "wrong", "wrong")
+	require.Error(t, err)
+}
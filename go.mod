@@ -7,17 +7,21 @@ toolchain go1.23.4
 require (
 	github.com/fclairamb/go-log v0.5.0
 	github.com/go-kit/log v0.2.1
+	github.com/pkg/sftp v1.13.6
 	github.com/secsy/goftp v0.0.0-20200609142545-aa2de14babf4
 	github.com/spf13/afero v1.11.0
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/net v0.19.0
 	golang.org/x/sys v0.28.0
+	golang.org/x/text v0.14.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/go-logfmt/logfmt v0.5.1 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/crypto v0.16.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
@@ -2,9 +2,16 @@ package ftpserver
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"time"
 )
 
+// errNoClientCertificate is reported when a user requiring a client
+// certificate logs in without presenting one
+var errNoClientCertificate = errors.New("no client certificate presented")
+
 // Handle the "USER" command
 func (c *clientHandler) handleUSER(user string) error {
 	if verifier, ok := c.server.driver.(MainDriverExtensionUserVerifier); ok {
@@ -25,17 +32,73 @@ func (c *clientHandler) handleUSER(user string) error {
 	}
 
 	if c.HasTLSForControl() {
+		if err := c.verifyUserClientCert(user); err != nil {
+			if collector := c.server.MetricsCollector; collector != nil {
+				collector.LoginFailed()
+			}
+
+			c.writeMessage(StatusNotLoggedIn, fmt.Sprintf("Client certificate verification failed: %v", err))
+			c.disconnect()
+
+			return nil
+		}
+
 		if c.handleUserTLS(user) {
 			return nil
 		}
 	}
 
-	c.user = user
+	c.setUser(user)
 	c.writeMessage(StatusUserOK, "OK")
 
 	return nil
 }
 
+// verifyUserClientCert enforces the per-user client certificate policy of the
+// MainDriverExtensionClientCertAuth extension: when a CA pool is returned for
+// the user, the chain presented during the TLS handshake must verify against it
+func (c *clientHandler) verifyUserClientCert(user string) error {
+	auth, ok := c.server.driver.(MainDriverExtensionClientCertAuth)
+	if !ok {
+		return nil
+	}
+
+	pool, err := auth.GetClientCertPool(c, user)
+	if err != nil {
+		return err
+	}
+
+	if pool == nil {
+		return nil
+	}
+
+	return verifyClientCertChain(c.GetPeerCertificates(), pool)
+}
+
+// verifyClientCertChain checks the presented chain, leaf first, against the
+// CA pool, the same way tls.RequireAndVerifyClientCert does during a handshake
+func verifyClientCertChain(certs []*x509.Certificate, pool *x509.CertPool) error {
+	if len(certs) == 0 {
+		return errNoClientCertificate
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err := certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("client certificate verification failed: %w", err)
+	}
+
+	return nil
+}
+
 func (c *clientHandler) handleUserTLS(user string) bool {
 	verifier, interfaceFound := c.server.driver.(MainDriverExtensionTLSVerifier)
 
@@ -51,6 +114,10 @@ func (c *clientHandler) handleUserTLS(user string) bool {
 
 	driver, err := verifier.VerifyConnection(c, user, tlsConn)
 	if err != nil {
+		if collector := c.server.MetricsCollector; collector != nil {
+			collector.LoginFailed()
+		}
+
 		c.writeMessage(StatusNotLoggedIn, fmt.Sprintf("TLS verification failed: %v", err))
 		c.disconnect()
 
@@ -58,8 +125,22 @@ func (c *clientHandler) handleUserTLS(user string) bool {
 	}
 
 	if driver != nil {
-		c.user = user
+		c.setUser(user)
+
+		if !c.registerUserSession() {
+			c.writeMessage(StatusServiceNotAvailable, "Too many connections for this user")
+			c.disconnect()
+
+			return true
+		}
+
 		c.driver = driver
+		c.bindDriverContext()
+
+		if collector := c.server.MetricsCollector; collector != nil {
+			collector.LoginSucceeded()
+		}
+
 		c.writeMessage(StatusUserLoggedIn, "TLS certificate ok, continue")
 
 		return true
@@ -68,6 +149,40 @@ func (c *clientHandler) handleUserTLS(user string) bool {
 	return false
 }
 
+// Handle the "HOST" command (RFC 7151)
+func (c *clientHandler) handleHOST(param string) error {
+	selector, ok := c.server.driver.(MainDriverExtensionVirtualHost)
+	if !ok {
+		c.writeMessage(StatusCommandNotImplemented, "This command hasn't been implemented !")
+
+		return nil
+	}
+
+	if param == "" {
+		c.writeMessage(StatusSyntaxErrorParameters, "Missing host name")
+
+		return nil
+	}
+
+	if c.driver != nil {
+		c.writeMessage(StatusBadCommandSequence, "HOST is not allowed after authentication")
+
+		return nil
+	}
+
+	tlsConfig, err := selector.SelectVirtualHost(c, param)
+	if err != nil {
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("Host rejected: %v", err))
+
+		return nil
+	}
+
+	c.setHost(param, tlsConfig)
+	c.writeMessage(StatusServiceReady, "HOST command ok")
+
+	return nil
+}
+
 // Handle the "PASS" command
 func (c *clientHandler) handlePASS(param string) error {
 	var err error
@@ -84,19 +199,114 @@ func (c *clientHandler) handlePASS(param string) error {
 		c.writeMessage(StatusNotLoggedIn, "Unexpected exception (driver is nil)")
 		c.disconnect()
 	case err != nil:
+		if collector := c.server.MetricsCollector; collector != nil {
+			collector.LoginFailed()
+		}
+
 		if msg == "" {
 			msg = fmt.Sprintf("Authentication error: %v", err)
 		}
 
+		if c.noteFailedLogin() {
+			c.writeMessage(StatusServiceNotAvailable, "Too many failed logins: closing control connection")
+			c.disconnect()
+
+			break
+		}
+
 		c.writeMessage(StatusNotLoggedIn, msg)
-		c.disconnect()
+
+		// without a per-connection budget a single failure ends the session
+		if c.server.getSettings().MaxFailedLogins == 0 {
+			c.disconnect()
+		}
 	default: // err == nil && c.driver != nil
+		// the per-user session limit is enforced once the credentials are accepted
+		if !c.registerUserSession() {
+			c.driver = nil
+			c.writeMessage(StatusServiceNotAvailable, "Too many connections for this user")
+			c.disconnect()
+
+			break
+		}
+
+		c.bindDriverContext()
+
 		if msg == "" {
 			msg = "Password ok, continue"
 		}
 
+		if c.server.getSettings().SessionTokenInWelcome {
+			msg = fmt.Sprintf("%s (session %s)", msg, c.sessionToken)
+		}
+
+		if collector := c.server.MetricsCollector; collector != nil {
+			collector.LoginSucceeded()
+		}
+
 		c.writeMessage(StatusUserLoggedIn, msg)
 	}
 
 	return nil
 }
+
+// noteFailedLogin counts a failed PASS attempt against the brute force
+// limits: the per-IP sliding window of the login throttler and the
+// per-connection counter. It returns true when the connection used up its
+// MaxFailedLogins budget and must be dropped
+func (c *clientHandler) noteFailedLogin() bool {
+	settings := c.server.getSettings()
+
+	if settings.MaxFailedLoginsPerIP > 0 {
+		if ipAddress, errIP := getIPFromRemoteAddr(c.conn.RemoteAddr()); errIP == nil {
+			if c.server.loginThrottler().RecordFailure(ipAddress.String()) {
+				c.logger.Warn("Source IP banned after too many failed logins", "remoteIP", ipAddress.String())
+			}
+		}
+	}
+
+	if settings.MaxFailedLogins == 0 {
+		return false
+	}
+
+	c.failedLogins++
+
+	return c.failedLogins >= settings.MaxFailedLogins
+}
+
+// handleREIN terminates the current USER as specified by RFC 959: the
+// authenticated driver and every user-scoped parameter are dropped while the
+// control connection, including its TLS state, stays open for a new
+// authentication sequence. Connection pooling gateways rely on it to reuse
+// control connections across users
+func (c *clientHandler) handleREIN(_ string) error {
+	if reinit, ok := c.server.driver.(MainDriverExtensionReinit); ok && c.driver != nil {
+		reinit.ClientReinit(c, c.user)
+	}
+
+	if c.registeredUser != "" {
+		c.server.unregisterUserSession(c.registeredUser, c)
+	}
+
+	c.paramsMutex.Lock()
+	c.driver = nil
+	c.user = ""
+	c.registeredUser = ""
+	c.path = "/"
+	c.listPath = ""
+	c.ctxRnfr = ""
+	c.alloSize = 0
+	c.resume.clear()
+	c.elevatedUntil = time.Time{}
+	c.listOpts = listOptions{}
+	c.mlsxFacts = nil
+	c.mlsdPageSize = 0
+	c.inProgressUploads = nil
+	// back to the type a fresh connection would start with
+	c.currentTransferType = c.server.getSettings().DefaultTransferType
+	c.paramsMutex.Unlock()
+
+	c.writeMessage(StatusServiceReady, "Service ready for new user")
+
+	return nil
+}
@@ -1,8 +1,19 @@
 package ftpserver
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -65,9 +76,15 @@ func TestLoginSuccess(t *testing.T) {
 	returnCode, response, err = raw.SendCommand("SYST")
 	require.NoError(t, err)
 	require.Equal(t, StatusSystemType, returnCode)
-	require.Equal(t, "UNIX Type: L8", response)
+	require.Equal(t, SystResponseUnix, response)
 
-	server.settings.DisableSYST = true
+	mustSwapSettings(server, func(settings *Settings) { settings.SystResponse = SystResponseWindows })
+	returnCode, response, err = raw.SendCommand("SYST")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemType, returnCode)
+	require.Equal(t, SystResponseWindows, response)
+
+	mustSwapSettings(server, func(settings *Settings) { settings.DisableSYST = true })
 	returnCode, response, err = raw.SendCommand("SYST")
 	require.NoError(t, err)
 	require.Equal(t, StatusCommandNotImplemented, returnCode, response)
@@ -90,6 +107,66 @@ func TestLoginFailure(t *testing.T) {
 	require.Error(t, err, "We should have failed to login")
 }
 
+func TestBruteForceProtection(t *testing.T) {
+	driver := &TestServerDriver{
+		Settings: &Settings{
+			MaxFailedLogins:      3,
+			MaxFailedLoginsPerIP: 4,
+			LoginBanDuration:     1,
+		},
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+
+	dial := func() (net.Conn, *bufio.Reader, string) {
+		conn, errDial := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+		require.NoError(t, errDial)
+
+		t.Cleanup(func() { _ = conn.Close() })
+
+		reader := bufio.NewReader(conn)
+		greeting, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return conn, reader, strings.TrimSpace(greeting)
+	}
+
+	send := func(conn net.Conn, reader *bufio.Reader, command string) string {
+		_, errWrite := fmt.Fprintf(conn, "%s\r\n", command)
+		require.NoError(t, errWrite)
+
+		response, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return strings.TrimSpace(response)
+	}
+
+	// the per-connection budget: two 530 replies, then a 421 and the connection is dropped
+	conn, reader, greeting := dial()
+	require.Equal(t, "220 TEST Server", greeting)
+	require.True(t, strings.HasPrefix(send(conn, reader, "USER "+authUser), "331"))
+	require.True(t, strings.HasPrefix(send(conn, reader, "PASS wrong"), "530"))
+	require.True(t, strings.HasPrefix(send(conn, reader, "PASS wrong"), "530"))
+	require.Equal(t, "421 Too many failed logins: closing control connection", send(conn, reader, "PASS wrong"))
+
+	// the fourth failure from this IP crosses MaxFailedLoginsPerIP and bans it
+	conn, reader, greeting = dial()
+	require.Equal(t, "220 TEST Server", greeting)
+	require.True(t, strings.HasPrefix(send(conn, reader, "USER "+authUser), "331"))
+	require.True(t, strings.HasPrefix(send(conn, reader, "PASS wrong"), "530"))
+
+	// a banned IP is refused before the greeting
+	_, _, greeting = dial()
+	require.Equal(t, "421 Temporarily banned: too many failed logins", greeting)
+
+	// the ban expires after LoginBanDuration
+	time.Sleep(1200 * time.Millisecond)
+
+	conn, reader, greeting = dial()
+	require.Equal(t, "220 TEST Server", greeting)
+	require.True(t, strings.HasPrefix(send(conn, reader, "USER "+authUser), "331"))
+	require.True(t, strings.HasPrefix(send(conn, reader, "PASS "+authPass), "230"))
+}
+
 func TestLoginCustom(t *testing.T) {
 	req := require.New(t)
 	driver := &MesssageDriver{}
@@ -156,6 +233,93 @@ func TestAuthTLS(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestAuthTLSVersionOverride(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug: false,
+		TLS:   true,
+	})
+
+	mustSwapSettings(server, func(settings *Settings) { settings.TLSMinVersion = tls.VersionTLS13 })
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+			MaxVersion:         tls.VersionTLS12,
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	_, err = client.OpenRawConn()
+	require.Error(t, err, "A TLS 1.2 handshake should be refused")
+
+	// the broken handshake already tore the connection down
+	_ = client.Close()
+
+	conf.TLSConfig = &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+	}
+
+	client, err = goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "A TLS 1.3 handshake should be accepted")
+	require.NoError(t, raw.Close())
+}
+
+func TestTLSSessionResumptionRequired(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug: false,
+		TLS:   true,
+	})
+	mustSwapSettings(server, func(settings *Settings) { settings.TLSSessionResumptionRequired = true })
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+			ServerName:         "localhost",
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	// the session cache holds the control connection ticket, so data
+	// connections resume it and transfers go through
+	ftpUpload(t, client, createTemporaryFile(t, 1*1024), "file.bin")
+
+	contents, err := client.ReadDir("/")
+	require.NoError(t, err, "Couldn't list files over a resumed data connection")
+	require.Len(t, contents, 1)
+
+	// without a session cache the client performs a full handshake on the
+	// data connection, which must now be refused
+	conf.TLSConfig = &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+	}
+
+	freshClient, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(freshClient.Close()) }()
+
+	_, err = freshClient.ReadDir("/")
+	require.Error(t, err, "A data connection that doesn't resume the control session must be refused")
+}
+
 func TestAuthExplicitTLSFailure(t *testing.T) {
 	server := NewTestServer(t, false)
 
@@ -183,7 +347,7 @@ func TestAuthTLSRequired(t *testing.T) {
 		Debug: false,
 		TLS:   true,
 	})
-	server.settings.TLSRequired = MandatoryEncryption
+	mustSwapSettings(server, func(settings *Settings) { settings.TLSRequired = MandatoryEncryption })
 
 	conf := goftp.Config{
 		User:     authUser,
@@ -314,6 +478,190 @@ func TestAuthPerClientTLSRequired(t *testing.T) {
 	require.Equal(t, StatusSystemStatus, rc)
 }
 
+func TestHOST(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: false,
+		VirtualHostSelector: func(_ ClientContext, host string) (*tls.Config, error) {
+			if host != "ftp.example.com" {
+				return nil, errHostRejected
+			}
+
+			return nil, nil
+		},
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	reader := bufio.NewReader(conn)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	send := func(command string) string {
+		_, errWrite := fmt.Fprintf(conn, "%s\r\n", command)
+		require.NoError(t, errWrite)
+
+		line, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return strings.TrimRight(line, "\r\n")
+	}
+
+	require.Equal(t, "501 Missing host name", send("HOST"))
+	require.Equal(t, "501 Host rejected: host rejected", send("HOST other.example.com"))
+	require.Equal(t, "220 HOST command ok", send("HOST ftp.example.com"))
+
+	// the selected host is exposed to the driver
+	driver.clientMU.Lock()
+	require.Len(t, driver.Clients, 1)
+	require.Equal(t, "ftp.example.com", driver.Clients[0].GetHost())
+	driver.clientMU.Unlock()
+
+	// once the client is authenticated the host can no longer be changed
+	require.True(t, strings.HasPrefix(send("USER "+authUser), "331"), "USER should be accepted")
+	require.True(t, strings.HasPrefix(send("PASS "+authPass), "230"), "PASS should be accepted")
+	require.Equal(t, "503 HOST is not allowed after authentication", send("HOST ftp.example.com"))
+}
+
+func TestSessionToken(t *testing.T) {
+	driver := &TestServerDriver{
+		Settings: &Settings{SessionTokenInWelcome: true},
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	reader := bufio.NewReader(conn)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	send := func(command string) string {
+		_, errWrite := fmt.Fprintf(conn, "%s\r\n", command)
+		require.NoError(t, errWrite)
+
+		line, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return strings.TrimRight(line, "\r\n")
+	}
+
+	require.True(t, strings.HasPrefix(send("USER "+authUser), "331"), "USER should be accepted")
+
+	// the 230 reply quotes the session token
+	welcome := send("PASS " + authPass)
+	require.True(t, strings.HasPrefix(welcome, "230"), "PASS should be accepted")
+	require.Contains(t, welcome, "(session ")
+
+	driver.clientMU.Lock()
+	require.Len(t, driver.Clients, 1)
+	token := driver.Clients[0].GetSessionToken()
+	id := driver.Clients[0].ID()
+	driver.clientMU.Unlock()
+
+	require.Len(t, token, sessionTokenBytes*2)
+	require.Contains(t, welcome, "(session "+token+")")
+
+	// the session report carries the same token
+	report, err := server.DumpSession(id)
+	require.NoError(t, err)
+	require.Equal(t, token, report.Token)
+}
+
+// reinitServerDriver records the sessions reinitialized through REIN
+type reinitServerDriver struct {
+	TestServerDriver
+	reinitUsers []string
+}
+
+func (driver *reinitServerDriver) ClientReinit(_ ClientContext, user string) {
+	driver.clientMU.Lock()
+	defer driver.clientMU.Unlock()
+
+	driver.reinitUsers = append(driver.reinitUsers, user)
+}
+
+func TestREIN(t *testing.T) {
+	req := require.New(t)
+	driver := &reinitServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	req.NoError(err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	req.NoError(err, "Couldn't open raw connection")
+
+	defer func() { req.NoError(raw.Close()) }()
+
+	returnCode, _, err := raw.SendCommand("MKD /dir")
+	req.NoError(err)
+	req.Equal(StatusPathCreated, returnCode)
+
+	returnCode, _, err = raw.SendCommand("CWD /dir")
+	req.NoError(err)
+	req.Equal(StatusFileOK, returnCode)
+
+	returnCode, _, err = raw.SendCommand("TYPE A")
+	req.NoError(err)
+	req.Equal(StatusOK, returnCode)
+
+	returnCode, response, err := raw.SendCommand("REIN")
+	req.NoError(err)
+	req.Equal(StatusServiceReady, returnCode, response)
+
+	// the session lost its authentication and its per-user registry slot
+	req.Empty(server.UserSessions(authUser))
+
+	returnCode, response, err = raw.SendCommand("PWD")
+	req.NoError(err)
+	req.Equal(StatusNotLoggedIn, returnCode, response)
+
+	driver.clientMU.Lock()
+	req.Equal([]string{authUser}, driver.reinitUsers)
+	driver.clientMU.Unlock()
+
+	// a new authentication sequence starts from a clean state
+	returnCode, _, err = raw.SendCommand("USER " + authUser)
+	req.NoError(err)
+	req.Equal(StatusUserOK, returnCode)
+
+	returnCode, _, err = raw.SendCommand("PASS " + authPass)
+	req.NoError(err)
+	req.Equal(StatusUserLoggedIn, returnCode)
+
+	returnCode, response, err = raw.SendCommand("PWD")
+	req.NoError(err)
+	req.Equal(StatusPathCreated, returnCode)
+	req.Contains(response, "\"/\"", "The working directory should be back to the root")
+
+	// the ASCII type negotiated before REIN does not leak into the next
+	// user, the session is back on the configured default
+	driver.clientMU.Lock()
+	clients := append([]ClientContext(nil), driver.Clients...)
+	driver.clientMU.Unlock()
+
+	req.NotEmpty(clients)
+
+	for _, cc := range clients {
+		report, errDump := server.DumpSession(cc.ID())
+		req.NoError(errDump)
+		req.Equal(TransferTypeBinary, report.TransferType, "The transfer type should be back to the default")
+	}
+}
+
 func TestUserVerifierError(t *testing.T) {
 	server := NewTestServerWithTestDriver(t, &TestServerDriver{
 		Debug: false,
@@ -341,3 +689,391 @@ func TestUserVerifierError(t *testing.T) {
 	require.Error(t, err, "Plain text login must fail, TLS is required")
 	require.EqualError(t, err, "unexpected response: 530-User rejected: invalid TLS requirement")
 }
+
+// clientCertServerDriver requires a client certificate for authUser logins
+type clientCertServerDriver struct {
+	TestServerDriver
+	pool *x509.CertPool
+}
+
+func (driver *clientCertServerDriver) GetClientCertPool(_ ClientContext, user string) (*x509.CertPool, error) {
+	if user == authUser {
+		return driver.pool, nil
+	}
+
+	return nil, nil
+}
+
+// buildClientCertAuthMaterial generates a throwaway CA along with a client
+// certificate it signed for authUser
+func buildClientCertAuthMaterial(t *testing.T) (*x509.CertPool, tls.Certificate) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ftpserver test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: authUser},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, &clientKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	return pool, tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	pool, clientCert := buildClientCertAuthMaterial(t)
+	driver := &clientCertServerDriver{TestServerDriver: TestServerDriver{TLS: true}, pool: pool}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	// without a client certificate the login is refused
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	_, err = client.OpenRawConn()
+	require.Error(t, err, "The login should be refused without a client certificate")
+	require.ErrorContains(t, err, "no client certificate presented")
+	_ = client.Close()
+
+	// presenting a certificate signed by the expected CA lets the login through
+	conf.TLSConfig.Certificates = []tls.Certificate{clientCert}
+	client, err = goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "The login should succeed with a client certificate")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the chain is exposed to the driver, so it can map the subject to an account
+	driver.clientMU.Lock()
+	require.NotEmpty(t, driver.Clients)
+	certs := driver.Clients[0].GetPeerCertificates()
+	driver.clientMU.Unlock()
+
+	require.NotEmpty(t, certs)
+	require.Equal(t, authUser, certs[0].Subject.CommonName)
+}
+
+// perClientTLSServerDriver serves TLS exclusively through the per-client
+// extension, its server-wide GetTLSConfig keeps failing
+type perClientTLSServerDriver struct {
+	TestServerDriver
+	calls int32 // number of per-client lookups (atomic access)
+}
+
+func (driver *perClientTLSServerDriver) GetClientTLSConfig(_ ClientContext) (*tls.Config, error) {
+	atomic.AddInt32(&driver.calls, 1)
+
+	keypair, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{keypair},
+	}, nil
+}
+
+func TestPerClientTLSConfig(t *testing.T) {
+	driver := &perClientTLSServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	_, err = client.ReadDir("/")
+	require.NoError(t, err)
+
+	// AUTH TLS and the data connection both used the per-client configuration
+	require.GreaterOrEqual(t, atomic.LoadInt32(&driver.calls), int32(2))
+}
+
+func TestCCC(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug: false,
+		TLS:   true,
+		Settings: &Settings{
+			EnableCCC: true,
+		},
+	})
+
+	conn, err := net.Dial("tcp", server.Addr())
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	buf := make([]byte, 1024)
+	readBytes, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "220"))
+
+	// clearing a control connection that was never encrypted makes no sense
+	_, err = fmt.Fprintf(conn, "CCC\r\n")
+	require.NoError(t, err)
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "503"))
+
+	_, err = fmt.Fprintf(conn, "AUTH TLS\r\n")
+	require.NoError(t, err)
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "234"))
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		//nolint:gosec
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, tlsConn.Handshake())
+
+	loginConnection(t, tlsConn)
+
+	_, err = fmt.Fprintf(tlsConn, "CCC\r\n")
+	require.NoError(t, err)
+
+	readBytes, err = tlsConn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "200"))
+
+	// from here on the control connection is plaintext again
+	_, err = fmt.Fprintf(conn, "NOOP\r\n")
+	require.NoError(t, err)
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "200"))
+}
+
+func TestCCCDisabled(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug: false,
+		TLS:   true,
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, response, err := raw.SendCommand("CCC")
+	require.NoError(t, err)
+	require.Equal(t, StatusCommandNotImplemented, returnCode, response)
+}
+
+func TestRepeatedAUTH(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug: false,
+		TLS:   true,
+	})
+
+	conn, err := net.Dial("tcp", server.Addr())
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	buf := make([]byte, 1024)
+	readBytes, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "220"))
+
+	_, err = fmt.Fprintf(conn, "AUTH TLS\r\n")
+	require.NoError(t, err)
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "234"))
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		//nolint:gosec
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, tlsConn.Handshake())
+
+	// a second AUTH is rejected by default instead of re-wrapping the
+	// connection and leaving both sides waiting on a handshake
+	_, err = fmt.Fprintf(tlsConn, "AUTH TLS\r\n")
+	require.NoError(t, err)
+
+	readBytes, err = tlsConn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "503"))
+
+	// the session is still usable after the rejection
+	loginConnection(t, tlsConn)
+
+	_, err = fmt.Fprintf(tlsConn, "NOOP\r\n")
+	require.NoError(t, err)
+
+	readBytes, err = tlsConn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "200"))
+}
+
+func TestRepeatedAUTHEnabled(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug: false,
+		TLS:   true,
+		Settings: &Settings{
+			EnableRepeatedAUTH: true,
+		},
+	})
+
+	conn, err := net.Dial("tcp", server.Addr())
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	buf := make([]byte, 1024)
+	readBytes, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "220"))
+
+	_, err = fmt.Fprintf(conn, "AUTH TLS\r\n")
+	require.NoError(t, err)
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "234"))
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		//nolint:gosec
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, tlsConn.Handshake())
+
+	// re-issuing AUTH starts a new handshake on top of the current session
+	_, err = fmt.Fprintf(tlsConn, "AUTH TLS\r\n")
+	require.NoError(t, err)
+
+	readBytes, err = tlsConn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "234"))
+
+	upgradedConn := tls.Client(tlsConn, &tls.Config{
+		//nolint:gosec
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, upgradedConn.Handshake())
+
+	loginConnection(t, upgradedConn)
+
+	_, err = fmt.Fprintf(upgradedConn, "NOOP\r\n")
+	require.NoError(t, err)
+
+	readBytes, err = upgradedConn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "200"))
+}
+
+// syncKeyLogBuffer is a goroutine-safe io.Writer collecting NSS key log
+// lines, the control and data connection handshakes can write concurrently
+type syncKeyLogBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncKeyLogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncKeyLogBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestTLSKeyLogWriter(t *testing.T) {
+	keyLog := &syncKeyLogBuffer{}
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug: false,
+		TLS:   true,
+		Settings: &Settings{
+			TLSKeyLogWriter: keyLog,
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			//nolint:gosec
+			InsecureSkipVerify: true,
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	_, err = client.ReadDir("/")
+	require.NoError(t, err)
+
+	require.Contains(t, keyLog.String(), "CLIENT_", "The handshake secrets should have been key-logged")
+}
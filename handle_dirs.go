@@ -7,6 +7,8 @@ import (
 	"io/fs"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,12 +21,152 @@ var errFileList = errors.New("listing a file isn't allowed")
 // the order matter, put parameters with more characters first
 var supportedlistArgs = []string{"-al", "-la", "-a", "-l"} //nolint:gochecknoglobals
 
+// NLSTFlagBehavior tells how a recognized list-style flag received as the
+// first NLST argument is handled, see Settings.NLSTCompatFlags
+type NLSTFlagBehavior int8
+
+const (
+	// NLSTFlagStrip drops the flag and serves the plain names-only listing
+	NLSTFlagStrip NLSTFlagBehavior = iota
+	// NLSTFlagAsLIST serves a LIST-style listing instead, which some legacy
+	// clients expect from "NLST -l"
+	NLSTFlagAsLIST
+)
+
+// nlstCompatParam applies Settings.NLSTCompatFlags to the NLST argument. It
+// returns the rewritten argument and whether the LIST formatter should be
+// used. An entry really named like a flag keeps priority over the mapping
+func (c *clientHandler) nlstCompatParam(param string) (string, bool) {
+	flags := c.server.getSettings().NLSTCompatFlags
+	if len(flags) == 0 {
+		return param, false
+	}
+
+	lower := strings.ToLower(param)
+
+	for _, flag := range supportedlistArgs {
+		if !strings.HasPrefix(lower, flag) {
+			continue
+		}
+
+		behavior, found := flags[flag]
+		if !found {
+			continue
+		}
+
+		if _, err := c.driver.Stat(c.absPath(param)); err == nil {
+			return param, false
+		}
+
+		rest := ""
+		if params := strings.SplitN(param, " ", 2); len(params) == 2 {
+			rest = params[1]
+		}
+
+		return rest, behavior == NLSTFlagAsLIST
+	}
+
+	return param, false
+}
+
+// listOptions regroups the per-session directory listing options set through
+// the "OPTS LIST" and "OPTS NLST" commands. The zero value matches the
+// historical behavior: directories and hidden files are included and NLST
+// returns paths relative to the current working directory
+type listOptions struct {
+	hideDirs     bool // exclude directories from LIST/NLST output
+	hideDotFiles bool // exclude entries whose name starts with a dot
+	absoluteNLST bool // NLST returns absolute paths instead of relative ones
+}
+
+// String reports the active options in the same keywords accepted by OPTS LIST/NLST
+func (opts listOptions) String() string {
+	report := make([]string, 0, 3)
+
+	if opts.hideDirs {
+		report = append(report, "NODIRS")
+	} else {
+		report = append(report, "DIRS")
+	}
+
+	if opts.hideDotFiles {
+		report = append(report, "NOHIDDEN")
+	} else {
+		report = append(report, "HIDDEN")
+	}
+
+	if opts.absoluteNLST {
+		report = append(report, "ABSOLUTE")
+	} else {
+		report = append(report, "RELATIVE")
+	}
+
+	return strings.Join(report, " ")
+}
+
+// filterListedFiles applies the session listing options to a fetched file list
+func (opts listOptions) filterListedFiles(files []os.FileInfo) []os.FileInfo {
+	if !opts.hideDirs && !opts.hideDotFiles {
+		return files
+	}
+
+	filtered := make([]os.FileInfo, 0, len(files))
+
+	for _, file := range files {
+		if opts.hideDirs && file.IsDir() {
+			continue
+		}
+
+		if opts.hideDotFiles && strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		filtered = append(filtered, file)
+	}
+
+	return filtered
+}
+
+// hideUploadTempNames drops the in-progress atomic upload names from a
+// fetched file list, so sessions polling a directory never see the
+// half-written files behind Settings.EnableAtomicUploads
+func (c *clientHandler) hideUploadTempNames(files []os.FileInfo) []os.FileInfo {
+	if !c.server.getSettings().EnableAtomicUploads {
+		return files
+	}
+
+	filtered := make([]os.FileInfo, 0, len(files))
+
+	for _, file := range files {
+		if isUploadTempName(file.Name()) {
+			continue
+		}
+
+		filtered = append(filtered, file)
+	}
+
+	return filtered
+}
+
+// absPath resolves a client-supplied path against the working directory and
+// normalizes it: "." and ".." segments are folded and trailing slashes are
+// dropped, so "CWD dir/" targets the same directory as "CWD dir" and drivers
+// never see a path ending with a slash. PWD and the directory replies quote
+// this cleaned form, "/" being the only path ending with a slash. Drivers
+// implementing ClientDriverExtensionPathResolver get the cleaned path to
+// rewrite as a last step
 func (c *clientHandler) absPath(p string) string {
-	if path.IsAbs(p) {
-		return path.Clean(p)
+	if !path.IsAbs(p) {
+		p = path.Join(c.Path(), p)
+	}
+
+	p = path.Clean(p)
+
+	if resolver, ok := c.driver.(ClientDriverExtensionPathResolver); ok {
+		p = resolver.ResolvePath(p)
 	}
 
-	return path.Join(c.Path(), p)
+	return p
 }
 
 // getRelativePath returns the specified path as relative to the
@@ -170,8 +312,9 @@ func (c *clientHandler) checkLISTArgs(args string) string {
 		if strings.HasPrefix(param, arg) {
 			// a check for a non-existent directory error is more appropriate here
 			// but we cannot assume that the driver implementation will return an
-			// os.IsNotExist error.
-			if _, err := c.driver.Stat(args); err != nil {
+			// os.IsNotExist error. The path is resolved and normalized first so
+			// an entry actually named like an option is found wherever we are
+			if _, err := c.driver.Stat(c.absPath(args)); err != nil {
 				params := strings.SplitN(args, " ", 2)
 				if len(params) == 1 {
 					result = ""
@@ -188,9 +331,9 @@ func (c *clientHandler) checkLISTArgs(args string) string {
 func (c *clientHandler) handleLIST(param string) error {
 	info := fmt.Sprintf("LIST %v", param)
 
-	if files, _, err := c.getFileList(param, true); err == nil || errors.Is(err, io.EOF) {
+	if files, dirPath, err := c.getFileList(param, true); err == nil || errors.Is(err, io.EOF) {
 		if tr, errTr := c.TransferOpen(info); errTr == nil {
-			err = c.dirTransferLIST(tr, files)
+			err = c.dirTransferLIST(c.listingWriter(tr), dirPath, files)
 			c.TransferClose(err)
 
 			return nil
@@ -205,11 +348,17 @@ func (c *clientHandler) handleLIST(param string) error {
 }
 
 func (c *clientHandler) handleNLST(param string) error {
+	rewritten, asList := c.nlstCompatParam(param)
+	if asList {
+		return c.handleLIST(rewritten)
+	}
+
+	param = rewritten
 	info := fmt.Sprintf("NLST %v", param)
 
 	if files, parentDir, err := c.getFileList(param, true); err == nil || errors.Is(err, io.EOF) {
 		if tr, errTrOpen := c.TransferOpen(info); errTrOpen == nil {
-			err = c.dirTransferNLST(tr, files, parentDir)
+			err = c.dirTransferNLST(c.listingWriter(tr), files, parentDir)
 			c.TransferClose(err)
 
 			return nil
@@ -224,6 +373,9 @@ func (c *clientHandler) handleNLST(param string) error {
 }
 
 func (c *clientHandler) dirTransferNLST(writer io.Writer, files []os.FileInfo, parentDir string) error {
+	opts := c.getListOptions()
+	files = c.hideUploadTempNames(opts.filterListedFiles(files))
+
 	if len(files) == 0 {
 		_, err := writer.Write([]byte(""))
 		if err != nil {
@@ -233,11 +385,17 @@ func (c *clientHandler) dirTransferNLST(writer io.Writer, files []os.FileInfo, p
 		return err
 	}
 
+	baseDir := c.getRelativePath(parentDir)
+	if opts.absoluteNLST {
+		baseDir = parentDir
+	}
+
 	for _, file := range files {
 		// Based on RFC 959 NLST is intended to return information that can be used
 		// by a program to further process the files automatically.
-		// So we return paths relative to the current working directory
-		if _, err := fmt.Fprintf(writer, "%s\r\n", path.Join(c.getRelativePath(parentDir), file.Name())); err != nil {
+		// So we return paths relative to the current working directory, unless the
+		// client asked for absolute paths with "OPTS NLST ABSOLUTE"
+		if _, err := fmt.Fprintf(writer, "%s\r\n", path.Join(baseDir, file.Name())); err != nil {
 			return newNetworkError("couldn't send NLST data", err)
 		}
 	}
@@ -245,18 +403,76 @@ func (c *clientHandler) dirTransferNLST(writer io.Writer, files []os.FileInfo, p
 	return nil
 }
 
+// handleMLSDPartial serves one page of a paginated MLSD listing: the request
+// is "MLSD <dir>" for the first page, then "MLSD <dir> <token>" with the
+// token the previous page ended on. Every page but the last one closes with
+// a synthetic entry named after the directory itself whose single "x.token"
+// fact carries the next token
+func (c *clientHandler) handleMLSDPartial(pager ClientDriverExtensionDirectoryPager, param string, pageSize int) error {
+	dirParam, token := c.splitMLSDContinuation(param)
+	listPath := c.absPath(dirParam)
+	c.SetListPath(listPath)
+
+	files, nextToken, err := pager.ReadDirPage(listPath, token, pageSize)
+	if err != nil {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Could not list: %v", err))
+
+		return nil
+	}
+
+	tr, errTr := c.TransferOpen(fmt.Sprintf("MLSD %v", param))
+	if errTr != nil {
+		return nil
+	}
+
+	writer := c.listingWriter(tr)
+	err = c.dirTransferMLSD(writer, listPath, files)
+
+	if err == nil && nextToken != "" {
+		if _, errWrite := fmt.Fprintf(writer, "x.token=%s; .\r\n", nextToken); errWrite != nil {
+			err = newNetworkError("error writing MLSD continuation", errWrite)
+		}
+	}
+
+	c.TransferClose(err)
+
+	return nil
+}
+
+// splitMLSDContinuation separates the optional continuation token from the
+// directory argument. A path that exists as given wins, so directories whose
+// name contains a space keep working
+func (c *clientHandler) splitMLSDContinuation(param string) (string, string) {
+	position := strings.LastIndex(param, " ")
+	if position < 0 {
+		return param, ""
+	}
+
+	if _, err := c.driver.Stat(c.absPath(param)); err == nil {
+		return param, ""
+	}
+
+	return param[:position], param[position+1:]
+}
+
 func (c *clientHandler) handleMLSD(param string) error {
-	if c.server.settings.DisableMLSD && !c.isCommandAborted() {
+	if c.server.getSettings().DisableMLSD && !c.isCommandAborted() {
 		c.writeMessage(StatusSyntaxErrorNotRecognised, "MLSD has been disabled")
 
 		return nil
 	}
 
+	if pageSize := c.getMLSDPageSize(); pageSize > 0 {
+		if pager, ok := c.driver.(ClientDriverExtensionDirectoryPager); ok {
+			return c.handleMLSDPartial(pager, param, pageSize)
+		}
+	}
+
 	info := fmt.Sprintf("MLSD %v", param)
 
-	if files, _, err := c.getFileList(param, false); err == nil || errors.Is(err, io.EOF) {
+	if files, dirPath, err := c.getFileList(param, c.server.getSettings().EnableMLSDFilePath); err == nil || errors.Is(err, io.EOF) {
 		if tr, errTr := c.TransferOpen(info); errTr == nil {
-			err = c.dirTransferMLSD(tr, files)
+			err = c.dirTransferMLSD(c.listingWriter(tr), dirPath, files)
 			c.TransferClose(err)
 
 			return nil
@@ -275,19 +491,34 @@ const (
 	dateFormatStatYear      = "Jan _2  2006"          // LIST date formatting with year
 	dateFormatStatOldSwitch = time.Hour * 24 * 30 * 6 // 6 months ago
 	dateFormatMLSD          = "20060102150405"        // MLSD date formatting
+	dateFormatMLSDWithMS    = "20060102150405.000"    // MLSD date formatting with millisecond precision
 	fakeUser                = "ftp"
 	fakeGroup               = "ftp"
 )
 
-func (c *clientHandler) fileStat(file os.FileInfo) string {
+func (c *clientHandler) fileStat(file os.FileInfo, entryPath string) string {
+	if lineFormatter, ok := c.driver.(ClientDriverExtensionListLine); ok {
+		if line, handled := lineFormatter.FormatListEntry(file, entryPath); handled {
+			return line
+		}
+	}
+
+	if formatter, ok := c.driver.(ClientDriverExtensionListFormatter); ok {
+		return formatter.FormatListLine(file)
+	}
+
 	modTime := file.ModTime()
 
+	if location := c.server.getSettings().ListTimeLocation; location != nil {
+		modTime = modTime.In(location)
+	}
+
 	var dateFormat string
 
 	if c.connectedAt.Sub(modTime) > dateFormatStatOldSwitch {
-		dateFormat = dateFormatStatYear
+		dateFormat = c.server.getSettings().ListOldTimeFormat
 	} else {
-		dateFormat = dateFormatStatTime
+		dateFormat = c.server.getSettings().ListRecentTimeFormat
 	}
 
 	return fmt.Sprintf(
@@ -296,13 +527,15 @@ func (c *clientHandler) fileStat(file os.FileInfo) string {
 		fakeUser,
 		fakeGroup,
 		file.Size(),
-		file.ModTime().Format(dateFormat),
+		modTime.Format(dateFormat),
 		file.Name(),
 	)
 }
 
 // fclairamb (2018-02-13): #64: Removed extra empty line
-func (c *clientHandler) dirTransferLIST(writer io.Writer, files []os.FileInfo) error {
+func (c *clientHandler) dirTransferLIST(writer io.Writer, dirPath string, files []os.FileInfo) error {
+	files = c.hideUploadTempNames(c.getListOptions().filterListedFiles(files))
+
 	if len(files) == 0 {
 		_, err := writer.Write([]byte(""))
 		if err != nil {
@@ -313,7 +546,7 @@ func (c *clientHandler) dirTransferLIST(writer io.Writer, files []os.FileInfo) e
 	}
 
 	for _, file := range files {
-		if _, err := fmt.Fprintf(writer, "%s\r\n", c.fileStat(file)); err != nil {
+		if _, err := fmt.Fprintf(writer, "%s\r\n", c.fileStat(file, path.Join(dirPath, file.Name()))); err != nil {
 			return fmt.Errorf("error writing LIST entry: %w", err)
 		}
 	}
@@ -322,7 +555,9 @@ func (c *clientHandler) dirTransferLIST(writer io.Writer, files []os.FileInfo) e
 }
 
 // fclairamb (2018-02-13): #64: Removed extra empty line
-func (c *clientHandler) dirTransferMLSD(writer io.Writer, files []os.FileInfo) error {
+func (c *clientHandler) dirTransferMLSD(writer io.Writer, dirPath string, files []os.FileInfo) error {
+	files = c.hideUploadTempNames(files)
+
 	if len(files) == 0 {
 		_, err := writer.Write([]byte(""))
 		if err != nil {
@@ -333,7 +568,7 @@ func (c *clientHandler) dirTransferMLSD(writer io.Writer, files []os.FileInfo) e
 	}
 
 	for _, file := range files {
-		if err := c.writeMLSxEntry(writer, file); err != nil {
+		if err := c.writeMLSxEntry(writer, path.Join(dirPath, file.Name()), file); err != nil {
 			return err
 		}
 	}
@@ -341,7 +576,31 @@ func (c *clientHandler) dirTransferMLSD(writer io.Writer, files []os.FileInfo) e
 	return nil
 }
 
-func (c *clientHandler) writeMLSxEntry(writer io.Writer, file os.FileInfo) error {
+// mlsxFact is a single "name=value" pair of an MLSx entry
+type mlsxFact struct {
+	name  string
+	value string
+}
+
+// mlsxFactSelected tells whether a fact made it through the "OPTS MLST"
+// selection, fact names are matched case-insensitively per RFC 3659
+func mlsxFactSelected(selected []string, name string) bool {
+	if selected == nil {
+		return true
+	}
+
+	name = strings.ToLower(name)
+
+	for _, fact := range selected {
+		if fact == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *clientHandler) writeMLSxEntry(writer io.Writer, filePath string, file os.FileInfo) error {
 	var listType string
 	if file.IsDir() {
 		listType = "dir"
@@ -349,14 +608,57 @@ func (c *clientHandler) writeMLSxEntry(writer io.Writer, file os.FileInfo) error
 		listType = "file"
 	}
 
-	_, err := fmt.Fprintf(
-		writer,
-		"Type=%s;Size=%d;Modify=%s; %s\r\n",
-		listType,
-		file.Size(),
-		file.ModTime().UTC().Format(dateFormatMLSD),
-		file.Name(),
-	)
+	facts := []mlsxFact{
+		{"Type", listType},
+		{"Size", strconv.FormatInt(file.Size(), 10)},
+		{"Modify", file.ModTime().UTC().Format(dateFormatMLSDWithMS)},
+	}
+
+	if provider, ok := c.driver.(ClientDriverExtensionMLSxFacts); ok {
+		extra := provider.GetExtraMLSxFacts(filePath, file)
+
+		// the extra facts are written in a stable order, map iteration would
+		// randomize the entries between runs
+		names := make([]string, 0, len(extra))
+		for name := range extra {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			facts = append(facts, mlsxFact{name, extra[name]})
+		}
+	}
+
+	selected := c.getMLSxFacts()
+
+	// an MLSx entry cannot be folded over several reply lines: when a line
+	// length bound is configured the trailing facts are shed to fit it, the
+	// file name is never cut
+	budget := 0
+	if maxLen := c.server.getSettings().MaxReplyLineLength; maxLen > 0 {
+		budget = maxLen - len(file.Name()) - replyLinePrefixLength - 2
+	}
+
+	var line strings.Builder
+
+	for _, fact := range facts {
+		if !mlsxFactSelected(selected, fact.name) {
+			continue
+		}
+
+		if budget > 0 && line.Len()+len(fact.name)+len(fact.value)+2 > budget {
+			break
+		}
+
+		line.WriteString(fact.name)
+		line.WriteByte('=')
+		line.WriteString(fact.value)
+		line.WriteByte(';')
+	}
+
+	_, err := fmt.Fprintf(writer, "%s %s\r\n", line.String(), file.Name())
 	if err != nil {
 		err = fmt.Errorf("error writing MLSD entry: %w", err)
 	}
@@ -365,7 +667,7 @@ func (c *clientHandler) writeMLSxEntry(writer io.Writer, file os.FileInfo) error
 }
 
 func (c *clientHandler) getFileList(param string, filePathAllowed bool) ([]os.FileInfo, string, error) {
-	if !c.server.settings.DisableLISTArgs {
+	if !c.server.getSettings().DisableLISTArgs {
 		param = c.checkLISTArgs(param)
 	}
 	// directory or filePath
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"path"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -80,6 +83,199 @@ func TestDirListing(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestDirListingCustomTimeFormat(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug: false,
+		Settings: &Settings{
+			// an always-year layout, used regardless of the entry age
+			ListRecentTimeFormat: "2006-01-02 15:04",
+			ListOldTimeFormat:    "2006-01-02 15:04",
+			ListTimeLocation:     time.UTC,
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	fileName := "testfile.ext"
+	ftpUpload(t, client, createTemporaryFile(t, 10), fileName)
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw.SendCommand("LIST")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+	resp, err := io.ReadAll(dataConn)
+	require.NoError(t, err)
+	require.Regexp(t, `\d{4}-\d{2}-\d{2} \d{2}:\d{2} `+fileName, string(resp))
+
+	returnCode, _, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode)
+}
+
+// listFormatterServerDriver hands out client drivers formatting their own
+// LIST lines
+type listFormatterServerDriver struct {
+	TestServerDriver
+}
+
+func (driver *listFormatterServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &listFormatterClientDriver{ClientDriver: clientDriver}, nil
+}
+
+type listFormatterClientDriver struct {
+	ClientDriver
+}
+
+func (driver *listFormatterClientDriver) FormatListLine(info os.FileInfo) string {
+	return fmt.Sprintf("%s alice staff %d %s", info.Mode(), info.Size(), info.Name())
+}
+
+func TestDirListingCustomFormatter(t *testing.T) {
+	driver := &listFormatterServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	fileName := "testfile.ext"
+	ftpUpload(t, client, createTemporaryFile(t, 10), fileName)
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw.SendCommand("LIST")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+	resp, err := io.ReadAll(dataConn)
+	require.NoError(t, err)
+	require.Contains(t, string(resp), "alice staff 10 "+fileName+"\r\n")
+
+	returnCode, _, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode)
+
+	// STAT entries go through the same formatter
+	returnCode, response, err = raw.SendCommand("STAT " + fileName)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, returnCode, response)
+	require.Contains(t, response, "alice staff 10 "+fileName)
+}
+
+// listLineServerDriver hands out client drivers formatting single LIST
+// entries, leaving the other ones to the default layout
+type listLineServerDriver struct {
+	TestServerDriver
+}
+
+func (driver *listLineServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &listLineClientDriver{ClientDriver: clientDriver}, nil
+}
+
+type listLineClientDriver struct {
+	ClientDriver
+}
+
+func (driver *listLineClientDriver) FormatListEntry(info os.FileInfo, entryPath string) (string, bool) {
+	if !strings.HasPrefix(info.Name(), "archived-") {
+		return "", false
+	}
+
+	return fmt.Sprintf("%s bob users A--- %d %s", info.Mode(), info.Size(), entryPath), true
+}
+
+func TestDirListingPerEntryFormatter(t *testing.T) {
+	driver := &listLineServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	ftpUpload(t, client, createTemporaryFile(t, 10), "archived-file.ext")
+	ftpUpload(t, client, createTemporaryFile(t, 10), "plain.ext")
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw.SendCommand("LIST")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+	resp, err := io.ReadAll(dataConn)
+	require.NoError(t, err)
+
+	// the driver formatted its entry, with the full path, the other one kept
+	// the default layout
+	require.Contains(t, string(resp), "bob users A--- 10 /archived-file.ext\r\n")
+	require.Contains(t, string(resp), "ftp ftp")
+	require.Contains(t, string(resp), "plain.ext\r\n")
+
+	returnCode, _, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode)
+
+	// STAT of a single file goes through the same per-entry formatter
+	returnCode, response, err = raw.SendCommand("STAT archived-file.ext")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, returnCode, response)
+	require.Contains(t, response, "bob users A--- 10 /archived-file.ext")
+}
+
 func TestDirListingPathArg(t *testing.T) {
 	// MLSD is disabled we relies on LIST of files listing
 	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false, Settings: &Settings{DisableMLSD: true}})
@@ -372,7 +568,7 @@ func TestTLSTransfer(t *testing.T) {
 		Debug: false,
 		TLS:   true,
 	})
-	server.settings.TLSRequired = MandatoryEncryption
+	mustSwapSettings(server, func(settings *Settings) { settings.TLSRequired = MandatoryEncryption })
 
 	conf := goftp.Config{
 		User:     authUser,
@@ -521,12 +717,12 @@ func testListDirArgs(t *testing.T, server *FtpServer) {
 	defer func() { panicOnError(client.Close()) }()
 
 	for _, arg := range supportedlistArgs {
-		server.settings.DisableLISTArgs = true
+		mustSwapSettings(server, func(settings *Settings) { settings.DisableLISTArgs = true })
 
 		_, err = client.ReadDir(arg)
 		require.Error(t, err, fmt.Sprintf("list args are disabled \"list %v\" must fail", arg))
 
-		server.settings.DisableLISTArgs = false
+		mustSwapSettings(server, func(settings *Settings) { settings.DisableLISTArgs = false })
 
 		contents, err := client.ReadDir(arg)
 		req.NoError(err)
@@ -557,6 +753,136 @@ func testListDirArgs(t *testing.T, server *FtpServer) {
 	}
 }
 
+func TestTrailingSlashes(t *testing.T) {
+	req := require.New(t)
+	server := NewTestServer(t, false)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	req.NoError(err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	req.NoError(err, "Couldn't open raw connection")
+
+	defer func() { req.NoError(raw.Close()) }()
+
+	// some clients always append a slash, the normalized form is used
+	// everywhere including the replies
+	returnCode, response, err := raw.SendCommand("MKD /trail/")
+	req.NoError(err)
+	req.Equal(StatusPathCreated, returnCode)
+	req.Contains(response, `"/trail"`)
+
+	returnCode, response, err = raw.SendCommand("CWD /trail/")
+	req.NoError(err)
+	req.Equal(StatusFileOK, returnCode)
+	req.Equal("CD worked on /trail", response)
+
+	returnCode, response, err = raw.SendCommand("PWD")
+	req.NoError(err)
+	req.Equal(StatusPathCreated, returnCode)
+	req.Contains(response, `"/trail"`)
+
+	// relative parameters are normalized the same way
+	returnCode, response, err = raw.SendCommand("MKD sub/")
+	req.NoError(err)
+	req.Equal(StatusPathCreated, returnCode)
+	req.Contains(response, `"/trail/sub"`)
+
+	contents, err := client.ReadDir("/trail/")
+	req.NoError(err, "Listing a directory with a trailing slash should work")
+	req.Len(contents, 1)
+	req.Equal("sub", contents[0].Name())
+
+	returnCode, response, err = raw.SendCommand("RMD sub/")
+	req.NoError(err)
+	req.Equal(StatusFileOK, returnCode)
+	req.Equal("Deleted dir /trail/sub", response)
+}
+
+type pathResolverServerDriver struct {
+	TestServerDriver
+}
+
+func (driver *pathResolverServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pathResolverClientDriver{ClientDriver: clientDriver}, nil
+}
+
+type pathResolverClientDriver struct {
+	ClientDriver
+}
+
+// ResolvePath aliases the virtual "/alias" folder onto "/real"
+func (driver *pathResolverClientDriver) ResolvePath(virtualPath string) string {
+	if virtualPath == "/alias" {
+		return "/real"
+	}
+
+	if strings.HasPrefix(virtualPath, "/alias/") {
+		return "/real" + strings.TrimPrefix(virtualPath, "/alias")
+	}
+
+	return virtualPath
+}
+
+func TestPathResolver(t *testing.T) {
+	req := require.New(t)
+	driver := &pathResolverServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	req.NoError(err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	_, err = client.Mkdir("/real")
+	req.NoError(err)
+
+	// a file stored through the alias lands in the backing directory
+	err = client.Store("/alias/file.bin", strings.NewReader("aliased content"))
+	req.NoError(err)
+
+	_, err = driver.fs.Stat("/real/file.bin")
+	req.NoError(err, "The upload should have been redirected to the backing directory")
+
+	contents, err := client.ReadDir("/alias")
+	req.NoError(err, "Listing the aliased directory should work")
+	req.Len(contents, 1)
+	req.Equal("file.bin", contents[0].Name())
+
+	// changing into the alias lands in the backing directory too
+	raw, err := client.OpenRawConn()
+	req.NoError(err, "Couldn't open raw connection")
+
+	defer func() { req.NoError(raw.Close()) }()
+
+	returnCode, response, err := raw.SendCommand("CWD /alias")
+	req.NoError(err)
+	req.Equal(StatusFileOK, returnCode)
+	req.Equal("CD worked on /real", response)
+
+	returnCode, response, err = raw.SendCommand("DELE file.bin")
+	req.NoError(err)
+	req.Equal(StatusFileOK, returnCode, response)
+
+	_, err = driver.fs.Stat("/real/file.bin")
+	req.Error(err, "The delete should have gone through the backing directory")
+}
+
 func TestMLSDTimezone(t *testing.T) {
 	server := NewTestServer(t, false)
 	conf := goftp.Config{
@@ -577,6 +903,96 @@ func TestMLSDTimezone(t *testing.T) {
 	require.InDelta(t, time.Now().Unix(), contents[0].ModTime().Unix(), 5)
 }
 
+func TestDirListingOptions(t *testing.T) {
+	server := NewTestServer(t, false)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	_, err = client.Mkdir("subdir")
+	require.NoError(t, err, "Couldn't create dir")
+
+	ftpUpload(t, client, createTemporaryFile(t, 10), "file.ext")
+	ftpUpload(t, client, createTemporaryFile(t, 10), ".hidden")
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	nlst := func() string {
+		dcGetter, errConn := raw.PrepareDataConn()
+		require.NoError(t, errConn)
+
+		returnCode, response, errCmd := raw.SendCommand("NLST /")
+		require.NoError(t, errCmd)
+		require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+		dataConn, errConn := dcGetter()
+		require.NoError(t, errConn)
+		resp, errRead := io.ReadAll(dataConn)
+		require.NoError(t, errRead)
+
+		returnCode, _, errCmd = raw.ReadResponse()
+		require.NoError(t, errCmd)
+		require.Equal(t, StatusClosingDataConn, returnCode)
+
+		return string(resp)
+	}
+
+	returnCode, response, err := raw.SendCommand("OPTS NLST NODIRS NOHIDDEN ABSOLUTE")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+	require.Equal(t, "NODIRS NOHIDDEN ABSOLUTE", response)
+
+	require.Equal(t, "/file.ext\r\n", nlst())
+
+	returnCode, response, err = raw.SendCommand("OPTS LIST DIRS HIDDEN RELATIVE")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+	require.Equal(t, "DIRS HIDDEN RELATIVE", response)
+
+	listing := nlst()
+	require.Contains(t, listing, "subdir\r\n")
+	require.Contains(t, listing, ".hidden\r\n")
+	require.Contains(t, listing, "file.ext\r\n")
+
+	returnCode, _, err = raw.SendCommand("OPTS LIST BOGUS")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode)
+}
+
+func TestMLSDFilePathAllowed(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug:    false,
+		Settings: &Settings{EnableMLSDFilePath: true},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	fileName := "testfile.ext"
+	ftpUpload(t, client, createTemporaryFile(t, 10), fileName)
+
+	// with the compatibility flag MLSD on a file path returns the single entry
+	contents, err := client.ReadDir(fileName)
+	require.NoError(t, err, "MLSD for a filePath must succeed when EnableMLSDFilePath is set")
+	require.Len(t, contents, 1)
+	require.Equal(t, fileName, contents[0].Name())
+}
+
 func TestMLSDAndNLSTFilePathError(t *testing.T) {
 	server := NewTestServer(t, false)
 	conf := goftp.Config{
@@ -619,3 +1035,224 @@ func TestMLSDAndNLSTFilePathError(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, fileName+"\r\n", string(resp))
 }
+
+func TestNLSTCompatFlags(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Settings: &Settings{
+			NLSTCompatFlags: map[string]NLSTFlagBehavior{
+				"-l": NLSTFlagAsLIST,
+				"-a": NLSTFlagStrip,
+			},
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	ftpUpload(t, client, createTemporaryFile(t, 10), "file.txt")
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	readListing := func(command string) string {
+		dcGetter, errPrep := raw.PrepareDataConn()
+		require.NoError(t, errPrep)
+
+		returnCode, response, errCmd := raw.SendCommand(command)
+		require.NoError(t, errCmd)
+		require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+		dataConn, errConn := dcGetter()
+		require.NoError(t, errConn)
+		data, errRead := io.ReadAll(dataConn)
+		require.NoError(t, errRead)
+
+		returnCode, _, errCmd = raw.ReadResponse()
+		require.NoError(t, errCmd)
+		require.Equal(t, StatusClosingDataConn, returnCode)
+
+		return string(data)
+	}
+
+	// "-l" is mapped to the LIST formatter
+	listing := readListing("NLST -l")
+	require.Contains(t, listing, "ftp ftp")
+	require.Contains(t, listing, "file.txt")
+
+	// "-a" is stripped and the plain names-only listing is kept
+	listing = readListing("NLST -a")
+	require.Equal(t, "file.txt\r\n", listing)
+
+	// an entry really named like a mapped flag keeps priority
+	ftpUpload(t, client, createTemporaryFile(t, 10), "-l")
+
+	listing = readListing("NLST -l")
+	require.Equal(t, "-l\r\n", listing)
+}
+
+// pagedDirServerDriver hands out client drivers reading directories one page
+// at a time, the way an object store with native pagination would
+type pagedDirServerDriver struct {
+	TestServerDriver
+}
+
+func (driver *pagedDirServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pagedDirClientDriver{ClientDriver: clientDriver}, nil
+}
+
+type pagedDirClientDriver struct {
+	ClientDriver
+}
+
+// ReadDirPage implements the ClientDriverExtensionDirectoryPager extension:
+// entries are served sorted by name, the token being the last name returned
+func (driver *pagedDirClientDriver) ReadDirPage(name string, token string, limit int) ([]os.FileInfo, string, error) {
+	directory, err := driver.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer directory.Close() //nolint:errcheck,gosec
+
+	entries, err := directory.Readdir(-1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	page := make([]os.FileInfo, 0, limit)
+	nextToken := ""
+
+	for _, entry := range entries {
+		if token != "" && entry.Name() <= token {
+			continue
+		}
+
+		if len(page) == limit {
+			nextToken = page[len(page)-1].Name()
+
+			break
+		}
+
+		page = append(page, entry)
+	}
+
+	return page, nextToken, nil
+}
+
+func TestMLSDPartialListings(t *testing.T) {
+	driver := &pagedDirServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	for i := 0; i < 5; i++ {
+		ftpUpload(t, client, createTemporaryFile(t, 10), fmt.Sprintf("file%d.ext", i))
+	}
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	readPage := func(args string) string {
+		dcGetter, errData := raw.PrepareDataConn()
+		require.NoError(t, errData)
+
+		returnCode, response, errCmd := raw.SendCommand("MLSD " + args)
+		require.NoError(t, errCmd)
+		require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+		dataConn, errConn := dcGetter()
+		require.NoError(t, errConn)
+
+		listing, errRead := io.ReadAll(dataConn)
+		require.NoError(t, errRead)
+
+		returnCode, response, errClose := raw.ReadResponse()
+		require.NoError(t, errClose)
+		require.Equal(t, StatusClosingDataConn, returnCode, response)
+
+		return string(listing)
+	}
+
+	returnCode, response, err := raw.SendCommand("OPTS MLSD PARTIAL=2")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode, response)
+
+	// first page: two entries and the continuation token
+	page := readPage("/")
+	require.Contains(t, page, " file0.ext\r\n")
+	require.Contains(t, page, " file1.ext\r\n")
+	require.NotContains(t, page, " file2.ext\r\n")
+	require.Contains(t, page, "x.token=file1.ext; .\r\n")
+
+	// resuming from the token skips what was already listed
+	page = readPage("/ file1.ext")
+	require.Contains(t, page, " file2.ext\r\n")
+	require.Contains(t, page, " file3.ext\r\n")
+	require.Contains(t, page, "x.token=file3.ext; .\r\n")
+
+	// the last page carries no token
+	page = readPage("/ file3.ext")
+	require.Contains(t, page, " file4.ext\r\n")
+	require.NotContains(t, page, "x.token=")
+
+	// back to complete listings
+	returnCode, response, err = raw.SendCommand("OPTS MLSD PARTIAL=0")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode, response)
+
+	page = readPage("/")
+	require.Contains(t, page, " file0.ext\r\n")
+	require.Contains(t, page, " file4.ext\r\n")
+	require.NotContains(t, page, "x.token=")
+}
+
+func TestMLSDPartialUnsupported(t *testing.T) {
+	server := NewTestServer(t, false)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, response, err := raw.SendCommand("OPTS MLSD PARTIAL=10")
+	require.NoError(t, err)
+	require.Equal(t, StatusCommandNotImplemented, returnCode, response)
+
+	returnCode, response, err = raw.SendCommand("OPTS MLSD PARTIAL=nope")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode, response)
+}
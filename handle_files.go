@@ -14,6 +14,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"path"
 	"runtime"
 	"strconv"
 	"strings"
@@ -41,6 +42,38 @@ func (c *clientHandler) handleRETR(param string) error {
 	return nil
 }
 
+// resumeContext carries the restart state of a single transfer: the REST
+// offset, the RANG range and the APPE intent. The commands preparing a
+// restart (REST, RANG) fill the pending context on the handler and the next
+// transfer consumes it as a whole, so the state is cleared in one place
+// whatever the outcome of the transfer is
+type resumeContext struct {
+	restOffset   int64 // Position set through REST
+	rangeStart   int64 // Zero-based range start set through RANG
+	rangeLength  int64 // Range length set through RANG, 0 when no range is active
+	appendIntent bool  // The transfer was started by APPE
+	asciiOffset  bool  // The REST offset is counted on the converted ASCII stream
+}
+
+// hasRange tells if a RANG range is active
+func (r *resumeContext) hasRange() bool {
+	return r.rangeLength > 0
+}
+
+// clear resets the whole restart state
+func (r *resumeContext) clear() {
+	*r = resumeContext{}
+}
+
+// consumeResumeContext takes ownership of the pending restart state: whatever
+// happens to the transfer, the next command starts from a clean slate
+func (c *clientHandler) consumeResumeContext() resumeContext {
+	resume := c.resume
+	c.resume.clear()
+
+	return resume
+}
+
 // File transfer, read or write, seek or not, is basically the same.
 // To make sure we don't miss any step, we execute everything in order
 func (c *clientHandler) transferFile(write bool, appendFile bool, param, info string) {
@@ -50,18 +83,112 @@ func (c *clientHandler) transferFile(write bool, appendFile bool, param, info st
 
 	path := c.absPath(param)
 
+	// the pending restart state is consumed, as a whole, by the transfer it
+	// applies to
+	resume := c.consumeResumeContext()
+	resume.appendIntent = appendFile
+
+	if resume.hasRange() {
+		resume.restOffset = resume.rangeStart
+	}
+
+	// a resumed ASCII download cannot seek the stored file: the offset is
+	// counted on the converted stream, so the converter discards the already
+	// transferred bytes instead. Resumed ASCII uploads are stored after
+	// conversion and keep the regular seek below
+	var asciiResumeOffset int64
+	if resume.asciiOffset && !write && c.currentTransferType == TransferTypeASCII {
+		asciiResumeOffset = resume.restOffset
+		resume.restOffset = 0
+	}
+
+	// a fresh upload writes the file from its beginning, as opposed to an
+	// append, a resume or a range upload
+	freshUpload := write && !resume.appendIntent && resume.restOffset == 0 && !resume.hasRange()
+
+	// content sniffing only makes sense when a new file is uploaded from its beginning
+	var sniffPath string
+	if freshUpload {
+		sniffPath = path
+	}
+
+	// uploads going over the account's storage quota are refused before any
+	// byte is moved
+	quotaRemaining := int64(-1)
+
+	// a deduplicating driver learns about the upload before any byte is
+	// moved and gets the content digest before the file becomes visible
+	deduplicator, hasDeduplicator := c.driver.(ClientDriverExtensionUploadDeduplicator)
+	dedupUpload := hasDeduplicator && freshUpload
+
+	// the size the client declared through ALLO or "OPTS STOR SIZE", if any
+	var declaredSize int64
+
+	if write {
+		declaredSize = c.alloSize
+		c.alloSize = 0
+
+		var errQuota error
+
+		if quotaRemaining, errQuota = c.uploadQuotaRemaining(declaredSize); errQuota != nil {
+			c.writeMessage(getErrorCode(errQuota, StatusActionNotTaken), "Could not store: "+errQuota.Error())
+
+			return
+		}
+
+		if dedupUpload {
+			if errPre := deduplicator.PreUpload(path, declaredSize); errPre != nil {
+				c.writeMessage(getErrorCode(errPre, StatusActionNotTaken), "Could not store: "+errPre.Error())
+
+				return
+			}
+		}
+	}
+
+	// the transfer is counted against the concurrency limits before any
+	// resource is allocated for it
+	releaseSlot, slotOK := c.acquireTransferSlot(write, path)
+	if !slotOK {
+		return
+	}
+
+	if releaseSlot != nil {
+		defer releaseSlot()
+	}
+
+	// an atomic upload is written under a temporary sibling name and only
+	// renamed into place once complete, see Settings.EnableAtomicUploads
+	var uploadTempTarget string
+
+	if freshUpload && c.server.getSettings().EnableAtomicUploads {
+		uploadTempTarget = uploadTempPath(path, c.id)
+	}
+
 	// We try to open the file
 	if write { //nolint:nestif // too much effort to change for now
 		fileFlag = os.O_WRONLY
-		if appendFile {
-			fileFlag |= os.O_CREATE | os.O_APPEND
-			// ignore the seek position for append mode
-			c.ctxRest = 0
+		if resume.appendIntent {
+			restPolicy := c.server.getSettings().RestAppendPolicy
+
+			switch {
+			case resume.restOffset == 0 || restPolicy == RestAppendPolicyIgnore:
+				fileFlag |= os.O_CREATE | os.O_APPEND
+				// ignore the seek position for append mode
+				resume.restOffset = 0
+			case restPolicy == RestAppendPolicyRefuse:
+				c.writeMessage(StatusSyntaxErrorParameters, "REST cannot be combined with APPE")
+
+				return
+			default:
+				// RestAppendPolicyHonor: same handling as a resumed STOR, the
+				// seek below will move to the requested offset
+				fileFlag |= os.O_CREATE
+			}
 		} else {
 			fileFlag |= os.O_CREATE
-			// if this isn't a resume we add the truncate flag
-			// to be sure to overwrite an existing file
-			if c.ctxRest == 0 {
+			// if this isn't a resume or a range upload we add the truncate
+			// flag to be sure to overwrite an existing file
+			if resume.restOffset == 0 && !resume.hasRange() {
 				fileFlag |= os.O_TRUNC
 			}
 		}
@@ -69,29 +196,37 @@ func (c *clientHandler) transferFile(write bool, appendFile bool, param, info st
 		fileFlag = os.O_RDONLY
 	}
 
-	file, err = c.getFileHandle(path, fileFlag, c.ctxRest)
-	// If this fail, can stop right here and reset the seek position
+	openPath := path
+	if uploadTempTarget != "" {
+		openPath = uploadTempTarget
+	}
+
+	file, err = c.getFileHandle(openPath, fileFlag, resume.restOffset)
+	// If this fail, can stop right here
 	if err != nil {
 		if !c.isCommandAborted() {
 			c.writeMessage(getErrorCode(err, StatusActionNotTaken), "Could not access file: "+err.Error())
 		}
 
-		c.ctxRest = 0
-
 		return
 	}
 
+	if uploadTempTarget != "" {
+		c.addInProgressUpload(path)
+		defer c.removeInProgressUpload(path)
+	}
+
 	// Try to seek on it
-	if c.ctxRest != 0 {
-		_, err = file.Seek(c.ctxRest, 0)
-		// Whatever happens we should reset the seek position
-		c.ctxRest = 0
+	if resume.restOffset != 0 {
+		_, err = file.Seek(resume.restOffset, 0)
 
 		if err != nil {
 			// if we are unable to seek we can stop right here and close the file
 			if !c.isCommandAborted() {
 				c.writeMessage(getErrorCode(err, StatusActionNotTaken), "Could not seek file: "+err.Error())
 			}
+
+			notifyTransferError(file, TransferPhaseSeek, err)
 			// we can ignore the close error here
 			c.closeUnchecked(file)
 
@@ -99,54 +234,394 @@ func (c *clientHandler) transferFile(write bool, appendFile bool, param, info st
 		}
 	}
 
+	// several clients parse the size out of the 150 reply to display progress
+	if !write && c.server.getSettings().EnableSizeInTransferReply {
+		if fileInfo, errStat := c.driver.Stat(path); errStat == nil {
+			info = fmt.Sprintf("%s (%d bytes)", info, fileInfo.Size())
+		}
+	}
+
 	fileTransferConn, err := c.TransferOpen(info)
 	if err != nil {
-		if fileTransferError, ok := file.(FileTransferError); ok {
-			fileTransferError.TransferError(err)
-		}
+		notifyTransferError(file, TransferPhaseOpen, err)
 		// an error is already returned to the FTP client
 		// we can stop right here and close the file ignoring close error if any
 		c.closeUnchecked(file)
 
+		if uploadTempTarget != "" {
+			c.removeUploadTemp(uploadTempTarget)
+		}
+
 		return
 	}
 
-	err = c.doFileTransfer(fileTransferConn, file, write)
+	direction := TransferDirectionDownload
+	if write {
+		direction = TransferDirectionUpload
+	}
+
+	// progress is reported through ClientContext.GetTransferStats until
+	// TransferClose ends the transfer
+	transferStart := time.Now()
+	c.startTransferStats(direction, path)
+
+	notifier, hasNotifier := c.server.driver.(MainDriverExtensionTransferNotifier)
+	if hasNotifier {
+		notifier.TransferStarted(c, direction, path)
+	}
+
+	collector := c.server.MetricsCollector
+	if collector != nil {
+		collector.TransferStarted()
+	}
+
+	// a declared size is only meaningful for an upload written from its
+	// beginning
+	if !freshUpload {
+		declaredSize = 0
+	}
+
+	// the digest handed to IsDuplicateUpload is computed while the content
+	// streams to the driver
+	var uploadDigest hash.Hash
+	if dedupUpload {
+		uploadDigest = sha256.New()
+	}
+
+	written, err := c.doFileTransfer(fileTransferConn, file, write, sniffPath, resume.rangeLength,
+		asciiResumeOffset, quotaRemaining, declaredSize, uploadDigest)
+
+	// a fresh upload that ends without a byte moved still went through one
+	// empty write inside doFileTransfer, so drivers materializing the file
+	// on its first write, typically object stores, saw the same call
+	// sequence as for any upload; here it can only be rejected as a whole
+	if err == nil && freshUpload && written == 0 && c.server.getSettings().RejectEmptyUploads {
+		err = ErrEmptyUploadRejected
+	}
 	// we ignore close error for reads
-	if errClose := file.Close(); errClose != nil && err == nil && write {
-		err = errClose
+	errClose := func() (closeErr error) {
+		defer c.recoverDriverPanic("closing "+path, &closeErr)
+
+		return file.Close()
+	}()
+	if errClose != nil && write {
+		notifyTransferError(file, TransferPhaseClose, errClose)
+
+		if err == nil {
+			err = errClose
+		}
+	}
+
+	// the deduplication decision comes before the upload is finalized, so a
+	// duplicate never becomes visible under its final name
+	if err == nil && uploadDigest != nil {
+		duplicate, errDedup := deduplicator.IsDuplicateUpload(path, hex.EncodeToString(uploadDigest.Sum(nil)), written)
+
+		switch {
+		case errDedup != nil:
+			err = newDriverError("could not deduplicate upload", errDedup)
+		case duplicate:
+			// the driver stores this content by reference, the freshly
+			// written copy goes away instead of being finalized
+			if uploadTempTarget != "" {
+				c.removeUploadTemp(uploadTempTarget)
+				uploadTempTarget = ""
+			} else if errRemove := c.driver.Remove(path); errRemove != nil {
+				c.logger.Warn("Couldn't remove deduplicated upload", "path", path, "err", errRemove)
+			}
+		}
+	}
+
+	// an atomic upload only becomes visible under its final name now, or its
+	// temporary file goes away with the failed transfer
+	if uploadTempTarget != "" {
+		err = c.finishAtomicUpload(uploadTempTarget, path, err)
+	} else if errors.Is(err, ErrEmptyUploadRejected) {
+		// the empty file of a rejected empty upload does not stay behind
+		if errRemove := c.driver.Remove(path); errRemove != nil {
+			c.logger.Warn("Couldn't remove rejected empty upload", "path", path, "err", errRemove)
+		}
+	}
+
+	// the driver is notified of the completed transfer before the FTP client
+	// so it can finalize its backend state first
+	if err == nil {
+		if fileTransferDone, ok := file.(FileTransferDone); ok {
+			fileTransferDone.TransferDone(written)
+		}
 	}
 
 	// closing the transfer we also send the response message to the FTP client
 	c.TransferClose(err)
+
+	if collector != nil {
+		collector.TransferEnded()
+	}
+
+	if hasNotifier {
+		notifier.TransferCompleted(c, direction, path, written, time.Since(transferStart), err)
+	}
+
+	c.logAccess(AccessRecordKindTransfer, c.GetLastCommand(), path, written, transferStart)
 }
 
-func (c *clientHandler) doFileTransfer(transferConn net.Conn, file io.ReadWriter, write bool) error {
-	var err error
+// acquireTransferSlot counts the transfer about to start against the global
+// MaxConcurrentTransfers limit and, when the driver classifies it through
+// MainDriverExtensionTransferPriority, against its priority class limit. It
+// returns the release function to call once the transfer is over, and false
+// when a limit is reached, the client then being refused with a 450 reply
+func (c *clientHandler) acquireTransferSlot(write bool, transferPath string) (func(), bool) {
+	settings := c.server.getSettings()
+
+	var class string
+	var classLimit int
+
+	if prioritizer, ok := c.server.driver.(MainDriverExtensionTransferPriority); ok &&
+		len(settings.TransferClassLimits) > 0 {
+		direction := TransferDirectionDownload
+		if write {
+			direction = TransferDirectionUpload
+		}
+
+		class = prioritizer.GetTransferClass(c, direction, transferPath)
+		classLimit = settings.TransferClassLimits[class]
+	}
+
+	if settings.MaxConcurrentTransfers <= 0 && classLimit <= 0 {
+		return nil, true
+	}
+
+	if !c.server.acquireTransferSlot(class, classLimit, settings.MaxConcurrentTransfers) {
+		c.writeMessage(StatusFileActionNotTaken, "Too many concurrent transfers, try again later")
+
+		return nil, false
+	}
+
+	return func() { c.server.releaseTransferSlot(class) }, true
+}
+
+// uploadTempPrefix starts the name of every in-progress atomic upload, the
+// directory listing code hides entries following this convention
+const uploadTempPrefix = ".ftpupload."
+
+// isUploadTempName tells whether a directory entry follows the atomic upload
+// temporary naming convention
+func isUploadTempName(name string) bool {
+	return strings.HasPrefix(name, uploadTempPrefix)
+}
+
+// uploadTempPath builds the temporary sibling name an atomic upload is
+// written to. The session ID keeps concurrent uploads of the same file by
+// different clients from colliding
+func uploadTempPath(finalPath string, clientID uint32) string {
+	dir, base := path.Split(finalPath)
+
+	return dir + uploadTempPrefix + strconv.FormatUint(uint64(clientID), 10) + "." + base
+}
+
+// finishAtomicUpload renames a completed upload from its temporary name to
+// its final one, or removes the temporary file when the transfer failed
+func (c *clientHandler) finishAtomicUpload(tempPath, finalPath string, transferErr error) error {
+	if transferErr != nil {
+		c.removeUploadTemp(tempPath)
+
+		return transferErr
+	}
+
+	if errRename := c.driver.Rename(tempPath, finalPath); errRename != nil {
+		c.removeUploadTemp(tempPath)
+
+		return newFileAccessError("could not rename temporary upload", errRename)
+	}
+
+	return nil
+}
+
+// removeUploadTemp deletes a leftover atomic upload temporary file, a failure
+// only deserves a log line as the transfer error, if any, takes precedence
+func (c *clientHandler) removeUploadTemp(tempPath string) {
+	if errRemove := c.driver.Remove(tempPath); errRemove != nil {
+		c.logger.Warn(
+			"Could not remove temporary upload file",
+			"path", tempPath,
+			"err", errRemove,
+		)
+	}
+}
+
+// uploadQuotaRemaining returns how many bytes the account may still store, -1
+// when no quota applies. ErrStorageExceeded is returned when the quota is
+// already used up or when declaredSize, announced through ALLO, does not fit
+// in what remains
+func (c *clientHandler) uploadQuotaRemaining(declaredSize int64) (int64, error) {
+	quotaDriver, ok := c.driver.(ClientDriverExtensionQuota)
+	if !ok {
+		return -1, nil
+	}
+
+	quota, err := quotaDriver.GetQuota()
+	if err != nil {
+		return -1, newDriverError("could not get the storage quota", err)
+	}
+
+	if quota < 0 {
+		return -1, nil
+	}
+
+	usage, err := quotaDriver.GetUsage()
+	if err != nil {
+		return -1, newDriverError("could not get the storage usage", err)
+	}
+
+	remaining := quota - usage
+	if remaining <= 0 || (declaredSize > 0 && declaredSize > remaining) {
+		return 0, ErrStorageExceeded
+	}
+
+	return remaining, nil
+}
+
+// quotaLimitedReader caps the bytes flowing into an upload to what the
+// account may still store: reads are trimmed to the remaining allowance and
+// ErrStorageExceeded is only returned once a byte beyond it actually arrives,
+// so an upload exactly filling the quota still ends on a clean EOF
+type quotaLimitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *quotaLimitedReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if r.remaining <= 0 {
+		// the allowance is exactly consumed: probe for EOF so an exact-fit
+		// upload succeeds, only actual extra content is refused
+		n, err := r.reader.Read(p[:1])
+		if n > 0 {
+			return 0, ErrStorageExceeded
+		}
+
+		return 0, err
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+
+	return n, err
+}
+
+// notifyTransferError reports a transfer failure to the driver file, wrapped
+// with the phase in which it happened
+func notifyTransferError(file io.ReadWriter, phase TransferPhase, err error) {
+	if fileTransferError, ok := file.(FileTransferError); ok {
+		fileTransferError.TransferError(newTransferError(phase, err))
+	}
+}
+
+func (c *clientHandler) doFileTransfer(
+	transferConn net.Conn, file io.ReadWriter, write bool, sniffPath string,
+	rangeLength, asciiResumeOffset, quotaRemaining, declaredSize int64,
+	uploadDigest hash.Hash,
+) (written int64, err error) {
+	// a driver file panicking mid-copy fails this transfer with a 451, the
+	// close, notification and accounting steps of the caller still run
+	defer c.recoverDriverPanic("data transfer", &err)
+
 	var reader io.Reader
 	var writer io.Writer
 
 	conversionMode := convertModeToCRLF
 
+	// transfers running past this deadline are aborted
+	if maxDuration := c.server.getSettings().MaxTransferDuration; maxDuration > 0 {
+		deadline := time.Now().Add(time.Duration(maxDuration) * time.Second)
+		if errDeadline := transferConn.SetDeadline(deadline); errDeadline != nil {
+			c.logger.Warn(
+				"Could not set the transfer deadline",
+				"err", errDeadline,
+			)
+		}
+	}
+
+	var buffer *uploadBuffer
+
+	// for uploads the bytes coming in on the wire are counted, so what the
+	// file acknowledged can be compared against them once the copy is done
+	var received *countingReader
+
 	// Copy the data
 	if write { // ... from the connection to the file
-		reader = transferConn
+		received = &countingReader{reader: transferConn}
+		reader = &accountedReader{reader: received, handler: c}
 		writer = file
 
+		// the deduplication digest covers exactly the bytes the file accepted
+		if uploadDigest != nil {
+			writer = io.MultiWriter(writer, uploadDigest)
+		}
+
+		// an upload may not move more bytes than the quota leaves
+		if quotaRemaining >= 0 {
+			reader = &quotaLimitedReader{reader: reader, remaining: quotaRemaining}
+		}
+
+		if sniffer, ok := c.driver.(ClientDriverExtensionContentSniffer); ok && sniffPath != "" {
+			reader = &sniffingReader{reader: reader, sniffer: sniffer, path: sniffPath}
+		}
+
+		if size := c.server.getSettings().UploadBufferSize; size > 0 {
+			var notify func(TransferStall)
+
+			if notifier, ok := file.(FileTransferStallNotifier); ok {
+				notify = notifier.TransferStall
+			}
+
+			buffer = newUploadBuffer(writer, size, notify)
+			writer = buffer
+		}
+
 		if runtime.GOOS != "windows" {
 			conversionMode = convertModeToLF
 		}
 	} else { // ... from the file to the connection
 		reader = file
-		writer = transferConn
+		writer = &accountedWriter{writer: transferConn, handler: c}
+	}
+
+	// a RANG range bounds the number of transferred bytes
+	if rangeLength > 0 {
+		reader = io.LimitReader(reader, rangeLength)
 	}
 
 	if c.currentTransferType == TransferTypeASCII {
-		reader = newASCIIConverter(reader, conversionMode)
+		// a resumed download starts at an offset of the converted stream, the
+		// part the client already holds is converted and dropped
+		reader = newASCIIConverterWithOffset(reader, conversionMode, asciiResumeOffset).
+			withChunkSize(c.server.getSettings().ASCIIConversionChunkSize)
 	}
 
 	// for reads io.EOF isn't an error, for writes it must be considered an error
-	if written, errCopy := io.Copy(writer, reader); errCopy != nil && (!errors.Is(errCopy, io.EOF) || write) {
+	var errCopy error
+	written, errCopy = io.Copy(writer, reader)
+
+	// wait for the buffered upload path, if any, to finish draining to the driver
+	if buffer != nil {
+		if errFlush := buffer.Close(); errFlush != nil && errCopy == nil {
+			errCopy = errFlush
+		}
+	}
+
+	// the only deadline set on the data connection is the maximum transfer duration
+	if errCopy != nil && errors.Is(errCopy, os.ErrDeadlineExceeded) {
+		errCopy = ErrTransferDurationExceeded
+	}
+	if errCopy != nil && (!errors.Is(errCopy, io.EOF) || write) {
 		err = errCopy
 	} else {
 		c.logger.Debug(
@@ -159,19 +634,128 @@ func (c *clientHandler) doFileTransfer(transferConn net.Conn, file io.ReadWriter
 		}
 	}
 
-	if err != nil {
-		if fileTransferError, ok := file.(FileTransferError); ok {
-			fileTransferError.TransferError(err)
+	// a binary upload storing fewer bytes than came in on the wire, or than
+	// the size the client declared beforehand, was silently truncated by an
+	// intermediate proxy or a lossy driver and must not pass as a success
+	if err == nil && write && c.currentTransferType == TransferTypeBinary {
+		switch {
+		case written != received.count:
+			err = fmt.Errorf("%w: stored %d of %d received bytes", ErrUploadTruncated, written, received.count)
+		case declaredSize > 0 && written != declaredSize:
+			err = fmt.Errorf("%w: stored %d of %d declared bytes", ErrUploadTruncated, written, declaredSize)
 		}
+	}
+
+	if err != nil {
+		notifyTransferError(file, TransferPhaseData, err)
 
 		err = newNetworkError("error transferring data", err)
 	}
 
-	return err
+	return written, err
+}
+
+// countingReader counts the bytes it lets through, giving the number of
+// bytes actually received on the data connection during an upload
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+
+	return n, err //nolint:wrapcheck // here wrapping errors brings nothing
+}
+
+// accountedReader counts the bytes read from the data connection (uploads)
+type accountedReader struct {
+	reader  io.Reader
+	handler *clientHandler
+}
+
+func (r *accountedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if errAccount := r.handler.accountDataTransfer(true, int64(n)); errAccount != nil && err == nil {
+			err = errAccount
+		}
+	}
+
+	return n, err //nolint:wrapcheck // here wrapping errors brings nothing
+}
+
+// accountedWriter counts the bytes written to the data connection (downloads)
+type accountedWriter struct {
+	writer  io.Writer
+	handler *clientHandler
+}
+
+func (w *accountedWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if n > 0 {
+		if errAccount := w.handler.accountDataTransfer(false, int64(n)); errAccount != nil && err == nil {
+			err = errAccount
+		}
+	}
+
+	return n, err //nolint:wrapcheck // here wrapping errors brings nothing
+}
+
+// contentSniffSize is the maximum number of uploaded bytes submitted to
+// ClientDriverExtensionContentSniffer, aligned with http.DetectContentType
+const contentSniffSize = 512
+
+// sniffingReader collects the first bytes of an upload, submits them to the
+// driver content sniffer and aborts the transfer if the content is rejected
+type sniffingReader struct {
+	reader  io.Reader
+	sniffer ClientDriverExtensionContentSniffer
+	path    string
+	header  []byte
+	sniffed bool
+}
+
+func (r *sniffingReader) Read(dest []byte) (int, error) {
+	if r.sniffed {
+		return r.reader.Read(dest) //nolint:wrapcheck // here wrapping errors brings nothing
+	}
+
+	n, err := r.reader.Read(dest)
+
+	if missing := contentSniffSize - len(r.header); n > 0 && missing > 0 {
+		if missing > n {
+			missing = n
+		}
+
+		r.header = append(r.header, dest[:missing]...)
+	}
+
+	// we sniff as soon as we have enough bytes or when the upload ends first
+	if len(r.header) >= contentSniffSize || err != nil {
+		if errSniff := r.sniff(); errSniff != nil {
+			return n, errSniff
+		}
+	}
+
+	return n, err //nolint:wrapcheck // here wrapping errors brings nothing
+}
+
+func (r *sniffingReader) sniff() error {
+	r.sniffed = true
+
+	if err := r.sniffer.SniffContent(r.path, r.header); err != nil {
+		return fmt.Errorf("%w: %v", ErrContentTypeNotAllowed, err)
+	}
+
+	r.header = nil
+
+	return nil
 }
 
 func (c *clientHandler) handleCOMB(param string) error {
-	if !c.server.settings.EnableCOMB {
+	if !c.server.getSettings().EnableCOMB {
 		// if disabled the client should not arrive here as COMB support is not declared in the FEAT response
 		c.writeMessage(StatusCommandNotImplemented, "COMB support is disabled")
 
@@ -262,6 +846,12 @@ func (c *clientHandler) combineFiles(targetPath string, fileFlag int, sourcePath
 }
 
 func (c *clientHandler) handleCHMOD(params string) {
+	if !c.hasDriverCapability(CapabilityChmod) {
+		c.writeMessage(StatusCommandNotImplemented, "SITE CHMOD is not supported by the storage backend")
+
+		return
+	}
+
 	spl := strings.SplitN(params, " ", 2)
 	modeNb, err := strconv.ParseUint(spl[0], 8, 32)
 
@@ -283,6 +873,12 @@ func (c *clientHandler) handleCHMOD(params string) {
 
 // https://www.raidenftpd.com/en/raiden-ftpd-doc/help-sitecmd.html (wildcard isn't supported)
 func (c *clientHandler) handleCHOWN(params string) {
+	if !c.hasDriverCapability(CapabilityChown) {
+		c.writeMessage(StatusCommandNotImplemented, "SITE CHOWN is not supported by the storage backend")
+
+		return
+	}
+
 	spl := strings.SplitN(params, " ", 3)
 
 	if len(spl) != 2 {
@@ -415,10 +1011,103 @@ func (c *clientHandler) handleSIZE(param string) error {
 	return nil
 }
 
+// limits protecting the DSIZ recursive-walk fallback from unbounded trees
+const (
+	dsizWalkMaxDepth = 32
+	dsizWalkTimeout  = 30 * time.Second
+)
+
+var errDSIZWalkLimit = errors.New("directory walk exceeded its depth or time budget")
+
+func (c *clientHandler) handleDSIZ(param string) error {
+	dirPath := c.absPath(param)
+
+	info, err := c.driver.Stat(dirPath)
+	if err != nil {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't access %s: %v", dirPath, err))
+
+		return nil
+	}
+
+	if !info.IsDir() {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("%s: Not a directory", dirPath))
+
+		return nil
+	}
+
+	var size int64
+
+	if dirSize, ok := c.driver.(ClientDriverExtensionDirSize); ok {
+		size, err = dirSize.DirSize(dirPath)
+	} else if c.server.getSettings().EnableDSIZWalkFallback {
+		size, err = c.walkDirSize(dirPath, 0, time.Now().Add(dsizWalkTimeout))
+	} else {
+		c.writeMessage(StatusCommandNotImplemented, "DSIZ is not supported by the storage backend")
+
+		return nil
+	}
+
+	if err != nil {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't compute directory size: %v", err))
+
+		return nil
+	}
+
+	c.writeMessage(StatusFileStatus, strconv.FormatInt(size, 10))
+
+	return nil
+}
+
+// walkDirSize adds up the sizes of the files below dirPath, giving up with
+// errDSIZWalkLimit when the tree is deeper than dsizWalkMaxDepth or the
+// deadline is crossed
+func (c *clientHandler) walkDirSize(dirPath string, depth int, deadline time.Time) (int64, error) {
+	if depth > dsizWalkMaxDepth || time.Now().After(deadline) {
+		return 0, errDSIZWalkLimit
+	}
+
+	var files []os.FileInfo
+	var err error
+
+	if fileList, ok := c.driver.(ClientDriverExtensionFileList); ok {
+		files, err = fileList.ReadDir(dirPath)
+	} else {
+		directory, errOpen := c.driver.Open(dirPath)
+		if errOpen != nil {
+			return 0, newFileAccessError("couldn't open directory", errOpen)
+		}
+
+		files, err = directory.Readdir(-1)
+
+		c.closeDirectory(dirPath, directory)
+	}
+
+	if err != nil {
+		return 0, newFileAccessError("couldn't list directory", err)
+	}
+
+	var total int64
+
+	for _, file := range files {
+		if file.IsDir() {
+			size, errWalk := c.walkDirSize(path.Join(dirPath, file.Name()), depth+1, deadline)
+			if errWalk != nil {
+				return 0, errWalk
+			}
+
+			total += size
+		} else {
+			total += file.Size()
+		}
+	}
+
+	return total, nil
+}
+
 func (c *clientHandler) handleSTATFile(param string) error {
-	path := c.absPath(param)
+	statPath := c.absPath(param)
 
-	info, err := c.driver.Stat(path)
+	info, err := c.driver.Stat(statPath)
 	if err != nil {
 		c.writeMessage(StatusFileActionNotTaken, fmt.Sprintf("Could not STAT: %v", err))
 
@@ -428,7 +1117,7 @@ func (c *clientHandler) handleSTATFile(param string) error {
 	if !info.IsDir() {
 		defer c.multilineAnswer(StatusFileStatus, fmt.Sprintf("STAT %v", param))()
 
-		c.writeLine(" " + c.fileStat(info))
+		c.writeLine(" " + c.fileStat(info, statPath))
 
 		return nil
 	}
@@ -457,7 +1146,7 @@ func (c *clientHandler) handleSTATFile(param string) error {
 		defer c.multilineAnswer(StatusDirectoryStatus, fmt.Sprintf("STAT %v", param))()
 
 		for _, f := range files {
-			c.writeLine(" %s" + c.fileStat(f))
+			c.writeLine(" %s" + c.fileStat(f, path.Join(directoryPath, f.Name())))
 		}
 	} else {
 		c.writeMessage(StatusFileActionNotTaken, fmt.Sprintf("Could not list: %v", errList))
@@ -467,7 +1156,7 @@ func (c *clientHandler) handleSTATFile(param string) error {
 }
 
 func (c *clientHandler) handleMLST(param string) error {
-	if c.server.settings.DisableMLST {
+	if c.server.getSettings().DisableMLST {
 		c.writeMessage(StatusSyntaxErrorNotRecognised, "MLST has been disabled")
 
 		return nil
@@ -481,7 +1170,7 @@ func (c *clientHandler) handleMLST(param string) error {
 
 		// Each MLSx entry must start with a space when returned in a multiline answer
 		if err = c.writer.WriteByte(' '); err == nil {
-			err = c.writeMLSxEntry(c.writer, info)
+			err = c.writeMLSxEntry(c.writer, path, info)
 		}
 	} else {
 		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Could not list: %v", err))
@@ -500,8 +1189,19 @@ func (c *clientHandler) handleALLO(param string) error {
 		return nil
 	}
 
+	// the announced size also feeds the quota check of the upload to come
+	c.alloSize = int64(size)
+
 	if alloInt, ok := c.driver.(ClientDriverExtensionAllocate); !ok {
-		c.writeMessage(StatusNotImplemented, "This extension hasn't been implemented !")
+		// quota and deduplication both consume the announced size
+		_, okQuota := c.driver.(ClientDriverExtensionQuota)
+		_, okDedup := c.driver.(ClientDriverExtensionUploadDeduplicator)
+
+		if okQuota || okDedup {
+			c.writeMessage(StatusOK, "Size noted")
+		} else {
+			c.writeMessage(StatusNotImplemented, "This extension hasn't been implemented !")
+		}
 	} else {
 		if errAllocate := alloInt.AllocateSpace(size); errAllocate != nil {
 			c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't alloInt: %v", errAllocate))
@@ -516,12 +1216,18 @@ func (c *clientHandler) handleALLO(param string) error {
 func (c *clientHandler) handleREST(param string) error {
 	if size, err := strconv.ParseInt(param, 10, 0); err == nil {
 		if c.currentTransferType == TransferTypeASCII {
-			c.writeMessage(StatusSyntaxErrorParameters, "Resuming transfers not allowed in ASCII mode")
+			if !c.server.getSettings().AllowASCIIResume {
+				c.writeMessage(StatusSyntaxErrorParameters, "Resuming transfers not allowed in ASCII mode")
 
-			return nil
+				return nil
+			}
+
+			// the offset applies to the converted stream, the next transfer
+			// cannot simply seek the stored file to it
+			c.resume.asciiOffset = true
 		}
 
-		c.ctxRest = size
+		c.resume.restOffset = size
 		c.writeMessage(StatusFileActionPending, "OK")
 	} else {
 		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't parse size: %v", err))
@@ -530,6 +1236,52 @@ func (c *clientHandler) handleREST(param string) error {
 	return nil
 }
 
+// handleRANG handles the RANG command (draft-bryan-ftp-range), setting the
+// byte range the next RETR or STOR applies to. The positions are 1-based and
+// inclusive, "RANG 1 0" resets a previously set range
+func (c *clientHandler) handleRANG(param string) error {
+	if c.currentTransferType == TransferTypeASCII {
+		c.writeMessage(StatusSyntaxErrorParameters, "Range transfers are not allowed in ASCII mode")
+
+		return nil
+	}
+
+	params := strings.Fields(param)
+	if len(params) != 2 {
+		c.writeMessage(StatusSyntaxErrorParameters, "RANG needs a start and an end position")
+
+		return nil
+	}
+
+	start, errStart := strconv.ParseInt(params[0], 10, 64)
+	end, errEnd := strconv.ParseInt(params[1], 10, 64)
+
+	if errStart != nil || errEnd != nil {
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("Couldn't parse range %#v", param))
+
+		return nil
+	}
+
+	if start == 1 && end == 0 {
+		c.resume.rangeStart, c.resume.rangeLength = 0, 0
+		c.writeMessage(StatusFileActionPending, "Range reset")
+
+		return nil
+	}
+
+	if start < 1 || end < start {
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("Invalid range %d-%d", start, end))
+
+		return nil
+	}
+
+	c.resume.rangeStart = start - 1
+	c.resume.rangeLength = end - start + 1
+	c.writeMessage(StatusFileActionPending, fmt.Sprintf("Restarting at %d. End byte range at %d", start, end))
+
+	return nil
+}
+
 func (c *clientHandler) handleMDTM(param string) error {
 	path := c.absPath(param)
 	if info, err := c.driver.Stat(path); err == nil {
@@ -541,8 +1293,33 @@ func (c *clientHandler) handleMDTM(param string) error {
 	return nil
 }
 
+// parseMFMTTime parses the time-val sent by the client. RFC 3659 defines it as
+// "YYYYMMDDHHMMSS" in UTC with an optional fractional part (time.Parse accepts
+// the fraction even when the layout doesn't declare it); several clients also
+// append a timezone suffix, which is honored before mapping the result to UTC
+func parseMFMTTime(value string) (time.Time, error) {
+	mtime, err := time.Parse(dateFormatMLSD, value)
+	if err == nil {
+		return mtime, nil
+	}
+
+	for _, layout := range []string{dateFormatMLSD + "Z0700", dateFormatMLSD + "Z07:00"} {
+		if zoned, errZoned := time.Parse(layout, value); errZoned == nil {
+			return zoned.UTC(), nil
+		}
+	}
+
+	return time.Time{}, err //nolint:wrapcheck // the time.Parse error already says it all
+}
+
 // RFC draft: https://tools.ietf.org/html/draft-somers-ftp-mfxx-04#section-3.1
 func (c *clientHandler) handleMFMT(param string) error {
+	if !c.hasDriverCapability(CapabilityChtimes) {
+		c.writeMessage(StatusCommandNotImplemented, "MFMT is not supported by the storage backend")
+
+		return nil
+	}
+
 	params := strings.SplitN(param, " ", 2)
 	if len(params) != 2 {
 		c.writeMessage(StatusSyntaxErrorNotRecognised,
@@ -552,7 +1329,7 @@ func (c *clientHandler) handleMFMT(param string) error {
 		return nil
 	}
 
-	mtime, err := time.Parse("20060102150405", params[0])
+	mtime, err := parseMFMTTime(params[0])
 	if err != nil {
 		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf(
 			"Couldn't parse mtime, given: %s, err: %v", params[0], err))
@@ -574,6 +1351,147 @@ func (c *clientHandler) handleMFMT(param string) error {
 	return nil
 }
 
+// MFCT is the creation-time sibling of MFMT, from the same draft. It needs
+// the ClientDriverExtensionSetCTime extension of the client driver
+func (c *clientHandler) handleMFCT(param string) error {
+	setCTime, ok := c.driver.(ClientDriverExtensionSetCTime)
+	if !ok {
+		c.writeMessage(StatusCommandNotImplemented, "MFCT is not supported by the storage backend")
+
+		return nil
+	}
+
+	params := strings.SplitN(param, " ", 2)
+	if len(params) != 2 {
+		c.writeMessage(StatusSyntaxErrorNotRecognised,
+			"Couldn't set ctime, not enough params, given: "+param,
+		)
+
+		return nil
+	}
+
+	ctime, err := parseMFMTTime(params[0])
+	if err != nil {
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf(
+			"Couldn't parse ctime, given: %s, err: %v", params[0], err))
+
+		return nil
+	}
+
+	path := c.absPath(params[1])
+
+	if err := setCTime.SetCTime(path, ctime); err != nil {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf(
+			"Couldn't set ctime %q for %q, err: %v", ctime.Format(time.RFC3339), path, err))
+
+		return nil
+	}
+
+	c.writeMessage(StatusFileStatus, fmt.Sprintf("Create=%s; %s", params[0], params[1]))
+
+	return nil
+}
+
+// handleSITEUTIME sets file times for the many deployment tools issuing
+// "SITE UTIME" instead of MFMT. Both historical forms are accepted: the
+// two-argument "<mtime> <path>" one, and the five-argument
+// "<path> <atime> <mtime> <ctime> UTC" one
+func (c *clientHandler) handleSITEUTIME(params string) {
+	if !c.hasDriverCapability(CapabilityChtimes) {
+		c.writeMessage(StatusCommandNotImplemented, "SITE UTIME is not supported by the storage backend")
+
+		return
+	}
+
+	tokens := strings.Fields(params)
+
+	if len(tokens) >= 5 && strings.EqualFold(tokens[len(tokens)-1], "UTC") {
+		c.handleSITEUTIMELong(params, tokens)
+
+		return
+	}
+
+	spl := strings.SplitN(params, " ", 2)
+	if len(spl) != 2 {
+		c.writeMessage(StatusSyntaxErrorParameters, "Couldn't set times, not enough params, given: "+params)
+
+		return
+	}
+
+	mtime, err := parseMFMTTime(spl[0])
+	if err != nil {
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf(
+			"Couldn't parse mtime, given: %s, err: %v", spl[0], err))
+
+		return
+	}
+
+	path := c.absPath(spl[1])
+
+	if err := c.driver.Chtimes(path, mtime, mtime); err != nil {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf(
+			"Couldn't set mtime %q for %q, err: %v", mtime.Format(time.RFC3339), path, err))
+
+		return
+	}
+
+	c.writeMessage(StatusOK, "UTIME OK")
+}
+
+// handleSITEUTIMELong handles the five-argument "SITE UTIME" form. The path
+// comes first and keeps any space it contains, the access, modification and
+// creation times follow, with a literal "UTC" keyword closing the line. The
+// creation time is only honored when the driver can set one
+func (c *clientHandler) handleSITEUTIMELong(params string, tokens []string) {
+	// the path is what remains of the line once the four last tokens are
+	// trimmed away
+	filePath := strings.TrimRight(params, " ")
+	for i := 0; i < 4; i++ {
+		filePath = strings.TrimRight(filePath[:strings.LastIndex(filePath, " ")], " ")
+	}
+
+	if filePath == "" {
+		c.writeMessage(StatusSyntaxErrorParameters, "Couldn't set times, missing path, given: "+params)
+
+		return
+	}
+
+	times := make([]time.Time, 3)
+
+	for i, token := range tokens[len(tokens)-4 : len(tokens)-1] {
+		parsed, err := parseMFMTTime(token)
+		if err != nil {
+			c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf(
+				"Couldn't parse time, given: %s, err: %v", token, err))
+
+			return
+		}
+
+		times[i] = parsed
+	}
+
+	atime, mtime, ctime := times[0], times[1], times[2]
+	path := c.absPath(filePath)
+
+	if err := c.driver.Chtimes(path, atime, mtime); err != nil {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf(
+			"Couldn't set times for %q, err: %v", path, err))
+
+		return
+	}
+
+	if setCTime, ok := c.driver.(ClientDriverExtensionSetCTime); ok {
+		if err := setCTime.SetCTime(path, ctime); err != nil {
+			c.writeMessage(StatusActionNotTaken, fmt.Sprintf(
+				"Couldn't set ctime %q for %q, err: %v", ctime.Format(time.RFC3339), path, err))
+
+			return
+		}
+	}
+
+	c.writeMessage(StatusOK, "UTIME OK")
+}
+
 func (c *clientHandler) handleHASH(param string) error {
 	return c.handleGenericHash(param, c.selectedHashAlgo, false)
 }
@@ -599,7 +1517,7 @@ func (c *clientHandler) handleSHA512(param string) error {
 }
 
 func (c *clientHandler) handleGenericHash(param string, algo HASHAlgo, isCustomMode bool) error {
-	if !c.server.settings.EnableHASH {
+	if !c.server.getSettings().EnableHASH {
 		// if disabled the client should not arrive here as HASH support is not declared in the FEAT response
 		c.writeMessage(StatusCommandNotImplemented, "File hash support is disabled")
 
@@ -629,15 +1547,19 @@ func (c *clientHandler) handleGenericHash(param string, algo HASHAlgo, isCustomM
 	start := int64(0)
 	end := info.Size()
 
-	// to support partial hash also for the HASH command, we should implement RANG,
-	// but it applies also to uploads/downloads and so it complicates their handling,
-	// we'll add this support in future improvements
 	if isCustomMode {
+		// the non-standard commands carry the range in their parameters
 		if err = getPartialHASHRange(args, &start, &end); err != nil {
 			c.writeMessage(StatusSyntaxErrorParameters, err.Error())
 
 			return nil
 		}
+	} else if c.resume.hasRange() {
+		// HASH hashes the range set through RANG and, as for transfers,
+		// consumes it
+		start = c.resume.rangeStart
+		end = start + c.resume.rangeLength
+		c.resume.rangeStart, c.resume.rangeLength = 0, 0
 	}
 
 	var result string
@@ -711,7 +1633,9 @@ func (c *clientHandler) computeHashForFile(filePath string, algo HASHAlgo, start
 	return hex.EncodeToString(chosenHashAlgo.Sum(nil)), nil
 }
 
-func (c *clientHandler) getFileHandle(name string, flags int, offset int64) (FileTransfer, error) {
+func (c *clientHandler) getFileHandle(name string, flags int, offset int64) (_ FileTransfer, err error) {
+	defer c.recoverDriverPanic("opening "+name, &err)
+
 	if fileTransfer, ok := c.driver.(ClientDriverExtentionFileTransfer); ok {
 		ft, err := fileTransfer.GetHandle(name, flags, offset)
 		if err != nil {
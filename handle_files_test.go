@@ -10,9 +10,13 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -200,6 +204,78 @@ func TestCHOWN(t *testing.T) {
 	require.Equal(t, StatusSyntaxErrorParameters, returnCode, "Should NOT have been accepted")
 }
 
+// limitedCapabilitiesServerDriver hands out client drivers that only support
+// the configured optional afero features
+type limitedCapabilitiesServerDriver struct {
+	TestServerDriver
+	capabilities DriverCapabilities
+}
+
+func (driver *limitedCapabilitiesServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &limitedCapabilitiesClientDriver{ClientDriver: clientDriver, capabilities: driver.capabilities}, nil
+}
+
+type limitedCapabilitiesClientDriver struct {
+	ClientDriver
+	capabilities DriverCapabilities
+}
+
+func (driver *limitedCapabilitiesClientDriver) GetCapabilities() DriverCapabilities {
+	return driver.capabilities
+}
+
+func TestDriverCapabilities(t *testing.T) {
+	driver := &limitedCapabilitiesServerDriver{capabilities: CapabilityChmod}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// commands backed by a missing capability are refused right away
+	returnCode, response, err := raw.SendCommand("MFMT 20201209211059 file")
+	require.NoError(t, err)
+	require.Equal(t, StatusCommandNotImplemented, returnCode, response)
+
+	returnCode, response, err = raw.SendCommand("SITE CHOWN 1000 file")
+	require.NoError(t, err)
+	require.Equal(t, StatusCommandNotImplemented, returnCode, response)
+
+	// the supported chmod is still attempted, the file simply doesn't exist
+	returnCode, _, err = raw.SendCommand("SITE CHMOD 600 file")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, returnCode)
+
+	// FEAT no longer advertises MFMT ...
+	returnCode, response, err = raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, returnCode)
+	require.NotContains(t, response, "MFMT")
+
+	// ... and SITE HELP hides CHOWN
+	returnCode, response, err = raw.SendCommand("SITE HELP")
+	require.NoError(t, err)
+	require.Equal(t, StatusHelpMessage, returnCode)
+	require.Contains(t, response, "CHMOD")
+	require.NotContains(t, response, "CHOWN")
+}
+
 func TestMFMT(t *testing.T) {
 	server := NewTestServerWithTestDriver(t, &TestServerDriver{
 		Debug: false,
@@ -232,6 +308,26 @@ func TestMFMT(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, StatusFileStatus, returnCode, "Should have succeeded")
 
+	// Millisecond precision
+	returnCode, _, err = raw.SendCommand("MFMT 20201209211059.123 file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, returnCode, "Should have succeeded")
+
+	// Timezone suffix, mapped to UTC before being applied
+	returnCode, _, err = raw.SendCommand("MFMT 20201209211059+0200 file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, returnCode, "Should have succeeded")
+
+	returnCode, response, err := raw.SendCommand("MDTM file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, returnCode)
+	require.Equal(t, "20201209191059", response)
+
+	// Zulu suffix combined with a fractional part
+	returnCode, _, err = raw.SendCommand("MFMT 20201209211059.123Z file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, returnCode, "Should have succeeded")
+
 	// 3 params instead of 2
 	returnCode, _, err = raw.SendCommand("MFMT 20201209211059 file somethingelse")
 	require.NoError(t, err)
@@ -300,13 +396,13 @@ func TestSYMLINK(t *testing.T) {
 	require.Equal(t, StatusActionNotTaken, returnCode, "Should have been refused")
 
 	// disable SITE
-	server.settings.DisableSite = true
+	mustSwapSettings(server, func(settings *Settings) { settings.DisableSite = true })
 
 	returnCode, _, err = raw.SendCommand("SITE SYMLINK file test")
 	require.NoError(t, err)
 	require.Equal(t, StatusSyntaxErrorNotRecognised, returnCode, "Should have been refused")
 
-	server.settings.DisableSite = false
+	mustSwapSettings(server, func(settings *Settings) { settings.DisableSite = false })
 
 	// Good symlink
 	returnCode, _, err = raw.SendCommand("SITE SYMLINK file test")
@@ -397,6 +493,153 @@ func TestMLST(t *testing.T) {
 	}
 }
 
+// mlsxFactsServerDriver hands out client drivers announcing extra MLSx facts
+type mlsxFactsServerDriver struct {
+	TestServerDriver
+}
+
+func (driver *mlsxFactsServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mlsxFactsClientDriver{ClientDriver: clientDriver}, nil
+}
+
+type mlsxFactsClientDriver struct {
+	ClientDriver
+}
+
+func (driver *mlsxFactsClientDriver) GetExtraMLSxFacts(_ string, info os.FileInfo) map[string]string {
+	perm := "r"
+	if info.IsDir() {
+		perm = "el"
+	}
+
+	return map[string]string{
+		"Perm":      perm,
+		"UNIX.mode": fmt.Sprintf("%04o", info.Mode().Perm()),
+	}
+}
+
+func TestMLSxFacts(t *testing.T) {
+	req := require.New(t)
+	driver := &mlsxFactsServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	req.NoError(err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	// Creating a tiny file
+	ftpUpload(t, client, createTemporaryFile(t, 10), "file")
+
+	raw, err := client.OpenRawConn()
+	req.NoError(err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the driver facts show up next to the built-in ones
+	returnCode, response, err := raw.SendCommand("MLST file")
+	req.NoError(err)
+	req.Equal(StatusFileOK, returnCode)
+	req.Contains(response, "Perm=r;")
+	req.Contains(response, "UNIX.mode=")
+
+	// the client narrows the selection ...
+	returnCode, response, err = raw.SendCommand("OPTS MLST type;perm;")
+	req.NoError(err)
+	req.Equal(StatusOK, returnCode)
+	req.Contains(response, "MLST OPTS type;perm;")
+
+	// ... and only the selected facts remain
+	returnCode, response, err = raw.SendCommand("MLST file")
+	req.NoError(err)
+	req.Equal(StatusFileOK, returnCode)
+	req.Contains(response, "Type=file;Perm=r; file")
+	req.NotContains(response, "Size=")
+	req.NotContains(response, "Modify=")
+}
+
+// longFactsServerDriver hands out client drivers producing a fact far longer
+// than any reasonable reply line
+type longFactsServerDriver struct {
+	TestServerDriver
+}
+
+func (driver *longFactsServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &longFactsClientDriver{ClientDriver: clientDriver}, nil
+}
+
+type longFactsClientDriver struct {
+	ClientDriver
+}
+
+func (driver *longFactsClientDriver) GetExtraMLSxFacts(_ string, _ os.FileInfo) map[string]string {
+	return map[string]string{"X.blob": strings.Repeat("b", 2000)}
+}
+
+func TestMaxReplyLineLength(t *testing.T) {
+	req := require.New(t)
+	driver := &longFactsServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	req.NoError(err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	ftpUpload(t, client, createTemporaryFile(t, 10), "file")
+
+	raw, err := client.OpenRawConn()
+	req.NoError(err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// without a bound the huge fact goes through untouched
+	returnCode, response, err := raw.SendCommand("MLST file")
+	req.NoError(err)
+	req.Equal(StatusFileOK, returnCode)
+	req.Contains(response, "X.blob="+strings.Repeat("b", 2000))
+
+	mustSwapSettings(server, func(settings *Settings) { settings.MaxReplyLineLength = 256 })
+
+	// the entry sheds its oversized fact instead of overflowing the bound,
+	// the built-in facts and the name stay
+	returnCode, response, err = raw.SendCommand("MLST file")
+	req.NoError(err)
+	req.Equal(StatusFileOK, returnCode)
+	req.NotContains(response, "X.blob")
+	req.Contains(response, "Type=file;")
+	req.Contains(response, " file")
+
+	// a long plain reply is folded over several lines, nothing is lost
+	longPath := strings.Repeat("z", 1000)
+	returnCode, response, err = raw.SendCommand("MLST " + longPath)
+	req.NoError(err)
+	req.Equal(StatusActionNotTaken, returnCode)
+	req.Equal(1000, strings.Count(response, "z"), "The folded reply should carry the whole path")
+
+	for _, line := range strings.Split(response, "\n") {
+		req.LessOrEqual(len(line), 256, "No folded line should exceed the bound")
+	}
+}
+
 func TestMDTM(t *testing.T) {
 	s := NewTestServer(t, false)
 	conf := goftp.Config{
@@ -614,7 +857,7 @@ func TestHashWithoutParams(t *testing.T) {
 
 func TestCustomHASHCommands(t *testing.T) {
 	server := NewTestServer(t, false)
-	server.settings.EnableHASH = true
+	mustSwapSettings(server, func(settings *Settings) { settings.EnableHASH = true })
 	conf := goftp.Config{
 		User:     authUser,
 		Password: authPass,
@@ -690,7 +933,7 @@ func TestCOMB(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, StatusCommandNotImplemented, returnCode, message)
 
-	server.settings.EnableCOMB = true
+	mustSwapSettings(server, func(settings *Settings) { settings.EnableCOMB = true })
 
 	var parts []*os.File
 
@@ -798,7 +1041,7 @@ func TestCOMBCloseError(t *testing.T) {
 		User:     authUser,
 		Password: authPass,
 	}
-	server.settings.EnableCOMB = true
+	mustSwapSettings(server, func(settings *Settings) { settings.EnableCOMB = true })
 
 	client, err := goftp.DialConfig(conf, server.Addr())
 	require.NoError(t, err, "Couldn't connect")
@@ -899,7 +1142,7 @@ func TestCOMBErrors(t *testing.T) {
 		Password: authPass,
 	}
 
-	server.settings.EnableCOMB = true
+	mustSwapSettings(server, func(settings *Settings) { settings.EnableCOMB = true })
 
 	client, err := goftp.DialConfig(conf, server.Addr())
 	require.NoError(t, err, "Couldn't connect")
@@ -991,3 +1234,732 @@ func getKnownHASHMappings() map[string]string {
 
 	return knownHASHMapping
 }
+
+// quotaServerDriver hands out client drivers enforcing a fixed storage quota
+type quotaServerDriver struct {
+	TestServerDriver
+	quota int64
+	usage int64 // reported storage usage (atomic access)
+}
+
+func (driver *quotaServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &quotaClientDriver{ClientDriver: clientDriver, server: driver}, nil
+}
+
+type quotaClientDriver struct {
+	ClientDriver
+	server *quotaServerDriver
+}
+
+func (driver *quotaClientDriver) GetUsage() (int64, error) {
+	return atomic.LoadInt64(&driver.server.usage), nil
+}
+
+func (driver *quotaClientDriver) GetQuota() (int64, error) {
+	return driver.server.quota, nil
+}
+
+func TestStorageQuota(t *testing.T) {
+	driver := &quotaServerDriver{quota: 500}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	// a file that fits goes through untouched
+	ftpUpload(t, client, createTemporaryFile(t, 100), "small.bin")
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// an upload bigger than what remains is cut off at the limit
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw.SendCommand("STOR big.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	// the server stops reading at the limit, the write errors depend on timing
+	_, _ = dataConn.Write(make([]byte, 1000))
+	_ = dataConn.Close()
+
+	returnCode, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusActionAborted, returnCode, response)
+
+	info, err := driver.fs.Stat("/big.bin")
+	require.NoError(t, err)
+	require.Equal(t, int64(500), info.Size(), "The stored file should stop at the quota")
+
+	// a size announced through ALLO that does not fit is refused before the
+	// transfer even opens
+	returnCode, response, err = raw.SendCommand("ALLO 600")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode, response)
+
+	returnCode, response, err = raw.SendCommand("STOR refused.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionAborted, returnCode, response)
+
+	// an upload exactly filling what remains is legal
+	atomic.StoreInt64(&driver.usage, driver.quota-100)
+	ftpUpload(t, client, createTemporaryFile(t, 100), "exact.bin")
+
+	info, err = driver.fs.Stat("/exact.bin")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), info.Size(), "The exact-fit file should be stored whole")
+
+	// with the quota fully used even a small upload is refused up front
+	atomic.StoreInt64(&driver.usage, driver.quota)
+
+	returnCode, response, err = raw.SendCommand("STOR refused-again.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionAborted, returnCode, response)
+}
+
+func TestAtomicUploads(t *testing.T) {
+	driver := &TestServerDriver{
+		Settings: &Settings{EnableAtomicUploads: true},
+	}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw.SendCommand("STOR pending.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = dataConn.Write([]byte("first half"))
+	require.NoError(t, err)
+
+	// while the transfer is running the data lives under the temporary name
+	entries, err := afero.ReadDir(driver.fs, "/")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.True(t, isUploadTempName(entries[0].Name()), "The upload should use the temporary naming convention")
+
+	// other sessions polling the directory never see the temporary name
+	observer, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(observer.Close()) }()
+
+	listed, err := observer.ReadDir("/")
+	require.NoError(t, err)
+	require.Empty(t, listed, "The in-progress upload should be hidden from listings")
+
+	// the driver sees the upload in progress through the client context
+	inProgress := make([]string, 0, 1)
+
+	for _, cltContext := range driver.Clients {
+		inProgress = append(inProgress, cltContext.GetInProgressUploads()...)
+	}
+
+	require.Equal(t, []string{"/pending.bin"}, inProgress)
+
+	_, err = dataConn.Write([]byte(" second half"))
+	require.NoError(t, err)
+	require.NoError(t, dataConn.Close())
+
+	returnCode, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode, response)
+
+	// once complete the file shows up under its final name only
+	listed, err = observer.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	require.Equal(t, "pending.bin", listed[0].Name())
+
+	info, err := driver.fs.Stat("/pending.bin")
+	require.NoError(t, err)
+	require.Equal(t, int64(len("first half second half")), info.Size())
+
+	for _, cltContext := range driver.Clients {
+		require.Empty(t, cltContext.GetInProgressUploads())
+	}
+}
+
+// dirSizeServerDriver hands out client drivers answering DSIZ natively
+type dirSizeServerDriver struct {
+	TestServerDriver
+}
+
+func (driver *dirSizeServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dirSizeClientDriver{ClientDriver: clientDriver}, nil
+}
+
+type dirSizeClientDriver struct {
+	ClientDriver
+}
+
+func (driver *dirSizeClientDriver) DirSize(_ string) (int64, error) {
+	return 4242, nil
+}
+
+func TestDSIZ(t *testing.T) {
+	server := NewTestServer(t, false)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	ftpUpload(t, client, createTemporaryFile(t, 100), "a.bin")
+
+	_, err = client.Mkdir("/sub")
+	require.NoError(t, err)
+
+	content := createTemporaryFile(t, 200)
+	_, err = content.Seek(0, 0)
+	require.NoError(t, err)
+	require.NoError(t, client.Store("/sub/b.bin", content))
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// without the extension nor the fallback, the command is refused
+	returnCode, response, err := raw.SendCommand("DSIZ /")
+	require.NoError(t, err)
+	require.Equal(t, StatusCommandNotImplemented, returnCode, response)
+
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.EnableDSIZWalkFallback = true
+	})
+
+	returnCode, response, err = raw.SendCommand("DSIZ /")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, returnCode, response)
+	require.Equal(t, "300", response)
+
+	returnCode, response, err = raw.SendCommand("DSIZ /sub")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, returnCode, response)
+	require.Equal(t, "200", response)
+
+	returnCode, _, err = raw.SendCommand("DSIZ /a.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, returnCode)
+
+	returnCode, _, err = raw.SendCommand("DSIZ /missing")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, returnCode)
+}
+
+func TestDSIZExtension(t *testing.T) {
+	driver := &dirSizeServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, response, err := raw.SendCommand("DSIZ /")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, returnCode, response)
+	require.Equal(t, "4242", response)
+}
+
+// ctimeServerDriver hands out client drivers accepting creation time updates
+type ctimeServerDriver struct {
+	TestServerDriver
+	lastCTimePath string
+	lastCTime     time.Time
+}
+
+func (driver *ctimeServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ctimeClientDriver{ClientDriver: clientDriver, server: driver}, nil
+}
+
+type ctimeClientDriver struct {
+	ClientDriver
+	server *ctimeServerDriver
+}
+
+func (driver *ctimeClientDriver) SetCTime(name string, ctime time.Time) error {
+	driver.server.fileMU.Lock()
+	defer driver.server.fileMU.Unlock()
+
+	driver.server.lastCTimePath = name
+	driver.server.lastCTime = ctime
+
+	return nil
+}
+
+func TestSITEUTIME(t *testing.T) {
+	server := NewTestServer(t, false)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	ftpUpload(t, client, createTemporaryFile(t, 10), "file")
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// two-argument form
+	returnCode, response, err := raw.SendCommand("SITE UTIME 20201209211059 file")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode, response)
+
+	stats, err := client.Stat("file")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2020, 12, 9, 21, 10, 59, 0, time.UTC), stats.ModTime().UTC())
+
+	// five-argument form
+	returnCode, response, err = raw.SendCommand("SITE UTIME file 20201011121314 20211011121314 20221011121314 UTC")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode, response)
+
+	stats, err = client.Stat("file")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2021, 10, 11, 12, 13, 14, 0, time.UTC), stats.ModTime().UTC())
+
+	// broken timestamp
+	returnCode, _, err = raw.SendCommand("SITE UTIME meh file")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode)
+
+	// missing path
+	returnCode, _, err = raw.SendCommand("SITE UTIME 20201209211059")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode)
+
+	// missing file
+	returnCode, _, err = raw.SendCommand("SITE UTIME 20201209211059 missing")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, returnCode)
+}
+
+func TestMFCT(t *testing.T) {
+	driver := &ctimeServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	ftpUpload(t, client, createTemporaryFile(t, 10), "file")
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, response, err := raw.SendCommand("MFCT 20201209211059 file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, returnCode, response)
+	require.Equal(t, "Create=20201209211059; file", response)
+
+	driver.fileMU.Lock()
+	require.Equal(t, "/file", driver.lastCTimePath)
+	require.Equal(t, time.Date(2020, 12, 9, 21, 10, 59, 0, time.UTC), driver.lastCTime.UTC())
+	driver.fileMU.Unlock()
+
+	returnCode, _, err = raw.SendCommand("MFCT meh file")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode)
+
+	returnCode, response, err = raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, returnCode)
+	require.Contains(t, response, "MFCT")
+}
+
+func TestMFCTUnsupported(t *testing.T) {
+	server := NewTestServer(t, false)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, _, err := raw.SendCommand("MFCT 20201209211059 file")
+	require.NoError(t, err)
+	require.Equal(t, StatusCommandNotImplemented, returnCode)
+}
+
+func TestEmptyUpload(t *testing.T) {
+	driver := &TestServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	storEmptyFile := func(fileName string) (int, string) {
+		dcGetter, errPrep := raw.PrepareDataConn()
+		require.NoError(t, errPrep)
+
+		returnCode, response, errStor := raw.SendCommand("STOR " + fileName)
+		require.NoError(t, errStor)
+		require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+		dataConn, errConn := dcGetter()
+		require.NoError(t, errConn)
+		require.NoError(t, dataConn.Close())
+
+		returnCode, response, errStor = raw.ReadResponse()
+		require.NoError(t, errStor)
+
+		return returnCode, response
+	}
+
+	// a zero-byte upload leaves an empty file behind
+	returnCode, response := storEmptyFile("empty.bin")
+	require.Equal(t, StatusClosingDataConn, returnCode, response)
+
+	info, err := driver.fs.Stat("/empty.bin")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size())
+
+	// with RejectEmptyUploads the same upload is refused and nothing stays
+	// behind
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.RejectEmptyUploads = true
+	})
+
+	returnCode, response = storEmptyFile("rejected.bin")
+	require.Equal(t, StatusActionAborted, returnCode, response)
+
+	_, err = driver.fs.Stat("/rejected.bin")
+	require.Error(t, err)
+
+	// non-empty uploads are not affected
+	ftpUpload(t, client, createTemporaryFile(t, 10), "kept.bin")
+
+	// the rejection also covers atomic uploads, whose temporary file goes
+	// away with the failed transfer
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.EnableAtomicUploads = true
+	})
+
+	returnCode, response = storEmptyFile("rejected-atomic.bin")
+	require.Equal(t, StatusActionAborted, returnCode, response)
+
+	files, err := afero.ReadDir(driver.fs, "/")
+	require.NoError(t, err)
+
+	for _, file := range files {
+		require.NotContains(t, file.Name(), "rejected-atomic")
+		require.False(t, isUploadTempName(file.Name()))
+	}
+}
+
+func TestDriverPanicIsolation(t *testing.T) {
+	server := NewTestServer(t, false)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// a panic while opening the file costs the command a 451, not the session
+	returnCode, response, err := raw.SendCommand("STOR panic-on-open.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionAbortedLocalError, returnCode, response)
+	require.Contains(t, response, "driver panic")
+
+	returnCode, _, err = raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+
+	// same for a panic raised mid-transfer by the driver file
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err = raw.SendCommand("STOR panic-on-write.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = dataConn.Write([]byte("some content"))
+	require.NoError(t, err)
+	require.NoError(t, dataConn.Close())
+
+	returnCode, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusActionAbortedLocalError, returnCode, response)
+	require.Contains(t, response, "driver panic")
+
+	// the session survived and can still move files
+	ftpUpload(t, client, createTemporaryFile(t, 1024), "fine.bin")
+}
+
+// dedupServerDriver hands out client drivers deduplicating uploads by
+// content digest, remembering every digest they were asked about
+type dedupServerDriver struct {
+	TestServerDriver
+	state *dedupState
+}
+
+type dedupState struct {
+	mu         sync.Mutex
+	preUploads map[string]int64  // declared size per uploaded path
+	seen       map[string]string // first path stored per digest
+	duplicates []string          // paths discarded as duplicates
+}
+
+func (driver *dedupServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	clientDriver, err := driver.TestServerDriver.AuthUser(cc, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dedupClientDriver{ClientDriver: clientDriver, state: driver.state}, nil
+}
+
+type dedupClientDriver struct {
+	ClientDriver
+	state *dedupState
+}
+
+func (driver *dedupClientDriver) PreUpload(name string, declaredSize int64) error {
+	driver.state.mu.Lock()
+	defer driver.state.mu.Unlock()
+
+	driver.state.preUploads[name] = declaredSize
+
+	return nil
+}
+
+func (driver *dedupClientDriver) IsDuplicateUpload(name string, digest string, _ int64) (bool, error) {
+	driver.state.mu.Lock()
+	defer driver.state.mu.Unlock()
+
+	if _, found := driver.state.seen[digest]; found {
+		driver.state.duplicates = append(driver.state.duplicates, name)
+
+		return true, nil
+	}
+
+	driver.state.seen[digest] = name
+
+	return false, nil
+}
+
+func TestUploadDeduplication(t *testing.T) {
+	req := require.New(t)
+	driver := &dedupServerDriver{state: &dedupState{
+		preUploads: make(map[string]int64),
+		seen:       make(map[string]string),
+	}}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	req.NoError(err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	content := "store this content once"
+
+	err = client.Store("first.bin", strings.NewReader(content))
+	req.NoError(err)
+
+	err = client.Store("second.bin", strings.NewReader(content))
+	req.NoError(err, "A deduplicated upload should still succeed for the client")
+
+	// the first copy is stored for real, the duplicate never materializes
+	_, err = driver.fs.Stat("/first.bin")
+	req.NoError(err)
+	_, err = driver.fs.Stat("/second.bin")
+	req.Error(err, "The duplicate should have been discarded")
+
+	expectedDigest := sha256.Sum256([]byte(content))
+
+	driver.state.mu.Lock()
+	req.Equal([]string{"/second.bin"}, driver.state.duplicates)
+	req.Equal(int64(0), driver.state.preUploads["/first.bin"])
+	req.Equal("/first.bin", driver.state.seen[hex.EncodeToString(expectedDigest[:])])
+	driver.state.mu.Unlock()
+
+	// the size declared through ALLO reaches PreUpload
+	raw, err := client.OpenRawConn()
+	req.NoError(err, "Couldn't open raw connection")
+
+	defer func() { req.NoError(raw.Close()) }()
+
+	returnCode, response, err := raw.SendCommand("ALLO 9")
+	req.NoError(err)
+	req.Equal(StatusOK, returnCode, response)
+
+	ftpUploadWithRawConnection(t, raw, strings.NewReader("new bytes"), "third.bin", false)
+
+	driver.state.mu.Lock()
+	req.Equal(int64(9), driver.state.preUploads["/third.bin"])
+	driver.state.mu.Unlock()
+}
+
+func TestUploadTruncationDetection(t *testing.T) {
+	server := NewTestServer(t, false)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	storWithSize := func(fileName string, sent int) (int, string) {
+		dcGetter, errPrep := raw.PrepareDataConn()
+		require.NoError(t, errPrep)
+
+		returnCode, response, errStor := raw.SendCommand("STOR " + fileName)
+		require.NoError(t, errStor)
+		require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+		dataConn, errConn := dcGetter()
+		require.NoError(t, errConn)
+
+		_, errWrite := dataConn.Write(make([]byte, sent))
+		require.NoError(t, errWrite)
+		require.NoError(t, dataConn.Close())
+
+		returnCode, response, errStor = raw.ReadResponse()
+		require.NoError(t, errStor)
+
+		return returnCode, response
+	}
+
+	// an upload matching its declared size goes through
+	returnCode, response, err := raw.SendCommand("OPTS STOR SIZE=100")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode, response)
+
+	returnCode, response = storWithSize("full.bin", 100)
+	require.Equal(t, StatusClosingDataConn, returnCode, response)
+
+	// an upload cut short of its declared size is flagged
+	returnCode, response, err = raw.SendCommand("ALLO 100")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode, response)
+
+	returnCode, response = storWithSize("cut.bin", 50)
+	require.Equal(t, StatusActionAbortedLocalError, returnCode, response)
+	require.Contains(t, response, "stored 50 of 100 declared bytes")
+
+	// the declaration was consumed, an undeclared upload is back to normal
+	returnCode, response = storWithSize("undeclared.bin", 50)
+	require.Equal(t, StatusClosingDataConn, returnCode, response)
+
+	// a broken size declaration is refused
+	returnCode, _, err = raw.SendCommand("OPTS STOR SIZE=meh")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode)
+}
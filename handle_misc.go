@@ -1,10 +1,10 @@
 package ftpserver
 
 import (
-	"bufio"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -13,11 +13,23 @@ import (
 var errUnknowHash = errors.New("unknown hash algorithm")
 
 func (c *clientHandler) handleAUTH(_ string) error {
-	if tlsConfig, err := c.server.driver.GetTLSConfig(); err == nil {
+	// a second AUTH on an already TLS protected connection is rejected unless
+	// re-handshaking was explicitly enabled: blindly wrapping another TLS
+	// layer leaves both sides waiting on a handshake a confused client never
+	// starts
+	if _, alreadyTLS := c.conn.(*tls.Conn); alreadyTLS && !c.server.getSettings().EnableRepeatedAUTH {
+		c.writeMessage(StatusBadCommandSequence, "Control connection is already TLS protected")
+
+		return nil
+	}
+
+	tlsConfig, err := c.getTLSConfig()
+
+	if err == nil {
 		c.writeMessage(StatusAuthAccepted, "AUTH command ok. Expecting TLS Negotiation.")
-		c.conn = tls.Server(c.conn, tlsConfig)
-		c.reader = bufio.NewReaderSize(c.conn, maxCommandSize)
-		c.writer = bufio.NewWriter(c.conn)
+		c.conn = tls.Server(c.conn, c.server.applyTLSOverrides(tlsConfig))
+		c.reader.Reset(c.conn)
+		c.writer.Reset(c.conn)
 		c.setTLSForControl(true)
 	} else {
 		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Cannot get a TLS config: %v", err))
@@ -28,6 +40,16 @@ func (c *clientHandler) handleAUTH(_ string) error {
 
 func (c *clientHandler) handlePROT(param string) error {
 	// P for Private, C for Clear
+	if param != "P" {
+		if verifier, ok := c.server.driver.(MainDriverExtensionTLSDowngradeVerifier); ok {
+			if err := verifier.VerifyTLSDowngrade(c); err != nil {
+				c.writeMessage(StatusRequestDenied, "Data channel protection downgrade refused: "+err.Error())
+
+				return nil
+			}
+		}
+	}
+
 	c.setTLSForTransfer(param == "P")
 	c.writeMessage(StatusOK, "OK")
 
@@ -40,14 +62,56 @@ func (c *clientHandler) handlePBSZ(_ string) error {
 	return nil
 }
 
+// handleCCC clears the command channel: the reply is still sent over TLS,
+// then the control connection goes back to plaintext so NAT devices can
+// rewrite PASV replies again. The data channel protection negotiated through
+// PROT is not affected
+func (c *clientHandler) handleCCC(_ string) error {
+	if !c.server.getSettings().EnableCCC {
+		c.writeMessage(StatusCommandNotImplemented, "CCC support is disabled")
+
+		return nil
+	}
+
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		c.writeMessage(StatusBadCommandSequence, "CCC requires a TLS control connection")
+
+		return nil
+	}
+
+	c.writeMessage(StatusOK, "Control channel cleared")
+
+	c.conn = tlsConn.NetConn()
+	c.reader.Reset(c.conn)
+	c.writer.Reset(c.conn)
+	c.setTLSForControl(false)
+
+	return nil
+}
+
+// SYST response presets, some clients alter their path handling and listing
+// parser based on the announced platform
+const (
+	SystResponseUnix    = "UNIX Type: L8"
+	SystResponseWindows = "Windows_NT"
+)
+
 func (c *clientHandler) handleSYST(_ string) error {
-	if c.server.settings.DisableSYST {
+	settings := c.server.getSettings()
+
+	if settings.DisableSYST {
 		c.writeMessage(StatusCommandNotImplemented, "SYST is disabled")
 
 		return nil
 	}
 
-	c.writeMessage(StatusSystemType, "UNIX Type: L8")
+	response := settings.SystResponse
+	if response == "" {
+		response = SystResponseUnix
+	}
+
+	c.writeMessage(StatusSystemType, response)
 
 	return nil
 }
@@ -62,7 +126,7 @@ func (c *clientHandler) handleSTAT(param string) error {
 }
 
 func (c *clientHandler) handleSITE(param string) error {
-	if c.server.settings.DisableSite {
+	if c.server.getSettings().DisableSite {
 		c.writeMessage(StatusSyntaxErrorNotRecognised, "SITE support is disabled")
 
 		return nil
@@ -85,38 +149,97 @@ func (c *clientHandler) handleSITE(param string) error {
 		c.handleCHOWN(params)
 	case "SYMLINK":
 		c.handleSYMLINK(params)
+	case "UTIME":
+		c.handleSITEUTIME(params)
 	case "MKDIR":
 		c.handleMKDIR(params)
 	case "RMDIR":
 		c.handleRMDIR(params)
+	case "HELP":
+		c.handleSITEHELP()
+	case "AUTHZ":
+		c.handleSITEAUTHZ(params)
 	default:
+		if c.handleSITEAdmin(cmd, params) {
+			break
+		}
+
 		c.writeMessage(StatusSyntaxErrorNotRecognised, "Unknown SITE subcommand: "+cmd)
 	}
 
 	return nil
 }
 
-func (c *clientHandler) handleSTATServer() error {
-	// we need to hold the transfer lock here:
-	// server STAT is a special action command so we need to ensure
-	// to write the whole STAT response before sending a transfer
-	// open/close message
-	c.transferMu.Lock()
-	defer c.transferMu.Unlock()
+// handleSITEHELP lists the SITE subcommands available to the current client.
+// Subcommands backed by an optional driver feature are only advertised when
+// the driver supports it
+func (c *clientHandler) handleSITEHELP() {
+	subCommands := []string{"HELP", "MKDIR", "RMDIR"}
+
+	if c.hasDriverCapability(CapabilityChmod) {
+		subCommands = append(subCommands, "CHMOD")
+	}
+
+	if c.hasDriverCapability(CapabilityChown) {
+		subCommands = append(subCommands, "CHOWN")
+	}
+
+	if _, ok := c.driver.(ClientDriverExtensionSymlink); ok {
+		subCommands = append(subCommands, "SYMLINK")
+	}
+
+	if c.hasDriverCapability(CapabilityChtimes) {
+		subCommands = append(subCommands, "UTIME")
+	}
 
-	if c.server.settings.DisableSTAT {
+	// the administrative subcommands only show up for elevated sessions
+	if c.IsElevated() {
+		for subCommand := range siteAdminCommands {
+			subCommands = append(subCommands, subCommand)
+		}
+	}
+
+	sort.Strings(subCommands)
+
+	defer c.multilineAnswer(StatusHelpMessage, "Supported SITE subcommands")()
+
+	for _, subCommand := range subCommands {
+		c.writeLine(" " + subCommand)
+	}
+}
+
+func (c *clientHandler) handleSTATServer() error {
+	if c.server.getSettings().DisableSTAT {
 		c.writeMessage(StatusCommandNotImplemented, "STAT is disabled")
 
 		return nil
 	}
 
+	// the transfer state is snapshotted first: replies are never written
+	// while holding transferMu
+	c.transferMu.Lock()
+
+	transferInfo := ""
+	if c.transfer != nil {
+		transferInfo = c.transfer.GetInfo()
+	}
+
+	stats := c.transferStatsLocked()
+	c.transferMu.Unlock()
+
+	// server STAT is a special action command, holding the reply lock for the
+	// whole response keeps a concurrent transfer open/close message from
+	// landing between its lines
+	c.replyMu.Lock()
+	defer c.replyMu.Unlock()
+
 	defer c.multilineAnswer(StatusSystemStatus, "Server status")()
 
 	duration := time.Now().UTC().Sub(c.connectedAt)
 	duration -= duration % time.Second
 	c.writeLine(fmt.Sprintf(
 		"Connected to %s from %s for %s",
-		c.server.settings.ListenAddr,
+		c.server.getSettings().ListenAddr,
 		c.conn.RemoteAddr(),
 		duration,
 	))
@@ -127,18 +250,61 @@ func (c *clientHandler) handleSTATServer() error {
 		c.writeLine("Not logged in yet")
 	}
 
-	if info := c.GetTranferInfo(); info != "" {
+	if transferInfo != "" {
 		c.writeLine("Transfer connection open")
-		c.writeLine(info)
+		c.writeLine(transferInfo)
+
+		// in-band progress report, so transfers can be polled without a
+		// second connection
+		if stats.Direction != TransferDirectionNone {
+			elapsed := time.Since(stats.Start)
+
+			var rate float64
+			if seconds := elapsed.Seconds(); seconds > 0 {
+				rate = float64(stats.BytesTransferred) / seconds
+			}
+
+			c.writeLine(fmt.Sprintf(
+				"Transferred %d bytes in %s (%.0f bytes/s)",
+				stats.BytesTransferred,
+				elapsed.Round(time.Second),
+				rate,
+			))
+		}
 	}
 
-	c.writeLine(c.server.settings.Banner)
+	c.writeLine(c.server.getSettings().Banner)
 
 	return nil
 }
 
-func (c *clientHandler) handleOptsUtf8() error {
-	c.writeMessage(StatusOK, "I'm in UTF8 only anyway")
+func (c *clientHandler) handleOptsUtf8(args []string) error {
+	mode := "ON"
+	if len(args) > 0 {
+		mode = strings.ToUpper(args[0])
+	}
+
+	switch mode {
+	case "ON":
+		c.setLegacyCharmap(nil)
+		c.setUTF8Negotiated(true)
+		c.writeMessage(StatusOK, "I'm in UTF8 only anyway")
+	case "OFF":
+		encodingName := c.server.getSettings().LegacyFilenameEncoding
+
+		cmap := lookupFilenameEncoding(encodingName)
+		if cmap == nil {
+			c.writeMessage(StatusSyntaxErrorParameters, "UTF8 cannot be disabled, no legacy encoding is configured")
+
+			return nil
+		}
+
+		c.setLegacyCharmap(cmap)
+		c.setUTF8Negotiated(false)
+		c.writeMessage(StatusOK, fmt.Sprintf("File names are now exchanged in %s", encodingName))
+	default:
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("Unknown UTF8 mode %#v", args[0]))
+	}
 
 	return nil
 }
@@ -171,16 +337,133 @@ func (c *clientHandler) handleOptsHash(args []string) error {
 	return nil
 }
 
+// handleOptsListing handles the "OPTS LIST" and "OPTS NLST" option strings.
+// The supported options are NODIRS/DIRS (exclude or include directories),
+// NOHIDDEN/HIDDEN (exclude or include dot files) and, for NLST, ABSOLUTE/RELATIVE
+// (return absolute or relative paths). Multiple options can be space-separated
+func (c *clientHandler) handleOptsListing(args []string) error {
+	opts := c.getListOptions()
+
+	if len(args) == 0 {
+		c.writeMessage(StatusOK, opts.String())
+
+		return nil
+	}
+
+	for _, arg := range strings.Fields(strings.ToUpper(args[0])) {
+		switch arg {
+		case "DIRS":
+			opts.hideDirs = false
+		case "NODIRS":
+			opts.hideDirs = true
+		case "HIDDEN":
+			opts.hideDotFiles = false
+		case "NOHIDDEN":
+			opts.hideDotFiles = true
+		case "RELATIVE":
+			opts.absoluteNLST = false
+		case "ABSOLUTE":
+			opts.absoluteNLST = true
+		default:
+			c.writeMessage(StatusSyntaxErrorParameters, "Unknown listing option: "+arg)
+
+			return nil
+		}
+	}
+
+	c.setListOptions(opts)
+	c.writeMessage(StatusOK, opts.String())
+
+	return nil
+}
+
+// handleOptsMLST lets the client choose the facts returned in MLSD/MLST
+// entries, per RFC 3659. An empty list disables every fact, leaving only the
+// file names
+func (c *clientHandler) handleOptsMLST(args []string) error {
+	facts := []string{}
+
+	if len(args) > 0 {
+		for _, fact := range strings.Split(args[0], ";") {
+			fact = strings.ToLower(strings.TrimSpace(fact))
+
+			if fact != "" {
+				facts = append(facts, fact)
+			}
+		}
+	}
+
+	c.setMLSxFacts(facts)
+
+	var report strings.Builder
+	for _, fact := range facts {
+		report.WriteString(fact)
+		report.WriteByte(';')
+	}
+
+	c.writeMessage(StatusOK, "MLST OPTS "+report.String())
+
+	return nil
+}
+
+// handleOptsMLSD negotiates partial MLSD listings: "OPTS MLSD PARTIAL=<size>"
+// caps every following MLSD response to that many entries, with an opaque
+// continuation token carried as the last entry; "OPTS MLSD PARTIAL=0" goes
+// back to complete listings. Requires a driver implementing the
+// ClientDriverExtensionDirectoryPager extension
+func (c *clientHandler) handleOptsMLSD(args []string) error {
+	const partialPrefix = "PARTIAL="
+
+	if len(args) == 0 || !strings.HasPrefix(strings.ToUpper(args[0]), partialPrefix) {
+		c.writeMessage(StatusSyntaxErrorParameters, "Only the PARTIAL=<size> option is understood")
+
+		return nil
+	}
+
+	pageSize, err := strconv.Atoi(args[0][len(partialPrefix):])
+	if err != nil || pageSize < 0 {
+		c.writeMessage(StatusSyntaxErrorParameters, "Invalid PARTIAL size")
+
+		return nil
+	}
+
+	if pageSize > 0 {
+		if _, ok := c.driver.(ClientDriverExtensionDirectoryPager); !ok {
+			c.writeMessage(StatusCommandNotImplemented, "Partial listings are not supported here")
+
+			return nil
+		}
+	}
+
+	c.setMLSDPageSize(pageSize)
+
+	if pageSize == 0 {
+		c.writeMessage(StatusOK, "MLSD listings are complete again")
+	} else {
+		c.writeMessage(StatusOK, fmt.Sprintf("MLSD listings are returned %d entries at a time", pageSize))
+	}
+
+	return nil
+}
+
 func (c *clientHandler) handleOPTS(param string) error {
 	args := strings.SplitN(param, " ", 2)
 
 	switch strings.ToUpper(args[0]) {
 	case "UTF8":
-		return c.handleOptsUtf8()
+		return c.handleOptsUtf8(args[1:])
 	case "HASH":
-		if c.server.settings.EnableHASH {
+		if c.server.getSettings().EnableHASH {
 			return c.handleOptsHash(args[1:])
 		}
+	case "LIST", "NLST":
+		return c.handleOptsListing(args[1:])
+	case "MLST":
+		return c.handleOptsMLST(args[1:])
+	case "MLSD":
+		return c.handleOptsMLSD(args[1:])
+	case "STOR":
+		return c.handleOptsStor(args[1:])
 	}
 
 	c.writeMessage(StatusSyntaxErrorNotRecognised, "Don't know this option")
@@ -188,6 +471,36 @@ func (c *clientHandler) handleOPTS(param string) error {
 	return nil
 }
 
+// handleOptsStor handles "OPTS STOR SIZE=<n>", an alternative to ALLO for
+// declaring the size of the next upload so what is actually stored can be
+// checked against it, see ErrUploadTruncated
+func (c *clientHandler) handleOptsStor(args []string) error {
+	if len(args) == 0 {
+		c.writeMessage(StatusSyntaxErrorParameters, "Missing parameter")
+
+		return nil
+	}
+
+	arg := strings.ToUpper(strings.TrimSpace(args[0]))
+	if !strings.HasPrefix(arg, "SIZE=") {
+		c.writeMessage(StatusSyntaxErrorNotRecognised, "Don't know this option")
+
+		return nil
+	}
+
+	size, err := strconv.ParseInt(arg[len("SIZE="):], 10, 64)
+	if err != nil || size < 0 {
+		c.writeMessage(StatusSyntaxErrorParameters, "Couldn't parse size")
+
+		return nil
+	}
+
+	c.alloSize = size
+	c.writeMessage(StatusOK, "Size noted")
+
+	return nil
+}
+
 func (c *clientHandler) handleNOOP(_ string) error {
 	c.writeMessage(StatusOK, "OK")
 
@@ -202,8 +515,22 @@ func (c *clientHandler) handleCLNT(param string) error {
 }
 
 func (c *clientHandler) handleFEAT(_ string) error {
+	settings := c.server.getSettings()
+
+	endLine := "end"
+	if settings.FeatEndLine != "" {
+		endLine = settings.FeatEndLine
+	}
+
 	c.writeLine(fmt.Sprintf("%d- These are my features", StatusSystemStatus))
-	defer c.writeMessage(StatusSystemStatus, "end")
+	defer c.writeMessage(StatusSystemStatus, endLine)
+
+	// without any IPv4 address to advertise, PASV cannot work and EPSV is
+	// the only usable passive mode
+	epsvFeature := "EPSV"
+	if c.epsvOnlyPassive() {
+		epsvFeature = "EPSV REQUIRED"
+	}
 
 	features := []string{
 		"CLNT",
@@ -211,37 +538,59 @@ func (c *clientHandler) handleFEAT(_ string) error {
 		"SIZE",
 		"MDTM",
 		"REST STREAM",
+		"RANG STREAM",
 		"EPRT",
-		"EPSV",
+		epsvFeature,
 	}
 
-	if !c.server.settings.DisableMLSD {
+	if !settings.DisableMLSD {
 		features = append(features, "MLSD")
 	}
 
-	if !c.server.settings.DisableMLST {
+	if !settings.DisableMLST {
 		features = append(features, "MLST")
 	}
 
-	if !c.server.settings.DisableMFMT {
+	if !settings.DisableMFMT && c.hasDriverCapability(CapabilityChtimes) {
 		features = append(features, "MFMT")
 	}
 
+	if _, ok := c.driver.(ClientDriverExtensionSetCTime); ok {
+		features = append(features, "MFCT")
+	}
+
 	// This code made me think about adding this: https://github.com/stianstr/ftpserver/commit/387f2ba
-	if tlsConfig, err := c.server.driver.GetTLSConfig(); tlsConfig != nil && err == nil {
+	if tlsConfig, err := c.getTLSConfig(); tlsConfig != nil && err == nil {
 		features = append(features, "AUTH TLS", "PBSZ", "PROT")
+
+		if settings.EnableCCC {
+			features = append(features, "CCC")
+		}
 	}
 
-	if c.server.settings.EnableHASH {
+	if settings.NodeIdentifier != "" {
+		features = append(features, "NODE "+settings.NodeIdentifier)
+	}
+
+	if settings.EnableHASH {
 		var hashLine strings.Builder
 
 		nonStandardHashImpl := []string{"XCRC", "MD5", "XMD5", "XSHA", "XSHA1", "XSHA256", "XSHA512"}
 		hashMapping := getHashMapping()
 
-		for k, v := range hashMapping {
+		// the algorithms are advertised in a stable order, map iteration would
+		// randomize the line between runs
+		algos := make([]string, 0, len(hashMapping))
+		for k := range hashMapping {
+			algos = append(algos, k)
+		}
+
+		sort.Strings(algos)
+
+		for _, k := range algos {
 			hashLine.WriteString(k)
 
-			if v == c.selectedHashAlgo {
+			if hashMapping[k] == c.selectedHashAlgo {
 				hashLine.WriteString("*")
 			}
 
@@ -252,7 +601,7 @@ func (c *clientHandler) handleFEAT(_ string) error {
 		features = append(features, nonStandardHashImpl...)
 	}
 
-	if c.server.settings.EnableCOMB {
+	if settings.EnableCOMB {
 		features = append(features, "COMB")
 	}
 
@@ -260,6 +609,14 @@ func (c *clientHandler) handleFEAT(_ string) error {
 		features = append(features, "AVBL")
 	}
 
+	// a deterministic output is guaranteed: clients and test harnesses diff
+	// capability responses
+	sort.Strings(features)
+
+	if settings.FeatFilter != nil {
+		features = settings.FeatFilter(features)
+	}
+
 	for _, f := range features {
 		c.writeLine(" " + f)
 	}
@@ -271,10 +628,17 @@ func (c *clientHandler) handleTYPE(param string) error {
 	param = strings.ReplaceAll(strings.ToUpper(param), " ", "")
 	switch param {
 	case "I", "L8":
-		c.currentTransferType = TransferTypeBinary
+		c.setCurrentTransferType(TransferTypeBinary)
 		c.writeMessage(StatusOK, "Type set to binary")
 	case "A", "AN", "L7":
-		c.currentTransferType = TransferTypeASCII
+		// the session stays in binary mode when ASCII transfers are disabled
+		if c.server.getSettings().DisableASCIITransfers {
+			c.writeMessage(StatusNotImplementedParam, "ASCII transfers are not allowed")
+
+			break
+		}
+
+		c.setCurrentTransferType(TransferTypeASCII)
 		c.writeMessage(StatusOK, "Type set to ASCII")
 	default:
 		c.writeMessage(StatusNotImplementedParam, "Unsupported transfer type")
@@ -313,12 +677,11 @@ func (c *clientHandler) handleQUIT(_ string) error {
 
 func (c *clientHandler) handleABOR(param string) error {
 	c.transferMu.Lock()
-	defer c.transferMu.Unlock()
 
 	if c.transfer != nil {
-		isOpened := c.isTransferOpen
+		isOpened := c.transferState == transferOpen
 
-		c.isTransferAborted = true
+		c.transferState = transferAborted
 
 		if err := c.closeTransfer(); err != nil {
 			c.logger.Warn(
@@ -334,11 +697,14 @@ func (c *clientHandler) handleABOR(param string) error {
 		}
 
 		if isOpened {
-			c.writeMessage(StatusTransferAborted, "Connection closed; transfer aborted")
+			c.queueTransferReply(StatusTransferAborted, "Connection closed; transfer aborted")
 		}
 	}
 
-	c.writeMessage(StatusClosingDataConn, "ABOR successful; closing transfer connection")
+	c.queueTransferReply(StatusClosingDataConn, "ABOR successful; closing transfer connection")
+	c.transferMu.Unlock()
+
+	c.flushTransferReplies()
 
 	return nil
 }
@@ -1,9 +1,12 @@
 package ftpserver
 
 import (
+	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -11,6 +14,7 @@ import (
 
 	"github.com/secsy/goftp"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/charmap"
 )
 
 func TestSiteCommand(t *testing.T) {
@@ -32,8 +36,14 @@ func TestSiteCommand(t *testing.T) {
 
 	rc, response, err := raw.SendCommand("SITE help")
 	require.NoError(t, err)
-	require.Equal(t, StatusSyntaxErrorNotRecognised, rc, "Are we supporting it now ?")
-	require.Equal(t, "Unknown SITE subcommand: HELP", response, "Are we supporting it now ?")
+	require.Equal(t, StatusHelpMessage, rc, response)
+	require.Contains(t, response, "CHMOD")
+	require.Contains(t, response, "SYMLINK", "The test driver implements symlinks, they should be advertised")
+
+	rc, response, err = raw.SendCommand("SITE BOGUS")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorNotRecognised, rc, response)
+	require.Equal(t, "Unknown SITE subcommand: BOGUS", response)
 }
 
 // florent(2018-01-14): #58: IDLE timeout: Testing timeout
@@ -71,6 +81,47 @@ func TestIdleTimeout(t *testing.T) {
 	require.Equal(t, StatusServiceNotAvailable, returnCode)
 }
 
+func TestPreAuthTimeout(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false, Settings: &Settings{PreAuthTimeout: 1}})
+
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	reader := bufio.NewReader(conn)
+	welcome, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Contains(t, welcome, "220")
+
+	// a connection that never sends a command is shed after PreAuthTimeout
+	response, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Contains(t, response, "421")
+
+	// once authenticated only IdleTimeout applies (none here)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	time.Sleep(1500 * time.Millisecond)
+
+	returnCode, _, err := raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+}
+
 func TestStat(t *testing.T) {
 	server := NewTestServer(t, false)
 	conf := goftp.Config{
@@ -94,13 +145,61 @@ func TestStat(t *testing.T) {
 	require.GreaterOrEqual(t, count, 4)
 	require.NotEqual(t, ' ', str[0])
 
-	server.settings.DisableSTAT = true
+	mustSwapSettings(server, func(settings *Settings) { settings.DisableSTAT = true })
 
 	returnCode, str, err = raw.SendCommand("STAT")
 	require.NoError(t, err)
 	require.Equal(t, StatusCommandNotImplemented, returnCode, str)
 }
 
+func TestStatDuringTransfer(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// "delay-io" keeps the upload running while we poll it with STAT
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw.SendCommand("STOR delay-io.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = dataConn.Write([]byte(strings.Repeat("x", 1024)))
+	require.NoError(t, err)
+
+	// give the server a moment to pick the bytes up
+	time.Sleep(200 * time.Millisecond)
+
+	returnCode, response, err = raw.SendCommand("STAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, returnCode, response)
+	require.Contains(t, response, "STOR delay-io.bin")
+	require.Contains(t, response, "Transferred ")
+	require.Contains(t, response, "bytes/s")
+
+	require.NoError(t, dataConn.Close())
+
+	returnCode, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode, response)
+}
+
 func TestCLNT(t *testing.T) {
 	server := NewTestServer(t, false)
 	conf := goftp.Config{
@@ -194,7 +293,7 @@ func TestOPTSHASH(t *testing.T) {
 	require.Equal(t, "MD5", message)
 
 	// now disable hash support
-	server.settings.EnableHASH = false
+	mustSwapSettings(server, func(settings *Settings) { settings.EnableHASH = false })
 
 	returnCode, _, err = raw.SendCommand("OPTS HASH")
 	require.NoError(t, err)
@@ -419,6 +518,39 @@ func TestTYPE(t *testing.T) {
 	require.Equal(t, StatusNotImplementedParam, returnCode)
 }
 
+func TestTypeASCIIDisabled(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false})
+
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.DisableASCIITransfers = true
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, response, err := raw.SendCommand("TYPE A")
+	require.NoError(t, err)
+	require.Equal(t, StatusNotImplementedParam, returnCode)
+	require.Equal(t, "ASCII transfers are not allowed", response)
+
+	// the session is still in binary mode
+	returnCode, _, err = raw.SendCommand("TYPE I")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+}
+
 func TestMode(t *testing.T) {
 	server := NewTestServer(t, false)
 	conf := goftp.Config{
@@ -443,8 +575,127 @@ func TestMode(t *testing.T) {
 	require.Equal(t, StatusNotImplementedParam, returnCode)
 }
 
-func TestREIN(t *testing.T) {
+// tlsDowngradeVetoDriver refuses to switch the data channel back to cleartext
+type tlsDowngradeVetoDriver struct {
+	TestServerDriver
+}
+
+var errMustStayEncrypted = errors.New("data must stay encrypted for this account")
+
+// VerifyTLSDowngrade implements the MainDriverExtensionTLSDowngradeVerifier extension
+func (driver *tlsDowngradeVetoDriver) VerifyTLSDowngrade(_ ClientContext) error {
+	return errMustStayEncrypted
+}
+
+func TestPROTDowngradeVeto(t *testing.T) {
+	driver := &tlsDowngradeVetoDriver{
+		TestServerDriver: TestServerDriver{
+			Debug: false,
+			TLS:   true,
+		},
+	}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the driver refuses the switch back to a cleartext data channel
+	returnCode, response, err := raw.SendCommand("PROT C")
+	require.NoError(t, err)
+	require.Equal(t, StatusRequestDenied, returnCode)
+	require.Contains(t, response, "data must stay encrypted")
+
+	// while staying private is always accepted
+	returnCode, response, err = raw.SendCommand("PROT P")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode, response)
+}
+
+func TestFEATStableOutput(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false, Settings: &Settings{EnableHASH: true}})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, first, err := raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, rc, first)
+
+	// the HASH line was built from a map iteration and changed between runs
+	require.Contains(t, first, "CRC32;MD5;SHA-1;SHA-256*;SHA-512;")
+
+	rc, second, err := raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, rc, second)
+	require.Equal(t, first, second)
+}
+
+func TestFEATOverrides(t *testing.T) {
 	server := NewTestServer(t, false)
+	mustSwapSettings(server, func(settings *Settings) {
+		// truncate the listing to a single feature and change the terminating line,
+		// as an interop suite reproducing a client stall would do
+		settings.FeatFilter = func(_ []string) []string {
+			return []string{"UTF8"}
+		}
+		settings.FeatEndLine = "END"
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, response, err := raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, returnCode)
+	require.Contains(t, response, "UTF8")
+	require.NotContains(t, response, "SIZE")
+	require.True(t, strings.HasSuffix(response, "END"), response)
+}
+
+func TestOPTSUTF8Off(t *testing.T) {
+	driver := &TestServerDriver{
+		Settings: &Settings{LegacyFilenameEncoding: "CP1251"},
+	}
+	server := NewTestServerWithTestDriver(t, driver)
 	conf := goftp.Config{
 		User:     authUser,
 		Password: authPass,
@@ -458,7 +709,229 @@ func TestREIN(t *testing.T) {
 	raw, err := client.OpenRawConn()
 	require.NoError(t, err, "Couldn't open raw connection")
 
-	returnCode, _, err := raw.SendCommand("REIN")
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, message, err := raw.SendCommand("OPTS UTF8 OFF")
 	require.NoError(t, err)
-	require.Equal(t, StatusCommandNotImplemented, returnCode)
+	require.Equal(t, StatusOK, rc)
+	require.Contains(t, message, "CP1251")
+
+	// the directory name travels in CP1251 but is stored in UTF-8
+	encodedName, err := charmap.Windows1251.NewEncoder().String("тест")
+	require.NoError(t, err)
+
+	rc, message, err = raw.SendCommand("MKD " + encodedName)
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc)
+	require.Contains(t, message, encodedName)
+
+	_, err = driver.fs.Stat("/тест")
+	require.NoError(t, err, "The name should be decoded to UTF-8 on the driver side")
+
+	// the listing is re-encoded on its way out
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, _, err = raw.SendCommand("NLST /")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+	data, err := io.ReadAll(dataConn)
+	require.NoError(t, err)
+	require.Equal(t, encodedName+"\r\n", string(data))
+
+	rc, _, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc)
+
+	// switching back to UTF-8 restores the default behavior
+	rc, _, err = raw.SendCommand("OPTS UTF8 ON")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc)
+
+	rc, _, err = raw.SendCommand("MKD другой")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc)
+
+	_, err = driver.fs.Stat("/другой")
+	require.NoError(t, err)
+}
+
+func TestOPTSUTF8OffUnavailable(t *testing.T) {
+	server := NewTestServer(t, false)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, _, err := raw.SendCommand("OPTS UTF8 OFF")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc)
+}
+
+func TestNonASCIIReplyPolicy(t *testing.T) {
+	driver := &TestServerDriver{
+		Settings: &Settings{NonASCIIReplyPolicy: NonASCIIPolicyEscape},
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the name is stored as sent, only the reply is escaped
+	rc, message, err := raw.SendCommand("MKD /étage")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc)
+	require.Contains(t, message, "%C3%A9tage")
+	require.NotContains(t, message, "étage")
+
+	_, err = driver.fs.Stat("/étage")
+	require.NoError(t, err, "The stored name should keep its UTF-8 form")
+
+	// the listing goes through the same policy
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, _, err = raw.SendCommand("NLST /")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+	data, err := io.ReadAll(dataConn)
+	require.NoError(t, err)
+	require.Equal(t, "%C3%A9tage\r\n", string(data))
+
+	rc, _, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc)
+
+	// a client that selected UTF-8 receives the raw bytes again
+	rc, _, err = raw.SendCommand("OPTS UTF8 ON")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc)
+
+	rc, message, err = raw.SendCommand("MKD /déjà")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc)
+	require.Contains(t, message, "déjà")
+
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.NonASCIIReplyPolicy = NonASCIIPolicyTransliterate
+	})
+
+	client2, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client2.Close()) }()
+
+	raw2, err := client2.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw2.Close()) }()
+
+	// accented letters decompose to their base letter
+	rc, message, err = raw2.SendCommand("MKD /çédille")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc)
+	require.Contains(t, message, "cedille")
+
+	// characters without an ASCII part become question marks
+	rc, message, err = raw2.SendCommand("MKD /тест")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc)
+	require.Contains(t, message, "????")
+}
+
+func TestNodeIdentifier(t *testing.T) {
+	server := NewTestServer(t, false)
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.NodeIdentifier = "node-7"
+		settings.NodeIdentifierInBanner = true
+	})
+
+	conn, err := net.Dial("tcp", server.Addr())
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	buf := make([]byte, 1024)
+	readBytes, err := conn.Read(buf)
+	require.NoError(t, err)
+
+	banner := string(buf[:readBytes])
+	require.True(t, strings.HasPrefix(banner, "220"), banner)
+	require.Contains(t, banner, "[node-7]", "The banner should carry the node identifier")
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, response, err := raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, returnCode)
+	require.Contains(t, response, "NODE node-7")
+}
+
+func TestWelcomeBanner(t *testing.T) {
+	server := NewTestServer(t, false)
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.NodeIdentifier = "node-7"
+		settings.MaxConnections = 10
+		settings.WelcomeBanner = "Welcome to {{nodeIdentifier}}, {{clientIP}}\n{{driverMessage}}\nSlots left: {{remainingConnections}}"
+	})
+
+	conn, err := net.Dial("tcp", server.Addr())
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	reader := bufio.NewReader(conn)
+	lines := make([]string, 0, 3)
+
+	for i := 0; i < 3; i++ {
+		line, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+
+	require.Equal(t, []string{
+		"220-Welcome to node-7, 127.0.0.1",
+		"220-TEST Server",
+		"220 Slots left: 9",
+	}, lines, "The banner template should expand into a multiline greeting")
 }
@@ -0,0 +1,130 @@
+// Package ftpserver - hidden administrative SITE subcommands
+package ftpserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// siteAdminCommands maps the administrative SITE subcommands to their
+// handlers. They are only reachable, and only listed by SITE HELP, while the
+// session holds a "SITE AUTHZ" elevation
+var siteAdminCommands = map[string]func(c *clientHandler, param string){ //nolint:gochecknoglobals // this mapping can be considered as a constant
+	"KICK":   (*clientHandler).handleSITEKICK,
+	"DRAIN":  (*clientHandler).handleSITEDRAIN,
+	"RELOAD": (*clientHandler).handleSITERELOAD,
+	"DEBUG":  (*clientHandler).handleSITEDEBUG,
+}
+
+// handleSITEAUTHZ asks the driver to verify the elevation token. Without a
+// driver implementing MainDriverExtensionAdminVerifier the whole
+// administrative surface stays hidden behind the unknown-subcommand reply
+func (c *clientHandler) handleSITEAUTHZ(param string) {
+	verifier, ok := c.server.driver.(MainDriverExtensionAdminVerifier)
+	if !ok {
+		c.writeMessage(StatusSyntaxErrorNotRecognised, "Unknown SITE subcommand: AUTHZ")
+
+		return
+	}
+
+	validity, err := verifier.VerifySiteAuthz(c, param)
+	if err != nil {
+		c.writeMessage(StatusNotLoggedIn, "Elevation refused")
+
+		return
+	}
+
+	c.setElevatedUntil(time.Now().Add(validity))
+	c.writeMessage(StatusOK, fmt.Sprintf("Elevation granted for %s", validity))
+}
+
+// handleSITEAdmin dispatches an administrative SITE subcommand, returning
+// false when cmd isn't one of them. Sessions without a valid elevation get
+// the same reply as for an unknown subcommand
+func (c *clientHandler) handleSITEAdmin(cmd, param string) bool {
+	handler := siteAdminCommands[cmd]
+	if handler == nil {
+		return false
+	}
+
+	if !c.IsElevated() {
+		c.writeMessage(StatusSyntaxErrorNotRecognised, "Unknown SITE subcommand: "+cmd)
+
+		return true
+	}
+
+	handler(c, param)
+
+	return true
+}
+
+// handleSITEKICK disconnects the session with the given client ID
+func (c *clientHandler) handleSITEKICK(param string) {
+	id, err := strconv.ParseUint(param, 10, 32)
+	if err != nil {
+		c.writeMessage(StatusSyntaxErrorParameters, "Invalid client ID")
+
+		return
+	}
+
+	target := c.server.clientByID(uint32(id))
+	if target == nil {
+		c.writeMessage(StatusActionNotTaken, "No such client")
+
+		return
+	}
+
+	if errClose := target.Close(); errClose != nil {
+		c.logger.Warn(
+			"Problem kicking a client",
+			"targetClientId", id,
+			"err", errClose,
+		)
+	}
+
+	c.writeMessage(StatusOK, fmt.Sprintf("Client %d kicked", id))
+}
+
+// handleSITEDRAIN makes the server refuse new connections while keeping the
+// established sessions running
+func (c *clientHandler) handleSITEDRAIN(_ string) {
+	c.server.setDraining(true)
+	c.writeMessage(StatusOK, "Server is draining: new connections will be refused")
+}
+
+// handleSITEDEBUG flips the verbose logging of this session at runtime, the
+// same flag ClientContext.SetDebug controls, so the transcript of a single
+// problematic production session can be captured without restarting the
+// server or enabling debug globally
+func (c *clientHandler) handleSITEDEBUG(param string) {
+	switch strings.ToUpper(param) {
+	case "ON":
+		c.SetDebug(true)
+		c.writeMessage(StatusOK, "Debug enabled for this session")
+	case "OFF":
+		c.SetDebug(false)
+		c.writeMessage(StatusOK, "Debug disabled for this session")
+	case "":
+		state := "OFF"
+		if c.Debug() {
+			state = "ON"
+		}
+
+		c.writeMessage(StatusOK, "Debug is "+state)
+	default:
+		c.writeMessage(StatusSyntaxErrorParameters, "SITE DEBUG takes ON or OFF")
+	}
+}
+
+// handleSITERELOAD re-loads the settings from the driver
+func (c *clientHandler) handleSITERELOAD(_ string) {
+	if err := c.server.loadSettings(); err != nil {
+		c.writeMessage(StatusActionNotTaken, "Could not reload settings: "+err.Error())
+
+		return
+	}
+
+	c.writeMessage(StatusOK, "Settings reloaded")
+}
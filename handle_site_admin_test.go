@@ -0,0 +1,203 @@
+package ftpserver
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSiteAdminCommands(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: false,
+		SiteAuthzVerifier: func(_ ClientContext, token string) (time.Duration, error) {
+			if token != "secret" {
+				return 0, errElevationRefused
+			}
+
+			return 10 * time.Second, nil
+		},
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// without an elevation the admin subcommands are indistinguishable from
+	// unknown ones
+	returnCode, response, err := raw.SendCommand("SITE RELOAD")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorNotRecognised, returnCode)
+	require.Equal(t, "Unknown SITE subcommand: RELOAD", response)
+
+	returnCode, _, err = raw.SendCommand("SITE AUTHZ wrong")
+	require.NoError(t, err)
+	require.Equal(t, StatusNotLoggedIn, returnCode)
+
+	returnCode, response, err = raw.SendCommand("SITE AUTHZ secret")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+	require.Contains(t, response, "Elevation granted")
+
+	// elevated sessions see the admin subcommands in SITE HELP
+	returnCode, response, err = raw.SendCommand("SITE HELP")
+	require.NoError(t, err)
+	require.Equal(t, StatusHelpMessage, returnCode)
+	require.Contains(t, response, "KICK")
+	require.Contains(t, response, "DRAIN")
+	require.Contains(t, response, "RELOAD")
+
+	returnCode, response, err = raw.SendCommand("SITE RELOAD")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+	require.Equal(t, "Settings reloaded", response)
+
+	returnCode, _, err = raw.SendCommand("SITE KICK bogus")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode)
+
+	returnCode, _, err = raw.SendCommand("SITE KICK 9999")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, returnCode)
+}
+
+func TestSiteDebug(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: false,
+		SiteAuthzVerifier: func(_ ClientContext, _ string) (time.Duration, error) {
+			return 10 * time.Second, nil
+		},
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// without an elevation the subcommand stays hidden
+	returnCode, response, err := raw.SendCommand("SITE DEBUG ON")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorNotRecognised, returnCode)
+	require.Equal(t, "Unknown SITE subcommand: DEBUG", response)
+
+	returnCode, _, err = raw.SendCommand("SITE AUTHZ token")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+
+	driver.clientMU.Lock()
+	require.Len(t, driver.Clients, 1)
+	session := driver.Clients[0]
+	driver.clientMU.Unlock()
+
+	require.False(t, session.Debug())
+
+	returnCode, response, err = raw.SendCommand("SITE DEBUG ON")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+	require.Equal(t, "Debug enabled for this session", response)
+	require.True(t, session.Debug(), "The session debug flag should have been raised")
+
+	returnCode, response, err = raw.SendCommand("SITE DEBUG")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+	require.Equal(t, "Debug is ON", response)
+
+	returnCode, _, err = raw.SendCommand("SITE DEBUG OFF")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+	require.False(t, session.Debug())
+
+	returnCode, _, err = raw.SendCommand("SITE DEBUG MAYBE")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode)
+}
+
+func TestSiteAdminKickAndDrain(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: false,
+		SiteAuthzVerifier: func(_ ClientContext, _ string) (time.Duration, error) {
+			return 10 * time.Second, nil
+		},
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, _, err := raw.SendCommand("SITE AUTHZ token")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+
+	// a second session gets kicked by the first one
+	victim, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { _ = victim.Close() }()
+
+	buf := make([]byte, 128)
+	_, err = victim.Read(buf)
+	require.NoError(t, err, "The victim should have received the welcome banner")
+
+	driver.clientMU.Lock()
+	require.Len(t, driver.Clients, 2)
+	victimID := driver.Clients[1].ID()
+	driver.clientMU.Unlock()
+
+	returnCode, _, err = raw.SendCommand("SITE KICK " + strconv.Itoa(int(victimID)))
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+
+	_, err = victim.Read(buf)
+	require.ErrorIs(t, err, io.EOF, "The victim connection should have been closed")
+
+	// once draining, new connections are refused without a banner
+	returnCode, _, err = raw.SendCommand("SITE DRAIN")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+
+	refused, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { _ = refused.Close() }()
+
+	_, err = refused.Read(buf)
+	require.ErrorIs(t, err, io.EOF)
+
+	// the established session keeps working
+	returnCode, _, err = raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+}
@@ -0,0 +1,65 @@
+package ftpserver
+
+// PreCommandHook is called before a command is executed. Returning a non-nil
+// error short-circuits the command: the error text is sent to the client with
+// the 550 status code, or with the code carried by a HookError
+type PreCommandHook func(cc ClientContext, command string, param string) error
+
+// PostCommandHook is called once a command has been executed
+type PostCommandHook func(cc ClientContext, command string, param string)
+
+// HookError is the error a PreCommandHook can return to pick the FTP status
+// code of the refusal reply
+type HookError struct {
+	Code    int    // FTP status code of the reply, 550 when left to 0
+	Message string // Text of the reply
+}
+
+func (e HookError) Error() string {
+	return e.Message
+}
+
+// Use registers a hook called before each command, in registration order. It
+// allows auditing, rate limiting or rejecting commands without altering the
+// command handling itself. Hooks only apply to the commands received after
+// the call, typically they should all be registered before starting to serve
+func (server *FtpServer) Use(hook PreCommandHook) {
+	server.hooksMutex.Lock()
+	defer server.hooksMutex.Unlock()
+
+	server.preCommandHooks = append(server.preCommandHooks, hook)
+}
+
+// UseAfter registers a hook called after each executed command, in
+// registration order
+func (server *FtpServer) UseAfter(hook PostCommandHook) {
+	server.hooksMutex.Lock()
+	defer server.hooksMutex.Unlock()
+
+	server.postCommandHooks = append(server.postCommandHooks, hook)
+}
+
+// runPreCommandHooks reports the first hook refusal, if any
+func (server *FtpServer) runPreCommandHooks(cc ClientContext, command string, param string) error {
+	server.hooksMutex.RLock()
+	hooks := server.preCommandHooks
+	server.hooksMutex.RUnlock()
+
+	for _, hook := range hooks {
+		if err := hook(cc, command, param); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (server *FtpServer) runPostCommandHooks(cc ClientContext, command string, param string) {
+	server.hooksMutex.RLock()
+	hooks := server.postCommandHooks
+	server.hooksMutex.RUnlock()
+
+	for _, hook := range hooks {
+		hook(cc, command, param)
+	}
+}
@@ -0,0 +1,78 @@
+package ftpserver
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+var errNoRemovalsToday = errors.New("no removals today")
+
+func TestCommandHooks(t *testing.T) {
+	server := NewTestServer(t, false)
+
+	server.Use(func(_ ClientContext, command string, _ string) error {
+		if command == "MKD" {
+			return HookError{Code: StatusCommandNotImplemented, Message: "MKD is administratively denied"}
+		}
+
+		return nil
+	})
+	server.Use(func(_ ClientContext, command string, _ string) error {
+		if command == "RMD" {
+			return errNoRemovalsToday
+		}
+
+		return nil
+	})
+
+	var postMutex sync.Mutex
+
+	postCommands := make(map[string]int)
+
+	server.UseAfter(func(_ ClientContext, command string, _ string) {
+		postMutex.Lock()
+		defer postMutex.Unlock()
+
+		postCommands[command]++
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, _, err := raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+
+	// a hook can short-circuit a command with a custom status code
+	returnCode, response, err := raw.SendCommand("MKD dir")
+	require.NoError(t, err)
+	require.Equal(t, StatusCommandNotImplemented, returnCode, response)
+	require.Equal(t, "MKD is administratively denied", response)
+
+	// a plain error is reported with a 550
+	returnCode, response, err = raw.SendCommand("RMD dir")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, returnCode, response)
+	require.Equal(t, errNoRemovalsToday.Error(), response)
+
+	postMutex.Lock()
+	defer postMutex.Unlock()
+
+	require.Equal(t, 1, postCommands["NOOP"])
+	require.Zero(t, postCommands["MKD"], "a short-circuited command should not reach the post hooks")
+}
@@ -0,0 +1,172 @@
+// Package ftpserver - login throttling and brute force protection
+package ftpserver
+
+import (
+	"sync"
+	"time"
+)
+
+// LoginThrottler counts failed logins per source IP so offending IPs can be
+// temporarily banned, see Settings.MaxFailedLoginsPerIP. Implementations
+// must be safe for concurrent use. The built-in in-memory store suits a
+// single node; deployments spanning several nodes can share the counters
+// through an implementation backed by Redis or similar
+type LoginThrottler interface {
+	// LoginAllowed tells whether the source IP may attempt to log in,
+	// false when it is currently banned
+	LoginAllowed(sourceIP string) bool
+
+	// RecordFailure counts a failed login from the source IP, returning
+	// true when this failure crossed the threshold and banned the IP
+	RecordFailure(sourceIP string) bool
+}
+
+// Default sliding window and ban duration of the built-in login throttler,
+// applied when the corresponding settings are left at 0
+const (
+	defaultLoginFailureWindow = 10 * time.Minute
+	defaultLoginBanDuration   = 10 * time.Minute
+)
+
+// memoryLoginThrottler is the built-in LoginThrottler: failed login
+// timestamps per source IP over a sliding window, kept in memory. The
+// counters die with the process
+type memoryLoginThrottler struct {
+	server    *FtpServer
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	bans      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newMemoryLoginThrottler(server *FtpServer) *memoryLoginThrottler {
+	return &memoryLoginThrottler{
+		server:   server,
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]time.Time),
+	}
+}
+
+// windows returns the sliding window and ban duration currently configured,
+// the defaults when the settings leave them at 0
+func (throttler *memoryLoginThrottler) windows() (time.Duration, time.Duration) {
+	settings := throttler.server.getSettings()
+
+	window := defaultLoginFailureWindow
+	if settings.LoginFailureWindow > 0 {
+		window = time.Duration(settings.LoginFailureWindow) * time.Second
+	}
+
+	ban := defaultLoginBanDuration
+	if settings.LoginBanDuration > 0 {
+		ban = time.Duration(settings.LoginBanDuration) * time.Second
+	}
+
+	return window, ban
+}
+
+// sweep drops the expired failure timestamps and bans of every IP, so
+// sources that failed once and never came back do not keep an entry forever,
+// e.g. during a distributed brute force. It must be called with mu held and
+// runs at most once per window
+func (throttler *memoryLoginThrottler) sweep(now time.Time, window time.Duration) {
+	if now.Sub(throttler.lastSweep) < window {
+		return
+	}
+
+	throttler.lastSweep = now
+	cutoff := now.Add(-window)
+
+	for sourceIP, failures := range throttler.failures {
+		kept := failures[:0]
+
+		for _, failedAt := range failures {
+			if failedAt.After(cutoff) {
+				kept = append(kept, failedAt)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(throttler.failures, sourceIP)
+		} else {
+			throttler.failures[sourceIP] = kept
+		}
+	}
+
+	for sourceIP, until := range throttler.bans {
+		if now.After(until) {
+			delete(throttler.bans, sourceIP)
+		}
+	}
+}
+
+func (throttler *memoryLoginThrottler) LoginAllowed(sourceIP string) bool {
+	window, _ := throttler.windows()
+
+	throttler.mu.Lock()
+	defer throttler.mu.Unlock()
+
+	throttler.sweep(time.Now(), window)
+
+	until, banned := throttler.bans[sourceIP]
+	if !banned {
+		return true
+	}
+
+	if time.Now().After(until) {
+		delete(throttler.bans, sourceIP)
+
+		return true
+	}
+
+	return false
+}
+
+func (throttler *memoryLoginThrottler) RecordFailure(sourceIP string) bool {
+	window, ban := throttler.windows()
+	threshold := throttler.server.getSettings().MaxFailedLoginsPerIP
+
+	throttler.mu.Lock()
+	defer throttler.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-window)
+
+	throttler.sweep(now, window)
+
+	// only the failures still inside the sliding window count
+	var recent []time.Time
+
+	for _, failedAt := range throttler.failures[sourceIP] {
+		if failedAt.After(cutoff) {
+			recent = append(recent, failedAt)
+		}
+	}
+
+	recent = append(recent, now)
+
+	if threshold > 0 && len(recent) >= threshold {
+		delete(throttler.failures, sourceIP)
+		throttler.bans[sourceIP] = now.Add(ban)
+
+		return true
+	}
+
+	throttler.failures[sourceIP] = recent
+
+	return false
+}
+
+// loginThrottler returns the store counting failed logins per source IP: the
+// one the settings provide, or the built-in in-memory one
+func (server *FtpServer) loginThrottler() LoginThrottler {
+	if custom := server.getSettings().LoginThrottler; custom != nil {
+		return custom
+	}
+
+	server.throttlerOnce.Do(func() {
+		server.throttler = newMemoryLoginThrottler(server)
+	})
+
+	return server.throttler
+}
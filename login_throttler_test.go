@@ -0,0 +1,49 @@
+package ftpserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryLoginThrottlerSweep(t *testing.T) {
+	driver := &TestServerDriver{Settings: &Settings{
+		MaxFailedLoginsPerIP: 3,
+		LoginFailureWindow:   1,
+		LoginBanDuration:     1,
+	}}
+	driver.Init()
+	server := NewFtpServer(driver)
+	require.NoError(t, server.loadSettings())
+
+	throttler := newMemoryLoginThrottler(server)
+
+	// a distributed attempt leaves one entry per source IP, none banned
+	for i := 0; i < 10; i++ {
+		require.False(t, throttler.RecordFailure(fmt.Sprintf("10.0.0.%d", i)))
+	}
+
+	// a single source crossing the threshold gets banned
+	require.False(t, throttler.RecordFailure("10.0.1.1"))
+	require.False(t, throttler.RecordFailure("10.0.1.1"))
+	require.True(t, throttler.RecordFailure("10.0.1.1"))
+	require.False(t, throttler.LoginAllowed("10.0.1.1"))
+
+	throttler.mu.Lock()
+	require.Len(t, throttler.failures, 10)
+	require.Len(t, throttler.bans, 1)
+	throttler.mu.Unlock()
+
+	// once the window and the ban expired, the next call sweeps every stale
+	// entry instead of keeping them until their source IP shows up again
+	time.Sleep(1100 * time.Millisecond)
+
+	require.True(t, throttler.LoginAllowed("10.0.1.1"))
+
+	throttler.mu.Lock()
+	require.Empty(t, throttler.failures)
+	require.Empty(t, throttler.bans)
+	throttler.mu.Unlock()
+}
@@ -0,0 +1,33 @@
+package ftpserver
+
+import "time"
+
+// MetricsCollector receives counters and timings from the server so they can
+// be exported to a monitoring system (Prometheus, StatsD, ...) without
+// patching the command handlers. It is enabled by setting the
+// FtpServer.MetricsCollector field. Implementations must be safe for
+// concurrent use: the callbacks are invoked from every session goroutine
+type MetricsCollector interface {
+	// ConnectionOpened and ConnectionClosed are called when a control
+	// connection starts being served and when it ends
+	ConnectionOpened()
+	ConnectionClosed()
+
+	// LoginSucceeded and LoginFailed are called after every authentication
+	// attempt
+	LoginSucceeded()
+	LoginFailed()
+
+	// CommandProcessed is called after every executed command with its verb
+	// and the time the server spent handling it
+	CommandProcessed(verb string, duration time.Duration)
+
+	// TransferStarted and TransferEnded delimit every file transfer, so the
+	// number of active transfers can be gauged
+	TransferStarted()
+	TransferEnded()
+
+	// DataTransferred reports the number of bytes just moved on a data
+	// connection, in the upload or the download direction
+	DataTransferred(uploadedBytes, downloadedBytes int64)
+}
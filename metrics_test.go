@@ -0,0 +1,153 @@
+package ftpserver
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+// testMetricsCollector records every callback so the tests can assert on the
+// counters once the session is over
+type testMetricsCollector struct {
+	mu              sync.Mutex
+	connections     int
+	disconnections  int
+	logins          int
+	failedLogins    int
+	commands        map[string]int
+	activeTransfers int
+	transfers       int
+	uploaded        int64
+	downloaded      int64
+}
+
+func (c *testMetricsCollector) ConnectionOpened() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.connections++
+}
+
+func (c *testMetricsCollector) ConnectionClosed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.disconnections++
+}
+
+func (c *testMetricsCollector) LoginSucceeded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.logins++
+}
+
+func (c *testMetricsCollector) LoginFailed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failedLogins++
+}
+
+func (c *testMetricsCollector) CommandProcessed(verb string, _ time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.commands == nil {
+		c.commands = make(map[string]int)
+	}
+
+	c.commands[verb]++
+}
+
+func (c *testMetricsCollector) TransferStarted() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.activeTransfers++
+	c.transfers++
+}
+
+func (c *testMetricsCollector) TransferEnded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.activeTransfers--
+}
+
+func (c *testMetricsCollector) DataTransferred(uploadedBytes, downloadedBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.uploaded += uploadedBytes
+	c.downloaded += downloadedBytes
+}
+
+func TestMetricsCollector(t *testing.T) {
+	collector := &testMetricsCollector{}
+	driver := &TestServerDriver{Debug: false}
+	driver.Init()
+
+	// the collector must be in place before the server starts serving, the
+	// usual helper would leave a window where a session could miss it
+	server := NewFtpServer(driver)
+	server.MetricsCollector = collector
+	require.NoError(t, server.Listen())
+
+	t.Cleanup(func() {
+		mustStopServer(server)
+	})
+
+	go func() {
+		_ = server.Serve()
+	}()
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	content := strings.Repeat("x", 1024)
+	require.NoError(t, client.Store("file.bin", strings.NewReader(content)))
+	ftpDownloadAndHash(t, client, "file.bin")
+	require.NoError(t, client.Close())
+
+	// a failed login is counted separately
+	badConf := goftp.Config{
+		User:     authUser,
+		Password: authPass + "_wrong",
+	}
+	badClient, err := goftp.DialConfig(badConf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	_, err = badClient.OpenRawConn()
+	require.Error(t, err, "The login should have failed")
+	_ = badClient.Close()
+
+	require.Eventually(t, func() bool {
+		collector.mu.Lock()
+		defer collector.mu.Unlock()
+
+		return collector.disconnections == collector.connections
+	}, 5*time.Second, 10*time.Millisecond, "every connection should have been closed")
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	require.GreaterOrEqual(t, collector.connections, 2)
+	require.Equal(t, 1, collector.logins)
+	require.Equal(t, 1, collector.failedLogins)
+	require.Equal(t, 2, collector.transfers)
+	require.Equal(t, 0, collector.activeTransfers)
+	require.Equal(t, int64(1024), collector.uploaded)
+	require.Equal(t, int64(1024), collector.downloaded)
+	require.Equal(t, 1, collector.commands["STOR"])
+	require.Equal(t, 1, collector.commands["RETR"])
+	require.GreaterOrEqual(t, collector.commands["PASS"], 1)
+}
@@ -0,0 +1,101 @@
+package ftpserver
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrPassivePortInUse is returned by a PassiveCoordination implementation when
+// the advertised host:port is already claimed by another server instance
+var ErrPassivePortInUse = errors.New("passive port is already advertised by another instance")
+
+// PassiveCoordination synchronizes passive-port advertisement between server
+// instances reachable through the same public address, typically behind a
+// NAT or a load balancer forwarding a shared port range. The PASV/EPSV
+// handler claims the port it is about to advertise and gives it back once
+// the data listener is closed, so two instances never hand the same
+// host:port to different clients. Implementations backed by an external
+// store (Redis, etcd, ...) are expected to attach a TTL to each claim and
+// use Heartbeat to keep it alive, so a crashed instance cannot leak ports
+type PassiveCoordination interface {
+	// Reserve claims the advertised host:port. Returning an error makes the
+	// server pick another port within its passive range
+	Reserve(host string, port int) error
+
+	// Heartbeat renews the claim while the server is still waiting for the
+	// client to connect back
+	Heartbeat(host string, port int)
+
+	// Release gives the claim back once the data listener is closed
+	Release(host string, port int)
+}
+
+// DefaultPassiveCoordinationTTL is how long an InMemoryPassiveCoordination
+// claim survives without a heartbeat
+const DefaultPassiveCoordinationTTL = time.Minute
+
+// InMemoryPassiveCoordination is the single-node PassiveCoordination
+// implementation: claims live in a map and expire after a TTL, which makes
+// it a reference for external-store implementations and a safety net
+// against listeners that were never released
+type InMemoryPassiveCoordination struct {
+	mutex        sync.Mutex
+	ttl          time.Duration
+	reservations map[string]time.Time
+}
+
+// NewInMemoryPassiveCoordination instantiates an in-memory coordinator. A
+// non-positive ttl falls back to DefaultPassiveCoordinationTTL
+func NewInMemoryPassiveCoordination(ttl time.Duration) *InMemoryPassiveCoordination {
+	if ttl <= 0 {
+		ttl = DefaultPassiveCoordinationTTL
+	}
+
+	return &InMemoryPassiveCoordination{
+		ttl:          ttl,
+		reservations: make(map[string]time.Time),
+	}
+}
+
+func passiveReservationKey(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Reserve claims host:port until it is released or its TTL runs out
+func (coord *InMemoryPassiveCoordination) Reserve(host string, port int) error {
+	key := passiveReservationKey(host, port)
+
+	coord.mutex.Lock()
+	defer coord.mutex.Unlock()
+
+	if expiry, found := coord.reservations[key]; found && time.Now().Before(expiry) {
+		return ErrPassivePortInUse
+	}
+
+	coord.reservations[key] = time.Now().Add(coord.ttl)
+
+	return nil
+}
+
+// Heartbeat pushes back the expiry of an existing claim
+func (coord *InMemoryPassiveCoordination) Heartbeat(host string, port int) {
+	key := passiveReservationKey(host, port)
+
+	coord.mutex.Lock()
+	defer coord.mutex.Unlock()
+
+	if _, found := coord.reservations[key]; found {
+		coord.reservations[key] = time.Now().Add(coord.ttl)
+	}
+}
+
+// Release drops the claim on host:port
+func (coord *InMemoryPassiveCoordination) Release(host string, port int) {
+	coord.mutex.Lock()
+	defer coord.mutex.Unlock()
+
+	delete(coord.reservations, passiveReservationKey(host, port))
+}
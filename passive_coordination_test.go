@@ -0,0 +1,152 @@
+package ftpserver
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryPassiveCoordination(t *testing.T) {
+	coordinator := NewInMemoryPassiveCoordination(time.Hour)
+
+	require.NoError(t, coordinator.Reserve("198.51.100.1", 2121))
+	require.ErrorIs(t, coordinator.Reserve("198.51.100.1", 2121), ErrPassivePortInUse)
+
+	// another host or port is an independent claim
+	require.NoError(t, coordinator.Reserve("198.51.100.2", 2121))
+	require.NoError(t, coordinator.Reserve("198.51.100.1", 2122))
+
+	coordinator.Release("198.51.100.1", 2121)
+	require.NoError(t, coordinator.Reserve("198.51.100.1", 2121))
+}
+
+func TestInMemoryPassiveCoordinationExpiry(t *testing.T) {
+	coordinator := NewInMemoryPassiveCoordination(20 * time.Millisecond)
+
+	require.NoError(t, coordinator.Reserve("198.51.100.1", 2121))
+	time.Sleep(30 * time.Millisecond)
+
+	// the claim expired without a heartbeat, so it can be taken again
+	require.NoError(t, coordinator.Reserve("198.51.100.1", 2121))
+
+	coordinator.Heartbeat("198.51.100.1", 2121)
+	require.ErrorIs(t, coordinator.Reserve("198.51.100.1", 2121), ErrPassivePortInUse)
+}
+
+// countingPassiveCoordinator wraps the in-memory coordinator so tests can
+// check that every advertised port was claimed and given back
+type countingPassiveCoordinator struct {
+	*InMemoryPassiveCoordination
+	mu       sync.Mutex
+	reserved int
+	released int
+	failAll  bool
+}
+
+func (coord *countingPassiveCoordinator) Reserve(host string, port int) error {
+	coord.mu.Lock()
+	defer coord.mu.Unlock()
+
+	if coord.failAll {
+		return ErrPassivePortInUse
+	}
+
+	if err := coord.InMemoryPassiveCoordination.Reserve(host, port); err != nil {
+		return err
+	}
+
+	coord.reserved++
+
+	return nil
+}
+
+func (coord *countingPassiveCoordinator) Release(host string, port int) {
+	coord.mu.Lock()
+	defer coord.mu.Unlock()
+
+	coord.InMemoryPassiveCoordination.Release(host, port)
+	coord.released++
+}
+
+func (coord *countingPassiveCoordinator) setFailAll(failAll bool) {
+	coord.mu.Lock()
+	defer coord.mu.Unlock()
+
+	coord.failAll = failAll
+}
+
+func (coord *countingPassiveCoordinator) counters() (int, int) {
+	coord.mu.Lock()
+	defer coord.mu.Unlock()
+
+	return coord.reserved, coord.released
+}
+
+func TestPassiveCoordinatorTransfers(t *testing.T) {
+	coordinator := &countingPassiveCoordinator{InMemoryPassiveCoordination: NewInMemoryPassiveCoordination(0)}
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Settings: &Settings{PassiveCoordinator: coordinator},
+	})
+
+	conf := goftp.Config{User: authUser, Password: authPass}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	file := createTemporaryFile(t, 1024)
+	ftpUpload(t, client, file, "file.bin")
+	ftpDownloadAndHash(t, client, "file.bin")
+
+	// each advertised port was claimed once and given back once
+	require.Eventually(t, func() bool {
+		reserved, released := coordinator.counters()
+
+		return reserved >= 2 && reserved == released
+	}, time.Second, 10*time.Millisecond)
+
+	// when no port can be claimed the passive request is refused
+	coordinator.setFailAll(true)
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, _, err := raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, returnCode)
+}
+
+func TestPassiveCoordinatorReleaseOnSetupFailure(t *testing.T) {
+	coordinator := &countingPassiveCoordinator{InMemoryPassiveCoordination: NewInMemoryPassiveCoordination(0)}
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		errPassiveListener: os.ErrClosed,
+		Settings:           &Settings{PassiveCoordinator: coordinator},
+	})
+
+	conf := goftp.Config{User: authUser, Password: authPass}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, _, err := raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, returnCode)
+
+	// a setup failure after the claim must give the port back right away,
+	// not wait for an eventual TTL expiry
+	reserved, released := coordinator.counters()
+	require.GreaterOrEqual(t, reserved, 1)
+	require.Equal(t, reserved, released)
+}
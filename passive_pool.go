@@ -0,0 +1,161 @@
+package ftpserver
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/fclairamb/go-log"
+)
+
+// passivePortPool keeps one TCP listener per port of the passive transfer
+// port range, bound once when the server starts listening. PASV borrows a
+// listener from the pool and gives it back when the transfer ends, so the
+// per-call bind/close cost disappears and a burst of transfers cannot leak
+// ports through listeners left in TIME_WAIT
+type passivePortPool struct {
+	mutex    sync.Mutex
+	free     []*net.TCPListener
+	borrowed int
+	closed   bool
+	logger   log.Logger
+}
+
+// newPassivePortPool binds every port of the range. Ports that are already
+// taken by another process are skipped with a warning; the pool refuses to
+// start only when none of them could be bound
+func newPassivePortPool(portRange *PortRange, logger log.Logger) (*passivePortPool, error) {
+	pool := &passivePortPool{logger: logger}
+
+	for port := portRange.Start; port <= portRange.End; port++ {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+		if err != nil {
+			logger.Warn("Could not pre-bind passive port", "port", port, "err", err)
+
+			continue
+		}
+
+		pool.free = append(pool.free, listener)
+	}
+
+	if len(pool.free) == 0 {
+		return nil, ErrNoAvailableListeningPort
+	}
+
+	return pool, nil
+}
+
+// borrow hands out a pre-bound listener, or ErrNoAvailableListeningPort when
+// every port of the range is currently lent to a transfer
+func (pool *passivePortPool) borrow() (*net.TCPListener, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.closed || len(pool.free) == 0 {
+		return nil, ErrNoAvailableListeningPort
+	}
+
+	listener := pool.free[len(pool.free)-1]
+	pool.free = pool.free[:len(pool.free)-1]
+	pool.borrowed++
+
+	return listener, nil
+}
+
+// giveBack returns a borrowed listener after a health check: connections the
+// previous transfer left pending are drained, and a listener whose socket
+// broke is bound again on the same port, or dropped from the pool when even
+// that fails
+func (pool *passivePortPool) giveBack(listener *net.TCPListener) {
+	healthy := pool.drain(listener)
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.borrowed--
+
+	if pool.closed {
+		pool.closeListener(listener)
+
+		return
+	}
+
+	if !healthy {
+		if listener = pool.rebind(listener); listener == nil {
+			return
+		}
+	}
+
+	pool.free = append(pool.free, listener)
+}
+
+// drain accepts and discards whatever is already queued on the listener,
+// reporting whether the socket is still usable
+func (pool *passivePortPool) drain(listener *net.TCPListener) bool {
+	if err := listener.SetDeadline(time.Now()); err != nil {
+		return false
+	}
+
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+
+			return false
+		}
+
+		connection.Close() //nolint:errcheck,gosec // stale connection of a past transfer
+	}
+
+	return listener.SetDeadline(time.Time{}) == nil
+}
+
+// rebind replaces a broken listener with a fresh one on the same port
+func (pool *passivePortPool) rebind(listener *net.TCPListener) *net.TCPListener {
+	port := listener.Addr().(*net.TCPAddr).Port //nolint:forcetypeassert
+	pool.closeListener(listener)
+
+	newListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+	if err != nil {
+		pool.logger.Warn("Dropping broken passive port from the pool", "port", port, "err", err)
+
+		return nil
+	}
+
+	return newListener
+}
+
+func (pool *passivePortPool) closeListener(listener *net.TCPListener) {
+	if err := listener.Close(); err != nil {
+		pool.logger.Warn("Problem closing pooled passive listener", "err", err)
+	}
+}
+
+// stats reports how many pre-bound listeners are free and lent out
+func (pool *passivePortPool) stats() (free int, borrowed int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return len(pool.free), pool.borrowed
+}
+
+// Close releases every free listener; borrowed ones are closed as the
+// transfers holding them give them back
+func (pool *passivePortPool) Close() error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.closed = true
+
+	for _, listener := range pool.free {
+		pool.closeListener(listener)
+	}
+
+	pool.free = nil
+
+	return nil
+}
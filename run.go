@@ -0,0 +1,92 @@
+package ftpserver
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// drainPollInterval is how often RunUntilSignal checks whether the last
+// session ended while draining
+const drainPollInterval = 100 * time.Millisecond
+
+// RunOptions configures RunUntilSignal
+type RunOptions struct {
+	// Signals ending the server; SIGINT and SIGTERM when empty
+	Signals []os.Signal
+	// DrainTimeout is how long established sessions are given to finish
+	// after the first signal, while new connections are refused. Zero
+	// disconnects everyone immediately
+	DrainTimeout time.Duration
+	// Reason reported to the sessions that are still connected when the
+	// server finally goes away; ShutdownMaintenance when left to the
+	// ShutdownNone default
+	Reason ShutdownReason
+}
+
+// RunUntilSignal serves until one of the configured signals arrives, then
+// shuts the server down gracefully: new connections are refused while the
+// established sessions get DrainTimeout to finish, and whoever remains is
+// disconnected with the configured reason. A second signal skips the drain.
+// It returns when the server stopped, with the error that ended it, and
+// saves embedding programs from rewriting this wiring around ListenAndServe,
+// Stop and in-flight transfers
+func RunUntilSignal(server *FtpServer, opts RunOptions) error {
+	signals := opts.Signals
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, signals...)
+
+	defer signal.Stop(signalCh)
+
+	serveErr := make(chan error, 1)
+
+	go func() { serveErr <- server.ListenAndServe() }()
+
+	select {
+	case err := <-serveErr:
+		// the server ended on its own, e.g. it could not listen
+		return err
+	case <-signalCh:
+	}
+
+	if opts.DrainTimeout > 0 {
+		server.setDraining(true)
+		server.waitForDrain(opts.DrainTimeout, signalCh)
+	}
+
+	reason := opts.Reason
+	if reason == ShutdownNone {
+		reason = ShutdownMaintenance
+	}
+
+	if err := server.Shutdown(reason); err != nil {
+		return err
+	}
+
+	return <-serveErr
+}
+
+// waitForDrain blocks until every session ended, the timeout expired or
+// another signal arrived
+func (server *FtpServer) waitForDrain(timeout time.Duration, signalCh <-chan os.Signal) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for server.clientsCount() > 0 {
+		select {
+		case <-deadline.C:
+			return
+		case <-signalCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package ftpserver
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunUntilSignal(t *testing.T) {
+	driver := &TestServerDriver{Debug: false}
+	driver.Init()
+	server := NewFtpServer(driver)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- RunUntilSignal(server, RunOptions{
+			Signals:      []os.Signal{syscall.SIGUSR1},
+			DrainTimeout: 5 * time.Second,
+		})
+	}()
+
+	require.Eventually(t, func() bool { return server.Addr() != "" }, time.Second, 10*time.Millisecond,
+		"The server should start listening")
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	// force the lazy client to actually open its session
+	_, err = client.ReadDir("/")
+	require.NoError(t, err)
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+
+	// the established session survives the signal while the server drains
+	require.Eventually(t, func() bool { return server.isDraining() }, time.Second, 10*time.Millisecond,
+		"The server should be draining after the signal")
+
+	_, err = client.ReadDir("/")
+	require.NoError(t, err, "The established session should outlive the signal")
+
+	// once the last session ends the helper returns without waiting for the
+	// full drain timeout
+	require.NoError(t, client.Close())
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("RunUntilSignal did not return after the last session ended")
+	}
+}
+
+func TestRunUntilSignalListenFailure(t *testing.T) {
+	driver := &TestServerDriver{Debug: false}
+	driver.Init()
+	driver.Settings.ListenAddr = "999.999.999.999:0" // unresolvable, the listen must fail
+
+	server := NewFtpServer(driver)
+
+	err := RunUntilSignal(server, RunOptions{Signals: []os.Signal{syscall.SIGUSR1}})
+	require.Error(t, err, "The listen failure should be reported")
+}
@@ -2,10 +2,14 @@
 package ftpserver
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -24,6 +28,18 @@ type CommandDescription struct {
 	Fn              func(*clientHandler, string) error // Function to handle it
 }
 
+// CustomCommandDescription describes a proprietary verb registered on a single
+// server instance through RegisterCommand or the
+// MainDriverExtensionCustomCommands extension
+type CustomCommandDescription struct {
+	// Open makes the command available before the client has logged in
+	Open bool
+	// Fn handles the command; the returned code and message form the reply
+	// sent to the client. A returned error is reported as a 500-series reply
+	// instead
+	Fn func(cc ClientContext, param string) (int, string, error)
+}
+
 // This is shared between FtpServer instances as there's no point in making the FTP commands behave differently
 // between them.
 var commandsMap = map[string]*CommandDescription{ //nolint:gochecknoglobals
@@ -37,7 +53,7 @@ var commandsMap = map[string]*CommandDescription{ //nolint:gochecknoglobals
 	"AUTH": {Fn: (*clientHandler).handleAUTH, Open: true},
 	"PROT": {Fn: (*clientHandler).handlePROT, Open: true},
 	"PBSZ": {Fn: (*clientHandler).handlePBSZ, Open: true},
-	"CCC":  {Fn: (*clientHandler).handleNotImplemented},
+	"CCC":  {Fn: (*clientHandler).handleCCC, Open: true},
 	"CONF": {Fn: (*clientHandler).handleNotImplemented},
 	"ENC":  {Fn: (*clientHandler).handleNotImplemented},
 	"MIC":  {Fn: (*clientHandler).handleNotImplemented},
@@ -53,7 +69,7 @@ var commandsMap = map[string]*CommandDescription{ //nolint:gochecknoglobals
 	"ABOR": {Fn: (*clientHandler).handleABOR, SpecialAction: true},
 	"CSID": {Fn: (*clientHandler).handleNotImplemented},
 	"HELP": {Fn: (*clientHandler).handleNotImplemented},
-	"HOST": {Fn: (*clientHandler).handleNotImplemented},
+	"HOST": {Fn: (*clientHandler).handleHOST, Open: true},
 	"LANG": {Fn: (*clientHandler).handleNotImplemented},
 	"XRSQ": {Fn: (*clientHandler).handleNotImplemented},
 	"XSEM": {Fn: (*clientHandler).handleNotImplemented},
@@ -61,12 +77,12 @@ var commandsMap = map[string]*CommandDescription{ //nolint:gochecknoglobals
 
 	// File access
 	"SIZE":    {Fn: (*clientHandler).handleSIZE},
-	"DSIZ":    {Fn: (*clientHandler).handleNotImplemented},
+	"DSIZ":    {Fn: (*clientHandler).handleDSIZ},
 	"STAT":    {Fn: (*clientHandler).handleSTAT, SpecialAction: true},
 	"MDTM":    {Fn: (*clientHandler).handleMDTM},
 	"MFMT":    {Fn: (*clientHandler).handleMFMT},
 	"MFF":     {Fn: (*clientHandler).handleNotImplemented},
-	"MFCT":    {Fn: (*clientHandler).handleNotImplemented},
+	"MFCT":    {Fn: (*clientHandler).handleMFCT},
 	"RETR":    {Fn: (*clientHandler).handleRETR, TransferRelated: true},
 	"STOR":    {Fn: (*clientHandler).handleSTOR, TransferRelated: true},
 	"STOU":    {Fn: (*clientHandler).handleNotImplemented},
@@ -77,6 +93,7 @@ var commandsMap = map[string]*CommandDescription{ //nolint:gochecknoglobals
 	"RNTO":    {Fn: (*clientHandler).handleRNTO},
 	"ALLO":    {Fn: (*clientHandler).handleALLO},
 	"REST":    {Fn: (*clientHandler).handleREST},
+	"RANG":    {Fn: (*clientHandler).handleRANG},
 	"SITE":    {Fn: (*clientHandler).handleSITE},
 	"HASH":    {Fn: (*clientHandler).handleHASH},
 	"XCRC":    {Fn: (*clientHandler).handleCRC32},
@@ -118,7 +135,7 @@ var commandsMap = map[string]*CommandDescription{ //nolint:gochecknoglobals
 	"PORT": {Fn: (*clientHandler).handlePORT},
 	"LRPT": {Fn: (*clientHandler).handleNotImplemented},
 	"EPRT": {Fn: (*clientHandler).handlePORT},
-	"REIN": {Fn: (*clientHandler).handleNotImplemented},
+	"REIN": {Fn: (*clientHandler).handleREIN, Open: true},
 }
 
 var specialAttentionCommands = []string{"ABOR", "STAT", "QUIT"} //nolint:gochecknoglobals
@@ -126,11 +143,203 @@ var specialAttentionCommands = []string{"ABOR", "STAT", "QUIT"} //nolint:gocheck
 // FtpServer is where everything is stored
 // We want to keep it as simple as possible
 type FtpServer struct {
-	Logger        log.Logger   // fclairamb/go-log generic logger
-	settings      *Settings    // General settings
-	listener      net.Listener // listener used to receive files
-	clientCounter uint32       // Clients counter
-	driver        MainDriver   // Driver to handle the client authentication and the file access driver selection
+	Logger            log.Logger                     // fclairamb/go-log generic logger
+	AccessLogger      AccessLogger                   // Optional access logger, receiving one record per command and per transfer
+	MetricsCollector  MetricsCollector               // Optional metrics collector, receiving counters and timings
+	settings          atomic.Pointer[Settings]       // General settings (atomically swappable snapshot)
+	listenerMutex     sync.RWMutex                   // mutex to protect the listener, Addr may poll it from another goroutine
+	listener          net.Listener                   // listener used to receive files
+	clientCounter     uint32                         // Clients counter
+	clientsMutex      sync.Mutex                     // mutex to protect the clients map
+	clients           map[uint32]*clientHandler      // Connected clients indexed by their ID
+	userSessionsMux   sync.Mutex                     // mutex to protect the per-user session registry
+	userSessions      map[string][]*clientHandler    // Authenticated sessions keyed by username
+	statsMutex        sync.Mutex                     // mutex to protect the per-user command counters
+	commandStats      map[string]UserCommandStats    // Per-user command usage counters
+	hooksMutex        sync.RWMutex                   // mutex to protect the command hooks
+	preCommandHooks   []PreCommandHook               // Hooks called before each command
+	postCommandHooks  []PostCommandHook              // Hooks called after each executed command
+	driver            MainDriver                     // Driver to handle the client authentication and the file access driver selection
+	customCommands    map[string]*CommandDescription // Per-instance verbs shadowing commandsMap, see RegisterCommand
+	passivePool       *passivePortPool               // Pre-bound passive listeners, nil unless PrebindPassivePorts is enabled
+	draining          int32                          // 1 when new connections are refused, see "SITE DRAIN" (atomic access)
+	dataListenerCount int32                          // Open passive data listeners (atomic access)
+	dataConnCount     int32                          // Open data connections (atomic access)
+	transferSlotMu    sync.Mutex                     // mutex to protect the running transfer counters
+	transferCount     int                            // Running file transfers, see MaxConcurrentTransfers
+	transferClasses   map[string]int                 // Running transfers per priority class, see TransferClassLimits
+	ticketKeyOnce     sync.Once                      // guards the session ticket key generation
+	ticketKey         [32]byte                       // TLS session ticket key shared by every handshake, see Settings.TLSSessionResumption
+	throttlerOnce     sync.Once                      // guards the built-in login throttler creation
+	throttler         LoginThrottler                 // built-in in-memory login throttler, see Settings.MaxFailedLoginsPerIP
+}
+
+// RegisterCommand adds a proprietary verb to this server instance, or replaces
+// a built-in one. The registry is read without locking once clients are
+// connected, so commands must be registered before the server starts serving
+func (server *FtpServer) RegisterCommand(verb string, description CustomCommandDescription) {
+	if server.customCommands == nil {
+		server.customCommands = make(map[string]*CommandDescription)
+	}
+
+	handler := description.Fn
+	server.customCommands[strings.ToUpper(verb)] = &CommandDescription{
+		Open: description.Open,
+		Fn: func(c *clientHandler, param string) error {
+			code, message, err := handler(c, param)
+			if err != nil {
+				return err
+			}
+
+			c.writeMessage(code, message)
+
+			return nil
+		},
+	}
+}
+
+// commandDescription resolves a verb against the per-instance registry first,
+// so registered commands can shadow the built-in ones
+func (server *FtpServer) commandDescription(command string) *CommandDescription {
+	if description, found := server.customCommands[command]; found {
+		return description
+	}
+
+	return commandsMap[command]
+}
+
+func (server *FtpServer) registerClient(c *clientHandler) {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+
+	if server.clients == nil {
+		server.clients = make(map[uint32]*clientHandler)
+	}
+
+	server.clients[c.id] = c
+}
+
+func (server *FtpServer) unregisterClient(c *clientHandler) {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+
+	delete(server.clients, c.id)
+}
+
+func (server *FtpServer) clientsCount() int {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+
+	return len(server.clients)
+}
+
+// registerUserSession adds an authenticated session to the per-user registry,
+// enforcing Settings.MaxConnectionsPerUser. It reports whether the session
+// was accepted
+func (server *FtpServer) registerUserSession(user string, c *clientHandler) bool {
+	maxPerUser := server.getSettings().MaxConnectionsPerUser
+
+	server.userSessionsMux.Lock()
+	defer server.userSessionsMux.Unlock()
+
+	if maxPerUser > 0 && len(server.userSessions[user]) >= maxPerUser {
+		return false
+	}
+
+	if server.userSessions == nil {
+		server.userSessions = make(map[string][]*clientHandler)
+	}
+
+	server.userSessions[user] = append(server.userSessions[user], c)
+
+	return true
+}
+
+// unregisterUserSession removes a session from the per-user registry
+func (server *FtpServer) unregisterUserSession(user string, c *clientHandler) {
+	server.userSessionsMux.Lock()
+	defer server.userSessionsMux.Unlock()
+
+	sessions := server.userSessions[user]
+
+	for idx, session := range sessions {
+		if session == c {
+			server.userSessions[user] = append(sessions[:idx], sessions[idx+1:]...)
+
+			break
+		}
+	}
+
+	if len(server.userSessions[user]) == 0 {
+		delete(server.userSessions, user)
+	}
+}
+
+// UserSessions returns the currently connected sessions authenticated as the
+// given user
+func (server *FtpServer) UserSessions(user string) []ClientContext {
+	server.userSessionsMux.Lock()
+	defer server.userSessionsMux.Unlock()
+
+	sessions := make([]ClientContext, 0, len(server.userSessions[user]))
+	for _, session := range server.userSessions[user] {
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// clientByID returns the connected client with the given ID, nil when there
+// is none
+func (server *FtpServer) clientByID(id uint32) *clientHandler {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+
+	return server.clients[id]
+}
+
+// setDraining toggles the refusal of new connections. Established sessions
+// are not affected
+func (server *FtpServer) setDraining(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+
+	atomic.StoreInt32(&server.draining, value)
+}
+
+func (server *FtpServer) isDraining() bool {
+	return atomic.LoadInt32(&server.draining) != 0
+}
+
+// getSettings returns the current settings snapshot. Handlers should call it once
+// and read all the fields they need from the returned pointer so that a concurrent
+// CloneAndSwapSettings cannot give them a mix of old and new values
+func (server *FtpServer) getSettings() *Settings {
+	return server.settings.Load()
+}
+
+// CloneAndSwapSettings atomically replaces the server settings with a modified
+// shallow copy of the current ones. It allows toggling settings at runtime
+// (e.g. DisableSite or EnableCOMB) without racing with the connected clients:
+// handlers always read a complete snapshot, either the old or the new one.
+// It returns ErrNotListening when called before the settings have been loaded
+// by Listen
+func (server *FtpServer) CloneAndSwapSettings(modify func(settings *Settings)) error {
+	for {
+		current := server.settings.Load()
+		if current == nil {
+			return ErrNotListening
+		}
+
+		newSettings := *current
+		modify(&newSettings)
+
+		if server.settings.CompareAndSwap(current, &newSettings) {
+			return nil
+		}
+	}
 }
 
 func (server *FtpServer) loadSettings() error {
@@ -141,16 +350,35 @@ func (server *FtpServer) loadSettings() error {
 	}
 
 	if settings.PublicHost != "" {
-		settings.PublicHost, err = parseIPv4(settings.PublicHost)
+		settings.PublicHost, err = parsePublicHost(settings.PublicHost)
 		if err != nil {
 			return err
 		}
 	}
 
+	for i, fallback := range settings.PasvIPv4Fallbacks {
+		parsed, errParse := parsePublicHost(fallback)
+		if errParse != nil {
+			return errParse
+		}
+
+		if strings.Contains(parsed, ":") {
+			return &ipValidationError{error: fmt.Sprintf("passive fallback %#v is not an IPv4 address", fallback)}
+		}
+
+		settings.PasvIPv4Fallbacks[i] = parsed
+	}
+
 	if settings.Listener == nil && settings.ListenAddr == "" {
 		settings.ListenAddr = "0.0.0.0:2121"
 	}
 
+	if settings.Listener == nil {
+		if err := validateListenAddr(settings.ListenAddr); err != nil {
+			return err
+		}
+	}
+
 	// florent(2018-01-14): #58: IDLE timeout: Default idle timeout will be set at 900 seconds
 	if settings.IdleTimeout == 0 {
 		settings.IdleTimeout = 900
@@ -164,25 +392,164 @@ func (server *FtpServer) loadSettings() error {
 		settings.Banner = "ftpserver - golang FTP server"
 	}
 
-	server.settings = settings
+	if settings.ListRecentTimeFormat == "" {
+		settings.ListRecentTimeFormat = dateFormatStatTime
+	}
+
+	if settings.ListOldTimeFormat == "" {
+		settings.ListOldTimeFormat = dateFormatStatYear
+	}
+
+	if settings.TLSMinVersion != 0 && settings.TLSMaxVersion != 0 && settings.TLSMinVersion > settings.TLSMaxVersion {
+		server.Logger.Warn(
+			"TLS version range is inverted, every TLS handshake will fail",
+			"tlsMinVersion", settings.TLSMinVersion,
+			"tlsMaxVersion", settings.TLSMaxVersion,
+		)
+	}
+
+	if settings.TLSMinVersion != 0 && settings.TLSMinVersion < tls.VersionTLS12 {
+		server.Logger.Warn("TLS versions below 1.2 are deprecated", "tlsMinVersion", settings.TLSMinVersion)
+	}
+
+	if len(settings.TLSCipherSuites) > 0 && settings.TLSMinVersion >= tls.VersionTLS13 {
+		server.Logger.Warn("TLS 1.3 ignores the configured cipher suites")
+	}
+
+	server.settings.Store(settings)
 
 	return nil
 }
 
-func parseIPv4(publicHost string) (string, error) {
-	parsedIP := net.ParseIP(publicHost)
+// applyTLSOverrides applies the TLS hardening settings on top of the
+// configuration returned by the driver. The configuration is cloned before
+// being altered so drivers may safely return a shared instance. When the
+// driver implements MainDriverExtensionClientCertAuth a client certificate
+// is also requested during the handshake, to be verified per user once the
+// USER command is received
+func (server *FtpServer) applyTLSOverrides(tlsConfig *tls.Config) *tls.Config {
+	settings := server.getSettings()
+
+	_, requestClientCert := server.driver.(MainDriverExtensionClientCertAuth)
+
+	// the certificate ownership check on data connections needs the client
+	// certificate to be requested on every handshake too
+	if settings.ActiveConnectionsCheck == CertMatchRequired || settings.PasvConnectionsCheck == CertMatchRequired {
+		requestClientCert = true
+	}
+
+	shareTicketKeys := settings.TLSSessionResumption || settings.TLSSessionResumptionRequired
+
+	if tlsConfig == nil ||
+		(!requestClientCert && !shareTicketKeys && settings.TLSKeyLogWriter == nil &&
+			settings.TLSMinVersion == 0 && settings.TLSMaxVersion == 0 && len(settings.TLSCipherSuites) == 0) {
+		return tlsConfig
+	}
+
+	tlsConfig = tlsConfig.Clone()
+
+	if requestClientCert && tlsConfig.ClientAuth == tls.NoClientCert {
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+
+	if settings.TLSMinVersion != 0 {
+		tlsConfig.MinVersion = settings.TLSMinVersion
+	}
+
+	if settings.TLSMaxVersion != 0 {
+		tlsConfig.MaxVersion = settings.TLSMaxVersion
+	}
+
+	if len(settings.TLSCipherSuites) > 0 {
+		tlsConfig.CipherSuites = settings.TLSCipherSuites
+	}
+
+	if settings.TLSKeyLogWriter != nil {
+		tlsConfig.KeyLogWriter = settings.TLSKeyLogWriter
+	}
+
+	if shareTicketKeys {
+		tlsConfig.SetSessionTicketKeys([][32]byte{server.sessionTicketKey()})
+	}
+
+	return tlsConfig
+}
+
+// sessionTicketKey returns the session ticket key shared by every TLS
+// handshake of this server, generated on first use. Each handshake runs on a
+// fresh clone of the driver configuration, and clones rotate their ticket
+// keys independently: without a common key a ticket issued on the control
+// connection cannot resume anything on a data connection
+func (server *FtpServer) sessionTicketKey() [32]byte {
+	server.ticketKeyOnce.Do(func() {
+		if _, err := rand.Read(server.ticketKey[:]); err != nil {
+			server.Logger.Error("Could not generate the TLS session ticket key", "err", err)
+		}
+	})
+
+	return server.ticketKey
+}
+
+// splitHostZone separates an IPv6 scope ID ("fe80::1%eth0") from the IP literal
+func splitHostZone(host string) (string, string) {
+	if idx := strings.IndexByte(host, '%'); idx >= 0 {
+		return host[:idx], host[idx+1:]
+	}
+
+	return host, ""
+}
+
+// parsePublicHost validates and normalizes the public host declared in the
+// settings. IPv4 addresses are returned in their dotted-quad form, IPv6
+// addresses can be bracketed ("[fe80::1%eth0]") and carry a scope ID which
+// is preserved in the normalized form
+func parsePublicHost(publicHost string) (string, error) {
+	host := publicHost
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+
+	host, zone := splitHostZone(host)
+
+	parsedIP := net.ParseIP(host)
 	if parsedIP == nil {
 		return "", &ipValidationError{error: fmt.Sprintf("invalid passive IP %#v", publicHost)}
 	}
 
-	parsedIP = parsedIP.To4()
-	if parsedIP == nil {
-		return "", &ipValidationError{error: fmt.Sprintf("invalid IPv4 passive IP %#v", publicHost)}
+	if ipv4 := parsedIP.To4(); ipv4 != nil {
+		if zone != "" {
+			return "", &ipValidationError{error: fmt.Sprintf("scope ID is only valid on an IPv6 passive IP %#v", publicHost)}
+		}
+
+		return ipv4.String(), nil
+	}
+
+	if zone != "" {
+		return parsedIP.String() + "%" + zone, nil
 	}
 
 	return parsedIP.String(), nil
 }
 
+// validateListenAddr checks the listen address when the settings are loaded so
+// that IPv6 deployments, most notably on link-local management networks, get an
+// explicit error instead of an opaque listen failure
+func validateListenAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &ipValidationError{error: fmt.Sprintf("invalid listen address %#v: %v", addr, err)}
+	}
+
+	// IPv6 literals, including link-local addresses carrying a scope ID such as
+	// "[fe80::1%eth0]:2121", must parse as IP addresses; hostnames are passed
+	// through untouched
+	if hostIP, _ := splitHostZone(host); strings.Contains(host, ":") && net.ParseIP(hostIP) == nil {
+		return &ipValidationError{error: fmt.Sprintf("invalid listen address %#v: bad IPv6 literal %#v", addr, host)}
+	}
+
+	return nil
+}
+
 // Listen starts the listening
 // It's not a blocking call
 func (server *FtpServer) Listen() error {
@@ -192,30 +559,46 @@ func (server *FtpServer) Listen() error {
 	}
 
 	// The driver can provide its own listener implementation
-	if server.settings.Listener != nil {
-		server.listener = server.settings.Listener
-	} else {
+	listener := server.getSettings().Listener
+	if listener == nil {
 		// Otherwise, it's what we currently use
-		server.listener, err = server.createListener()
+		listener, err = server.createListener()
 		if err != nil {
 			return fmt.Errorf("could not create listener: %w", err)
 		}
 	}
 
-	server.Logger.Info("Listening...", "address", server.listener.Addr())
+	if settings := server.getSettings(); settings.PrebindPassivePorts && settings.PassiveTransferPortRange != nil {
+		server.passivePool, err = newPassivePortPool(settings.PassiveTransferPortRange, server.Logger)
+		if err != nil {
+			if errClose := listener.Close(); errClose != nil {
+				server.Logger.Warn("Could not close listener", "err", errClose)
+			}
+
+			return fmt.Errorf("could not pre-bind passive ports: %w", err)
+		}
+	}
+
+	server.listenerMutex.Lock()
+	server.listener = listener
+	server.listenerMutex.Unlock()
+
+	server.Logger.Info("Listening...", "address", listener.Addr())
 
 	return nil
 }
 
 func (server *FtpServer) createListener() (net.Listener, error) {
-	listener, err := net.Listen("tcp", server.settings.ListenAddr)
+	settings := server.getSettings()
+
+	listener, err := net.Listen("tcp", settings.ListenAddr)
 	if err != nil {
-		server.Logger.Error("cannot listen on main port", "err", err, "listenAddr", server.settings.ListenAddr)
+		server.Logger.Error("cannot listen on main port", "err", err, "listenAddr", settings.ListenAddr)
 
 		return nil, newNetworkError("cannot listen on main port", err)
 	}
 
-	if server.settings.TLSRequired == ImplicitEncryption {
+	if settings.TLSRequired == ImplicitEncryption {
 		// implicit TLS
 		var tlsConfig *tls.Config
 
@@ -226,7 +609,7 @@ func (server *FtpServer) createListener() (net.Listener, error) {
 			return nil, newDriverError("cannot get tls config", err)
 		}
 
-		listener = tls.NewListener(listener, tlsConfig)
+		listener = tls.NewListener(listener, server.applyTLSOverrides(tlsConfig))
 	}
 
 	return listener, nil
@@ -246,8 +629,16 @@ func temporaryError(err net.Error) bool {
 func (server *FtpServer) Serve() error {
 	var tempDelay time.Duration // how long to sleep on accept failure
 
+	server.listenerMutex.RLock()
+	listener := server.listener
+	server.listenerMutex.RUnlock()
+
+	if listener == nil {
+		return ErrNotListening
+	}
+
 	for {
-		connection, err := server.listener.Accept()
+		connection, err := listener.Accept()
 		if err != nil {
 			if ok, finalErr := server.handleAcceptError(err, &tempDelay); ok {
 				return finalErr
@@ -271,7 +662,9 @@ func (server *FtpServer) handleAcceptError(err error, tempDelay *time.Duration)
 	if errOp := (&net.OpError{}); errors.As(err, &errOp) {
 		// This means we just closed the connection and it's OK
 		if errOp.Err.Error() == "use of closed network connection" {
+			server.listenerMutex.Lock()
 			server.listener = nil
+			server.listenerMutex.Unlock()
 
 			return true, nil
 		}
@@ -319,14 +712,25 @@ func (server *FtpServer) ListenAndServe() error {
 
 // NewFtpServer creates a new FtpServer instance
 func NewFtpServer(driver MainDriver) *FtpServer {
-	return &FtpServer{
+	server := &FtpServer{
 		driver: driver,
 		Logger: lognoop.NewNoOpLogger(),
 	}
+
+	if extension, ok := driver.(MainDriverExtensionCustomCommands); ok {
+		for verb, description := range extension.GetCustomCommands() {
+			server.RegisterCommand(verb, description)
+		}
+	}
+
+	return server
 }
 
 // Addr shows the listening address
 func (server *FtpServer) Addr() string {
+	server.listenerMutex.RLock()
+	defer server.listenerMutex.RUnlock()
+
 	if server.listener != nil {
 		return server.listener.Addr().String()
 	}
@@ -334,13 +738,27 @@ func (server *FtpServer) Addr() string {
 	return ""
 }
 
-// Stop closes the listener
+// Stop closes the listener and ends the established sessions with the
+// ShutdownMaintenance reason. Use Shutdown to report a different one
 func (server *FtpServer) Stop() error {
-	if server.listener == nil {
+	return server.Shutdown(ShutdownMaintenance)
+}
+
+// Shutdown closes the listener and ends every established session after
+// sending it a final 421 reply built from the given reason. The reason
+// remains readable through ClientContext.GetShutdownReason when the driver's
+// ClientDisconnected is called, so deliberate shutdowns can be told apart
+// from network failures
+func (server *FtpServer) Shutdown(reason ShutdownReason) error {
+	server.listenerMutex.RLock()
+	listener := server.listener
+	server.listenerMutex.RUnlock()
+
+	if listener == nil {
 		return ErrNotListening
 	}
 
-	if err := server.listener.Close(); err != nil {
+	if err := listener.Close(); err != nil {
 		server.Logger.Warn(
 			"Could not close listener",
 			"err", err,
@@ -349,21 +767,84 @@ func (server *FtpServer) Stop() error {
 		return newNetworkError("couln't close listener", err)
 	}
 
+	if server.passivePool != nil {
+		server.passivePool.Close() //nolint:errcheck,gosec // only logs closing problems
+	}
+
+	server.disconnectClients(reason)
+
 	return nil
 }
 
+// disconnectClients ends every established session with the reason-specific
+// final reply
+func (server *FtpServer) disconnectClients(reason ShutdownReason) {
+	server.clientsMutex.Lock()
+	clients := make([]*clientHandler, 0, len(server.clients))
+
+	for _, c := range server.clients {
+		clients = append(clients, c)
+	}
+	server.clientsMutex.Unlock()
+
+	for _, c := range clients {
+		c.disconnectForShutdown(reason)
+	}
+}
+
 // When a client connects, the server could refuse the connection
 func (server *FtpServer) clientArrival(conn net.Conn) {
-	server.clientCounter++
-	id := server.clientCounter
+	// a draining server refuses new connections while the established
+	// sessions keep running
+	if server.isDraining() {
+		if errClose := conn.Close(); errClose != nil {
+			server.Logger.Warn(
+				"Problem closing a connection while draining",
+				"err", errClose,
+			)
+		}
 
-	c := server.newClientHandler(conn, id, server.settings.DefaultTransferType)
-	go c.HandleCommands()
+		return
+	}
 
+	// banned addresses are rejected before paying for the welcome banner and
+	// the session goroutine
+	if filter, ok := server.driver.(MainDriverExtensionConnectionFilter); ok {
+		if err := filter.FilterConnection(conn.RemoteAddr()); err != nil {
+			server.Logger.Info(
+				"Connection refused by the connection filter",
+				"remoteAddr", conn.RemoteAddr(),
+				"err", err,
+			)
+
+			if errClose := conn.Close(); errClose != nil {
+				server.Logger.Warn(
+					"Problem closing a refused connection",
+					"err", errClose,
+				)
+			}
+
+			return
+		}
+	}
+
+	id := atomic.AddUint32(&server.clientCounter, 1)
+
+	c := server.newClientHandler(conn, id, server.getSettings().DefaultTransferType)
 	c.logger.Debug("Client connected", "clientIp", conn.RemoteAddr())
+
+	// no access to the handler is allowed past this point: it can be recycled
+	// for another connection as soon as the session goroutine is done with it
+	go c.HandleCommands()
 }
 
 // clientDeparture
 func (server *FtpServer) clientDeparture(c *clientHandler) {
+	server.unregisterClient(c)
+
+	if c.registeredUser != "" {
+		server.unregisterUserSession(c.registeredUser, c)
+	}
+
 	c.logger.Debug("Client disconnected", "clientIp", c.conn.RemoteAddr())
 }
@@ -1,14 +1,18 @@
 package ftpserver
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
 	"net"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
 	lognoop "github.com/fclairamb/go-log/noop"
+	"github.com/secsy/goftp"
 	"github.com/stretchr/testify/require"
 )
 
@@ -156,6 +160,56 @@ func TestPortCommandFormatInvalid(t *testing.T) {
 	}
 }
 
+func TestEPRTArgumentParsing(t *testing.T) {
+	addr, err := ParseEPRTArgument("|1|192.168.150.80|2000|")
+	require.NoError(t, err)
+	require.Equal(t, NetworkProtocolIPv4, addr.Protocol)
+	require.Equal(t, "192.168.150.80", addr.IP.String())
+	require.Equal(t, 2000, addr.Port)
+	require.Equal(t, "192.168.150.80:2000", addr.TCPAddr().String())
+
+	addr, err = ParseEPRTArgument("|2|::1|2000|")
+	require.NoError(t, err)
+	require.Equal(t, NetworkProtocolIPv6, addr.Protocol)
+	require.Equal(t, "::1", addr.IP.String())
+
+	// the argument can be built back from the parsed form
+	require.Equal(t, "|2|::1|2000|", addr.String())
+
+	badFormats := []string{
+		"",
+		"something",
+		"|1|192.168.150.80|2000",
+		"1|192.168.150.80|2000|",
+		"|1|192.168.150.80|2000|x",
+		"|1|253.254.255.256|2000|",
+		"|1|192.168.150.80|0|",
+		"|1|192.168.150.80|65536|",
+	}
+	for _, f := range badFormats {
+		_, err = ParseEPRTArgument(f)
+		require.ErrorIs(t, err, ErrRemoteAddrFormat, f)
+	}
+
+	_, err = ParseEPRTArgument("|3|::1|2000|")
+	require.ErrorIs(t, err, ErrUnsupportedNetworkProtocol)
+}
+
+func TestEPSVArgumentParsing(t *testing.T) {
+	for _, param := range []string{"", "ALL", "all"} {
+		protocol, err := ParseEPSVArgument(param)
+		require.NoError(t, err, param)
+		require.Equal(t, NetworkProtocol(0), protocol, param)
+	}
+
+	protocol, err := ParseEPSVArgument("2")
+	require.NoError(t, err)
+	require.Equal(t, NetworkProtocolIPv6, protocol)
+
+	_, err = ParseEPSVArgument("4")
+	require.ErrorIs(t, err, ErrUnsupportedNetworkProtocol)
+}
+
 func TestQuoteDoubling(t *testing.T) {
 	type args struct {
 		s string
@@ -196,13 +250,59 @@ func TestServerSettingsIPError(t *testing.T) {
 		require.True(t, ok)
 	})
 
-	t.Run("localhost public host", func(t *testing.T) {
+	t.Run("IPv6 public host", func(t *testing.T) {
 		server.driver = &TestServerDriver{
 			Settings: &Settings{
 				PublicHost: "::1",
 			},
 		}
 
+		err := server.loadSettings()
+		require.NoError(t, err)
+		require.Equal(t, "::1", server.getSettings().PublicHost)
+	})
+
+	t.Run("Bracketed IPv6 public host with a scope ID", func(t *testing.T) {
+		server.driver = &TestServerDriver{
+			Settings: &Settings{
+				PublicHost: "[fe80::1%eth0]",
+			},
+		}
+
+		err := server.loadSettings()
+		require.NoError(t, err)
+		require.Equal(t, "fe80::1%eth0", server.getSettings().PublicHost)
+	})
+
+	t.Run("Scope ID on an IPv4 public host", func(t *testing.T) {
+		server.driver = &TestServerDriver{
+			Settings: &Settings{
+				PublicHost: "192.168.1.1%eth0",
+			},
+		}
+
+		err := server.loadSettings()
+		_, ok := err.(*ipValidationError) //nolint:errorlint // Here we want to test the exact error match
+		require.True(t, ok)
+	})
+
+	t.Run("IPv6 listen address with a scope ID", func(t *testing.T) {
+		server.driver = &TestServerDriver{
+			Settings: &Settings{
+				ListenAddr: "[fe80::1%eth0]:2121",
+			},
+		}
+
+		require.NoError(t, server.loadSettings())
+	})
+
+	t.Run("Unbracketed IPv6 listen address", func(t *testing.T) {
+		server.driver = &TestServerDriver{
+			Settings: &Settings{
+				ListenAddr: "fe80::1:2121",
+			},
+		}
+
 		err := server.loadSettings()
 		_, ok := err.(*ipValidationError) //nolint:errorlint // Here we want to test the exact error match
 		require.True(t, ok)
@@ -216,7 +316,7 @@ func TestServerSettingsIPError(t *testing.T) {
 		}
 		err := server.loadSettings()
 		require.NoError(t, err)
-		require.Equal(t, "192.168.1.1", server.settings.PublicHost)
+		require.Equal(t, "192.168.1.1", server.getSettings().PublicHost)
 	})
 }
 
@@ -253,3 +353,223 @@ func TestTemporaryError(t *testing.T) {
 
 	req.False(temporaryError(&net.OpError{Err: &os.SyscallError{Err: syscall.EAGAIN}}))
 }
+
+func TestMaxConnections(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false})
+
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.MaxConnections = 1
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	// the first connection is accepted ...
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// ... and the second one is refused with a 421
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "421 Too many connections\r\n", line)
+}
+
+func TestMaxConnectionsPerUser(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false})
+
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.MaxConnectionsPerUser = 1
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	sessions := server.UserSessions(authUser)
+	require.Len(t, sessions, 1)
+
+	// a second login as the same user is refused after PASS
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	reader := bufio.NewReader(conn)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	_, err = fmt.Fprintf(conn, "USER %s\r\n", authUser)
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(line, "331"), line)
+
+	_, err = fmt.Fprintf(conn, "PASS %s\r\n", authPass)
+	require.NoError(t, err)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "421 Too many connections for this user\r\n", line)
+
+	// once the first session is gone the user can log in again
+	require.NoError(t, raw.Close())
+	require.NoError(t, client.Close())
+
+	require.Eventually(t, func() bool {
+		return len(server.UserSessions(authUser)) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client2, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err)
+
+	defer func() { panicOnError(client2.Close()) }()
+
+	raw2, err := client2.OpenRawConn()
+	require.NoError(t, err, "The user should be able to log in again")
+	require.NoError(t, raw2.Close())
+}
+
+func TestShutdownReason(t *testing.T) {
+	driver := &TestServerDriver{Debug: false}
+	driver.Init()
+
+	// the server is not built through the usual helper because the test
+	// shuts it down itself, the cleanup would stop it a second time
+	server := NewFtpServer(driver)
+	require.NoError(t, server.Listen())
+
+	go func() {
+		_ = server.Serve()
+	}()
+
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(line, "220"), line)
+
+	require.NoError(t, server.Shutdown(ShutdownOverload))
+
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "421 Server is overloaded, closing connection\r\n", line)
+
+	// the driver sees the reason from ClientDisconnected
+	require.Eventually(t, func() bool {
+		return len(driver.getDisconnectionReasons()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []ShutdownReason{ShutdownOverload}, driver.getDisconnectionReasons())
+}
+
+func TestShutdownReasonNoneForNormalDisconnect(t *testing.T) {
+	driver := &TestServerDriver{Debug: false}
+	server := NewTestServerWithTestDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+	require.NoError(t, raw.Close())
+	require.NoError(t, client.Close())
+
+	require.Eventually(t, func() bool {
+		return len(driver.getDisconnectionReasons()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []ShutdownReason{ShutdownNone}, driver.getDisconnectionReasons())
+}
+
+// customCommandsServerDriver registers two proprietary verbs and replaces the
+// built-in NOOP
+type customCommandsServerDriver struct {
+	TestServerDriver
+}
+
+func (driver *customCommandsServerDriver) GetCustomCommands() map[string]CustomCommandDescription {
+	return map[string]CustomCommandDescription{
+		"XWHO": {
+			Open: true,
+			Fn: func(cc ClientContext, _ string) (int, string, error) {
+				return StatusOK, fmt.Sprintf("you are client %d", cc.ID()), nil
+			},
+		},
+		"XFAIL": {
+			Fn: func(ClientContext, string) (int, string, error) {
+				return 0, "", errors.New("not today")
+			},
+		},
+		"NOOP": {
+			Open: true,
+			Fn: func(ClientContext, string) (int, string, error) {
+				return StatusOK, "Custom NOOP", nil
+			},
+		},
+	}
+}
+
+func TestCustomCommands(t *testing.T) {
+	driver := &customCommandsServerDriver{}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	reader := bufio.NewReader(conn)
+	readReply := func() string {
+		line, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return line
+	}
+	require.True(t, strings.HasPrefix(readReply(), "220 "))
+
+	// an open custom command is available before the login
+	fmt.Fprintf(conn, "XWHO\r\n")
+	require.Equal(t, "200 you are client 1\r\n", readReply())
+
+	// a registered verb shadows the built-in one
+	fmt.Fprintf(conn, "NOOP\r\n")
+	require.Equal(t, "200 Custom NOOP\r\n", readReply())
+
+	// a non-open custom command still requires a login
+	fmt.Fprintf(conn, "XFAIL\r\n")
+	require.Equal(t, "530 Please login with USER and PASS\r\n", readReply())
+
+	fmt.Fprintf(conn, "USER %s\r\n", authUser)
+	require.True(t, strings.HasPrefix(readReply(), "331 "))
+	fmt.Fprintf(conn, "PASS %s\r\n", authPass)
+	require.True(t, strings.HasPrefix(readReply(), "230 "))
+
+	// handler errors are reported the same way as built-in command errors
+	fmt.Fprintf(conn, "XFAIL\r\n")
+	require.Equal(t, "500 Error: not today\r\n", readReply())
+}
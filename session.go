@@ -0,0 +1,59 @@
+package ftpserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// Session gives an embedder full control over the lifecycle of a single client
+// connection. The server accept loop normally spawns one goroutine per accepted
+// client; custom schedulers (worker pools, priority queues, ...) can instead
+// accept connections themselves, wrap each one with FtpServer.NewSession and
+// decide when, where and for how long Run is executed
+type Session struct {
+	handler *clientHandler
+}
+
+// NewSession wraps an already accepted network connection into a Session.
+// The settings are loaded from the driver on the first call if the server
+// isn't listening. The connection is left untouched until Session.Run is
+// called
+func (server *FtpServer) NewSession(conn net.Conn) (*Session, error) {
+	if server.getSettings() == nil {
+		if err := server.loadSettings(); err != nil {
+			return nil, fmt.Errorf("could not load settings: %w", err)
+		}
+	}
+
+	id := atomic.AddUint32(&server.clientCounter, 1)
+
+	handler := server.newClientHandler(conn, id, server.getSettings().DefaultTransferType)
+	handler.logger.Debug("Client connected", "clientIp", conn.RemoteAddr())
+
+	return &Session{handler: handler}, nil
+}
+
+// ClientContext exposes the session to the library users with the same
+// accessors they get from the driver callbacks
+func (session *Session) ClientContext() ClientContext {
+	return session.handler
+}
+
+// Run handles the client commands and blocks until the client disconnects.
+// Canceling the context closes the underlying connection, which ends the
+// session, and the context error is then returned. Run must only be called
+// once per session
+func (session *Session) Run(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, session.handler.disconnect)
+	defer stop()
+
+	session.handler.HandleCommands()
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("session ended: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package ftpserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrSessionNotFound is returned when dumping a session whose ID doesn't match
+// any connected client
+var ErrSessionNotFound = errors.New("session not found")
+
+// sessionHistorySize is the number of commands kept in the per-session ring buffer
+const sessionHistorySize = 100
+
+// SessionHistoryEntry is a single command of the session timeline
+type SessionHistoryEntry struct {
+	ReceivedAt time.Time // When the command was received
+	Command    string    // FTP verb, uppercased
+	Param      string    // Command parameter, redacted for PASS
+	ReplyCode  int       // Code of the last reply sent while handling the command, 0 if none was sent yet
+}
+
+// SessionReport is a structured dump of a single session (commands history,
+// transfers, timings, errors and negotiated options), suitable for attaching
+// to a support ticket
+type SessionReport struct {
+	ID              uint32                // ID of the client, the "clientId" of the logs
+	Token           string                // Session token, the "sessionToken" of the logs
+	RemoteAddr      string                // Peer address of the control connection
+	User            string                // Authenticated user, empty before login
+	ClientVersion   string                // Client version reported through CLNT
+	ConnectedAt     time.Time             // When the control connection was accepted
+	LastCommand     string                // Last command received
+	LastDataChannel DataChannel           // Last data channel mode (passive or active)
+	TransferType    TransferType          // Negotiated transfer type (ASCII or binary)
+	TLSForControl   bool                  // Whether the control connection is TLS protected
+	TLSForTransfers bool                  // Whether the data connections are TLS protected
+	ControlTLS      *SessionTLSInfo       // Negotiated TLS parameters of the control connection, nil in cleartext
+	LastDataTLS     *SessionTLSInfo       // Negotiated TLS parameters of the last closed data connection, nil when none used TLS
+	ListOptions     string                // Directory listing options set through OPTS LIST/NLST
+	UploadedBytes   int64                 // Number of bytes received on data connections
+	DownloadedBytes int64                 // Number of bytes sent on data connections
+	History         []SessionHistoryEntry // Commands history, oldest first
+}
+
+// SessionTLSInfo describes a TLS connection of a session as it was
+// negotiated, letting operators spot clients still using old protocol
+// versions before tightening Settings.TLSMinVersion
+type SessionTLSInfo struct {
+	Version     uint16 // Negotiated protocol version, one of the tls.VersionTLS* constants
+	CipherSuite uint16 // Negotiated cipher suite, one of the tls.TLS_* constants
+	ServerName  string // SNI presented by the client, empty when none was sent
+}
+
+// newSessionTLSInfo snapshots the negotiated parameters of a connection, nil
+// when it is not TLS or its handshake never completed
+func newSessionTLSInfo(conn net.Conn) *SessionTLSInfo {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		return nil
+	}
+
+	return &SessionTLSInfo{
+		Version:     state.Version,
+		CipherSuite: state.CipherSuite,
+		ServerName:  state.ServerName,
+	}
+}
+
+// sessionHistory is a fixed-size ring buffer keeping the latest commands
+// handled by a session
+type sessionHistory struct {
+	mutex   sync.Mutex
+	entries []SessionHistoryEntry
+	start   int // index of the oldest entry once the ring is full
+}
+
+// reset clears the history so the backing slice can be reused by a recycled
+// client handler
+func (history *sessionHistory) reset() {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	history.entries = history.entries[:0]
+	history.start = 0
+}
+
+func (history *sessionHistory) recordCommand(command, param string) {
+	// the password must never leak into a report
+	if command == "PASS" && param != "" {
+		param = "****"
+	}
+
+	entry := SessionHistoryEntry{
+		ReceivedAt: time.Now().UTC(),
+		Command:    command,
+		Param:      param,
+	}
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if len(history.entries) < sessionHistorySize {
+		history.entries = append(history.entries, entry)
+
+		return
+	}
+
+	history.entries[history.start] = entry
+	history.start = (history.start + 1) % sessionHistorySize
+}
+
+func (history *sessionHistory) recordReply(code int) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	// the welcome banner is sent before any command was received
+	if len(history.entries) == 0 {
+		return
+	}
+
+	last := (history.start + len(history.entries) - 1) % len(history.entries)
+	history.entries[last].ReplyCode = code
+}
+
+func (history *sessionHistory) snapshot() []SessionHistoryEntry {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	entries := make([]SessionHistoryEntry, 0, len(history.entries))
+	entries = append(entries, history.entries[history.start:]...)
+	entries = append(entries, history.entries[:history.start]...)
+
+	return entries
+}
+
+// dumpSession gathers the session state into a report
+func (c *clientHandler) dumpSession() SessionReport {
+	uploadedBytes, downloadedBytes := c.GetTransferredBytes()
+
+	c.paramsMutex.RLock()
+	report := SessionReport{
+		ID:              c.id,
+		Token:           c.sessionToken,
+		RemoteAddr:      c.conn.RemoteAddr().String(),
+		User:            c.user,
+		ClientVersion:   c.clnt,
+		ConnectedAt:     c.connectedAt,
+		LastCommand:     c.command,
+		LastDataChannel: c.lastDataChannel,
+		TransferType:    c.currentTransferType,
+		TLSForControl:   c.controlTLS,
+		TLSForTransfers: c.transferTLS,
+		ControlTLS:      newSessionTLSInfo(c.conn),
+		LastDataTLS:     c.lastDataTLS,
+		ListOptions:     c.listOpts.String(),
+		UploadedBytes:   uploadedBytes,
+		DownloadedBytes: downloadedBytes,
+	}
+	c.paramsMutex.RUnlock()
+
+	report.History = c.history.snapshot()
+
+	return report
+}
+
+// DumpSession produces the timeline report of a connected client given its ID,
+// e.g. the one provided by ClientContext.ID or found in the logs. It returns
+// ErrSessionNotFound once the client has disconnected
+func (server *FtpServer) DumpSession(id uint32) (SessionReport, error) {
+	server.clientsMutex.Lock()
+	handler := server.clients[id]
+	server.clientsMutex.Unlock()
+
+	if handler == nil {
+		return SessionReport{}, ErrSessionNotFound
+	}
+
+	return handler.dumpSession(), nil
+}
@@ -0,0 +1,142 @@
+package ftpserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpSession(t *testing.T) {
+	driver := &TestServerDriver{Debug: false}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, _, err := raw.SendCommand("TYPE A")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+
+	returnCode, _, err = raw.SendCommand("BOGUS")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorNotRecognised, returnCode)
+
+	driver.clientMU.Lock()
+	require.NotEmpty(t, driver.Clients, "We should have a connected client")
+	id := driver.Clients[len(driver.Clients)-1].ID()
+	driver.clientMU.Unlock()
+
+	report, err := server.DumpSession(id)
+	require.NoError(t, err)
+
+	require.Equal(t, id, report.ID)
+	require.Equal(t, authUser, report.User)
+	require.Equal(t, TransferTypeASCII, report.TransferType)
+	require.Equal(t, "BOGUS", report.LastCommand)
+	require.False(t, report.ConnectedAt.IsZero())
+	require.NotEmpty(t, report.History)
+
+	// the failing command ends the timeline with its error reply
+	last := report.History[len(report.History)-1]
+	require.Equal(t, "BOGUS", last.Command)
+	require.Equal(t, StatusSyntaxErrorNotRecognised, last.ReplyCode)
+	require.False(t, last.ReceivedAt.IsZero())
+
+	// the login must be part of the history with a redacted password
+	var passEntry *SessionHistoryEntry
+
+	for idx, entry := range report.History {
+		if entry.Command == "PASS" {
+			passEntry = &report.History[idx]
+		}
+	}
+
+	require.NotNil(t, passEntry, "The PASS command should be part of the history")
+	require.Equal(t, "****", passEntry.Param)
+	require.Equal(t, StatusUserLoggedIn, passEntry.ReplyCode)
+
+	// an unknown or disconnected client cannot be dumped
+	_, err = server.DumpSession(id + 1000)
+	require.True(t, errors.Is(err, ErrSessionNotFound), err)
+}
+
+func TestSessionTLSReport(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: false,
+		TLS:   true,
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+			ServerName:         "localhost",
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	// a completed transfer leaves the parameters of its data connection behind
+	ftpUpload(t, client, createTemporaryFile(t, 1024), "file.bin")
+
+	driver.clientMU.Lock()
+	require.NotEmpty(t, driver.Clients)
+	id := driver.Clients[len(driver.Clients)-1].ID()
+	driver.clientMU.Unlock()
+
+	report, err := server.DumpSession(id)
+	require.NoError(t, err)
+
+	require.True(t, report.TLSForControl)
+	require.NotNil(t, report.ControlTLS, "The control connection TLS parameters should be reported")
+	require.GreaterOrEqual(t, report.ControlTLS.Version, uint16(tls.VersionTLS12))
+	require.NotZero(t, report.ControlTLS.CipherSuite)
+	require.Equal(t, "localhost", report.ControlTLS.ServerName)
+
+	require.NotNil(t, report.LastDataTLS, "The last data connection TLS parameters should be reported")
+	require.Equal(t, report.ControlTLS.Version, report.LastDataTLS.Version)
+	require.NotZero(t, report.LastDataTLS.CipherSuite)
+}
+
+func TestSessionTLSReportCleartext(t *testing.T) {
+	driver := &TestServerDriver{Debug: false}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	ftpUpload(t, client, createTemporaryFile(t, 1024), "file.bin")
+
+	driver.clientMU.Lock()
+	require.NotEmpty(t, driver.Clients)
+	id := driver.Clients[len(driver.Clients)-1].ID()
+	driver.clientMU.Unlock()
+
+	report, err := server.DumpSession(id)
+	require.NoError(t, err)
+	require.Nil(t, report.ControlTLS)
+	require.Nil(t, report.LastDataTLS)
+}
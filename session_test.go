@@ -0,0 +1,107 @@
+package ftpserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+// newSessionTestSetup provides a server that doesn't listen by itself and a
+// listener from which the test can accept and schedule sessions
+func newSessionTestSetup(t *testing.T) (*FtpServer, net.Listener) {
+	t.Helper()
+
+	driver := &TestServerDriver{Debug: false}
+	driver.Init()
+	server := NewFtpServer(driver)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		// the session closes the connection, only the listener is left
+		_ = listener.Close()
+	})
+
+	return server, listener
+}
+
+func TestSessionRun(t *testing.T) {
+	server, listener := newSessionTestSetup(t)
+	errs := make(chan error, 1)
+
+	go func() {
+		conn, errAccept := listener.Accept()
+		if errAccept != nil {
+			errs <- errAccept
+
+			return
+		}
+
+		session, errSession := server.NewSession(conn)
+		if errSession != nil {
+			errs <- errSession
+
+			return
+		}
+
+		errs <- session.Run(context.Background())
+	}()
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, listener.Addr().String())
+	require.NoError(t, err, "Couldn't connect")
+
+	_, err = client.ReadDir("/")
+	require.NoError(t, err)
+
+	require.NoError(t, client.Close())
+	require.NoError(t, <-errs, "The session should end cleanly when the client quits")
+}
+
+func TestSessionContextCancellation(t *testing.T) {
+	server, listener := newSessionTestSetup(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+
+	go func() {
+		conn, errAccept := listener.Accept()
+		if errAccept != nil {
+			errs <- errAccept
+
+			return
+		}
+
+		session, errSession := server.NewSession(conn)
+		if errSession != nil {
+			errs <- errSession
+
+			return
+		}
+
+		errs <- session.Run(ctx)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	defer func() { _ = conn.Close() }()
+
+	welcome, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	require.Contains(t, welcome, "220 TEST Server")
+
+	cancel()
+
+	err = <-errs
+	require.Error(t, err)
+	require.True(t, errors.Is(err, context.Canceled), err)
+}
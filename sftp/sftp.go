@@ -0,0 +1,199 @@
+// Package sftp exposes a ftpserverlib ClientDriver over the SFTP protocol, so
+// applications built on ftpserverlib drivers can add SFTP without writing a
+// second storage layer.
+//
+// The SSH layer is pluggable: authenticate the user and accept the "sftp"
+// subsystem channel with the SSH server of your choice (for instance
+// golang.org/x/crypto/ssh), select the ClientDriver the same way your
+// MainDriver does, and hand both to ServeChannel.
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+// ServeChannel answers the SFTP requests read from channel with the given
+// driver until the channel is closed. Authentication and driver selection
+// must have been performed by the caller beforehand.
+func ServeChannel(driver ftpserver.ClientDriver, channel io.ReadWriteCloser) error {
+	server := sftp.NewRequestServer(channel, Handlers(driver))
+
+	if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("sftp server stopped: %w", err)
+	}
+
+	if err := server.Close(); err != nil {
+		return fmt.Errorf("couldn't close sftp server: %w", err)
+	}
+
+	return nil
+}
+
+// Handlers returns the SFTP request handlers backed by the given driver, for
+// callers that want to assemble their own sftp.RequestServer
+func Handlers(driver ftpserver.ClientDriver) sftp.Handlers {
+	handler := &driverHandler{driver: driver}
+
+	return sftp.Handlers{
+		FileGet:  handler,
+		FilePut:  handler,
+		FileCmd:  handler,
+		FileList: handler,
+	}
+}
+
+// driverHandler maps the SFTP requests to the ClientDriver (afero) methods
+type driverHandler struct {
+	driver ftpserver.ClientDriver
+}
+
+func (h *driverHandler) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	return h.driver.OpenFile(request.Filepath, os.O_RDONLY, os.ModePerm) //nolint:wrapcheck // driver errors are reported as is
+}
+
+func (h *driverHandler) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	return h.driver.OpenFile(request.Filepath, pflagsToOpenFlags(request.Pflags()), os.ModePerm) //nolint:wrapcheck // driver errors are reported as is
+}
+
+//nolint:wrapcheck // driver errors are reported as is
+func (h *driverHandler) Filecmd(request *sftp.Request) error {
+	switch request.Method {
+	case "Setstat":
+		return h.setstat(request)
+	case "Rename":
+		return h.driver.Rename(request.Filepath, request.Target)
+	case "Remove":
+		return h.driver.Remove(request.Filepath)
+	case "Rmdir":
+		if removeDir, ok := h.driver.(ftpserver.ClientDriverExtensionRemoveDir); ok {
+			return removeDir.RemoveDir(request.Filepath)
+		}
+
+		return h.driver.Remove(request.Filepath)
+	case "Mkdir":
+		return h.driver.Mkdir(request.Filepath, 0o755)
+	case "Symlink":
+		if symlinker, ok := h.driver.(ftpserver.ClientDriverExtensionSymlink); ok {
+			return symlinker.Symlink(request.Filepath, request.Target)
+		}
+
+		return sftp.ErrSSHFxOpUnsupported
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+//nolint:wrapcheck // driver errors are reported as is
+func (h *driverHandler) setstat(request *sftp.Request) error {
+	attrFlags := request.AttrFlags()
+	attributes := request.Attributes()
+
+	if attrFlags.Permissions {
+		if err := h.driver.Chmod(request.Filepath, attributes.FileMode()); err != nil {
+			return err
+		}
+	}
+
+	if attrFlags.Acmodtime {
+		accessTime := time.Unix(int64(attributes.Atime), 0)
+		modTime := time.Unix(int64(attributes.Mtime), 0)
+
+		if err := h.driver.Chtimes(request.Filepath, accessTime, modTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *driverHandler) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+	switch request.Method {
+	case "List":
+		files, err := h.readDir(request.Filepath)
+		if err != nil {
+			return nil, err
+		}
+
+		return listerAt(files), nil
+	case "Stat":
+		info, err := h.driver.Stat(request.Filepath)
+		if err != nil {
+			return nil, err //nolint:wrapcheck // driver errors are reported as is
+		}
+
+		return listerAt{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+//nolint:wrapcheck // driver errors are reported as is
+func (h *driverHandler) readDir(name string) ([]os.FileInfo, error) {
+	if fileList, ok := h.driver.(ftpserver.ClientDriverExtensionFileList); ok {
+		return fileList.ReadDir(name)
+	}
+
+	directory, err := h.driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer directory.Close() //nolint:errcheck // we are only reading
+
+	return directory.Readdir(-1)
+}
+
+func pflagsToOpenFlags(pflags sftp.FileOpenFlags) int {
+	var flags int
+
+	switch {
+	case pflags.Read && pflags.Write:
+		flags = os.O_RDWR
+	case pflags.Write:
+		flags = os.O_WRONLY
+	default:
+		flags = os.O_RDONLY
+	}
+
+	if pflags.Append {
+		flags |= os.O_APPEND
+	}
+
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+
+	return flags
+}
+
+// listerAt exposes an already fetched list of files to the paginated SFTP listing
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(list []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(list, l[offset:])
+	if n < len(list) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,78 @@
+package sftp
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient serves an in-memory driver on one end of a pipe and returns
+// an SFTP client connected to the other end
+func newTestClient(t *testing.T) (*sftp.Client, afero.Fs) {
+	t.Helper()
+
+	driver := afero.NewMemMapFs()
+	serverConn, clientConn := net.Pipe()
+
+	go func() {
+		if err := ServeChannel(driver, serverConn); err != nil && err != io.EOF {
+			t.Log("server stopped:", err)
+		}
+	}()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	require.NoError(t, err, "Couldn't create SFTP client")
+
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+
+	return client, driver
+}
+
+func TestServeChannel(t *testing.T) {
+	client, driver := newTestClient(t)
+
+	require.NoError(t, client.Mkdir("/dir"))
+
+	file, err := client.Create("/dir/file.txt")
+	require.NoError(t, err)
+
+	_, err = file.Write([]byte("hello sftp"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// the file must be visible through the driver too
+	content, err := afero.ReadFile(driver, "/dir/file.txt")
+	require.NoError(t, err)
+	require.Equal(t, "hello sftp", string(content))
+
+	entries, err := client.ReadDir("/dir")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "file.txt", entries[0].Name())
+
+	info, err := client.Stat("/dir/file.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(10), info.Size())
+
+	require.NoError(t, client.Rename("/dir/file.txt", "/dir/file2.txt"))
+
+	remote, err := client.Open("/dir/file2.txt")
+	require.NoError(t, err)
+
+	readBack, err := io.ReadAll(remote)
+	require.NoError(t, err)
+	require.Equal(t, "hello sftp", string(readBack))
+	require.NoError(t, remote.Close())
+
+	require.NoError(t, client.Remove("/dir/file2.txt"))
+	require.NoError(t, client.RemoveDirectory("/dir"))
+
+	_, err = client.Stat("/dir")
+	require.Error(t, err, "The directory should have been removed")
+}
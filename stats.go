@@ -0,0 +1,168 @@
+package ftpserver
+
+import "sync/atomic"
+
+// UserCommandStats maps FTP command names (upper-case, e.g. "RETR") to the
+// number of times an authenticated user issued them
+type UserCommandStats map[string]uint64
+
+// ServerStats exposes the usage counters collected by a server instance. The
+// counters survive client disconnections and are only reset when the server
+// instance itself goes away
+type ServerStats struct {
+	// CommandsPerUser holds, for each authenticated user, how many times each
+	// command was received on their sessions
+	CommandsPerUser map[string]UserCommandStats
+
+	// ControlConnections is the number of control connections currently open
+	ControlConnections int
+
+	// DataListeners is the number of passive data listeners currently open
+	DataListeners int
+
+	// DataConnections is the number of data connections currently open
+	DataConnections int
+
+	// PassivePoolFree is the number of pre-bound passive listeners waiting to
+	// be borrowed, 0 when PrebindPassivePorts is disabled
+	PassivePoolFree int
+
+	// PassivePoolBorrowed is the number of pre-bound passive listeners
+	// currently lent to a transfer
+	PassivePoolBorrowed int
+}
+
+// Data socket accounting: both transfer handler flavors report the sockets
+// they open and close, so Stats and the DataFdSoftLimit check can see them
+
+func (server *FtpServer) dataListenerOpened() {
+	atomic.AddInt32(&server.dataListenerCount, 1)
+}
+
+func (server *FtpServer) dataListenerClosed() {
+	atomic.AddInt32(&server.dataListenerCount, -1)
+}
+
+func (server *FtpServer) dataConnOpened() {
+	atomic.AddInt32(&server.dataConnCount, 1)
+}
+
+func (server *FtpServer) dataConnClosed() {
+	atomic.AddInt32(&server.dataConnCount, -1)
+}
+
+// estimatedOpenFds approximates the file descriptors held by this server
+// instance: the main listener, one per control connection, plus the data
+// sockets currently open
+func (server *FtpServer) estimatedOpenFds() int {
+	count := server.clientsCount() +
+		int(atomic.LoadInt32(&server.dataListenerCount)) +
+		int(atomic.LoadInt32(&server.dataConnCount))
+
+	if server.listener != nil {
+		count++
+	}
+
+	return count
+}
+
+// File transfer accounting: every file transfer is counted globally and per
+// priority class, so the MaxConcurrentTransfers and TransferClassLimits
+// settings can be enforced
+
+// acquireTransferSlot counts a starting transfer against the global limit and
+// its priority class, class being empty when the transfer is unclassified. It
+// returns false, without counting anything, when either limit is reached
+func (server *FtpServer) acquireTransferSlot(class string, classLimit int, globalLimit int) bool {
+	server.transferSlotMu.Lock()
+	defer server.transferSlotMu.Unlock()
+
+	if globalLimit > 0 && server.transferCount >= globalLimit {
+		return false
+	}
+
+	if classLimit > 0 && server.transferClasses[class] >= classLimit {
+		return false
+	}
+
+	server.transferCount++
+
+	if class != "" {
+		if server.transferClasses == nil {
+			server.transferClasses = make(map[string]int)
+		}
+
+		server.transferClasses[class]++
+	}
+
+	return true
+}
+
+// releaseTransferSlot undoes acquireTransferSlot once the transfer is over
+func (server *FtpServer) releaseTransferSlot(class string) {
+	server.transferSlotMu.Lock()
+	defer server.transferSlotMu.Unlock()
+
+	if server.transferCount > 0 {
+		server.transferCount--
+	}
+
+	if class != "" && server.transferClasses[class] > 0 {
+		server.transferClasses[class]--
+	}
+}
+
+// recordCommandStat attributes one command execution to the given user.
+// Commands received before authentication (USER, PASS, AUTH, ...) carry an
+// empty user and are not counted
+func (server *FtpServer) recordCommandStat(user string, command string) {
+	if user == "" {
+		return
+	}
+
+	server.statsMutex.Lock()
+	defer server.statsMutex.Unlock()
+
+	if server.commandStats == nil {
+		server.commandStats = make(map[string]UserCommandStats)
+	}
+
+	userStats := server.commandStats[user]
+
+	if userStats == nil {
+		userStats = make(UserCommandStats)
+		server.commandStats[user] = userStats
+	}
+
+	userStats[command]++
+}
+
+// Stats returns a snapshot of the per-user command usage counters collected
+// since the server instance was created
+func (server *FtpServer) Stats() ServerStats {
+	server.statsMutex.Lock()
+	defer server.statsMutex.Unlock()
+
+	stats := ServerStats{
+		CommandsPerUser:    make(map[string]UserCommandStats, len(server.commandStats)),
+		ControlConnections: server.clientsCount(),
+		DataListeners:      int(atomic.LoadInt32(&server.dataListenerCount)),
+		DataConnections:    int(atomic.LoadInt32(&server.dataConnCount)),
+	}
+
+	if server.passivePool != nil {
+		stats.PassivePoolFree, stats.PassivePoolBorrowed = server.passivePool.stats()
+	}
+
+	for user, userStats := range server.commandStats {
+		copied := make(UserCommandStats, len(userStats))
+
+		for command, count := range userStats {
+			copied[command] = count
+		}
+
+		stats.CommandsPerUser[user] = copied
+	}
+
+	return stats
+}
@@ -0,0 +1,81 @@
+package ftpserver
+
+import (
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsPerUserCommands(t *testing.T) {
+	server := NewTestServer(t, false)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	for i := 0; i < 2; i++ {
+		returnCode, _, err := raw.SendCommand("NOOP")
+		require.NoError(t, err)
+		require.Equal(t, StatusOK, returnCode)
+	}
+
+	stats := server.Stats()
+	userStats := stats.CommandsPerUser[authUser]
+	require.NotNil(t, userStats)
+	require.Equal(t, uint64(2), userStats["NOOP"])
+
+	// pre-authentication commands are not attributed to anyone
+	require.Zero(t, userStats["USER"])
+	require.NotContains(t, stats.CommandsPerUser, "")
+}
+
+func TestStatsOpenFds(t *testing.T) {
+	server := NewTestServer(t, false)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	stats := server.Stats()
+	require.Equal(t, 1, stats.ControlConnections)
+	require.Equal(t, 0, stats.DataListeners)
+	require.Equal(t, 0, stats.DataConnections)
+
+	returnCode, _, err := raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, returnCode)
+
+	stats = server.Stats()
+	require.Equal(t, 1, stats.DataListeners)
+
+	// with the soft limit below the fds already held, passive requests are refused
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.DataFdSoftLimit = 1
+	})
+
+	returnCode, response, err := raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusCannotOpenDataConnection, returnCode)
+	require.Contains(t, response, "file descriptor")
+}
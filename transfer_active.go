@@ -14,7 +14,7 @@ import (
 func (c *clientHandler) handlePORT(param string) error {
 	command := c.GetLastCommand()
 
-	if c.server.settings.DisableActiveMode {
+	if c.server.getSettings().DisableActiveMode {
 		c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("%v command is disabled", command))
 
 		return nil
@@ -24,17 +24,44 @@ func (c *clientHandler) handlePORT(param string) error {
 	var raddr *net.TCPAddr
 
 	if command == "EPRT" {
-		raddr, err = parseEPRTAddr(param)
+		var extAddr ExtendedAddress
+		if extAddr, err = ParseEPRTArgument(param); err == nil {
+			raddr = extAddr.TCPAddr()
+		}
 	} else { // PORT
 		raddr, err = parsePORTAddr(param)
 	}
 
 	if err != nil {
+		if errors.Is(err, ErrUnsupportedNetworkProtocol) {
+			c.writeMessage(StatusNetworkProtocolNotSupported, "Network protocol not supported, use (1,2)")
+
+			return nil
+		}
+
 		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("Problem parsing %s: %v", param, err))
 
 		return nil
 	}
 
+	// an FXP-enabled server must still refuse to open connections to
+	// privileged ports of other hosts: that is the classic bounce attack,
+	// not a site-to-site transfer
+	if c.server.getSettings().EnableFXP && raddr.Port < 1024 {
+		if controlConnIP, errIP := getIPFromRemoteAddr(c.RemoteAddr()); errIP != nil || !controlConnIP.Equal(raddr.IP) {
+			c.writeMessage(StatusSyntaxErrorParameters, "Connections to privileged ports of other hosts are refused")
+
+			return nil
+		}
+	}
+
+	if err = c.validateActiveTarget(raddr); err != nil {
+		c.logger.Warn("Active transfer target refused", "raddr", raddr.String(), "err", err)
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("Active transfer target refused: %v", err))
+
+		return nil
+	}
+
 	err = c.checkDataConnectionRequirement(raddr.IP, DataChannelActive)
 	if err != nil {
 		// we don't want to expose the full error to the client, we just log it
@@ -47,22 +74,27 @@ func (c *clientHandler) handlePORT(param string) error {
 
 	var tlsConfig *tls.Config
 
-	if c.HasTLSForTransfers() || c.server.settings.TLSRequired == ImplicitEncryption {
-		tlsConfig, err = c.server.driver.GetTLSConfig()
+	if c.HasTLSForTransfers() || c.server.getSettings().TLSRequired == ImplicitEncryption {
+		tlsConfig, err = c.getTLSConfig()
 		if err != nil {
 			c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("Cannot get a TLS config for active connection: %v", err))
 
 			return nil
 		}
+
+		tlsConfig = c.dataTLSConfig(c.server.applyTLSOverrides(tlsConfig), DataChannelActive)
 	}
 
 	c.transferMu.Lock()
 
 	c.transfer = &activeTransferHandler{
 		raddr:     raddr,
-		settings:  c.server.settings,
+		settings:  c.server.getSettings(),
 		tlsConfig: tlsConfig,
+		eprt:      command == "EPRT",
+		server:    c.server,
 	}
+	c.transferState = transferReady
 
 	c.transferMu.Unlock()
 	c.setLastDataChannel(DataChannelActive)
@@ -72,13 +104,57 @@ func (c *clientHandler) handlePORT(param string) error {
 	return nil
 }
 
+var (
+	errActiveTargetPrivileged = errors.New("privileged ports are refused")
+	errActiveTargetPrivate    = errors.New("private addresses are refused")
+	errActiveTargetForeign    = errors.New("addresses other than yours are refused")
+)
+
+// validateActiveTarget applies the anti-bounce checks selected through
+// Settings.ActiveTargetRestrictions (RFC 2577, section 3) to a PORT or EPRT
+// target, then defers to the MainDriverExtensionActiveTargetValidator
+// extension when the driver implements it
+func (c *clientHandler) validateActiveTarget(raddr *net.TCPAddr) error {
+	restrictions := c.server.getSettings().ActiveTargetRestrictions
+
+	if restrictions&ActiveTargetRefusePrivilegedPorts != 0 && raddr.Port < 1024 {
+		return errActiveTargetPrivileged
+	}
+
+	if restrictions&ActiveTargetRefusePrivateAddresses != 0 &&
+		(raddr.IP.IsLoopback() || raddr.IP.IsLinkLocalUnicast() || raddr.IP.IsPrivate()) {
+		return errActiveTargetPrivate
+	}
+
+	if restrictions&ActiveTargetRequireControlIP != 0 {
+		controlConnIP, err := getIPFromRemoteAddr(c.RemoteAddr())
+		if err != nil {
+			return err
+		}
+
+		if !controlConnIP.Equal(raddr.IP) {
+			return errActiveTargetForeign
+		}
+	}
+
+	if validator, ok := c.server.driver.(MainDriverExtensionActiveTargetValidator); ok {
+		if err := validator.ValidateActiveTarget(c, raddr.IP, raddr.Port); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Active connection
 type activeTransferHandler struct {
 	raddr     *net.TCPAddr // Remote address of the client
 	conn      net.Conn     // Connection used to connect to him
 	settings  *Settings    // Settings
 	tlsConfig *tls.Config  // not nil if the active connection requires TLS
+	eprt      bool         // the connection was requested through EPRT
 	info      string       // transfer info
+	server    *FtpServer   // server owning the transfer, for the data socket accounting, may be nil
 }
 
 func (a *activeTransferHandler) GetInfo() string {
@@ -89,16 +165,28 @@ func (a *activeTransferHandler) SetInfo(info string) {
 	a.info = info
 }
 
+// activeTransferRetryBackoff is the initial delay between two dial attempts,
+// it doubles after every refused connection
+const activeTransferRetryBackoff = 100 * time.Millisecond
+
 func (a *activeTransferHandler) Open() (net.Conn, error) {
 	timeout := time.Duration(time.Second.Nanoseconds() * int64(a.settings.ConnectionTimeout))
+	if a.settings.ActiveTransferDialTimeout > 0 {
+		timeout = time.Duration(time.Second.Nanoseconds() * int64(a.settings.ActiveTransferDialTimeout))
+	}
+
 	dialer := &net.Dialer{Timeout: timeout}
 
-	if !a.settings.ActiveTransferPortNon20 {
+	switch {
+	case a.eprt && a.settings.ActiveTransferSourcePort > 0:
+		dialer.LocalAddr, _ = net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", a.settings.ActiveTransferSourcePort))
+		dialer.Control = Control
+	case !a.settings.ActiveTransferPortNon20:
 		dialer.LocalAddr, _ = net.ResolveTCPAddr("tcp", ":20")
 		dialer.Control = Control
 	}
 
-	conn, err := dialer.Dial("tcp", a.raddr.String())
+	conn, err := a.dialWithRetries(dialer)
 	if err != nil {
 		return nil, newNetworkError("could not establish active connection", err)
 	}
@@ -110,15 +198,42 @@ func (a *activeTransferHandler) Open() (net.Conn, error) {
 	// keep connection as it will be closed by Close()
 	a.conn = conn
 
+	if a.server != nil {
+		a.server.dataConnOpened()
+	}
+
 	return a.conn, nil
 }
 
+// dialWithRetries dials the client address, retrying with a growing backoff
+// when the connection fails: some client firewalls only open the data port
+// shortly after the PORT/EPRT command has been sent
+func (a *activeTransferHandler) dialWithRetries(dialer *net.Dialer) (net.Conn, error) {
+	backoff := activeTransferRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		conn, err := dialer.Dial("tcp", a.raddr.String())
+		if err == nil || attempt >= a.settings.ActiveTransferDialRetries {
+			return conn, err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 // Close closes only if connection is established
 func (a *activeTransferHandler) Close() error {
 	if a.conn != nil {
 		if err := a.conn.Close(); err != nil {
 			return newNetworkError("could not close active connection", err)
 		}
+
+		a.conn = nil
+
+		if a.server != nil {
+			a.server.dataConnClosed()
+		}
 	}
 
 	return nil
@@ -164,46 +279,84 @@ func parsePORTAddr(param string) (*net.TCPAddr, error) {
 	return addr, err
 }
 
-// Parse EPRT parameter. Full EPRT command format:
-// - IPv4 : "EPRT |1|h1.h2.h3.h4|port|\r\n"
-// - IPv6 : "EPRT |2|h1::h2:h3:h4:h5|port|\r\n"
-func parseEPRTAddr(param string) (*net.TCPAddr, error) {
-	var addr *net.TCPAddr
-	var err error
+// NetworkProtocol is the RFC 2428 network protocol identifier carried in
+// EPRT and EPSV arguments
+type NetworkProtocol int8
 
-	params := strings.Split(param, "|")
-	if len(params) != 5 {
-		return nil, ErrRemoteAddrFormat
-	}
+// Supported network protocols
+const (
+	// NetworkProtocolIPv4 identifies an IPv4 address, "1" on the wire
+	NetworkProtocolIPv4 NetworkProtocol = 1
+	// NetworkProtocolIPv6 identifies an IPv6 address, "2" on the wire
+	NetworkProtocolIPv6 NetworkProtocol = 2
+)
+
+// String returns the protocol number as it appears in EPRT and EPSV arguments
+func (protocol NetworkProtocol) String() string {
+	return strconv.Itoa(int(protocol))
+}
 
-	netProtocol := params[1]
-	remoteIP := params[2]
-	remotePort := params[3]
+// ErrUnsupportedNetworkProtocol is returned when an EPRT or EPSV argument
+// carries a network protocol other than NetworkProtocolIPv4 and
+// NetworkProtocolIPv6. The client is answered with the 522 reply mandated by
+// RFC 2428, listing the supported protocols
+var ErrUnsupportedNetworkProtocol = errors.New("unsupported network protocol")
+
+// ExtendedAddress is the parsed form of an RFC 2428 EPRT argument
+type ExtendedAddress struct {
+	Protocol NetworkProtocol // Network protocol of the endpoint
+	IP       net.IP          // Address of the data connection endpoint
+	Port     int             // Port of the data connection endpoint
+}
 
-	// check port is valid
-	var portI int
-	if portI, err = strconv.Atoi(remotePort); err != nil || portI <= 0 || portI > 65535 {
-		return nil, ErrRemoteAddrFormat
-	}
+// String builds the "|protocol|address|port|" EPRT argument for the address
+func (addr ExtendedAddress) String() string {
+	return fmt.Sprintf("|%d|%s|%d|", addr.Protocol, addr.IP, addr.Port)
+}
 
-	var ipAddress net.IP
+// TCPAddr converts the address into a net.TCPAddr
+func (addr ExtendedAddress) TCPAddr() *net.TCPAddr {
+	return &net.TCPAddr{IP: addr.IP, Port: addr.Port}
+}
 
-	switch netProtocol {
-	case "1", "2":
-		// use protocol 1 means IPv4. 2 means IPv6
-		// net.ParseIP for validate IP
-		if ipAddress = net.ParseIP(remoteIP); ipAddress == nil {
-			return nil, ErrRemoteAddrFormat
-		}
+// parseNetworkProtocol parses the protocol number of an EPRT or EPSV argument
+func parseNetworkProtocol(value string) (NetworkProtocol, error) {
+	switch value {
+	case "1":
+		return NetworkProtocolIPv4, nil
+	case "2":
+		return NetworkProtocolIPv6, nil
 	default:
-		// wrong network protocol
-		return nil, ErrRemoteAddrFormat
+		return 0, fmt.Errorf("%w: %#v", ErrUnsupportedNetworkProtocol, value)
 	}
+}
 
-	addr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(ipAddress.String(), strconv.Itoa(portI)))
+// ParseEPRTArgument parses an RFC 2428 "|protocol|address|port|" argument.
+// ErrRemoteAddrFormat is returned when the argument is malformed and
+// ErrUnsupportedNetworkProtocol when the protocol is neither IPv4 nor IPv6.
+// Full EPRT command format:
+// - IPv4 : "EPRT |1|h1.h2.h3.h4|port|\r\n"
+// - IPv6 : "EPRT |2|h1::h2:h3:h4:h5|port|\r\n"
+func ParseEPRTArgument(param string) (ExtendedAddress, error) {
+	params := strings.Split(param, "|")
+	if len(params) != 5 || params[0] != "" || params[4] != "" {
+		return ExtendedAddress{}, ErrRemoteAddrFormat
+	}
+
+	protocol, err := parseNetworkProtocol(params[1])
 	if err != nil {
-		err = newNetworkError(fmt.Sprintf("could not resolve addr %v:%v", ipAddress, portI), err)
+		return ExtendedAddress{}, err
 	}
 
-	return addr, err
+	port, err := strconv.Atoi(params[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return ExtendedAddress{}, ErrRemoteAddrFormat
+	}
+
+	ipAddress := net.ParseIP(params[2])
+	if ipAddress == nil {
+		return ExtendedAddress{}, ErrRemoteAddrFormat
+	}
+
+	return ExtendedAddress{Protocol: protocol, IP: ipAddress, Port: port}, nil
 }
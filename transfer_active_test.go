@@ -2,6 +2,7 @@
 package ftpserver
 
 import (
+	"errors"
 	"net"
 	"regexp"
 	"testing"
@@ -25,6 +26,88 @@ func TestRemoteAddrFormat(t *testing.T) {
 	testRegexMatch(t, remoteAddrRegex, []string{"1,2,3,4,5"}, false)
 }
 
+// activeTargetServerDriver refuses PORT/EPRT targets pointing at port 2000,
+// the way an operator allowlist of partner servers would
+type activeTargetServerDriver struct {
+	TestServerDriver
+}
+
+var errNotAPartner = errors.New("this host is not a partner server")
+
+func (driver *activeTargetServerDriver) ValidateActiveTarget(_ ClientContext, _ net.IP, port int) error {
+	if port == 2000 {
+		return errNotAPartner
+	}
+
+	return nil
+}
+
+func TestActiveTargetValidation(t *testing.T) {
+	driver := &activeTargetServerDriver{}
+	driver.Settings = &Settings{ActiveConnectionsCheck: IPMatchDisabled}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	send := func(command string) (int, string) {
+		status, resp, errSend := raw.SendCommand(command)
+		require.NoError(t, errSend)
+
+		return status, resp
+	}
+
+	// the driver callback refuses port 2000 and accepts the rest
+	status, resp := send("PORT 198,51,100,1,7,208") // port 2000
+	require.Equal(t, StatusSyntaxErrorParameters, status, resp)
+	require.Contains(t, resp, "not a partner server")
+
+	status, resp = send("PORT 198,51,100,1,11,184") // port 3000
+	require.Equal(t, StatusOK, status, resp)
+
+	// privileged ports can be refused without enabling FXP
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.ActiveTargetRestrictions = ActiveTargetRefusePrivilegedPorts
+	})
+
+	status, resp = send("PORT 198,51,100,1,0,80") // port 80
+	require.Equal(t, StatusSyntaxErrorParameters, status, resp)
+	require.Contains(t, resp, "privileged ports")
+
+	// private and loopback ranges can be refused
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.ActiveTargetRestrictions = ActiveTargetRefusePrivateAddresses
+	})
+
+	status, resp = send("PORT 10,0,0,1,11,184")
+	require.Equal(t, StatusSyntaxErrorParameters, status, resp)
+	require.Contains(t, resp, "private addresses")
+
+	// the strictest mode only accepts the control connection address
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.ActiveTargetRestrictions = ActiveTargetRequireControlIP
+	})
+
+	status, resp = send("PORT 198,51,100,1,11,184")
+	require.Equal(t, StatusSyntaxErrorParameters, status, resp)
+	require.Contains(t, resp, "other than yours")
+
+	status, resp = send("PORT 127,0,0,1,11,184")
+	require.Equal(t, StatusOK, status, resp)
+}
+
 func TestActiveTransferFromPort20(t *testing.T) {
 	listener, err := net.Listen("tcp", ":20") //nolint:gosec
 	if err != nil {
@@ -35,6 +35,14 @@ type passiveTransferHandler struct {
 	settings    *Settings        // Settings
 	info        string           // transfer info
 	logger      log.Logger       // Logger
+	// server owning the transfer, for the data socket accounting, may be nil
+	server *FtpServer
+	// pool the listener was borrowed from, nil when it was bound for this transfer
+	pool *passivePortPool
+	// cluster coordinator holding the claim on the advertised host:port, may be nil
+	coordinator PassiveCoordination
+	// advertised host the claim was made for
+	advertisedHost string
 	// data connection requirement checker
 	checkDataConn func(dataConnIP net.IP, channelType DataChannel) error
 }
@@ -49,23 +57,40 @@ func (e *ipValidationError) Error() string {
 
 func (c *clientHandler) getCurrentIP() ([]string, error) {
 	// Provide our external IP address so the ftp client can connect back to us
-	ipParts := c.server.settings.PublicHost
+	ipParts := c.server.getSettings().PublicHost
 
 	// If we don't have an IP address, we can take the one that was used for the current connection
 	if ipParts == "" {
 		// Defer to the user-provided resolver.
-		if c.server.settings.PublicIPResolver != nil {
+		if c.server.getSettings().PublicIPResolver != nil {
 			var err error
-			ipParts, err = c.server.settings.PublicIPResolver(c)
+			ipParts, err = c.server.getSettings().PublicIPResolver(c)
 
 			if err != nil {
 				return nil, fmt.Errorf("couldn't fetch public IP: %w", err)
 			}
 		} else {
-			ipParts = strings.Split(c.conn.LocalAddr().String(), ":")[0]
+			host, _, errSplit := net.SplitHostPort(c.conn.LocalAddr().String())
+			if errSplit != nil {
+				return nil, newNetworkError("could not parse local address", errSplit)
+			}
+
+			ipParts = host
 		}
 	}
 
+	// an IPv6 address cannot be represented in a PASV reply: advertise the
+	// configured IPv4 fallback instead, or have the client switch to EPSV
+	// whose reply only carries the port
+	if host, _ := splitHostZone(ipParts); strings.Contains(host, ":") {
+		fallback := c.pasvIPv4Fallback()
+		if fallback == "" {
+			return nil, &ipValidationError{error: fmt.Sprintf("cannot advertise IPv6 passive IP %#v in a PASV reply, use EPSV instead", ipParts)}
+		}
+
+		ipParts = fallback
+	}
+
 	quads := strings.Split(ipParts, ".")
 	if len(quads) != 4 {
 		c.logger.Warn("Invalid passive IP", "IP", ipParts)
@@ -76,6 +101,40 @@ func (c *clientHandler) getCurrentIP() ([]string, error) {
 	return quads, nil
 }
 
+// pasvIPv4Fallback returns the configured IPv4 address to advertise when the
+// session address is IPv6, or an empty string when there is none
+func (c *clientHandler) pasvIPv4Fallback() string {
+	fallbacks := c.server.getSettings().PasvIPv4Fallbacks
+	if len(fallbacks) == 0 {
+		return ""
+	}
+
+	return fallbacks[0]
+}
+
+// epsvOnlyPassive tells whether no IPv4 address can be advertised in a PASV
+// reply for this session, leaving EPSV as the only working passive mode
+func (c *clientHandler) epsvOnlyPassive() bool {
+	if c.pasvIPv4Fallback() != "" {
+		return false
+	}
+
+	host := c.server.getSettings().PublicHost
+	if host == "" {
+		localHost, _, err := net.SplitHostPort(c.conn.LocalAddr().String())
+		if err != nil {
+			return false
+		}
+
+		host = localHost
+	}
+
+	host, _ = splitHostZone(host)
+	parsedIP := net.ParseIP(host)
+
+	return parsedIP != nil && parsedIP.To4() == nil
+}
+
 // ErrNoAvailableListeningPort is returned when no port could be found to accept incoming connection
 var ErrNoAvailableListeningPort = errors.New("could not find any port to listen to")
 
@@ -84,7 +143,29 @@ const (
 	portSearchMaxAttempts = 1000
 )
 
-func (c *clientHandler) findListenerWithinPortRange(portRange *PortRange) (*net.TCPListener, error) {
+// passiveAdvertisedHost returns the host the passive reply will carry, which
+// is the name the coordinator claims ports under
+func (c *clientHandler) passiveAdvertisedHost() string {
+	settings := c.server.getSettings()
+
+	if settings.PublicHost != "" {
+		return settings.PublicHost
+	}
+
+	if settings.PublicIPResolver != nil {
+		if host, err := settings.PublicIPResolver(c); err == nil {
+			return host
+		}
+	}
+
+	return strings.Split(c.conn.LocalAddr().String(), ":")[0]
+}
+
+func (c *clientHandler) findListenerWithinPortRange(
+	portRange *PortRange,
+	coordinator PassiveCoordination,
+	advertisedHost string,
+) (*net.TCPListener, error) {
 	nbAttempts := portRange.End - portRange.Start
 
 	// Making sure we trying a reasonable amount of ports before giving up
@@ -106,9 +187,23 @@ func (c *clientHandler) findListenerWithinPortRange(portRange *PortRange) (*net.
 		}
 
 		tcpListener, errListen := net.ListenTCP("tcp", laddr)
-		if errListen == nil {
-			return tcpListener, nil
+		if errListen != nil {
+			continue
 		}
+
+		// a port that is free locally can still be advertised by another
+		// instance behind the same public address
+		if coordinator != nil {
+			if errReserve := coordinator.Reserve(advertisedHost, port); errReserve != nil {
+				if errClose := tcpListener.Close(); errClose != nil {
+					c.logger.Warn("Problem closing unreserved passive listener", "err", errClose)
+				}
+
+				continue
+			}
+		}
+
+		return tcpListener, nil
 	}
 
 	c.logger.Warn(
@@ -121,25 +216,120 @@ func (c *clientHandler) findListenerWithinPortRange(portRange *PortRange) (*net.
 	return nil, ErrNoAvailableListeningPort
 }
 
-func (c *clientHandler) handlePASV(_ string) error {
+// replyPassiveOpenFailure reports a passive-mode allocation failure (port
+// exhaustion, wrapper failure) as a structured log event. When the
+// ActiveFallbackOnPasvFailure setting is enabled the reply is a non-fatal 425
+// hinting at active mode, so the client can immediately retry with PORT/EPRT;
+// otherwise the historical 421 reply is kept
+func (c *clientHandler) replyPassiveOpenFailure(err error) {
+	activeFallback := c.server.getSettings().ActiveFallbackOnPasvFailure
+
+	c.logger.Error(
+		"Could not listen for passive connection",
+		"command", c.GetLastCommand(),
+		"activeFallback", activeFallback,
+		"err", err,
+	)
+
+	if activeFallback {
+		c.writeMessage(StatusCannotOpenDataConnection,
+			fmt.Sprintf("Could not listen for passive connection, retry with PORT/EPRT: %v", err))
+
+		return
+	}
+
+	c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("Could not listen for passive connection: %v", err))
+}
+
+// ParseEPSVArgument parses the optional RFC 2428 EPSV argument: an empty
+// value and the "ALL" keyword return no protocol, otherwise the value must be
+// a supported protocol number or ErrUnsupportedNetworkProtocol is returned
+func ParseEPSVArgument(param string) (NetworkProtocol, error) {
+	if param == "" || strings.EqualFold(param, "ALL") {
+		return 0, nil
+	}
+
+	return parseNetworkProtocol(param)
+}
+
+func (c *clientHandler) handlePASV(param string) error {
 	command := c.GetLastCommand()
+
+	if command == "EPSV" {
+		if _, err := ParseEPSVArgument(param); err != nil {
+			c.writeMessage(StatusNetworkProtocolNotSupported, "Network protocol not supported, use (1,2)")
+
+			return nil
+		}
+	}
+	if softLimit := c.server.getSettings().DataFdSoftLimit; softLimit > 0 && c.server.estimatedOpenFds() >= softLimit {
+		c.writeMessage(StatusCannotOpenDataConnection, "No file descriptor available for the data connection")
+
+		return nil
+	}
+
 	addr, _ := net.ResolveTCPAddr("tcp", ":0")
 	var tcpListener *net.TCPListener
 	var err error
-	portRange := c.server.settings.PassiveTransferPortRange
+	portRange := c.server.getSettings().PassiveTransferPortRange
+	coordinator := c.server.getSettings().PassiveCoordinator
 
-	if portRange != nil {
-		tcpListener, err = c.findListenerWithinPortRange(portRange)
-	} else {
+	var advertisedHost string
+	if coordinator != nil {
+		advertisedHost = c.passiveAdvertisedHost()
+	}
+
+	pool := c.server.passivePool
+
+	switch {
+	case pool != nil:
+		// pre-bound ports are owned for the whole lifetime of the server, no
+		// per-transfer claim is needed
+		coordinator = nil
+		tcpListener, err = pool.borrow()
+	case portRange != nil:
+		tcpListener, err = c.findListenerWithinPortRange(portRange, coordinator, advertisedHost)
+	default:
 		tcpListener, err = net.ListenTCP("tcp", addr)
+
+		if err == nil && coordinator != nil {
+			//nolint:forcetypeassert
+			if errReserve := coordinator.Reserve(advertisedHost, tcpListener.Addr().(*net.TCPAddr).Port); errReserve != nil {
+				tcpListener.Close() //nolint:errcheck,gosec
+				err = errReserve
+			}
+		}
 	}
 
 	if err != nil {
-		c.logger.Error("Could not listen for passive connection", "err", err)
-		c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("Could not listen for passive connection: %v", err))
+		c.replyPassiveOpenFailure(err)
 
 		return nil
 	}
+
+	c.server.dataListenerOpened()
+
+	// a failure between here and the transfer handler taking ownership must
+	// close the listener and revert the fd accounting, or the soft limit
+	// eventually refuses every passive transfer
+	releaseListener := func() {
+		// the port claim is released with the listener, as documented on
+		// PassiveCoordinator
+		if coordinator != nil {
+			coordinator.Release(advertisedHost, tcpListener.Addr().(*net.TCPAddr).Port) //nolint:forcetypeassert
+		}
+
+		// a pre-bound listener goes back to the pool instead of being
+		// closed, like passiveTransferHandler.Close does
+		if pool != nil {
+			pool.giveBack(tcpListener)
+		} else {
+			tcpListener.Close() //nolint:errcheck,gosec
+		}
+
+		c.server.dataListenerClosed()
+	}
+
 	// The listener will either be plain TCP or TLS
 	var listener net.Listener
 	listener = tcpListener
@@ -147,39 +337,68 @@ func (c *clientHandler) handlePASV(_ string) error {
 	if wrapper, ok := c.server.driver.(MainDriverExtensionPassiveWrapper); ok {
 		listener, err = wrapper.WrapPassiveListener(listener)
 		if err != nil {
-			c.logger.Error("Could not wrap passive connection", "err", err)
-			c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("Could not listen for passive connection: %v", err))
+			c.replyPassiveOpenFailure(err)
+			releaseListener()
 
 			return nil
 		}
 	}
 
-	if c.HasTLSForTransfers() || c.server.settings.TLSRequired == ImplicitEncryption {
-		if tlsConfig, err := c.server.driver.GetTLSConfig(); err == nil {
-			listener = tls.NewListener(listener, tlsConfig)
+	if c.HasTLSForTransfers() || c.server.getSettings().TLSRequired == ImplicitEncryption {
+		if tlsConfig, err := c.getTLSConfig(); err == nil {
+			listener = tls.NewListener(listener, c.dataTLSConfig(c.server.applyTLSOverrides(tlsConfig), DataChannelPassive))
 		} else {
 			c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("Cannot get a TLS config: %v", err))
+			releaseListener()
 
 			return nil
 		}
 	}
 
 	transferHandler := &passiveTransferHandler{ //nolint:forcetypeassert
-		tcpListener:   tcpListener,
-		listener:      listener,
-		Port:          tcpListener.Addr().(*net.TCPAddr).Port,
-		settings:      c.server.settings,
-		logger:        c.logger,
-		checkDataConn: c.checkDataConnectionRequirement,
+		tcpListener:    tcpListener,
+		listener:       listener,
+		Port:           tcpListener.Addr().(*net.TCPAddr).Port,
+		settings:       c.server.getSettings(),
+		logger:         c.logger,
+		server:         c.server,
+		pool:           pool,
+		coordinator:    coordinator,
+		advertisedHost: advertisedHost,
+		checkDataConn:  c.checkDataConnectionRequirement,
+	}
+
+	// a deployment reachable through several NATs advertises a different
+	// mapping per client, see Settings.PasvPortResolver
+	advertisedPort := transferHandler.Port
+
+	var resolvedHost string
+
+	if resolver := c.server.getSettings().PasvPortResolver; resolver != nil {
+		host, port, errResolve := resolver(c, transferHandler.Port)
+		if errResolve != nil {
+			c.replyPassiveOpenFailure(errResolve)
+			// the handler owns the listener by now, closing it gives back the
+			// fd accounting, the pool slot and the port claim
+			transferHandler.Close() //nolint:errcheck,gosec
+
+			return nil
+		}
+
+		resolvedHost, advertisedPort = host, port
 	}
 
 	// We should rewrite this part
 	if command == "PASV" {
-		if c.handlePassivePASV(transferHandler) {
+		if c.handlePassivePASV(resolvedHost, advertisedPort) {
+			// the 421 was already sent, closing the handler gives back the
+			// listener and everything accounted to it
+			transferHandler.Close() //nolint:errcheck,gosec
+
 			return nil
 		}
 	} else {
-		c.writeMessage(StatusEnteringEPSV, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", transferHandler.Port))
+		c.writeMessage(StatusEnteringEPSV, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", advertisedPort))
 	}
 
 	c.transferMu.Lock()
@@ -188,16 +407,28 @@ func (c *clientHandler) handlePASV(_ string) error {
 	}
 
 	c.transfer = transferHandler
+	c.transferState = transferReady
 	c.transferMu.Unlock()
 	c.setLastDataChannel(DataChannelPassive)
 
 	return nil
 }
 
-func (c *clientHandler) handlePassivePASV(transferHandler *passiveTransferHandler) bool {
-	portByte1 := transferHandler.Port / 256
-	portByte2 := transferHandler.Port - (portByte1 * 256)
-	quads, err2 := c.getCurrentIP()
+func (c *clientHandler) handlePassivePASV(resolvedHost string, advertisedPort int) bool {
+	portByte1 := advertisedPort / 256
+	portByte2 := advertisedPort - (portByte1 * 256)
+
+	var quads []string
+
+	var err2 error
+
+	if resolvedHost != "" {
+		if quads = strings.Split(resolvedHost, "."); len(quads) != 4 {
+			err2 = &ipValidationError{error: fmt.Sprintf("invalid passive IP %#v", resolvedHost)}
+		}
+	} else {
+		quads, err2 = c.getCurrentIP()
+	}
 
 	if err2 != nil {
 		c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("Could not listen for passive connection: %v", err2))
@@ -218,33 +449,60 @@ func (c *clientHandler) handlePassivePASV(transferHandler *passiveTransferHandle
 }
 
 func (p *passiveTransferHandler) ConnectionWait(wait time.Duration) (net.Conn, error) {
-	if p.connection == nil {
-		var err error
-		if err = p.tcpListener.SetDeadline(time.Now().Add(wait)); err != nil {
-			return nil, fmt.Errorf("failed to set deadline: %w", err)
-		}
+	if p.connection != nil {
+		return p.connection, nil
+	}
+
+	if err := p.tcpListener.SetDeadline(time.Now().Add(wait)); err != nil {
+		return nil, fmt.Errorf("failed to set deadline: %w", err)
+	}
 
-		p.connection, err = p.listener.Accept()
+	// the claim on the advertised port is renewed for as long as the client
+	// may still connect back
+	if p.coordinator != nil {
+		p.coordinator.Heartbeat(p.advertisedHost, p.Port)
+	}
+
+	// connections from unexpected peers are dropped as they arrive: a scanner
+	// hitting the passive port must not consume the slot of the legitimate
+	// client, which is awaited until the deadline
+	for {
+		connection, err := p.listener.Accept()
 		if err != nil {
 			return nil, fmt.Errorf("failed to accept passive transfer connection: %w", err)
 		}
 
-		ipAddress, err := getIPFromRemoteAddr(p.connection.RemoteAddr())
+		ipAddress, err := getIPFromRemoteAddr(connection.RemoteAddr())
 		if err != nil {
 			p.logger.Warn("Could get remote passive IP address", "err", err)
+			p.closeDropped(connection)
 
-			return nil, err
+			continue
 		}
 
 		if err := p.checkDataConn(ipAddress, DataChannelPassive); err != nil {
 			// we don't want to expose the full error to the client, we just log it
 			p.logger.Warn("Could not validate passive data connection requirement", "err", err)
+			p.closeDropped(connection)
+
+			continue
+		}
+
+		p.connection = connection
 
-			return nil, &ipValidationError{error: "data connection security requirements not met"}
+		if p.server != nil {
+			p.server.dataConnOpened()
 		}
+
+		return p.connection, nil
 	}
+}
 
-	return p.connection, nil
+// closeDropped closes the connection of a rejected peer, only logging problems
+func (p *passiveTransferHandler) closeDropped(connection net.Conn) {
+	if err := connection.Close(); err != nil {
+		p.logger.Warn("Problem closing a rejected data connection", "err", err)
+	}
 }
 
 func (p *passiveTransferHandler) GetInfo() string {
@@ -263,10 +521,22 @@ func (p *passiveTransferHandler) Open() (net.Conn, error) {
 
 // Closing only the client connection is not supported at that time
 func (p *passiveTransferHandler) Close() error {
+	if p.coordinator != nil {
+		p.coordinator.Release(p.advertisedHost, p.Port)
+	}
+
 	if p.tcpListener != nil {
-		if err := p.tcpListener.Close(); err != nil {
+		if p.pool != nil {
+			p.pool.giveBack(p.tcpListener)
+		} else if err := p.tcpListener.Close(); err != nil {
 			p.logger.Warn("Problem closing passive listener", "err", err)
 		}
+
+		p.tcpListener = nil
+
+		if p.server != nil {
+			p.server.dataListenerClosed()
+		}
 	}
 
 	if p.connection != nil {
@@ -274,6 +544,12 @@ func (p *passiveTransferHandler) Close() error {
 			p.logger.Warn(
 				"Problem closing passive connection", "err", err)
 		}
+
+		p.connection = nil
+
+		if p.server != nil {
+			p.server.dataConnClosed()
+		}
 	}
 
 	return nil
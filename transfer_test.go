@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -19,6 +20,7 @@ import (
 
 	lognoop "github.com/fclairamb/go-log/noop"
 	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -358,6 +360,312 @@ func TestFailedTransfer(t *testing.T) {
 	require.NoError(t, err, "This upload should have succeeded")
 }
 
+func TestTransferStats(t *testing.T) {
+	driver := &TestServerDriver{Debug: false}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	getStats := func() TransferStats {
+		driver.clientMU.Lock()
+		defer driver.clientMU.Unlock()
+
+		if len(driver.Clients) == 0 {
+			return TransferStats{}
+		}
+
+		return driver.Clients[0].GetTransferStats()
+	}
+
+	// "delay-io" slows down the driver's Write, giving us a window to observe
+	// the upload in progress
+	done := make(chan error, 1)
+
+	go func() {
+		done <- client.Store("delay-io.bin", strings.NewReader(strings.Repeat("x", 2*1024)))
+	}()
+
+	var stats TransferStats
+
+	require.Eventually(t, func() bool {
+		stats = getStats()
+
+		return stats.Direction == TransferDirectionUpload
+	}, 5*time.Second, 10*time.Millisecond, "the upload never showed up in the transfer stats")
+
+	require.Equal(t, "/delay-io.bin", stats.Path)
+	require.False(t, stats.Start.IsZero(), "the transfer start time should be set")
+
+	require.NoError(t, <-done)
+
+	require.Eventually(t, func() bool {
+		stats = getStats()
+
+		return stats.Direction == TransferDirectionNone
+	}, 5*time.Second, 10*time.Millisecond, "the transfer stats were not cleared after the upload")
+	require.Empty(t, stats.Path)
+}
+
+func TestTransferNotifier(t *testing.T) {
+	driver := &TestServerDriver{Debug: false}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	ftpUpload(t, client, createTemporaryFile(t, 1024), "file.bin")
+	ftpDownloadAndHash(t, client, "file.bin")
+
+	notifications := driver.getTransferNotifications()
+	require.Len(t, notifications, 4)
+
+	// ftpUpload stores to a temporary name before renaming the file
+	require.Equal(t, TransferDirectionUpload, notifications[0].direction)
+	require.Equal(t, "/file.bin.tmp", notifications[0].path)
+	require.False(t, notifications[0].completed)
+
+	require.True(t, notifications[1].completed)
+	require.Equal(t, TransferDirectionUpload, notifications[1].direction)
+	require.Equal(t, int64(1024), notifications[1].bytes)
+	require.NoError(t, notifications[1].err)
+
+	require.Equal(t, TransferDirectionDownload, notifications[2].direction)
+	require.False(t, notifications[2].completed)
+
+	require.True(t, notifications[3].completed)
+	require.Equal(t, int64(1024), notifications[3].bytes)
+	require.NoError(t, notifications[3].err)
+}
+
+func TestMaxTransferDuration(t *testing.T) {
+	driver := &TestServerDriver{Debug: false}
+	server := NewTestServerWithTestDriver(t, driver)
+
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.MaxTransferDuration = 1
+	})
+
+	// the file is seeded directly in the backing filesystem: the "delay-io"
+	// reads are slow enough for the download to outlive the allowed duration
+	require.NoError(t, afero.WriteFile(driver.fs, "/delay-io.bin", bytes.Repeat([]byte("x"), 100*1024), 0o644))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw.SendCommand("RETR delay-io.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(dataConn)
+	require.NoError(t, err)
+	require.Less(t, len(data), 100*1024, "The transfer should have been aborted before completing")
+	require.NoError(t, dataConn.Close())
+
+	returnCode, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusTransferAborted, returnCode, response)
+	require.Contains(t, response, "maximum transfer duration exceeded")
+}
+
+func TestTransferAccounting(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:         false,
+		TransferQuota: 6 * 1024,
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	// We use a raw connection as goftp would silently resume a rejected upload
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// We create a 4KB file and upload it, this fits in the 6KB allowance
+	file := createTemporaryFile(t, 4*1024)
+	_, err = file.Seek(0, 0)
+	require.NoError(t, err, "Couldn't seek")
+	ftpUploadWithRawConnection(t, raw, file, "file.bin", false)
+
+	driver.clientMU.Lock()
+	require.NotEmpty(t, driver.Clients, "We should have a connected client")
+	uploaded, downloaded := driver.Clients[0].GetTransferredBytes()
+	driver.clientMU.Unlock()
+
+	require.Equal(t, int64(4*1024), uploaded, "The upload counter doesn't match the file size")
+	require.Equal(t, int64(0), downloaded, "Nothing was downloaded yet")
+
+	// The second upload brings the session over its traffic allowance
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw.SendCommand("STOR file2.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = file.Seek(0, 0)
+	require.NoError(t, err, "Couldn't seek")
+	// the server can close the data connection early, we only care about the final reply
+	_, _ = io.Copy(dataConn, file)
+	_ = dataConn.Close()
+
+	returnCode, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusActionAborted, returnCode, response)
+}
+
+var errExecutableNotAllowed = errors.New("executables are not welcome here")
+
+func TestUploadContentSniffing(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: false,
+		ContentSniffer: func(_ string, header []byte) error {
+			if bytes.HasPrefix(header, []byte("MZ")) {
+				return errExecutableNotAllowed
+			}
+
+			return nil
+		},
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	// We use a raw connection as goftp would silently resume a rejected upload
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// An innocuous file is accepted
+	ftpUploadWithRawConnection(t, raw, strings.NewReader("#!/bin/sh\necho hello\n"), "ok.sh", false)
+
+	// An upload starting with the executable magic number is rejected with a 553
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw.SendCommand("STOR malware.exe")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = dataConn.Write([]byte("MZ\x90\x00 certainly an executable"))
+	require.NoError(t, err)
+	require.NoError(t, dataConn.Close())
+
+	returnCode, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTakenNoFile, returnCode, response)
+	require.Contains(t, response, "content type not allowed")
+}
+
+func TestTransferOutcomeNotifications(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: false,
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	// A completed upload triggers TransferDone with the number of bytes exchanged
+	content := []byte("transfer done payload")
+	require.NoError(t, client.Store("file.bin", bytes.NewReader(content)))
+
+	file := driver.GetLastOpenedFile()
+	require.NotNil(t, file)
+
+	bytesDone, errTransfer := file.getTransferOutcome()
+	require.NoError(t, errTransfer)
+	require.Equal(t, int64(len(content)), bytesDone)
+
+	// We use a raw connection as goftp would silently resume a failed upload
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// A failure to close an upload is reported with its phase
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw.SendCommand("STOR fail-to-close.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = dataConn.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, dataConn.Close())
+
+	returnCode, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, returnCode, response)
+
+	file = driver.GetLastOpenedFile()
+	require.NotNil(t, file)
+
+	_, errTransfer = file.getTransferOutcome()
+
+	var transferErr TransferError
+	require.ErrorAs(t, errTransfer, &transferErr)
+	require.Equal(t, TransferPhaseClose, transferErr.Phase())
+	require.ErrorIs(t, errTransfer, errFailClose)
+}
+
 func TestBogusTransferStart(t *testing.T) {
 	server := NewTestServer(t, false)
 	conf := goftp.Config{
@@ -396,10 +704,11 @@ func TestBogusTransferStart(t *testing.T) {
 		require.Equal(t, StatusSyntaxErrorParameters, status, resp)
 	}
 
-	{ // Bad protocol type: 3
+	{ // Unsupported protocol type: 3, answered with the RFC 2428 522 reply
 		status, resp, err := returnCode.SendCommand("EPRT |3|::1|2000|")
 		require.NoError(t, err)
-		require.Equal(t, StatusSyntaxErrorParameters, status, resp)
+		require.Equal(t, StatusNetworkProtocolNotSupported, status, resp)
+		require.Contains(t, resp, "use (1,2)")
 	}
 
 	{ // good request but unacceptable ip address
@@ -409,7 +718,7 @@ func TestBogusTransferStart(t *testing.T) {
 		require.Contains(t, resp, "Your request does not meet the configured security requirements")
 	}
 
-	server.settings.ActiveConnectionsCheck = IPMatchDisabled
+	mustSwapSettings(server, func(settings *Settings) { settings.ActiveConnectionsCheck = IPMatchDisabled })
 
 	{ // We end-up on a positive note
 		status, resp, err := returnCode.SendCommand("EPRT |1|::1|2000|")
@@ -579,63 +888,56 @@ func TestAPPENewFile(t *testing.T) {
 	require.Equal(t, localHash, remoteHash)
 }
 
-func TestTransfersFromOffset(t *testing.T) {
-	driver := &TestServerDriver{
-		Debug: false,
-	}
-	server := NewTestServerWithTestDriver(t, driver)
+func TestTransferReplyWithSize(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false})
 	conf := goftp.Config{
 		User:     authUser,
 		Password: authPass,
 	}
-	file := createTemporaryFile(t, 1*1024)
 	client, err := goftp.DialConfig(conf, server.Addr())
 	require.NoError(t, err)
 
 	defer func() { require.NoError(t, client.Close()) }()
 
-	_, err = file.Seek(0, io.SeekStart)
+	raw, err := client.OpenRawConn()
 	require.NoError(t, err)
 
-	err = client.Store("file", file)
-	require.NoError(t, err)
+	defer func() { require.NoError(t, raw.Close()) }()
 
-	_, err = file.Seek(0, io.SeekEnd)
-	require.NoError(t, err)
+	content := "hello"
+	ftpUploadWithRawConnection(t, raw, strings.NewReader(content), "file.bin", false)
 
-	data := []byte("some more data")
-	_, err = file.Write(data)
-	require.NoError(t, err)
+	mustSwapSettings(server, func(settings *Settings) { settings.EnableSizeInTransferReply = true })
 
-	_, err = file.Seek(1024, io.SeekStart)
+	dcGetter, err := raw.PrepareDataConn()
 	require.NoError(t, err)
 
-	_, err = client.TransferFromOffset("file", nil, file, 1024)
+	returnCode, response, err := raw.SendCommand("RETR file.bin")
 	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+	require.Contains(t, response, "RETR file.bin (5 bytes)")
 
-	info, err := client.Stat("file")
+	dataConn, err := dcGetter()
 	require.NoError(t, err)
-	require.Equal(t, int64(1024+len(data)), info.Size())
 
-	localHash := hashFile(t, file)
-	remoteHash := ftpDownloadAndHash(t, client, "file")
-	require.Equal(t, localHash, remoteHash)
+	data, err := io.ReadAll(dataConn)
+	require.NoError(t, err)
+	require.Equal(t, content, string(data))
+	require.NoError(t, dataConn.Close())
 
-	// finally test a partial RETR
-	buf := bytes.NewBuffer(nil)
-	_, err = client.TransferFromOffset("file", buf, nil, 1024)
+	returnCode, response, err = raw.ReadResponse()
 	require.NoError(t, err)
-	require.Equal(t, string(data), buf.String())
+	require.Equal(t, StatusClosingDataConn, returnCode, response)
 }
 
-func TestBasicABOR(t *testing.T) {
-	server := NewTestServer(t, false)
+func TestAPPEWithRestOffset(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false})
 	conf := goftp.Config{
 		User:     authUser,
 		Password: authPass,
 	}
 	client, err := goftp.DialConfig(conf, server.Addr())
-	require.NoError(t, err, "Couldn't connect")
+	require.NoError(t, err)
 
 	defer func() { require.NoError(t, client.Close()) }()
 
@@ -644,36 +946,217 @@ func TestBasicABOR(t *testing.T) {
 
 	defer func() { require.NoError(t, raw.Close()) }()
 
-	returnCode, _, err := raw.SendCommand("EPSV")
-	require.NoError(t, err)
-	require.Equal(t, StatusEnteringEPSV, returnCode)
+	readBack := func() string {
+		buf := new(bytes.Buffer)
+		require.NoError(t, client.Retrieve("file.bin", buf))
 
-	returnCode, _, err = raw.SendCommand(getABORCmd())
-	require.NoError(t, err)
-	require.Equal(t, StatusClosingDataConn, returnCode)
+		return buf.String()
+	}
 
-	// verify we are in sync
-	returnCode, _, err = raw.SendCommand("NOOP")
-	require.NoError(t, err)
-	require.Equal(t, StatusOK, returnCode)
+	// the offset is silently ignored by default
+	ftpUploadWithRawConnection(t, raw, strings.NewReader("0123456789"), "file.bin", false)
 
-	_, err = raw.PrepareDataConn()
+	returnCode, response, err := raw.SendCommand("REST 2")
 	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, returnCode, response)
 
-	returnCode, _, err = raw.SendCommand("NLST")
-	require.NoError(t, err)
-	require.Equal(t, StatusFileStatusOK, returnCode)
+	ftpUploadWithRawConnection(t, raw, strings.NewReader("AB"), "file.bin", true)
+	require.Equal(t, "0123456789AB", readBack())
 
-	returnCode, _, err = raw.ReadResponse()
+	// with RestAppendPolicyRefuse the combination is rejected with a 501
+	mustSwapSettings(server, func(settings *Settings) { settings.RestAppendPolicy = RestAppendPolicyRefuse })
+
+	returnCode, response, err = raw.SendCommand("REST 2")
 	require.NoError(t, err)
-	require.Equal(t, StatusClosingDataConn, returnCode)
+	require.Equal(t, StatusFileActionPending, returnCode, response)
 
-	// test ABOR cmd without special attention chars
-	returnCode, _, err = raw.SendCommand("ABOR")
+	returnCode, response, err = raw.SendCommand("APPE file.bin")
 	require.NoError(t, err)
-	require.Equal(t, StatusClosingDataConn, returnCode)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode, response)
+	require.Equal(t, "0123456789AB", readBack())
 
-	// verify we are in sync
+	// with RestAppendPolicyHonor the offset is used as a seek position
+	mustSwapSettings(server, func(settings *Settings) { settings.RestAppendPolicy = RestAppendPolicyHonor })
+
+	returnCode, response, err = raw.SendCommand("REST 2")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, returnCode, response)
+
+	ftpUploadWithRawConnection(t, raw, strings.NewReader("ZZ"), "file.bin", true)
+	require.Equal(t, "01ZZ456789AB", readBack())
+}
+
+func TestRANGTransfers(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	readBack := func() string {
+		buf := new(bytes.Buffer)
+		require.NoError(t, client.Retrieve("file.bin", buf))
+
+		return buf.String()
+	}
+
+	ftpUploadWithRawConnection(t, raw, strings.NewReader("0123456789"), "file.bin", false)
+
+	// invalid ranges are refused
+	returnCode, response, err := raw.SendCommand("RANG 5")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode, response)
+
+	returnCode, response, err = raw.SendCommand("RANG 6 2")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, returnCode, response)
+
+	// a partial download, the positions are 1-based and inclusive
+	returnCode, response, err = raw.SendCommand("RANG 3 6")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, returnCode, response)
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err = raw.SendCommand("RETR file.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(dataConn)
+	require.NoError(t, err)
+	require.Equal(t, "2345", string(data))
+	require.NoError(t, dataConn.Close())
+
+	returnCode, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode, response)
+
+	// the range is consumed by the transfer it applied to
+	require.Equal(t, "0123456789", readBack())
+
+	// a partial upload overwrites the range without truncating the file
+	returnCode, response, err = raw.SendCommand("RANG 3 6")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, returnCode, response)
+
+	ftpUploadWithRawConnection(t, raw, strings.NewReader("zzzz"), "file.bin", false)
+	require.Equal(t, "01zzzz6789", readBack())
+
+	// "RANG 1 0" resets a pending range
+	returnCode, response, err = raw.SendCommand("RANG 1 0")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, returnCode, response)
+	require.Equal(t, "Range reset", response)
+}
+
+func TestTransfersFromOffset(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: false,
+	}
+	server := NewTestServerWithTestDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	file := createTemporaryFile(t, 1*1024)
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, client.Close()) }()
+
+	_, err = file.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	err = client.Store("file", file)
+	require.NoError(t, err)
+
+	_, err = file.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+
+	data := []byte("some more data")
+	_, err = file.Write(data)
+	require.NoError(t, err)
+
+	_, err = file.Seek(1024, io.SeekStart)
+	require.NoError(t, err)
+
+	_, err = client.TransferFromOffset("file", nil, file, 1024)
+	require.NoError(t, err)
+
+	info, err := client.Stat("file")
+	require.NoError(t, err)
+	require.Equal(t, int64(1024+len(data)), info.Size())
+
+	localHash := hashFile(t, file)
+	remoteHash := ftpDownloadAndHash(t, client, "file")
+	require.Equal(t, localHash, remoteHash)
+
+	// finally test a partial RETR
+	buf := bytes.NewBuffer(nil)
+	_, err = client.TransferFromOffset("file", buf, nil, 1024)
+	require.NoError(t, err)
+	require.Equal(t, string(data), buf.String())
+}
+
+func TestBasicABOR(t *testing.T) {
+	server := NewTestServer(t, false)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { require.NoError(t, client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, _, err := raw.SendCommand("EPSV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringEPSV, returnCode)
+
+	returnCode, _, err = raw.SendCommand(getABORCmd())
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode)
+
+	// verify we are in sync
+	returnCode, _, err = raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode)
+
+	_, err = raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, _, err = raw.SendCommand("NLST")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode)
+
+	returnCode, _, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode)
+
+	// test ABOR cmd without special attention chars
+	returnCode, _, err = raw.SendCommand("ABOR")
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode)
+
+	// verify we are in sync
 	returnCode, _, err = raw.SendCommand("NOOP")
 	require.NoError(t, err)
 	require.Equal(t, StatusOK, returnCode)
@@ -682,10 +1165,12 @@ func TestBasicABOR(t *testing.T) {
 func TestTransferABOR(t *testing.T) {
 	t.Run("passive-mode", func(t *testing.T) {
 		server := NewTestServer(t, false)
-		server.settings.PassiveTransferPortRange = &PortRange{
-			Start: 49152,
-			End:   65535,
-		}
+		mustSwapSettings(server, func(settings *Settings) {
+			settings.PassiveTransferPortRange = &PortRange{
+				Start: 49152,
+				End:   65535,
+			}
+		})
 		conf := goftp.Config{
 			User:     authUser,
 			Password: authPass,
@@ -705,7 +1190,7 @@ func TestTransferABOR(t *testing.T) {
 			Password:        authPass,
 			ActiveTransfers: true,
 		}
-		server.settings.ActiveTransferPortNon20 = true
+		mustSwapSettings(server, func(settings *Settings) { settings.ActiveTransferPortNon20 = true })
 		client, err := goftp.DialConfig(conf, server.Addr())
 		require.NoError(t, err, "Couldn't connect")
 
@@ -781,7 +1266,7 @@ func TestABORBeforeOpenTransfer(t *testing.T) {
 			User:     authUser,
 			Password: authPass,
 		}
-		server.settings.ActiveTransferPortNon20 = true
+		mustSwapSettings(server, func(settings *Settings) { settings.ActiveTransferPortNon20 = true })
 		client, err := goftp.DialConfig(conf, server.Addr())
 		require.NoError(t, err, "Couldn't connect")
 
@@ -797,7 +1282,7 @@ func TestABORBeforeOpenTransfer(t *testing.T) {
 			Password:        authPass,
 			ActiveTransfers: true,
 		}
-		server.settings.ActiveTransferPortNon20 = true
+		mustSwapSettings(server, func(settings *Settings) { settings.ActiveTransferPortNon20 = true })
 		client, err := goftp.DialConfig(conf, server.Addr())
 		require.NoError(t, err, "Couldn't connect")
 
@@ -944,6 +1429,62 @@ func TestASCIITransfers(t *testing.T) {
 	require.Equal(t, localHash, remoteHash)
 }
 
+func TestASCIITransferResume(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{Debug: false})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { require.NoError(t, client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("TYPE A")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	// REST in ASCII mode stays rejected by default
+	rc, response, err = raw.SendCommand("REST 7")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc, response)
+
+	mustSwapSettings(server, func(settings *Settings) { settings.AllowASCIIResume = true })
+
+	contents := "line1\r\nline2\r\nline3"
+	ftpUploadWithRawConnection(t, raw, strings.NewReader(contents), "file.txt", false)
+
+	// resume the download past the first line: the offset is counted on the
+	// converted stream, i.e. the CRLF representation sent on the wire
+	rc, response, err = raw.SendCommand("REST 7")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err = raw.SendCommand("RETR file.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(dataConn)
+	require.NoError(t, err)
+	require.NoError(t, dataConn.Close())
+	require.Equal(t, "line2\r\nline3", string(data))
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+}
+
 func TestASCIITransfersInvalidFiles(t *testing.T) {
 	s := NewTestServer(t, false)
 	conf := goftp.Config{
@@ -1003,6 +1544,44 @@ func TestPASVWrappedListenerError(t *testing.T) {
 	if assert.Error(t, err) {
 		assert.Contains(t, err.Error(), "421-Could not listen for passive connection")
 	}
+
+	// the listener bound before the wrapper failed must not stay in the fd
+	// accounting
+	require.Equal(t, 0, server.Stats().DataListeners)
+}
+
+func TestPASVActiveFallbackReply(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug:              true,
+		errPassiveListener: os.ErrClosed,
+	})
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.ActiveFallbackOnPasvFailure = true
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { require.NoError(t, client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	returnCode, response, err := raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusCannotOpenDataConnection, returnCode, response)
+	require.Contains(t, response, "retry with PORT/EPRT")
+
+	// the session is still healthy and ready for an active-mode retry
+	returnCode, response, err = raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, returnCode, response)
 }
 
 func TestPASVPublicIPResolver(t *testing.T) {
@@ -1021,66 +1600,282 @@ func TestPASVPublicIPResolver(t *testing.T) {
 	raw, err := client.OpenRawConn()
 	require.NoError(t, err, "Couldn't open raw connection")
 
-	server.settings.PublicHost = ""
-	server.settings.PublicIPResolver = func(_ ClientContext) (string, error) {
-		return "127.0.0", nil
-	}
+	mustSwapSettings(server, func(settings *Settings) { settings.PublicHost = "" })
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.PublicIPResolver = func(_ ClientContext) (string, error) {
+			return "127.0.0", nil
+		}
+	})
 	// we crash if the PublicIPResolver returns an invalid IP, this must be fixed outside the lib
 	returnCode, resp, err := raw.SendCommand("PASV")
 	require.NoError(t, err)
 	require.Equal(t, StatusServiceNotAvailable, returnCode)
 	require.Contains(t, resp, "invalid passive IP")
 
-	server.settings.PublicIPResolver = func(_ ClientContext) (string, error) {
-		return "", errConnectionNotAllowed
-	}
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.PublicIPResolver = func(_ ClientContext) (string, error) {
+			return "", errConnectionNotAllowed
+		}
+	})
 
 	returnCode, resp, err = raw.SendCommand("PASV")
 	require.NoError(t, err)
 	require.Equal(t, StatusServiceNotAvailable, returnCode)
 	require.Contains(t, resp, "couldn't fetch public IP")
+
+	// the listeners bound for the failed replies were released again
+	require.Equal(t, 0, server.Stats().DataListeners)
 }
 
-func TestPASVConnectionWait(t *testing.T) {
-	addr, err := net.ResolveTCPAddr("tcp", ":0")
-	require.NoError(t, err)
+func TestPASVIPv4Fallback(t *testing.T) {
+	// the fallback entries are validated when the settings are loaded
+	badServer := NewFtpServer(&TestServerDriver{Settings: &Settings{PasvIPv4Fallbacks: []string{"::1"}}})
+	err := badServer.loadSettings()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not an IPv4 address")
 
-	tcpListener, err := net.ListenTCP("tcp", addr)
-	require.NoError(t, err)
+	server := NewTestServer(t, false)
 
-	cltHandler := clientHandler{
-		conn: &testNetConn{
-			remoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 21},
-		},
-		server: &FtpServer{
-			settings: &Settings{
-				PasvConnectionsCheck:   IPMatchRequired,
-				ActiveConnectionsCheck: IPMatchRequired,
-			},
-		},
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
 	}
 
-	transferHandler := passiveTransferHandler{ //nolint:forcetypeassert
-		listener: &testNetListener{
-			conn: &testNetConn{
-				remoteAddr: &net.TCPAddr{IP: nil, Port: 21}, // invalid IP
-			},
-		},
-		tcpListener:   tcpListener,
-		Port:          tcpListener.Addr().(*net.TCPAddr).Port,
-		settings:      cltHandler.server.settings,
-		logger:        lognoop.NewNoOpLogger(),
-		checkDataConn: cltHandler.checkDataConnectionRequirement,
-	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
 
-	defer func() {
-		err = transferHandler.Close()
-		assert.NoError(t, err)
-	}()
+	defer func() { require.NoError(t, client.Close()) }()
 
-	_, err = transferHandler.ConnectionWait(1 * time.Second)
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	// an IPv6 public host without any fallback leaves EPSV as the only
+	// passive mode
+	mustSwapSettings(server, func(settings *Settings) { settings.PublicHost = "::1" })
+
+	returnCode, resp, err := raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, returnCode)
+	require.Contains(t, resp, "use EPSV instead")
+
+	// the listener bound for the refused reply was released again
+	require.Equal(t, 0, server.Stats().DataListeners)
+
+	returnCode, resp, err = raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, returnCode)
+	require.Contains(t, resp, "EPSV REQUIRED")
+
+	// with a fallback, PASV advertises the IPv4 address instead
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.PasvIPv4Fallbacks = []string{"192.168.1.1"}
+	})
+
+	returnCode, resp, err = raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, returnCode)
+	require.Contains(t, resp, "(192,168,1,1,")
+
+	returnCode, resp, err = raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, returnCode)
+	require.NotContains(t, resp, "EPSV REQUIRED")
+}
+
+func TestPasvPortResolver(t *testing.T) {
+	server := NewTestServer(t, false)
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.PasvPortResolver = func(_ ClientContext, internalPort int) (string, int, error) {
+			if internalPort == 0 {
+				return "", 0, errors.New("no mapping")
+			}
+
+			return "192.168.2.2", 2121, nil
+		}
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { require.NoError(t, client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	// the PASV reply carries the resolved address and port (2121 = 8*256+73)
+	returnCode, resp, err := raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, returnCode)
+	require.Contains(t, resp, "(192,168,2,2,8,73)")
+
+	// EPSV only advertises the resolved port
+	returnCode, resp, err = raw.SendCommand("EPSV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringEPSV, returnCode)
+	require.Contains(t, resp, "(|||2121|)")
+
+	// a mapping failure is reported like any passive allocation failure
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.PasvPortResolver = func(ClientContext, int) (string, int, error) {
+			return "", 0, errors.New("no mapping for this client")
+		}
+	})
+
+	listenersBefore := server.Stats().DataListeners
+
+	returnCode, resp, err = raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, returnCode)
+	require.Contains(t, resp, "no mapping for this client")
+
+	// the listener bound for the failed mapping was released again
+	require.Equal(t, listenersBefore, server.Stats().DataListeners)
+}
+
+func TestActiveTransferDialRetry(t *testing.T) {
+	// reserve a local port then release it: the first dial attempts are
+	// refused until the listener is reopened
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+	require.NoError(t, listener.Close())
+
+	handler := &activeTransferHandler{
+		raddr: addr,
+		settings: &Settings{
+			ActiveTransferPortNon20:   true,
+			ActiveTransferDialTimeout: 1,
+			ActiveTransferDialRetries: 5,
+		},
+	}
+
+	// the client's "firewall" only opens the port while the retries are running
+	ready := make(chan net.Listener, 1)
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+
+		lst, errListen := net.Listen("tcp", addr.String())
+		if errListen != nil {
+			ready <- nil
+
+			return
+		}
+
+		ready <- lst
+	}()
+
+	conn, err := handler.Open()
+	require.NoError(t, err, "the dial should have been retried until the port opened")
+	require.NoError(t, conn.Close())
+
+	lst := <-ready
+	require.NotNil(t, lst)
+	require.NoError(t, lst.Close())
+
+	// without retries the same situation fails on the first attempt
+	handler = &activeTransferHandler{
+		raddr: addr,
+		settings: &Settings{
+			ActiveTransferPortNon20:   true,
+			ActiveTransferDialTimeout: 1,
+		},
+	}
+
+	_, err = handler.Open()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not establish active connection")
+}
+
+func TestActiveTransferSourcePort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, listener.Close()) }()
+
+	// reserve a source port for the data connection
+	sourceListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	sourceAddr, ok := sourceListener.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+	require.NoError(t, sourceListener.Close())
+
+	raddr, ok := listener.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+
+	handler := &activeTransferHandler{
+		raddr: raddr,
+		eprt:  true,
+		settings: &Settings{
+			ActiveTransferSourcePort: sourceAddr.Port,
+		},
+	}
+
+	conn, err := handler.Open()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	accepted, err := listener.Accept()
+	require.NoError(t, err)
+
+	acceptedAddr, ok := accepted.RemoteAddr().(*net.TCPAddr)
+	require.True(t, ok)
+	require.Equal(t, sourceAddr.Port, acceptedAddr.Port, "the data connection should originate from the configured port")
+	require.NoError(t, accepted.Close())
+}
+
+func TestPASVConnectionWait(t *testing.T) {
+	addr, err := net.ResolveTCPAddr("tcp", ":0")
+	require.NoError(t, err)
+
+	tcpListener, err := net.ListenTCP("tcp", addr)
+	require.NoError(t, err)
+
+	server := &FtpServer{}
+	server.settings.Store(&Settings{
+		PasvConnectionsCheck:   IPMatchRequired,
+		ActiveConnectionsCheck: IPMatchRequired,
+	})
+
+	cltHandler := clientHandler{
+		conn: &testNetConn{
+			remoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 21},
+		},
+		server: server,
+	}
+
+	transferHandler := passiveTransferHandler{ //nolint:forcetypeassert
+		listener: &testNetListener{
+			conn: &testNetConn{
+				remoteAddr: &net.TCPAddr{IP: nil, Port: 21}, // invalid IP
+			},
+		},
+		tcpListener:   tcpListener,
+		Port:          tcpListener.Addr().(*net.TCPAddr).Port,
+		settings:      cltHandler.server.getSettings(),
+		logger:        lognoop.NewNoOpLogger(),
+		checkDataConn: cltHandler.checkDataConnectionRequirement,
+	}
+
+	defer func() {
+		err = transferHandler.Close()
+		assert.NoError(t, err)
+	}()
+
+	// the connection with an invalid remote IP is dropped and the handler
+	// keeps waiting for a valid peer until it runs out of connections
+	_, err = transferHandler.ConnectionWait(1 * time.Second)
 	if assert.Error(t, err) {
-		assert.Contains(t, err.Error(), "invalid remote IP")
+		assert.Contains(t, err.Error(), "failed to accept passive transfer connection")
 	}
 
 	transferHandler.listener = &testNetListener{
@@ -1116,7 +1911,7 @@ func TestPASVIPMatch(t *testing.T) {
 	loginConnection(t, conn)
 
 	for _, mode := range []DataConnectionRequirement{IPMatchRequired, IPMatchDisabled} {
-		server.settings.PasvConnectionsCheck = mode
+		mustSwapSettings(server, func(settings *Settings) { settings.PasvConnectionsCheck = mode })
 
 		_, err = conn.Write([]byte("PASV\r\n"))
 		require.NoError(t, err)
@@ -1148,25 +1943,116 @@ func TestPASVIPMatch(t *testing.T) {
 			assert.NoError(t, err)
 		}()
 
-		readBytes, err = conn.Read(buf)
-		require.NoError(t, err)
+		if mode == IPMatchRequired {
+			// the connection from the unexpected address is dropped right away
+			// and the passive port keeps waiting for the legitimate peer
+			require.NoError(t, dataConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			_, err = dataConn.Read(buf)
+			require.ErrorIs(t, err, io.EOF)
 
-		resp = string(buf[:readBytes])
+			legitConn, errDial := net.DialTimeout("tcp", addr, 5*time.Second)
+			require.NoError(t, errDial)
 
-		if mode == IPMatchRequired {
-			require.Equal(t, "425 data connection security requirements not met", strings.TrimSpace(resp))
+			_, err = io.Copy(io.Discard, legitConn)
+			require.NoError(t, err)
+			require.NoError(t, legitConn.Close())
+
+			resp = ""
+			for !strings.Contains(resp, "226") {
+				readBytes, err = conn.Read(buf)
+				require.NoError(t, err)
+
+				resp += string(buf[:readBytes])
+			}
+
+			require.Contains(t, resp, "150 Using transfer connection")
 		} else {
+			readBytes, err = conn.Read(buf)
+			require.NoError(t, err)
+
+			resp = string(buf[:readBytes])
 			require.True(t, strings.HasPrefix(resp, "150 Using transfer connection"))
 		}
 	}
 }
 
+// peerVerifierDriver accepts data connections coming from a single known gateway IP
+type peerVerifierDriver struct {
+	TestServerDriver
+	allowedDataConnIP string
+}
+
+// VerifyDataConnection implements the MainDriverExtensionDataConnectionVerifier extension
+func (driver *peerVerifierDriver) VerifyDataConnection(_ ClientContext, _, dataConnIP net.IP,
+	_ DataChannel,
+) error {
+	if dataConnIP.String() == driver.allowedDataConnIP {
+		return nil
+	}
+
+	return errConnectionNotAllowed
+}
+
+func TestPASVIPMatchVerifier(t *testing.T) {
+	driver := &peerVerifierDriver{
+		TestServerDriver:  TestServerDriver{Debug: false},
+		allowedDataConnIP: "127.0.1.1",
+	}
+	driver.Init()
+	server := NewTestServerWithDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	buf := make([]byte, 1024)
+	readBytes, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "220 TEST Server\r\n", string(buf[:readBytes]))
+
+	loginConnection(t, conn)
+
+	_, err = conn.Write([]byte("PASV\r\n"))
+	require.NoError(t, err)
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+
+	port := getPortFromPASVResponse(t, string(buf[:readBytes]))
+	require.NotEqual(t, 0, port)
+
+	_, err = conn.Write([]byte("NLST\r\n"))
+	require.NoError(t, err)
+
+	// now dial from 127.0.1.1 instead of 127.0.0.1: the IP-match check fails
+	// but the driver accepts this gateway address
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{
+			IP:   net.ParseIP("127.0.1.1"),
+			Port: 0,
+		},
+		Timeout: 5 * time.Second,
+	}
+	dataConn, err := dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	require.NoError(t, err)
+
+	defer func() { assert.NoError(t, dataConn.Close()) }()
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "150 Using transfer connection"),
+		string(buf[:readBytes]))
+}
+
 func TestPassivePortExhaustion(t *testing.T) {
 	server := NewTestServer(t, false)
-	server.settings.PassiveTransferPortRange = &PortRange{
-		Start: 40000,
-		End:   40005,
-	}
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.PassiveTransferPortRange = &PortRange{
+			Start: 40000,
+			End:   40005,
+		}
+	})
 
 	client, err := goftp.DialConfig(goftp.Config{
 		User:     authUser,
@@ -1231,3 +2117,411 @@ func getPortFromPASVResponse(t *testing.T, resp string) int {
 
 	return port
 }
+
+func TestTransferCertMatchRequired(t *testing.T) {
+	_, clientCert := buildClientCertAuthMaterial(t)
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		TLS: true,
+		Settings: &Settings{
+			PasvConnectionsCheck: CertMatchRequired,
+		},
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+			Certificates:       []tls.Certificate{clientCert},
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	// the same certificate is presented on the control and data connections,
+	// transfers are accepted
+	file := createTemporaryFile(t, 1024)
+	hashUpload := hashFile(t, file)
+	ftpUpload(t, client, file, "file.bin")
+	require.Equal(t, hashUpload, ftpDownloadAndHash(t, client, "file.bin"))
+
+	// a session without any client certificate cannot pass the ownership check
+	confNoCert := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	clientNoCert, err := goftp.DialConfig(confNoCert, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(clientNoCert.Close()) }()
+
+	_, err = clientNoCert.ReadDir("/")
+	require.Error(t, err, "The data connection should be refused without a client certificate")
+}
+
+func TestPrebindPassivePorts(t *testing.T) {
+	// grab a couple of ports that are free right now for the pool to bind
+	probe, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	basePort := probe.Addr().(*net.TCPAddr).Port //nolint:forcetypeassert
+	require.NoError(t, probe.Close())
+
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug: false,
+		Settings: &Settings{
+			PassiveTransferPortRange: &PortRange{Start: basePort, End: basePort + 1},
+			PrebindPassivePorts:      true,
+		},
+	})
+
+	stats := server.Stats()
+	require.Equal(t, 2, stats.PassivePoolFree)
+	require.Equal(t, 0, stats.PassivePoolBorrowed)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	// every listing borrows a listener and must give it back
+	for i := 0; i < 8; i++ {
+		_, err = client.ReadDir("/")
+		require.NoError(t, err)
+	}
+
+	stats = server.Stats()
+	require.Equal(t, 2, stats.PassivePoolFree)
+	require.Equal(t, 0, stats.PassivePoolBorrowed)
+
+	// two pending PASV replies hold both pooled listeners, the next PASV
+	// has no port left to advertise
+	client2, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client2.Close()) }()
+
+	raw1, err := client.OpenRawConn()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, raw1.Close()) }()
+
+	raw2, err := client2.OpenRawConn()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, raw2.Close()) }()
+
+	for _, raw := range []goftp.RawConn{raw1, raw2} {
+		returnCode, _, errPasv := raw.SendCommand("PASV")
+		require.NoError(t, errPasv)
+		require.Equal(t, StatusEnteringPASV, returnCode)
+	}
+
+	stats = server.Stats()
+	require.Equal(t, 0, stats.PassivePoolFree)
+	require.Equal(t, 2, stats.PassivePoolBorrowed)
+
+	returnCode, response, err := raw1.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, returnCode, response)
+}
+
+func TestPrebindPassivePortsWrapperFailure(t *testing.T) {
+	probe, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	basePort := probe.Addr().(*net.TCPAddr).Port //nolint:forcetypeassert
+	require.NoError(t, probe.Close())
+
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug:              false,
+		errPassiveListener: os.ErrClosed,
+		Settings: &Settings{
+			PassiveTransferPortRange: &PortRange{Start: basePort, End: basePort + 1},
+			PrebindPassivePorts:      true,
+		},
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client.Close()) }()
+
+	raw, err := client.OpenRawConn()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// each failed setup must give the borrowed listener back: more failures
+	// than pooled ports would otherwise leave the pool empty for good
+	for i := 0; i < 4; i++ {
+		returnCode, _, errPasv := raw.SendCommand("PASV")
+		require.NoError(t, errPasv)
+		require.Equal(t, StatusServiceNotAvailable, returnCode)
+	}
+
+	stats := server.Stats()
+	require.Equal(t, 2, stats.PassivePoolFree)
+	require.Equal(t, 0, stats.PassivePoolBorrowed)
+}
+
+// fxpAuthorizerDriver accepts FXP peers from a single known partner server IP
+type fxpAuthorizerDriver struct {
+	TestServerDriver
+	allowedPeerIP string
+}
+
+// AuthorizeDataConnection implements the MainDriverExtensionFXPAuthorizer extension
+func (driver *fxpAuthorizerDriver) AuthorizeDataConnection(_ ClientContext, dataConnIP net.IP,
+	_ DataChannel,
+) error {
+	if dataConnIP.String() == driver.allowedPeerIP {
+		return nil
+	}
+
+	return errConnectionNotAllowed
+}
+
+func TestFXPDataConnection(t *testing.T) {
+	driver := &fxpAuthorizerDriver{
+		TestServerDriver: TestServerDriver{Debug: false},
+		allowedPeerIP:    "127.0.1.1",
+	}
+	driver.Init()
+	driver.Settings.EnableFXP = true
+	server := NewTestServerWithDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	buf := make([]byte, 1024)
+	readBytes, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "220 TEST Server\r\n", string(buf[:readBytes]))
+
+	loginConnection(t, conn)
+
+	_, err = conn.Write([]byte("PASV\r\n"))
+	require.NoError(t, err)
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+
+	port := getPortFromPASVResponse(t, string(buf[:readBytes]))
+	require.NotEqual(t, 0, port)
+
+	_, err = conn.Write([]byte("NLST\r\n"))
+	require.NoError(t, err)
+
+	// the peer the driver knows as a partner server may connect in place of
+	// the client
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{
+			IP:   net.ParseIP("127.0.1.1"),
+			Port: 0,
+		},
+		Timeout: 5 * time.Second,
+	}
+	dataConn, err := dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	require.NoError(t, err)
+
+	defer func() { assert.NoError(t, dataConn.Close()) }()
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "150 Using transfer connection"),
+		string(buf[:readBytes]))
+
+	// a foreign PORT target the driver doesn't know is refused up front
+	_, err = conn.Write([]byte("PORT 1,2,3,4,200,100\r\n"))
+	require.NoError(t, err)
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "501"), string(buf[:readBytes]))
+	require.Contains(t, string(buf[:readBytes]), "security requirements")
+}
+
+func TestFXPBounceProtection(t *testing.T) {
+	server := NewTestServerWithTestDriver(t, &TestServerDriver{
+		Debug:    false,
+		Settings: &Settings{EnableFXP: true},
+	})
+
+	conn, err := net.DialTimeout("tcp", server.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	buf := make([]byte, 1024)
+	readBytes, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "220 TEST Server\r\n", string(buf[:readBytes]))
+
+	loginConnection(t, conn)
+
+	// port 80 of a foreign host: the bounce attack pattern
+	_, err = conn.Write([]byte("PORT 1,2,3,4,0,80\r\n"))
+	require.NoError(t, err)
+
+	readBytes, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:readBytes]), "501"), string(buf[:readBytes]))
+	require.Contains(t, string(buf[:readBytes]), "privileged ports")
+}
+
+// priorityServerDriver classifies transfers below /bulk in a "bulk" class
+type priorityServerDriver struct {
+	TestServerDriver
+}
+
+func (driver *priorityServerDriver) GetTransferClass(_ ClientContext, _ TransferDirection, path string) string {
+	if strings.HasPrefix(path, "/bulk/") {
+		return "bulk"
+	}
+
+	return ""
+}
+
+func TestTransferClassLimits(t *testing.T) {
+	driver := &priorityServerDriver{}
+	driver.Init()
+	driver.Settings = &Settings{
+		TransferClassLimits: map[string]int{"bulk": 1},
+	}
+	server := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	client1, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client1.Close()) }()
+
+	client2, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(client2.Close()) }()
+
+	_, err = client1.Mkdir("/bulk")
+	require.NoError(t, err)
+
+	raw1, err := client1.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw1.Close()) }()
+
+	raw2, err := client2.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw2.Close()) }()
+
+	// the first bulk upload takes the only slot of its class and is kept
+	// running by leaving its data connection open
+	dcGetter, err := raw1.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err := raw1.SendCommand("STOR /bulk/one.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err := dcGetter()
+	require.NoError(t, err)
+
+	// a second transfer of the same class is refused
+	_, err = raw2.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err = raw2.SendCommand("STOR /bulk/two.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionNotTaken, returnCode, response)
+
+	// an unclassified transfer is not held back by the bulk class
+	dcGetter2, err := raw2.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err = raw2.SendCommand("STOR /other.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn2, err := dcGetter2()
+	require.NoError(t, err)
+	require.NoError(t, dataConn2.Close())
+
+	returnCode, _, err = raw2.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode)
+
+	// ending the first bulk upload frees its slot
+	require.NoError(t, dataConn.Close())
+
+	returnCode, _, err = raw1.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode)
+
+	dcGetter2, err = raw2.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err = raw2.SendCommand("STOR /bulk/two.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn2, err = dcGetter2()
+	require.NoError(t, err)
+	require.NoError(t, dataConn2.Close())
+
+	returnCode, _, err = raw2.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode)
+
+	// the global limit applies to unclassified transfers as well
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.MaxConcurrentTransfers = 1
+	})
+
+	dcGetter, err = raw1.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err = raw1.SendCommand("STOR /other2.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, returnCode, response)
+
+	dataConn, err = dcGetter()
+	require.NoError(t, err)
+
+	_, err = raw2.PrepareDataConn()
+	require.NoError(t, err)
+
+	returnCode, response, err = raw2.SendCommand("STOR /other3.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionNotTaken, returnCode, response)
+
+	require.NoError(t, dataConn.Close())
+
+	returnCode, _, err = raw1.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, returnCode)
+}
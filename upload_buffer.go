@@ -0,0 +1,176 @@
+// Package ftpserver - bounded buffering between the data connection and the driver on uploads
+package ftpserver
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// stalls shorter than this are considered normal scheduling jitter and are not
+// reported to the driver
+const uploadStallMinDuration = 100 * time.Millisecond
+
+// uploadBuffer is the bounded buffer enabled by Settings.UploadBufferSize. The
+// producer side implements io.Writer and is fed by the data-connection copy
+// loop; when the buffer is full the producer blocks, the copy loop stops
+// reading from the data socket and TCP backpressure reaches the client. A
+// dedicated goroutine drains the buffer to the driver's file. Waits on either
+// side are reported as TransferStall events through the notify callback.
+type uploadBuffer struct {
+	mu       sync.Mutex
+	notFull  sync.Cond
+	notEmpty sync.Cond
+	data     []byte
+	start    int // offset of the first pending byte
+	length   int // number of pending bytes
+	lowWater int // once full, the producer resumes below this level
+	closed   bool
+	writeErr error
+	file     io.Writer
+	notify   func(TransferStall)
+	drained  chan struct{}
+}
+
+func newUploadBuffer(file io.Writer, size int, notify func(TransferStall)) *uploadBuffer {
+	buffer := &uploadBuffer{
+		data:     make([]byte, size),
+		lowWater: size / 2,
+		file:     file,
+		notify:   notify,
+		drained:  make(chan struct{}),
+	}
+	buffer.notFull.L = &buffer.mu
+	buffer.notEmpty.L = &buffer.mu
+
+	go buffer.drain()
+
+	return buffer
+}
+
+// Write queues p in the buffer. When the buffer is full it waits until the
+// drain goroutine brought it back under the low watermark, so that we don't
+// wake up for every single drained chunk, and reports the wait as a storage
+// stall.
+func (b *uploadBuffer) Write(p []byte) (int, error) {
+	written := 0
+
+	for written < len(p) {
+		b.mu.Lock()
+
+		if b.writeErr != nil {
+			err := b.writeErr
+			b.mu.Unlock()
+
+			return written, err
+		}
+
+		if b.length == len(b.data) {
+			start := time.Now()
+
+			for b.length > b.lowWater && b.writeErr == nil {
+				b.notFull.Wait()
+			}
+
+			duration := time.Since(start)
+			b.mu.Unlock()
+			b.reportStall(StallSourceStorage, duration)
+
+			continue
+		}
+
+		end := (b.start + b.length) % len(b.data)
+
+		chunk := len(b.data) - end
+		if free := len(b.data) - b.length; chunk > free {
+			chunk = free
+		}
+
+		copied := copy(b.data[end:end+chunk], p[written:])
+		b.length += copied
+		written += copied
+		b.notEmpty.Signal()
+		b.mu.Unlock()
+	}
+
+	return written, nil
+}
+
+// Close signals the end of the upload, waits for the buffer to be fully
+// drained to the file and returns the first error the drain goroutine hit
+func (b *uploadBuffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.notEmpty.Signal()
+	b.mu.Unlock()
+
+	<-b.drained
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.writeErr
+}
+
+// drain moves pending bytes from the buffer to the driver's file, reporting
+// the times it had to wait for the client as client stalls
+func (b *uploadBuffer) drain() {
+	defer close(b.drained)
+
+	for {
+		b.mu.Lock()
+
+		start := time.Now()
+
+		for b.length == 0 && !b.closed {
+			b.notEmpty.Wait()
+		}
+
+		duration := time.Since(start)
+
+		if b.length == 0 {
+			b.mu.Unlock()
+
+			return
+		}
+
+		// take the first contiguous chunk out of the ring: the producer only
+		// writes into the free region, so we can release the lock while the
+		// driver consumes it
+		chunk := b.length
+		if b.start+chunk > len(b.data) {
+			chunk = len(b.data) - b.start
+		}
+
+		pending := b.data[b.start : b.start+chunk]
+		b.mu.Unlock()
+
+		b.reportStall(StallSourceClient, duration)
+
+		written, err := b.file.Write(pending)
+
+		b.mu.Lock()
+		b.start = (b.start + written) % len(b.data)
+		b.length -= written
+
+		if err != nil {
+			b.writeErr = err
+			b.notFull.Broadcast()
+			b.mu.Unlock()
+
+			return
+		}
+
+		if b.length <= b.lowWater {
+			b.notFull.Broadcast()
+		}
+
+		b.mu.Unlock()
+	}
+}
+
+func (b *uploadBuffer) reportStall(source StallSource, duration time.Duration) {
+	if b.notify != nil && duration >= uploadStallMinDuration {
+		b.notify(TransferStall{Source: source, Duration: duration})
+	}
+}
@@ -0,0 +1,55 @@
+package ftpserver
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferedUploadBackpressure(t *testing.T) {
+	driver := &TestServerDriver{Debug: false}
+	server := NewTestServerWithTestDriver(t, driver)
+
+	mustSwapSettings(server, func(settings *Settings) {
+		settings.UploadBufferSize = 2 * 1024
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	client, err := goftp.DialConfig(conf, server.Addr())
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, client.Close()) }()
+
+	// "delay-io" slows down every driver Write, so the bounded buffer fills up
+	// and the transfer stalls on storage
+	content := bytes.Repeat([]byte("x"), 6*1024)
+	require.NoError(t, client.Store("delay-io.bin", bytes.NewReader(content)))
+
+	stored, err := afero.ReadFile(driver.fs, "/delay-io.bin")
+	require.NoError(t, err)
+	require.Equal(t, content, stored)
+
+	file := driver.GetLastOpenedFile()
+	require.NotNil(t, file)
+
+	storageStalls := 0
+
+	for _, stall := range file.getStalls() {
+		require.Greater(t, stall.Duration, time.Duration(0))
+
+		if stall.Source == StallSourceStorage {
+			require.Equal(t, "storage", stall.Source.String())
+
+			storageStalls++
+		}
+	}
+
+	require.Positive(t, storageStalls)
+}
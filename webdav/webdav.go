@@ -0,0 +1,64 @@
+// Package webdav exposes a ftpserverlib ClientDriver as a read-only WebDAV
+// handler, for users who need browser-based read access to the same storage
+// tree served over FTP.
+//
+// The handler only accepts read methods (OPTIONS, GET, HEAD, PROPFIND); any
+// request that would modify the tree is rejected with a permission error.
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/webdav"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+// Handler returns a read-only WebDAV http.Handler serving the given driver.
+// The prefix is stripped from the request paths, it can be left empty to
+// serve the tree from the URL root
+func Handler(driver ftpserver.ClientDriver, prefix string) http.Handler {
+	return &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: FileSystem(driver),
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+// FileSystem adapts a ClientDriver to the webdav.FileSystem interface,
+// refusing any modification, for callers that want to assemble their own
+// webdav.Handler
+func FileSystem(driver ftpserver.ClientDriver) webdav.FileSystem {
+	return &fileSystem{driver: driver}
+}
+
+// fileSystem maps the WebDAV file system calls to the ClientDriver (afero) methods
+type fileSystem struct {
+	driver ftpserver.ClientDriver
+}
+
+func (fs *fileSystem) Mkdir(_ context.Context, _ string, _ os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *fileSystem) OpenFile(_ context.Context, name string, flag int, _ os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, os.ErrPermission
+	}
+
+	return fs.driver.Open(name) //nolint:wrapcheck // driver errors are reported as is
+}
+
+func (fs *fileSystem) RemoveAll(_ context.Context, _ string) error {
+	return os.ErrPermission
+}
+
+func (fs *fileSystem) Rename(_ context.Context, _, _ string) error {
+	return os.ErrPermission
+}
+
+func (fs *fileSystem) Stat(_ context.Context, name string) (os.FileInfo, error) {
+	return fs.driver.Stat(name) //nolint:wrapcheck // driver errors are reported as is
+}
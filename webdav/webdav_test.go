@@ -0,0 +1,76 @@
+package webdav
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, afero.Fs) {
+	t.Helper()
+
+	driver := afero.NewMemMapFs()
+	server := httptest.NewServer(Handler(driver, ""))
+
+	t.Cleanup(server.Close)
+
+	return server, driver
+}
+
+func TestReadOnlyGateway(t *testing.T) {
+	server, driver := newTestServer(t)
+
+	require.NoError(t, driver.Mkdir("/dir", 0o755))
+	require.NoError(t, afero.WriteFile(driver, "/dir/file.txt", []byte("hello webdav"), 0o644))
+
+	// GET serves the file content
+	resp, err := http.Get(server.URL + "/dir/file.txt")
+	require.NoError(t, err)
+
+	content, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello webdav", string(content))
+
+	// PROPFIND lists the directory
+	req, err := http.NewRequest("PROPFIND", server.URL+"/dir", nil)
+	require.NoError(t, err)
+	req.Header.Set("Depth", "1")
+
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	listing, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	require.Contains(t, string(listing), "file.txt")
+
+	// any write method is rejected, the webdav handler maps the refused
+	// PUT open to 404 and the refused MKCOL to 405
+	req, err = http.NewRequest(http.MethodPut, server.URL+"/dir/new.txt", strings.NewReader("nope"))
+	require.NoError(t, err)
+
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	req, err = http.NewRequest("MKCOL", server.URL+"/dir2", nil)
+	require.NoError(t, err)
+
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// the tree was not modified
+	_, err = driver.Stat("/dir/new.txt")
+	require.Error(t, err)
+}